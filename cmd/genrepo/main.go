@@ -0,0 +1,79 @@
+// genrepo creates a bare repository for testing or benchmarking
+// spokes-receive-pack, like
+//
+//	genrepo -commits 100 -blob-size 1048576 -refs 'refs/tags/v%d=10000' -forks 3 /tmp/big.git
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/github/spokes-receive-pack/internal/genrepo"
+)
+
+// refSets collects the -refs flags.
+type refSets []genrepo.RefSet
+
+func (r *refSets) String() string {
+	var parts []string
+	for _, set := range *r {
+		parts = append(parts, fmt.Sprintf("%s=%d", set.Format, set.Count))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *refSets) Set(value string) error {
+	format, count, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected FORMAT=COUNT, got %q", value)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid ref count %q", count)
+	}
+	*r = append(*r, genrepo.RefSet{Format: format, Count: n})
+	return nil
+}
+
+func main() {
+	var (
+		spec genrepo.Spec
+		refs refSets
+	)
+	flag.StringVar(&spec.ObjectFormat, "object-format", "sha1", "object format of the repository (sha1 or sha256)")
+	flag.IntVar(&spec.Commits, "commits", 1, "number of commits on main")
+	flag.IntVar(&spec.BlobSize, "blob-size", 0, "size in bytes of the file that each commit changes")
+	flag.Int64Var(&spec.Seed, "seed", 0, "seed for the contents of the files")
+	flag.Var(&refs, "refs", "create COUNT refs named by FORMAT, like 'refs/tags/v%d=100' (can be repeated)")
+	flag.IntVar(&spec.Forks, "forks", 0, "number of forks to create next to the repository")
+	flag.IntVar(&spec.MissingBlobs, "missing-blobs", 0, "remove the files of this many of the newest commits")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [options] <path>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	spec.Refs = refs
+
+	repo, err := genrepo.Generate(context.Background(), flag.Arg(0), spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "genrepo: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s %s\n", repo.Head, repo.Path)
+	for _, fork := range repo.Forks {
+		fmt.Printf("fork %s\n", fork)
+	}
+	for _, oid := range repo.Missing {
+		fmt.Printf("missing %s\n", oid)
+	}
+}
@@ -0,0 +1,127 @@
+// Package audit writes durable records of the decisions that were made about
+// each ref update, for auditing and for replication.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DestinationEnv is the name of an environment variable that says where the
+// audit journal is. See OpenIn.
+const DestinationEnv = "SPOKES_AUDIT_JOURNAL"
+
+// The possible decisions about a ref update.
+const (
+	Accepted = "accepted"
+	Rejected = "rejected"
+)
+
+// Record describes what happened to one ref update.
+type Record struct {
+	Time      time.Time `json:"time"`
+	RepoName  string    `json:"repo_name,omitempty"`
+	Refname   string    `json:"refname"`
+	OldOID    string    `json:"old_oid"`
+	NewOID    string    `json:"new_oid"`
+	Decision  string    `json:"decision"`
+	Reason    string    `json:"reason,omitempty"`
+	UserID    uint32    `json:"user_id,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+
+	// Forced is set if the update isn't a fast-forward.
+	Forced bool `json:"forced,omitempty"`
+}
+
+// Journal is an append-only log of Records, one JSON object per line.
+//
+// It is safe to call any method on a nil *Journal, which doesn't record
+// anything.
+type Journal struct {
+	w    io.WriteCloser
+	sync func() error
+}
+
+// Open opens the journal at `dest`, which is either the path of a file to
+// append to or "unix://" followed by the path of a unix socket to write
+// to. If `dest` is empty, Open returns (nil, nil).
+func Open(dest string) (*Journal, error) {
+	if dest == "" {
+		return nil, nil
+	}
+
+	if path, ok := strings.CutPrefix(dest, "unix://"); ok {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to journal: %w", err)
+		}
+		return &Journal{w: conn}, nil
+	}
+
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening journal: %w", err)
+	}
+	return &Journal{w: f, sync: f.Sync}, nil
+}
+
+// OpenIn is like Open, but a relative path in `dest` is relative to `dir`,
+// the repository, instead of the working directory.
+func OpenIn(dir, dest string) (*Journal, error) {
+	if dest != "" && !strings.HasPrefix(dest, "unix://") && !filepath.IsAbs(dest) {
+		dest = filepath.Join(dir, dest)
+	}
+	return Open(dest)
+}
+
+// Write appends `records` to the journal. They are written all at once, so
+// that the records of concurrent pushes don't get interleaved, and, for a
+// file, flushed to disk before Write returns.
+func (j *Journal) Write(records []Record) error {
+	if j == nil || len(records) == 0 {
+		return nil
+	}
+
+	values := make([]interface{}, len(records))
+	for i, r := range records {
+		values[i] = r
+	}
+	return j.append(values)
+}
+
+// append writes `values` to the journal as lines of JSON, all at once.
+func (j *Journal) append(values []interface{}) error {
+	var buf []byte
+	for _, v := range values {
+		line, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("encoding journal entry: %w", err)
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+
+	if _, err := j.w.Write(buf); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	if j.sync != nil {
+		if err := j.sync(); err != nil {
+			return fmt.Errorf("syncing journal: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the journal.
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.w.Close()
+}
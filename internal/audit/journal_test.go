@@ -0,0 +1,101 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		j, err := Open(path)
+		require.NoError(t, err)
+		require.NoError(t, j.Write([]Record{
+			{Time: now, Refname: "refs/heads/main", OldOID: "a", NewOID: "b", Decision: Accepted, UserID: 1, RequestID: "r", Forced: true},
+			{Time: now, Refname: "refs/pull/1/head", OldOID: "a", NewOID: "c", Decision: Rejected, Reason: "deny updating a hidden ref"},
+		}))
+		require.NoError(t, j.Close())
+	}
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t,
+		`{"time":"2024-01-02T03:04:05Z","refname":"refs/heads/main","old_oid":"a","new_oid":"b","decision":"accepted","user_id":1,"request_id":"r","forced":true}`,
+		lines[0])
+	assert.Equal(t,
+		`{"time":"2024-01-02T03:04:05Z","refname":"refs/pull/1/head","old_oid":"a","new_oid":"c","decision":"rejected","reason":"deny updating a hidden ref"}`,
+		lines[1])
+	assert.Equal(t, lines[:2], lines[2:])
+}
+
+func TestJournalSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.sock")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer l.Close()
+
+	received := make(chan Record, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var r Record
+		if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&r); err == nil {
+			received <- r
+		}
+	}()
+
+	j, err := Open("unix://" + path)
+	require.NoError(t, err)
+	require.NoError(t, j.Write([]Record{{Refname: "refs/heads/main", Decision: Accepted}}))
+	require.NoError(t, j.Close())
+
+	r := <-received
+	assert.Equal(t, "refs/heads/main", r.Refname)
+	assert.Equal(t, Accepted, r.Decision)
+}
+
+func TestNilJournal(t *testing.T) {
+	j, err := Open("")
+	require.NoError(t, err)
+	assert.Nil(t, j)
+	assert.NoError(t, j.Write([]Record{{Refname: "refs/heads/main"}}))
+	assert.NoError(t, j.Close())
+}
+
+func TestOpenIn(t *testing.T) {
+	repo := t.TempDir()
+
+	j, err := OpenIn(repo, "audit.log")
+	require.NoError(t, err)
+	require.NoError(t, j.Write([]Record{{Refname: "refs/heads/main", Decision: Accepted}}))
+	require.NoError(t, j.Close())
+	_, err = os.Stat(filepath.Join(repo, "audit.log"))
+	assert.NoError(t, err)
+
+	abs := filepath.Join(t.TempDir(), "audit.log")
+	j, err = OpenIn(repo, abs)
+	require.NoError(t, err)
+	require.NoError(t, j.Close())
+	_, err = os.Stat(abs)
+	assert.NoError(t, err)
+
+	j, err = OpenIn(repo, "")
+	assert.NoError(t, err)
+	assert.Nil(t, j)
+}
@@ -0,0 +1,38 @@
+package audit
+
+import "time"
+
+// ReplicationDestinationEnv is the name of an environment variable that says
+// where the replication journal is. It is opened with OpenIn, so a relative
+// path is relative to the repository, which gives each repository a
+// journal of its own.
+const ReplicationDestinationEnv = "SPOKES_REPLICATION_JOURNAL"
+
+// RefUpdate is a ref update that was accepted.
+type RefUpdate struct {
+	Refname string `json:"refname"`
+	OldOID  string `json:"old_oid"`
+	NewOID  string `json:"new_oid"`
+}
+
+// ReplicationEntry records the ref updates that were accepted in one push,
+// and where their objects are, for the replication layer.
+type ReplicationEntry struct {
+	Time         time.Time   `json:"time"`
+	RepoName     string      `json:"repo_name,omitempty"`
+	RepoID       uint32      `json:"repo_id,omitempty"`
+	NetworkID    uint32      `json:"network_id,omitempty"`
+	QuarantineID string      `json:"quarantine_id"`
+	RequestID    string      `json:"request_id,omitempty"`
+	UserID       uint32      `json:"user_id,omitempty"`
+	Updates      []RefUpdate `json:"updates"`
+}
+
+// WriteReplicationEntry appends `entry` to the journal, and, for a file,
+// flushes it to disk before returning.
+func (j *Journal) WriteReplicationEntry(entry ReplicationEntry) error {
+	if j == nil {
+		return nil
+	}
+	return j.append([]interface{}{entry})
+}
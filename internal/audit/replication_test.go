@@ -0,0 +1,33 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteReplicationEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replication.log")
+	j, err := Open(path)
+	require.NoError(t, err)
+	require.NoError(t, j.WriteReplicationEntry(ReplicationEntry{
+		Time:         time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		RepoID:       12,
+		QuarantineID: "q1",
+		Updates:      []RefUpdate{{Refname: "refs/heads/main", OldOID: "a", NewOID: "b"}},
+	}))
+	require.NoError(t, j.Close())
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t,
+		`{"time":"2024-01-02T03:04:05Z","repo_id":12,"quarantine_id":"q1","updates":[{"refname":"refs/heads/main","old_oid":"a","new_oid":"b"}]}`+"\n",
+		string(contents))
+
+	var nilJournal *Journal
+	assert.NoError(t, nilJournal.WriteReplicationEntry(ReplicationEntry{}))
+}
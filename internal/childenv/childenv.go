@@ -0,0 +1,50 @@
+// Package childenv decides which of our environment variables the commands
+// that we run get to see: git, its hooks, and the check commands and blob
+// scanner that the repository's config names.
+package childenv
+
+import (
+	"os"
+	"strings"
+
+	"github.com/github/spokes-receive-pack/internal/pipe"
+)
+
+// names are the environment variables, besides git's own (see Environ), that
+// the git commands we run get from us. They are the ones that git needs to
+// find its programs, configuration, and temporary files. Everything else in
+// our environment, like credentials for the services we talk to or the
+// settings of our frontend, is none of their business. Locale settings are
+// left out too, so that git's messages, which we look for in its stderr, are
+// in English.
+var names = []string{"PATH", "HOME", "XDG_CONFIG_HOME", "TMPDIR", "TZ"}
+
+// Environ returns the part of `environ`, a list of "KEY=value" strings like
+// os.Environ() returns, that the git commands we run should see: git's own
+// variables, which include the sockstat vars, and the few others that git
+// needs.
+func Environ(environ []string) []string {
+	env := make([]string, 0, len(environ))
+	for _, kv := range environ {
+		key, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(key, "GIT_") || isName(key) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+func isName(key string) bool {
+	for _, name := range names {
+		if key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Scrubbed makes `stage`, which must be a command stage, start out with
+// Environ(os.Environ()) instead of our whole environment.
+func Scrubbed(stage pipe.Stage) pipe.Stage {
+	return pipe.WithEnviron(stage, Environ(os.Environ()))
+}
@@ -0,0 +1,32 @@
+package childenv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnviron(t *testing.T) {
+	assert.Equal(
+		t,
+		[]string{
+			"PATH=/usr/bin",
+			"GIT_SOCKSTAT_VAR_repo_name=a/b",
+			"GIT_TRACE2_EVENT=/tmp/trace",
+			"HOME=/home/git",
+			"TMPDIR=/tmp",
+		},
+		Environ([]string{
+			"PATH=/usr/bin",
+			"GIT_SOCKSTAT_VAR_repo_name=a/b",
+			"SPOKES_POLICY_TOKEN=secret",
+			"GIT_TRACE2_EVENT=/tmp/trace",
+			"HOME=/home/git",
+			"LANG=de_DE.UTF-8",
+			"PATHS=nope",
+			"TMPDIR=/tmp",
+			"AWS_SECRET_ACCESS_KEY=secret",
+		}),
+	)
+	assert.Empty(t, Environ(nil))
+}
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+
+	"github.com/github/spokes-receive-pack/internal/childenv"
 )
 
 // ConfigEntry represents an entry in the gitconfig.
@@ -28,6 +31,20 @@ type Config struct {
 	Entries []ConfigEntry
 }
 
+// RepoEnviron returns `environ`, a list of "KEY=value" strings like
+// os.Environ() returns, without GIT_DIR, for git commands that find the
+// repository from their working directory. An inherited GIT_DIR, which might
+// be relative to some other directory, would take precedence.
+func RepoEnviron(environ []string) []string {
+	env := make([]string, 0, len(environ))
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, "GIT_DIR=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
 // GetConfig returns the entries from gitconfig in the repo located at repo.
 func GetConfig(repo string) (*Config, error) {
 	cmd := exec.Command(
@@ -36,6 +53,7 @@ func GetConfig(repo string) (*Config, error) {
 		"--list",
 		"-z")
 	cmd.Dir = repo
+	cmd.Env = RepoEnviron(childenv.Environ(os.Environ()))
 
 	out, err := cmd.Output()
 	if err != nil {
@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func testGetConfigEntryValue(repoPath, name string) string {
@@ -156,3 +158,22 @@ func TestParseSigned(t *testing.T) {
 		}
 	}
 }
+
+func TestGetConfigIgnoresRelativeGitDir(t *testing.T) {
+	repo := t.TempDir()
+	cmd := commandBuilderInDir(repo)
+	assert.NoError(t, cmd("git", "init", "--bare").Run())
+	assert.NoError(t, cmd("git", "config", "receive.hiderefs", "refs/pull/").Run())
+
+	// Like a caller that was in the repository's parent directory when
+	// it set GIT_DIR, but runs us somewhere else.
+	t.Setenv("GIT_DIR", filepath.Base(repo))
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	config, err := GetConfig(repo)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"refs/pull/"}, config.GetAll("receive.hiderefs"))
+}
@@ -0,0 +1,134 @@
+// Package events tells other systems about pushes that have been accepted,
+// so that they don't need to poll for them.
+//
+// Accepted isn't the same as done: spokes-receive-pack leaves migrating the
+// quarantine and updating the refs to its caller, which happens after the
+// event is sent and can still fail. Subscribers that act on the new values
+// must check that the refs really have them.
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DestinationEnv is the name of an environment variable that says where to
+// send push events. See New.
+const DestinationEnv = "SPOKES_PUSH_EVENTS"
+
+// sendTimeout is how long we wait for an event to be delivered. Events are
+// best-effort, so a slow subscriber mustn't hold up the push.
+const sendTimeout = 2 * time.Second
+
+// RefUpdate is a ref update that was accepted.
+type RefUpdate struct {
+	Refname string `json:"refname"`
+	OldOID  string `json:"old_oid"`
+	NewOID  string `json:"new_oid"`
+}
+
+// PushAccepted is the Event of an AcceptedPush.
+const PushAccepted = "push.accepted"
+
+// AcceptedPush describes a push whose ref updates spokes-receive-pack
+// accepted, but that hasn't updated the refs yet.
+type AcceptedPush struct {
+	Event     string      `json:"event"`
+	Time      time.Time   `json:"time"`
+	RepoName  string      `json:"repo_name,omitempty"`
+	RepoID    uint32      `json:"repo_id,omitempty"`
+	UserID    uint32      `json:"user_id,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+	PackSize  int64       `json:"pack_size"`
+	Refs      []RefUpdate `json:"refs"`
+}
+
+// Emitter sends push events to a unix socket or an HTTP endpoint.
+//
+// It is safe to call Emit with a nil *Emitter, which doesn't send anything.
+type Emitter struct {
+	socket string
+	url    string
+	http   *http.Client
+}
+
+// New returns an emitter that sends events to `dest`, which is either
+// "unix://" followed by the path of a unix socket, to which each event is
+// written as a line of JSON, or an http:// or https:// URL, to which each
+// event is POSTed. If `dest` is empty, New returns (nil, nil).
+func New(dest string) (*Emitter, error) {
+	switch {
+	case dest == "":
+		return nil, nil
+	case strings.HasPrefix(dest, "unix://"):
+		return &Emitter{socket: strings.TrimPrefix(dest, "unix://")}, nil
+	case strings.HasPrefix(dest, "http://"), strings.HasPrefix(dest, "https://"):
+		return &Emitter{url: dest, http: &http.Client{}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported push event destination %q", dest)
+	}
+}
+
+// Emit sends `ev`.
+func (e *Emitter) Emit(ctx context.Context, ev AcceptedPush) error {
+	if e == nil {
+		return nil
+	}
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("encoding push event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+
+	if e.socket != "" {
+		return e.writeSocket(ctx, append(body, '\n'))
+	}
+	return e.post(ctx, body)
+}
+
+func (e *Emitter) writeSocket(ctx context.Context, line []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", e.socket)
+	if err != nil {
+		return fmt.Errorf("connecting to push event socket: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetWriteDeadline(deadline)
+	}
+	if _, err := conn.Write(line); err != nil {
+		return fmt.Errorf("writing push event: %w", err)
+	}
+	return nil
+}
+
+func (e *Emitter) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating push event request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting push event: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("posting push event: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testEvent = AcceptedPush{
+	Event:    PushAccepted,
+	Time:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	RepoName: "a/b",
+	UserID:   7,
+	PackSize: 1234,
+	Refs:     []RefUpdate{{Refname: "refs/heads/main", OldOID: "1111", NewOID: "2222"}},
+}
+
+func TestEmitUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer l.Close()
+
+	received := make(chan AcceptedPush, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var ev AcceptedPush
+		if line, err := bufio.NewReader(conn).ReadBytes('\n'); err == nil {
+			_ = json.Unmarshal(line, &ev)
+		}
+		received <- ev
+	}()
+
+	e, err := New("unix://" + path)
+	require.NoError(t, err)
+	require.NoError(t, e.Emit(context.Background(), testEvent))
+	assert.Equal(t, testEvent, <-received)
+}
+
+func TestEmitHTTP(t *testing.T) {
+	var got AcceptedPush
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	e, err := New(srv.URL)
+	require.NoError(t, err)
+	require.NoError(t, e.Emit(context.Background(), testEvent))
+	assert.Equal(t, testEvent, got)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	e, err = New(failing.URL)
+	require.NoError(t, err)
+	assert.Error(t, e.Emit(context.Background(), testEvent))
+}
+
+func TestNew(t *testing.T) {
+	e, err := New("")
+	assert.NoError(t, err)
+	assert.Nil(t, e)
+	assert.NoError(t, e.Emit(context.Background(), testEvent))
+
+	_, err = New("/some/path")
+	assert.Error(t, err)
+
+	e, err = New("unix://" + filepath.Join(t.TempDir(), "missing.sock"))
+	require.NoError(t, err)
+	assert.Error(t, e.Emit(context.Background(), testEvent))
+}
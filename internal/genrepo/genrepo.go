@@ -0,0 +1,267 @@
+// Package genrepo builds bare repositories for tests and benchmarks, so
+// that they don't need checked-in fixtures. The same Spec always produces
+// the same objects, so tests can rely on their OIDs.
+package genrepo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The identity and time that every generated commit uses. Each commit is a
+// second later than its parent.
+const (
+	ident     = "genrepo <genrepo@example.com>"
+	startTime = 1680000000
+)
+
+// RefSet is Count refs named by formatting the numbers from 1 to Count
+// with Format, like "refs/tags/v%d".
+type RefSet struct {
+	Format string
+	Count  int
+}
+
+// Spec describes a repository to generate.
+type Spec struct {
+	// ObjectFormat is "sha1" or "sha256". It defaults to "sha1".
+	ObjectFormat string
+
+	// Commits is how many commits refs/heads/main has. It defaults to 1.
+	Commits int
+
+	// BlobSize is the size of the file that each commit changes. Its
+	// contents are random, so it doesn't compress.
+	BlobSize int
+
+	// Seed seeds the contents of the files.
+	Seed int64
+
+	// Refs are more refs to create, which all point at the tip of main.
+	Refs []RefSet
+
+	// Forks is how many forks to create next to the repository. They
+	// borrow its objects through alternates, and each has a branch with a
+	// commit of its own.
+	Forks int
+
+	// MissingBlobs is how many of the newest commits on main have their
+	// file removed from the repository, leaving it broken.
+	MissingBlobs int
+}
+
+// Repo is a generated repository.
+type Repo struct {
+	Path string
+
+	// Head is the OID of the tip of main.
+	Head string
+
+	// Forks are the paths of the forks.
+	Forks []string
+
+	// Missing are the OIDs of the blobs that were removed.
+	Missing []string
+}
+
+// Generate creates the repository that `spec` describes at `path`, which
+// must not exist yet. Forks are created in the same directory, named like
+// "<name>-fork-1.git".
+func Generate(ctx context.Context, path string, spec Spec) (*Repo, error) {
+	if spec.Commits <= 0 {
+		spec.Commits = 1
+	}
+	if spec.ObjectFormat == "" {
+		spec.ObjectFormat = "sha1"
+	}
+	if spec.MissingBlobs > spec.Commits {
+		return nil, fmt.Errorf("can't remove the blobs of %d commits out of %d", spec.MissingBlobs, spec.Commits)
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := initBare(ctx, path, spec.ObjectFormat); err != nil {
+		return nil, err
+	}
+
+	// Keep every object in a pack, even when there are few of them, so
+	// that removeBlobs only has to deal with packs.
+	var stream bytes.Buffer
+	writeHistory(&stream, spec)
+	if err := git(ctx, path, &stream, nil, "-c", "fastimport.unpackLimit=0", "fast-import", "--quiet"); err != nil {
+		return nil, err
+	}
+	if err := git(ctx, path, nil, nil, "pack-refs", "--all"); err != nil {
+		return nil, err
+	}
+
+	repo := &Repo{Path: path}
+	if repo.Head, err = revParse(ctx, path, "refs/heads/main"); err != nil {
+		return nil, err
+	}
+
+	if spec.MissingBlobs > 0 {
+		if repo.Missing, err = removeBlobs(ctx, path, spec.MissingBlobs); err != nil {
+			return nil, err
+		}
+	}
+
+	base := strings.TrimSuffix(path, ".git")
+	for i := 1; i <= spec.Forks; i++ {
+		fork := fmt.Sprintf("%s-fork-%d.git", base, i)
+		if err := generateFork(ctx, repo, fork, spec.ObjectFormat, i); err != nil {
+			return nil, fmt.Errorf("creating fork %d: %w", i, err)
+		}
+		repo.Forks = append(repo.Forks, fork)
+	}
+
+	return repo, nil
+}
+
+func initBare(ctx context.Context, path, objectFormat string) error {
+	if err := git(ctx, "", nil, nil, "init", "--quiet", "--bare", "--object-format="+objectFormat, path); err != nil {
+		return err
+	}
+	return git(ctx, path, nil, nil, "symbolic-ref", "HEAD", "refs/heads/main")
+}
+
+// writeHistory writes the fast-import commands that create the history
+// and refs of `spec` to `w`.
+func writeHistory(w *bytes.Buffer, spec Spec) {
+	rnd := rand.New(rand.NewSource(spec.Seed))
+	content := make([]byte, spec.BlobSize)
+
+	for i := 1; i <= spec.Commits; i++ {
+		_, _ = rnd.Read(content)
+		fmt.Fprintf(w, "blob\nmark :%d\ndata %d\n", 2*i-1, len(content))
+		w.Write(content)
+		w.WriteString("\n")
+
+		msg := fmt.Sprintf("commit %d\n", i)
+		fmt.Fprintf(w, "commit refs/heads/main\nmark :%d\n", 2*i)
+		fmt.Fprintf(w, "committer %s %d +0000\n", ident, startTime+i)
+		fmt.Fprintf(w, "data %d\n%s", len(msg), msg)
+		if i > 1 {
+			fmt.Fprintf(w, "from :%d\n", 2*i-2)
+		}
+		fmt.Fprintf(w, "M 100644 :%d file\n\n", 2*i-1)
+	}
+
+	for _, set := range spec.Refs {
+		for n := 1; n <= set.Count; n++ {
+			fmt.Fprintf(w, "reset %s\nfrom :%d\n\n", fmt.Sprintf(set.Format, n), 2*spec.Commits)
+		}
+	}
+}
+
+// removeBlobs repacks the repository at `path` without the files of the
+// newest `n` commits on main, and returns their OIDs.
+func removeBlobs(ctx context.Context, path string, n int) ([]string, error) {
+	doomed := make(map[string]bool)
+	var missing []string
+	for i := 0; i < n; i++ {
+		oid, err := revParse(ctx, path, fmt.Sprintf("refs/heads/main~%d:file", i))
+		if err != nil {
+			return nil, err
+		}
+		if !doomed[oid] {
+			doomed[oid] = true
+			missing = append(missing, oid)
+		}
+	}
+
+	var objects bytes.Buffer
+	if err := git(ctx, path, nil, &objects, "rev-list", "--objects", "--all"); err != nil {
+		return nil, err
+	}
+	var keep bytes.Buffer
+	scanner := bufio.NewScanner(&objects)
+	for scanner.Scan() {
+		oid, _, _ := strings.Cut(scanner.Text(), " ")
+		if !doomed[oid] {
+			fmt.Fprintln(&keep, oid)
+		}
+	}
+
+	oldPacks, err := filepath.Glob(filepath.Join(path, "objects", "pack", "pack-*"))
+	if err != nil {
+		return nil, err
+	}
+	var name bytes.Buffer
+	if err := git(ctx, path, &keep, &name, "pack-objects", "--quiet", filepath.Join(path, "objects", "pack", "pack")); err != nil {
+		return nil, err
+	}
+	newPack := "pack-" + strings.TrimSpace(name.String())
+	for _, p := range oldPacks {
+		if strings.HasPrefix(filepath.Base(p), newPack+".") {
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			return nil, err
+		}
+	}
+
+	return missing, nil
+}
+
+// generateFork creates a fork of `repo` at `path` with main and a branch
+// "fork-<n>" that has one more commit.
+func generateFork(ctx context.Context, repo *Repo, path, objectFormat string, n int) error {
+	if err := initBare(ctx, path, objectFormat); err != nil {
+		return err
+	}
+	alternates := filepath.Join(path, "objects", "info", "alternates")
+	if err := os.WriteFile(alternates, []byte(filepath.Join(repo.Path, "objects")+"\n"), 0o644); err != nil {
+		return err
+	}
+
+	var stream bytes.Buffer
+	content := fmt.Sprintf("fork %d\n", n)
+	msg := fmt.Sprintf("fork %d\n", n)
+	fmt.Fprintf(&stream, "reset refs/heads/main\nfrom %s\n\n", repo.Head)
+	fmt.Fprintf(&stream, "commit refs/heads/fork-%d\n", n)
+	fmt.Fprintf(&stream, "committer %s %d +0000\n", ident, startTime)
+	fmt.Fprintf(&stream, "data %d\n%s", len(msg), msg)
+	fmt.Fprintf(&stream, "from %s\n", repo.Head)
+	fmt.Fprintf(&stream, "M 100644 inline fork\ndata %d\n%s\n", len(content), content)
+
+	if err := git(ctx, path, &stream, nil, "-c", "fastimport.unpackLimit=0", "fast-import", "--quiet"); err != nil {
+		return err
+	}
+	return git(ctx, path, nil, nil, "pack-refs", "--all")
+}
+
+func revParse(ctx context.Context, path, rev string) (string, error) {
+	var out bytes.Buffer
+	if err := git(ctx, path, nil, &out, "rev-parse", "--verify", rev); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// git runs git with `args` in the repository at `dir`, if it is set.
+func git(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	if dir != "" {
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_DIR="+dir)
+	}
+	var stderr bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
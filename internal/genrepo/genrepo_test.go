@@ -0,0 +1,77 @@
+package genrepo
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	ctx := context.Background()
+	spec := Spec{
+		Commits:  3,
+		BlobSize: 1000,
+		Seed:     1,
+		Refs:     []RefSet{{Format: "refs/tags/v%d", Count: 5}},
+	}
+
+	a, err := Generate(ctx, filepath.Join(t.TempDir(), "a.git"), spec)
+	require.NoError(t, err)
+	b, err := Generate(ctx, filepath.Join(t.TempDir(), "b.git"), spec)
+	require.NoError(t, err)
+	assert.Equal(t, a.Head, b.Head, "the same spec should produce the same objects")
+
+	refs := run(t, a.Path, "for-each-ref", "--format=%(objectname) %(refname)")
+	assert.Len(t, strings.Split(refs, "\n"), 6)
+	assert.Contains(t, refs, a.Head+" refs/tags/v5")
+	assert.Equal(t, "3", run(t, a.Path, "rev-list", "--count", "HEAD"))
+	assert.Equal(t, "1000", run(t, a.Path, "cat-file", "-s", "HEAD:file"))
+
+	spec.Seed = 2
+	c, err := Generate(ctx, filepath.Join(t.TempDir(), "c.git"), spec)
+	require.NoError(t, err)
+	assert.NotEqual(t, a.Head, c.Head)
+}
+
+func TestGenerateForks(t *testing.T) {
+	repo, err := Generate(context.Background(), filepath.Join(t.TempDir(), "network.git"), Spec{Forks: 2})
+	require.NoError(t, err)
+	require.Len(t, repo.Forks, 2)
+	assert.Equal(t, "network-fork-2.git", filepath.Base(repo.Forks[1]))
+
+	for _, fork := range repo.Forks {
+		assert.Equal(t, repo.Head, run(t, fork, "rev-parse", "refs/heads/main"))
+		run(t, fork, "fsck", "--connectivity-only")
+	}
+	assert.Equal(t, repo.Head, run(t, repo.Forks[0], "rev-parse", "refs/heads/fork-1^"))
+}
+
+func TestGenerateMissingBlobs(t *testing.T) {
+	repo, err := Generate(context.Background(), filepath.Join(t.TempDir(), "broken.git"), Spec{
+		Commits:      3,
+		BlobSize:     10,
+		MissingBlobs: 2,
+	})
+	require.NoError(t, err)
+	require.Len(t, repo.Missing, 2)
+
+	for _, oid := range repo.Missing {
+		assert.Error(t, exec.Command("git", "-C", repo.Path, "cat-file", "-e", oid).Run())
+	}
+	run(t, repo.Path, "cat-file", "-e", "HEAD~2:file")
+
+	_, err = Generate(context.Background(), filepath.Join(t.TempDir(), "x.git"), Spec{MissingBlobs: 2})
+	assert.Error(t, err)
+}
+
+func run(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	require.NoError(t, err, "git %v: %s", args, out)
+	return strings.TrimSpace(string(out))
+}
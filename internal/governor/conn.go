@@ -3,10 +3,13 @@ package governor
 import (
 	"bufio"
 	"context"
+	"fmt"
+	"io"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/github/spokes-receive-pack/internal/sockstat"
@@ -14,6 +17,10 @@ import (
 
 const (
 	connectTimeout = time.Second
+
+	// defaultSockstatPath is where governor listens unless
+	// GIT_SOCKSTAT_PATH says otherwise.
+	defaultSockstatPath = "/var/run/gitmon/gitstats.sock"
 )
 
 func scheduleTimeout() time.Duration {
@@ -31,6 +38,26 @@ func shouldFailClosed() bool {
 	return os.Getenv("FAIL_CLOSED") == "1"
 }
 
+// devLogOutput is where messages are written when GOVERNOR_LOG_ONLY is set.
+var devLogOutput io.Writer = os.Stderr
+
+func isLogOnly() bool {
+	return os.Getenv("GOVERNOR_LOG_ONLY") == "1"
+}
+
+// logWriter writes each governor message on its own line, so that the
+// messages are readable when logged instead of sent to governor.
+type logWriter struct {
+	w io.Writer
+}
+
+func (lw logWriter) Write(p []byte) (int, error) {
+	if _, err := fmt.Fprintf(lw.w, "governor: %s\n", p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 // Start connects to governor and sends the "update" and "schedule" messages.
 //
 // If "schedule" says to wait, Start will pause for the specified time and try
@@ -38,16 +65,37 @@ func shouldFailClosed() bool {
 //
 // If there is a connection or other low level error when talking to governor,
 // Start will return (nil, nil).
-func Start(ctx context.Context, gitDir string) (*Conn, error) {
+//
+// If GOVERNOR_LOG_ONLY=1 is set, Start doesn't connect to governor at all.
+// Instead, the messages that would have been sent are logged to stderr and
+// scheduling always continues immediately. This is meant for local
+// development.
+func Start(ctx context.Context, gitDir string, vars sockstat.Vars) (*Conn, error) {
+	return StartProgram(ctx, "spokes-receive-pack", gitDir, vars)
+}
+
+// StartProgram is like Start, but reports to governor that `program` is
+// being run.
+func StartProgram(ctx context.Context, program, gitDir string, vars sockstat.Vars) (*Conn, error) {
+	updateData := newUpdateData(vars)
+	updateData.PID = os.Getpid()
+	updateData.Program = program
+	updateData.GitDir = gitDir
+
+	if isLogOnly() {
+		lw := logWriter{w: devLogOutput}
+		if err := update(lw, updateData); err != nil {
+			return nil, nil
+		}
+		_, _ = lw.Write([]byte(`{"command":"schedule"}`))
+		return &Conn{logOnly: lw}, nil
+	}
+
 	sock, err := connect(ctx)
 	if err != nil {
 		return nil, nil
 	}
 
-	updateData := readSockstat(os.Environ())
-	updateData.PID = os.Getpid()
-	updateData.Program = "spokes-receive-pack"
-	updateData.GitDir = gitDir
 	if err := update(sock, updateData); err != nil {
 		sock.Close()
 		return nil, nil
@@ -90,10 +138,72 @@ func Start(ctx context.Context, gitDir string) (*Conn, error) {
 	return &Conn{sock: sock}, nil
 }
 
+// Ping checks that governor can be reached, without telling it about a
+// process. It returns where governor was reached, which is "log-only" if
+// GOVERNOR_LOG_ONLY=1 is set.
+func Ping(ctx context.Context) (string, error) {
+	if isLogOnly() {
+		return "log-only", nil
+	}
+
+	path := os.Getenv("GIT_SOCKSTAT_PATH")
+	if path == "" {
+		path = defaultSockstatPath
+	}
+	sock, err := connect(ctx)
+	if err != nil {
+		return path, err
+	}
+	return path, sock.Close()
+}
+
 // Conn is an active connection to governor.
 type Conn struct {
-	sock   net.Conn
-	finish finishData
+	sock    net.Conn
+	logOnly io.Writer
+	finish  finishData
+}
+
+// ClientCapabilities describes the capabilities that the client negotiated.
+type ClientCapabilities struct {
+	Agent       string
+	SessionID   string
+	Sideband    string
+	Atomic      bool
+	PushOptions bool
+}
+
+// UpdateClientCapabilities sends an additional "update" message to governor
+// with the client's agent and the capabilities that it negotiated.
+//
+// It is safe to call UpdateClientCapabilities with a nil *Conn.
+func (c *Conn) UpdateClientCapabilities(cc ClientCapabilities) {
+	if c == nil {
+		return
+	}
+	w := c.writer()
+	if w == nil {
+		return
+	}
+	_ = update(w, updateData{
+		ClientAgent:     cc.Agent,
+		ClientSessionID: cc.SessionID,
+		Sideband:        cc.Sideband,
+		Atomic:          cc.Atomic,
+		PushOptions:     cc.PushOptions,
+	})
+}
+
+// writer returns where messages to governor should be written, or nil if
+// the connection has already been finished.
+func (c *Conn) writer() io.Writer {
+	if c.logOnly != nil {
+		return c.logOnly
+	}
+	if c.sock != nil {
+		return c.sock
+	}
+	return nil
 }
 
 // SetError stores an error to include with the finish message.
@@ -107,6 +217,17 @@ func (c *Conn) SetError(exitCode uint8, message string) {
 	c.finish.Fatal = message
 }
 
+// SetCategory records the category of the failure to include with the finish
+// message.
+//
+// It is safe to call SetCategory with a nil *Conn.
+func (c *Conn) SetCategory(category string) {
+	if c == nil {
+		return
+	}
+	c.finish.Category = category
+}
+
 // SetReceivePackSize records the incoming packfile's size to include with the
 // finish message.
 //
@@ -120,19 +241,95 @@ func (c *Conn) SetReceivePackSize(size int64) {
 	}
 }
 
+// SetForcedUpdates records how many of the ref updates weren't
+// fast-forwards to include with the finish message.
+//
+// It is safe to call SetForcedUpdates with a nil *Conn.
+func (c *Conn) SetForcedUpdates(n int) {
+	if c == nil {
+		return
+	}
+	c.finish.ForcedUpdates = uint32(n)
+}
+
+// SetTimeToAdvertisement records how long the client waited for the ref
+// advertisement to include with the finish message.
+//
+// It is safe to call SetTimeToAdvertisement with a nil *Conn.
+func (c *Conn) SetTimeToAdvertisement(d time.Duration) {
+	if c == nil {
+		return
+	}
+	c.finish.TimeToAdvertisement = uint32(d.Milliseconds())
+}
+
+// Rejections are how many ref update commands were rejected, in all and
+// for some kinds of reasons.
+type Rejections struct {
+	Rejected  int
+	HiddenRef int
+	Limit     int
+	Policy    int
+}
+
+// SetRejections records how many commands were rejected to include with
+// the finish message, since the command succeeds even if all of them were.
+//
+// It is safe to call SetRejections with a nil *Conn.
+func (c *Conn) SetRejections(rej Rejections) {
+	if c == nil {
+		return
+	}
+	c.finish.Rejected = uint32(rej.Rejected)
+	c.finish.HiddenRefRejects = uint32(rej.HiddenRef)
+	c.finish.LimitRejects = uint32(rej.Limit)
+	c.finish.PolicyRejects = uint32(rej.Policy)
+}
+
+// SetNoCommands records, to include with the finish message, that the
+// client sent no ref update commands, after we waited `waited` for them.
+//
+// It is safe to call SetNoCommands with a nil *Conn.
+func (c *Conn) SetNoCommands(waited time.Duration) {
+	if c == nil {
+		return
+	}
+	c.finish.NoCommands = true
+	c.finish.CommandWait = uint32(waited.Milliseconds())
+}
+
+// AddHookUsage adds the CPU time and maximum resident set size, in bytes,
+// of a hook that was run to the totals to include with the finish message.
+//
+// It is safe to call AddHookUsage with a nil *Conn.
+func (c *Conn) AddHookUsage(cpu time.Duration, rss uint64) {
+	if c == nil {
+		return
+	}
+	c.finish.HookCPU += uint32(cpu.Milliseconds())
+	c.finish.HookRSS += rss
+}
+
 // Finish sends the "finish" message to governor and closes the connection.
 //
 // It is safe to call Finish with a nil *Conn.
 func (c *Conn) Finish(ctx context.Context) {
-	if c == nil || c.sock == nil {
+	if c == nil {
 		return
 	}
 
-	stats := getProcStats()
-	c.finish.CPU = stats.CPU
-	c.finish.RSS = stats.RSS
-	c.finish.DiskReadBytes = stats.DiskReadBytes
-	c.finish.DiskWriteBytes = stats.DiskWriteBytes
+	if c.logOnly != nil {
+		c.fillProcStats()
+		_ = finish(c.logOnly, c.finish)
+		c.logOnly = nil
+		return
+	}
+
+	if c.sock == nil {
+		return
+	}
+
+	c.fillProcStats()
 
 	_ = finish(c.sock, c.finish)
 
@@ -140,6 +337,14 @@ func (c *Conn) Finish(ctx context.Context) {
 	c.sock = nil
 }
 
+func (c *Conn) fillProcStats() {
+	stats := getProcStats()
+	c.finish.CPU = stats.CPU
+	c.finish.RSS = stats.RSS
+	c.finish.DiskReadBytes = stats.DiskReadBytes
+	c.finish.DiskWriteBytes = stats.DiskWriteBytes
+}
+
 type procStats struct {
 	CPU            uint32
 	RSS            uint64
@@ -153,70 +358,85 @@ func connect(ctx context.Context) (net.Conn, error) {
 
 	path := os.Getenv("GIT_SOCKSTAT_PATH")
 	if path == "" {
-		path = "/var/run/gitmon/gitstats.sock"
+		path = defaultSockstatPath
+	}
+
+	network, address, err := parseSockstatPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "fd" {
+		fd, err := strconv.ParseUint(address, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid governor file descriptor %q: %w", address, err)
+		}
+		// The inherited descriptor must stay open for the next connect,
+		// like the fallback's, so only a copy of it is ours to close.
+		// net.FileConn dups that again.
+		dup, err := syscall.Dup(int(fd))
+		if err != nil {
+			return nil, fmt.Errorf("invalid governor file descriptor %d: %w", fd, err)
+		}
+		f := os.NewFile(uintptr(dup), "governor")
+		defer f.Close()
+		return net.FileConn(f)
 	}
 
 	dialer := &net.Dialer{}
-	return dialer.DialContext(ctx, "unix", path)
+	return dialer.DialContext(ctx, network, address)
 }
 
-func readSockstat(environ []string) updateData {
-	var res updateData
+// parseSockstatPath interprets GIT_SOCKSTAT_PATH. A plain path is a unix
+// socket. Otherwise, the value may be a URL like "unix:///path/to/sock",
+// "tcp://127.0.0.1:1234", or "fd://3", where the last one refers to an
+// already-connected socket inherited from the parent process (e.g. via
+// systemd socket activation).
+func parseSockstatPath(path string) (string, string, error) {
+	scheme, address, ok := strings.Cut(path, "://")
+	if !ok {
+		return "unix", path, nil
+	}
 
-	for _, env := range environ {
-		if !strings.HasPrefix(env, sockstat.Prefix) {
-			continue
-		}
-		env = env[len(sockstat.Prefix):]
-		parts := strings.SplitN(env, "=", 2)
-		if len(parts) != 2 {
-			continue
-		}
-		switch parts[0] {
-		case "repo_name":
-			res.RepoName = sockstat.StringValue(parts[1])
-		case "repo_id":
-			res.RepoID = sockstat.Uint32Value(parts[1])
-		case "network_id":
-			res.NetworkID = sockstat.Uint32Value(parts[1])
-		case "user_id":
-			res.UserID = sockstat.Uint32Value(parts[1])
-		case "real_ip":
-			res.RealIP = sockstat.StringValue(parts[1])
-		case "request_id":
-			res.RequestID = sockstat.StringValue(parts[1])
-		case "user_agent":
-			res.UserAgent = sockstat.StringValue(parts[1])
-		case "features":
-			res.Features = sockstat.StringValue(parts[1])
-		case "via":
-			res.Via = sockstat.StringValue(parts[1])
-		case "ssh_connection":
-			res.SSHConnection = sockstat.StringValue(parts[1])
-		case "babeld":
-			res.Babeld = sockstat.StringValue(parts[1])
-		case "git_protocol":
-			res.GitProtocol = sockstat.StringValue(parts[1])
-		case "pubkey_verifier_id":
-			res.PubkeyVerifierID = sockstat.Uint32Value(parts[1])
-		case "pubkey_creator_id":
-			res.PubkeyCreatorID = sockstat.Uint32Value(parts[1])
-		case "max_delay":
-			res.MaxDelay = sockstat.Uint32Value(parts[1])
-		case "command_id":
-			res.CommandID = sockstat.StringValue(parts[1])
-		case "group_id":
-			res.GroupID = sockstat.StringValue(parts[1])
-		case "group_leader":
-			res.GroupLeader = sockstat.GetBool(parts[1])
-		case "is_importing":
-			res.IsImporting = sockstat.BoolValue(parts[1])
-		case "import_skip_push_limit":
-			res.ImportSkipPushLimit = sockstat.BoolValue(parts[1])
-		case "import_soft_throttling":
-			res.ImportSoftThrottling = sockstat.BoolValue(parts[1])
-		}
+	if address == "" {
+		return "", "", fmt.Errorf("missing address in governor socket path %q", path)
 	}
 
-	return res
+	switch scheme {
+	case "unix", "tcp", "fd":
+		return scheme, address, nil
+	default:
+		return "", "", fmt.Errorf("unsupported governor socket scheme %q", scheme)
+	}
+}
+
+func readSockstat(environ []string) updateData {
+	return newUpdateData(sockstat.Parse(environ))
+}
+
+func newUpdateData(vars sockstat.Vars) updateData {
+	return updateData{
+		RepoName:             vars.RepoName,
+		RepoID:               vars.RepoID,
+		NetworkID:            vars.NetworkID,
+		UserID:               vars.UserID,
+		RealIP:               vars.RealIP,
+		RequestID:            vars.RequestID,
+		UserAgent:            vars.UserAgent,
+		Features:             vars.Features,
+		Via:                  vars.Via,
+		SSHConnection:        vars.SSHConnection,
+		Babeld:               vars.Babeld,
+		GitProtocol:          vars.GitProtocol,
+		PubkeyVerifierID:     vars.PubkeyVerifierID,
+		PubkeyCreatorID:      vars.PubkeyCreatorID,
+		MaxDelay:             vars.MaxDelay,
+		CommandID:            vars.CommandID,
+		GroupID:              vars.GroupID,
+		GroupLeader:          vars.GroupLeader,
+		QualityOfService:     vars.QualityOfService,
+		IsImporting:          vars.IsImporting,
+		ImportSkipPushLimit:  vars.ImportSkipPushLimit,
+		ImportSoftThrottling: vars.ImportSoftThrottling,
+	}
 }
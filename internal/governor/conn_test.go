@@ -1,6 +1,22 @@
 package governor
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/sockstat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
 
 func TestReadSockstat(t *testing.T) {
 	examples := []struct {
@@ -35,6 +51,7 @@ func TestReadSockstat(t *testing.T) {
 				"GIT_SOCKSTAT_VAR_git_protocol=http",
 				"GIT_SOCKSTAT_VAR_pubkey_verifier_id=uint:10",
 				"GIT_SOCKSTAT_VAR_pubkey_creator_id=uint:11",
+				"GIT_SOCKSTAT_VAR_qos=batch",
 			},
 			expected: updateData{
 				RepoName:         "a/b",
@@ -51,6 +68,7 @@ func TestReadSockstat(t *testing.T) {
 				GitProtocol:      "http",
 				PubkeyVerifierID: 10,
 				PubkeyCreatorID:  11,
+				QualityOfService: "batch",
 			},
 		},
 	}
@@ -62,3 +80,120 @@ func TestReadSockstat(t *testing.T) {
 		}
 	}
 }
+
+func TestLogOnlyMode(t *testing.T) {
+	var buf bytes.Buffer
+	origOutput := devLogOutput
+	devLogOutput = &buf
+	t.Cleanup(func() { devLogOutput = origOutput })
+
+	t.Setenv("GOVERNOR_LOG_ONLY", "1")
+	t.Setenv("GIT_SOCKSTAT_PATH", "/nonexistent/governor.sock")
+	t.Setenv("GIT_SOCKSTAT_VAR_repo_name", "a/b")
+
+	c, err := Start(context.Background(), "/tmp/a/b.git", sockstat.Snapshot())
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	c.UpdateClientCapabilities(ClientCapabilities{Agent: "git/2.42.0", SessionID: "client-1"})
+	c.SetError(1, "boom")
+	c.SetCategory("terminated")
+	c.SetForcedUpdates(2)
+	c.SetTimeToAdvertisement(1500 * time.Millisecond)
+	c.SetNoCommands(250 * time.Millisecond)
+	c.SetRejections(Rejections{Rejected: 3, HiddenRef: 1, Policy: 2})
+	c.AddHookUsage(300*time.Millisecond, 1000)
+	c.AddHookUsage(200*time.Millisecond, 500)
+	c.Finish(context.Background())
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 4)
+	assert.Contains(t, lines[0], `governor: {"command":"update","data":{`)
+	assert.Contains(t, lines[0], `"repo_name":"a/b"`)
+	assert.Equal(t, `governor: {"command":"schedule"}`, lines[1])
+	assert.Equal(t, `governor: {"command":"update","data":{"client_agent":"git/2.42.0","client_session_id":"client-1"}}`, lines[2])
+	assert.Contains(t, lines[3], `governor: {"command":"finish","data":{"result_code":1,`)
+	assert.Contains(t, lines[3], `"fatal":"boom"`)
+	assert.Contains(t, lines[3], `"category":"terminated"`)
+	assert.Contains(t, lines[3], `"forced_updates":2`)
+	assert.Contains(t, lines[3], `"time_to_advertisement_ms":1500`)
+	assert.Contains(t, lines[3], `"no_commands":true`)
+	assert.Contains(t, lines[3], `"command_wait_ms":250`)
+	assert.Contains(t, lines[3], `"rejected":3,"hidden_ref_rejects":1,"policy_rejects":2`)
+	assert.Contains(t, lines[3], `"hook_cpu":500,"hook_rss":1500`)
+}
+
+func TestPing(t *testing.T) {
+	dir := t.TempDir()
+	sockPath := filepath.Join(dir, "governor.sock")
+	l, err := net.Listen("unix", sockPath)
+	require.NoError(t, err)
+	defer l.Close()
+
+	t.Setenv("GIT_SOCKSTAT_PATH", sockPath)
+	addr, err := Ping(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, sockPath, addr)
+
+	t.Setenv("GIT_SOCKSTAT_PATH", filepath.Join(dir, "missing.sock"))
+	_, err = Ping(context.Background())
+	assert.Error(t, err)
+
+	t.Setenv("GOVERNOR_LOG_ONLY", "1")
+	addr, err = Ping(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "log-only", addr)
+}
+
+func TestParseSockstatPath(t *testing.T) {
+	examples := []struct {
+		path            string
+		network, addr   string
+		expectedFailure bool
+	}{
+		{path: "/var/run/gitmon/gitstats.sock", network: "unix", addr: "/var/run/gitmon/gitstats.sock"},
+		{path: "unix:///var/run/gitmon/gitstats.sock", network: "unix", addr: "/var/run/gitmon/gitstats.sock"},
+		{path: "tcp://127.0.0.1:7000", network: "tcp", addr: "127.0.0.1:7000"},
+		{path: "fd://3", network: "fd", addr: "3"},
+		{path: "tcp://", expectedFailure: true},
+		{path: "http://localhost:7000", expectedFailure: true},
+	}
+
+	for _, ex := range examples {
+		t.Run(ex.path, func(t *testing.T) {
+			network, addr, err := parseSockstatPath(ex.path)
+			if ex.expectedFailure {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, ex.network, network)
+			assert.Equal(t, ex.addr, addr)
+		})
+	}
+}
+
+func TestConnectInheritedFD(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	inherited := os.NewFile(uintptr(fds[0]), "inherited")
+	defer inherited.Close()
+	peer := os.NewFile(uintptr(fds[1]), "peer")
+	defer peer.Close()
+
+	t.Setenv("GIT_SOCKSTAT_PATH", fmt.Sprintf("fd://%d", fds[0]))
+
+	// Every connection uses the inherited socket, which stays open.
+	for i := 0; i < 2; i++ {
+		conn, err := connect(context.Background())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte{'a' + byte(i)})
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	}
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(peer, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ab", string(buf))
+}
@@ -82,6 +82,23 @@ type updateData struct {
 	// ImportSoftThrottling is true if the command is an import and
 	// we want to apply it some soft throttling policies.
 	ImportSoftThrottling bool `json:"import_soft_throttling,omitempty"`
+
+	// The following fields describe what the client negotiated. They
+	// are only known after the commands have been read, so they are
+	// sent in a follow-up "update" message.
+
+	// ClientAgent is the value of the client's agent capability.
+	ClientAgent string `json:"client_agent,omitempty"`
+	// ClientSessionID is the value of the client's session-id
+	// capability.
+	ClientSessionID string `json:"client_session_id,omitempty"`
+	// Sideband is the sideband capability that the client chose, if
+	// any.
+	Sideband string `json:"sideband,omitempty"`
+	// Atomic is true if the client requested an atomic push.
+	Atomic bool `json:"atomic,omitempty"`
+	// PushOptions is true if the client sent push options.
+	PushOptions bool `json:"push_options,omitempty"`
 }
 
 func update(w io.Writer, ud updateData) error {
@@ -235,6 +252,39 @@ type finishData struct {
 
 	// If git died, what was the error message that it emitted?
 	Fatal string `json:"fatal,omitempty"`
+
+	// The category of the failure, if any (e.g. "terminated").
+	Category string `json:"category,omitempty"`
+
+	// The number of ref updates that weren't fast-forwards.
+	ForcedUpdates uint32 `json:"forced_updates,omitempty"`
+
+	// How long the client waited for the first byte of the ref
+	// advertisement, in milliseconds, counting from the start of the
+	// process.
+	TimeToAdvertisement uint32 `json:"time_to_advertisement_ms,omitempty"`
+
+	// Whether the client sent no ref update commands, like when it had
+	// nothing to push or only wanted the ref advertisement.
+	NoCommands bool `json:"no_commands,omitempty"`
+
+	// How many of the ref update commands were rejected, in all and
+	// for the kinds of reasons that are counted separately.
+	Rejected         uint32 `json:"rejected,omitempty"`
+	HiddenRefRejects uint32 `json:"hidden_ref_rejects,omitempty"`
+	LimitRejects     uint32 `json:"limit_rejects,omitempty"`
+	PolicyRejects    uint32 `json:"policy_rejects,omitempty"`
+
+	// How long we waited for the client's commands after the ref
+	// advertisement, in milliseconds. It is only sent with NoCommands.
+	CommandWait uint32 `json:"command_wait_ms,omitempty"`
+
+	// The user plus system CPU, in milliseconds, and the maximum resident
+	// set size, in bytes, of the hooks that the command ran, like the blob
+	// scanner, summed over all of them. They are also counted in CPU and
+	// RSS.
+	HookCPU uint32 `json:"hook_cpu,omitempty"`
+	HookRSS uint64 `json:"hook_rss,omitempty"`
 }
 
 func finish(w io.Writer, fd finishData) error {
@@ -9,10 +9,21 @@ func getProcStats() procStats {
 	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
 		return procStats{}
 	}
-	return procStats{
-		CPU:            uint32(ru.Utime.Sec*1000) + uint32(ru.Utime.Usec/1000) + uint32(ru.Stime.Sec*1000) + uint32(ru.Stime.Usec/1000),
+	res := procStats{
+		CPU:            rusageCPU(&ru),
 		RSS:            uint64(ru.Maxrss),
 		DiskReadBytes:  uint64(ru.Inblock),
 		DiskWriteBytes: uint64(ru.Oublock),
 	}
+
+	// Most of the work of a push happens in git child processes, so
+	// include their usage too.
+	if cru, ok := childRusage(); ok {
+		res.CPU += rusageCPU(&cru)
+		res.RSS += uint64(cru.Maxrss)
+		res.DiskReadBytes += uint64(cru.Inblock)
+		res.DiskWriteBytes += uint64(cru.Oublock)
+	}
+
+	return res
 }
@@ -10,12 +10,15 @@ import (
 	"syscall"
 )
 
+// Linux reports `ru_inblock` and `ru_oublock` in 512-byte blocks.
+const rusageBlockSize = 512
+
 func getProcStats() procStats {
 	var res procStats
 
 	var ru syscall.Rusage
 	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err == nil {
-		res.CPU = uint32(ru.Utime.Sec*1000) + uint32(ru.Utime.Usec/1000) + uint32(ru.Stime.Sec*1000) + uint32(ru.Stime.Usec/1000)
+		res.CPU = rusageCPU(&ru)
 	}
 
 	res.RSS = getPeakRSS()
@@ -38,51 +41,83 @@ func getProcStats() procStats {
 
 	iostats, err := os.ReadFile("/proc/self/io")
 	if err == nil {
-		const (
-			readPrefix           = "read_bytes: "
-			writePrefix          = "write_bytes: "
-			cancelledWritePrefix = "cancelled_write_bytes: "
-		)
-		for _, line := range strings.Split(string(iostats), "\n") {
-			switch {
-			case strings.HasPrefix(line, readPrefix):
-				if val, err := strconv.ParseUint(line[len(readPrefix):], 10, 64); err != nil {
-					res.DiskReadBytes = val
-				}
-			case strings.HasPrefix(line, writePrefix):
-				if val, err := strconv.ParseUint(line[len(writePrefix):], 10, 64); err != nil {
-					res.DiskWriteBytes = val
-				}
-			case strings.HasPrefix(line, cancelledWritePrefix):
-				if val, err := strconv.ParseUint(line[len(cancelledWritePrefix):], 10, 64); err != nil {
-					// This always comes after write_bytes.
-					if val > res.DiskWriteBytes {
-						res.DiskWriteBytes = 0
-					} else {
-						res.DiskWriteBytes -= val
-					}
+		res.DiskReadBytes, res.DiskWriteBytes = parseProcIO(iostats)
+	}
+
+	// index-pack and rev-list do most of the work of a push, so include
+	// the usage of every child that we have waited for. The kernel
+	// doesn't expose per-child I/O byte counts once a child has been
+	// reaped, so use the block counts from rusage instead.
+	if cru, ok := childRusage(); ok {
+		res.CPU += rusageCPU(&cru)
+		// `ru_maxrss` is in kilobytes, and is the peak of the largest
+		// child.
+		res.RSS += uint64(cru.Maxrss) * 1024
+		res.DiskReadBytes += uint64(cru.Inblock) * rusageBlockSize
+		res.DiskWriteBytes += uint64(cru.Oublock) * rusageBlockSize
+	}
+
+	return res
+}
+
+// parseProcIO extracts the number of bytes read and written from the
+// contents of `/proc/<pid>/io`.
+func parseProcIO(iostats []byte) (readBytes, writeBytes uint64) {
+	const (
+		readPrefix           = "read_bytes: "
+		writePrefix          = "write_bytes: "
+		cancelledWritePrefix = "cancelled_write_bytes: "
+	)
+	for _, line := range strings.Split(string(iostats), "\n") {
+		switch {
+		case strings.HasPrefix(line, readPrefix):
+			if val, err := strconv.ParseUint(line[len(readPrefix):], 10, 64); err == nil {
+				readBytes = val
+			}
+		case strings.HasPrefix(line, writePrefix):
+			if val, err := strconv.ParseUint(line[len(writePrefix):], 10, 64); err == nil {
+				writeBytes = val
+			}
+		case strings.HasPrefix(line, cancelledWritePrefix):
+			if val, err := strconv.ParseUint(line[len(cancelledWritePrefix):], 10, 64); err == nil {
+				// This always comes after write_bytes.
+				if val > writeBytes {
+					writeBytes = 0
+				} else {
+					writeBytes -= val
 				}
 			}
 		}
 	}
-
-	return res
+	return readBytes, writeBytes
 }
 
 func getPeakRSS() uint64 {
-	const prefix = "\nVmHWM:"
-
 	stat, err := os.ReadFile("/proc/self/status")
 	if err != nil {
 		return 0
 	}
 
-	i := bytes.Index(stat, []byte(prefix))
+	return parsePeakRSS(stat)
+}
+
+// parsePeakRSS extracts the `VmHWM` value (in bytes) from the contents of
+// `/proc/<pid>/status`.
+func parsePeakRSS(status []byte) uint64 {
+	const prefix = "\nVmHWM:"
+
+	i := bytes.Index(status, []byte(prefix))
 	if i == -1 {
 		return 0
 	}
 
-	val, err := strconv.ParseUint(string(stat[i:]), 10, 64)
+	// The line looks like "VmHWM:	    1234 kB".
+	fields := bytes.Fields(status[i+len(prefix):])
+	if len(fields) == 0 {
+		return 0
+	}
+
+	val, err := strconv.ParseUint(string(fields[0]), 10, 64)
 	if err != nil {
 		return 0
 	}
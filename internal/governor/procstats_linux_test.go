@@ -0,0 +1,29 @@
+//go:build linux
+
+package governor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProcIO(t *testing.T) {
+	iostats := []byte("rchar: 1000\nwchar: 2000\nsyscr: 3\nsyscw: 4\nread_bytes: 4096\nwrite_bytes: 8192\ncancelled_write_bytes: 4096\n")
+
+	readBytes, writeBytes := parseProcIO(iostats)
+	assert.Equal(t, uint64(4096), readBytes)
+	assert.Equal(t, uint64(4096), writeBytes)
+}
+
+func TestParsePeakRSS(t *testing.T) {
+	status := []byte("Name:\tspokes-receive-pack\nVmPeak:\t   20000 kB\nVmHWM:\t    1234 kB\nVmRSS:\t    1000 kB\n")
+
+	assert.Equal(t, uint64(1234*1024), parsePeakRSS(status))
+	assert.Equal(t, uint64(0), parsePeakRSS([]byte("Name:\tanything\n")))
+}
+
+func TestGetProcStatsIncludesSelf(t *testing.T) {
+	stats := getProcStats()
+	assert.Greater(t, stats.RSS, uint64(0))
+}
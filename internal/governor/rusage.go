@@ -0,0 +1,19 @@
+package governor
+
+import "syscall"
+
+// rusageCPU returns the user plus system CPU time recorded in `ru`, as an
+// integer number of milliseconds.
+func rusageCPU(ru *syscall.Rusage) uint32 {
+	return uint32(ru.Utime.Sec*1000) + uint32(ru.Utime.Usec/1000) + uint32(ru.Stime.Sec*1000) + uint32(ru.Stime.Usec/1000)
+}
+
+// childRusage returns the resource usage of all of the child processes
+// (index-pack, rev-list, etc.) that have terminated and been waited for.
+func childRusage() (syscall.Rusage, bool) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_CHILDREN, &ru); err != nil {
+		return ru, false
+	}
+	return ru, true
+}
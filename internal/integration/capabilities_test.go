@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/github/spokes-receive-pack/internal/pktline"
+	"github.com/github/spokes-receive-pack/internal/testclient"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -68,9 +69,9 @@ func TestCapabilities(t *testing.T) {
 		srp.Start()
 
 		bufSRPOut := bufio.NewReader(srpOut)
-		_, capsLine, err := readAdv(bufSRPOut)
+		adv, err := testclient.ReadAdvertisement(bufSRPOut)
 		require.NoError(t, err)
-		caps, err := pktline.ParseCapabilities([]byte(capsLine))
+		caps, err := pktline.ParseCapabilities([]byte(adv.Capabilities))
 		require.NoError(t, err)
 
 		assert.NoError(t, srp.Wait())
@@ -13,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/github/spokes-receive-pack/internal/testclient"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -79,30 +80,30 @@ func TestHiderefsConfig(t *testing.T) {
 
 	bufSRPOut := bufio.NewReader(srpOut)
 
-	refs, _, err := readAdv(bufSRPOut)
+	adv, err := testclient.ReadAdvertisement(bufSRPOut)
 	require.NoError(t, err)
-	assert.Contains(t, refs, defaultBranch)
-	assert.NotContains(t, refs, transferhide1)
-	assert.NotContains(t, refs, transferhide2)
-	assert.Contains(t, refs, transferunhide)
-	assert.NotContains(t, refs, receivehide1)
-	assert.NotContains(t, refs, receivehide2)
-	assert.Contains(t, refs, uploadhide)
+	assert.Contains(t, adv.Refs, defaultBranch)
+	assert.NotContains(t, adv.Refs, transferhide1)
+	assert.NotContains(t, adv.Refs, transferhide2)
+	assert.Contains(t, adv.Refs, transferunhide)
+	assert.NotContains(t, adv.Refs, receivehide1)
+	assert.NotContains(t, adv.Refs, receivehide2)
+	assert.Contains(t, adv.Refs, uploadhide)
 
 	oldnew := fmt.Sprintf("%040d %s", 0, testCommit)
-	require.NoError(t, writePktlinef(srpIn,
+	require.NoError(t, testclient.WritePktlinef(srpIn,
 		"%s %s\x00report-status report-status-v2 side-band-64k object-format=sha1\n", oldnew, createBranch))
-	require.NoError(t, writePktlinef(srpIn,
+	require.NoError(t, testclient.WritePktlinef(srpIn,
 		"%s %s\n", oldnew, createtransferhide1))
-	require.NoError(t, writePktlinef(srpIn,
+	require.NoError(t, testclient.WritePktlinef(srpIn,
 		"%s %s\n", oldnew, createtransferhide2))
-	require.NoError(t, writePktlinef(srpIn,
+	require.NoError(t, testclient.WritePktlinef(srpIn,
 		"%s %s\n", oldnew, createtransferunhide))
-	require.NoError(t, writePktlinef(srpIn,
+	require.NoError(t, testclient.WritePktlinef(srpIn,
 		"%s %s\n", oldnew, createreceivehide1))
-	require.NoError(t, writePktlinef(srpIn,
+	require.NoError(t, testclient.WritePktlinef(srpIn,
 		"%s %s\n", oldnew, createreceivehide2))
-	require.NoError(t, writePktlinef(srpIn,
+	require.NoError(t, testclient.WritePktlinef(srpIn,
 		"%s %s\n", oldnew, createuploadhide))
 	_, err = srpIn.Write([]byte("0000"))
 	require.NoError(t, err)
@@ -115,7 +116,7 @@ func TestHiderefsConfig(t *testing.T) {
 		t.Logf("error writing pack to spokes-receive-pack input: %v", err)
 	}
 
-	refStatus, unpackRes, _, err := readResult(t, bufSRPOut)
+	res, err := testclient.ReadResult(bufSRPOut)
 	require.NoError(t, err)
 	assert.Equal(t, map[string]string{
 		createBranch:         "ok",
@@ -125,6 +126,6 @@ func TestHiderefsConfig(t *testing.T) {
 		createreceivehide1:   "ng deny updating a hidden ref",
 		createreceivehide2:   "ng deny updating a hidden ref",
 		createuploadhide:     "ok",
-	}, refStatus)
-	assert.Equal(t, "unpack ok\n", unpackRes)
+	}, res.Refs)
+	assert.Equal(t, "unpack ok\n", res.Unpack)
 }
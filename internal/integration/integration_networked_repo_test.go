@@ -56,7 +56,7 @@ func (suite *SpokesReceivePackNetworkedTestSuite) TearDownTest() {
 
 	// Clean the environment before exiting
 	require.NoError(os.RemoveAll(suite.clone))
-	require.NoError(os.RemoveAll("../testdata/remote/git-internals-fork.git/objects/quarantine"))
+	require.NoError(os.RemoveAll("../testdata/remote/git-internals-fork.git/objects/test_quarantine_id"))
 }
 
 func (suite *SpokesReceivePackNetworkedTestSuite) TestSpokesReceivePackPushFork() {
@@ -268,6 +268,11 @@ func (suite *SpokesReceivePackTestSuite) TestWithGovernor() {
 		assert.Equal(suite.T(), "spokes-receive-pack", msg.Data["program"])
 		assert.Equal(suite.T(), filepath.Base(suite.remoteRepo), filepath.Base(msg.Data["git_dir"].(string))) // avoid problems from non-canonical paths, e.g. on macOS with its /tmp symlink.
 	})
+	requireGovernorMessage(suite.T(), timeout, msgs, func(msg govMessage) {
+		assert.Equal(suite.T(), "update", msg.Command)
+		assert.Contains(suite.T(), keys(msg.Data), "client_agent")
+		assert.Equal(suite.T(), "side-band-64k", msg.Data["sideband"])
+	})
 	requireGovernorMessage(suite.T(), timeout, msgs, func(msg govMessage) {
 		assert.Equal(suite.T(), "finish", msg.Command)
 		// This varies by platform:
@@ -3,17 +3,16 @@
 package integration
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/github/spokes-receive-pack/internal/objectformat"
+	"github.com/github/spokes-receive-pack/internal/testclient"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -29,9 +28,9 @@ func TestMissingObjects(t *testing.T) {
 
 	srp := startSpokesReceivePack(ctx, t, testRepo)
 
-	refs, _, err := readAdv(srp.Out)
+	adv, err := srp.ReadAdvertisement()
 	require.NoError(t, err)
-	assert.Equal(t, refs, map[string]string{
+	assert.Equal(t, adv.Refs, map[string]string{
 		info.Ref:    info.OldOID,
 		info.DelRef: info.OldOID,
 	})
@@ -43,20 +42,20 @@ func TestMissingObjects(t *testing.T) {
 
 	writePushData(
 		t, srp,
-		[]refUpdate{
+		[]testclient.RefUpdate{
 			// Try to update the ref that's already there to commit C (but we won't
 			// push its parent and the remote doesn't have the parent either).
-			{info.OldOID, info.NewOID, info.Ref},
+			{OldOID: info.OldOID, NewOID: info.NewOID, Ref: info.Ref},
 		},
 		pack,
 	)
 
-	refStatus, unpackRes, _, err := readResult(t, srp.Out)
+	res, err := srp.ReadResult()
 	require.NoError(t, err)
 	assert.Equal(t, map[string]string{
 		info.Ref: "ng error processing packfiles: exit status 128",
-	}, refStatus)
-	assert.Equal(t, "unpack index-pack failed\n", unpackRes)
+	}, res.Refs)
+	assert.Equal(t, "unpack index-pack failed\n", res.Unpack)
 }
 
 func TestDeleteAndUpdate(t *testing.T) {
@@ -71,9 +70,9 @@ func TestDeleteAndUpdate(t *testing.T) {
 
 	srp := startSpokesReceivePack(ctx, t, testRepo)
 
-	refs, _, err := readAdv(srp.Out)
+	adv, err := srp.ReadAdvertisement()
 	require.NoError(t, err)
-	assert.Equal(t, refs, map[string]string{
+	assert.Equal(t, adv.Refs, map[string]string{
 		info.Ref:    info.OldOID,
 		info.DelRef: info.OldOID,
 	})
@@ -85,22 +84,22 @@ func TestDeleteAndUpdate(t *testing.T) {
 
 	writePushData(
 		t, srp,
-		[]refUpdate{
+		[]testclient.RefUpdate{
 			// Try to create another ref with a commit that the remote already has.
-			{objectformat.NullOIDSHA1, info.OldOID, refToCreate},
+			{OldOID: objectformat.NullOIDSHA1, NewOID: info.OldOID, Ref: refToCreate},
 			// Try to delete a ref.
-			{info.OldOID, objectformat.NullOIDSHA1, info.DelRef},
+			{OldOID: info.OldOID, NewOID: objectformat.NullOIDSHA1, Ref: info.DelRef},
 		},
 		pack,
 	)
 
-	refStatus, unpackRes, _, err := readResult(t, srp.Out)
+	res, err := srp.ReadResult()
 	require.NoError(t, err)
 	assert.Equal(t, map[string]string{
 		refToCreate: "ok",
 		info.DelRef: "ok",
-	}, refStatus)
-	assert.Equal(t, "unpack ok\n", unpackRes)
+	}, res.Refs)
+	assert.Equal(t, "unpack ok\n", res.Unpack)
 }
 
 type missingObjectsTestInfo struct {
@@ -135,57 +134,16 @@ func setUpMissingObjectsTestRepo(t *testing.T) missingObjectsTestInfo {
 	return res
 }
 
-type spokesReceivePackProcess struct {
-	Cmd *exec.Cmd
-	In  io.WriteCloser
-	Out io.Reader
-	Err chan error
-}
-
-func startSpokesReceivePack(ctx context.Context, t *testing.T, testRepo string) spokesReceivePackProcess {
-	srp := exec.CommandContext(ctx, "spokes-receive-pack", ".")
-	srp.Dir = testRepo
-	srp.Env = append(os.Environ(),
-		"GIT_SOCKSTAT_VAR_quarantine_id=config-test-quarantine-id")
-	srp.Stderr = &testLogWriter{t}
-	srpIn, err := srp.StdinPipe()
-	require.NoError(t, err)
-	srpOut, err := srp.StdoutPipe()
+func startSpokesReceivePack(ctx context.Context, t *testing.T, testRepo string) *testclient.PushSession {
+	srp, err := testclient.Start(ctx, testRepo, testclient.Options{
+		Env:    []string{"GIT_SOCKSTAT_VAR_quarantine_id=config-test-quarantine-id"},
+		Stderr: &testLogWriter{t},
+	})
 	require.NoError(t, err)
-
-	srpErr := make(chan error)
-	go func() { srpErr <- srp.Run() }()
-
-	bufSRPOut := bufio.NewReader(srpOut)
-
-	return spokesReceivePackProcess{
-		Cmd: srp,
-		In:  srpIn,
-		Out: bufSRPOut,
-		Err: srpErr,
-	}
+	return srp
 }
 
-type refUpdate struct {
-	OldOID, NewOID, Ref string
-}
-
-func writePushData(t *testing.T, srp spokesReceivePackProcess, updates []refUpdate, pack io.Reader) {
-	caps := "\x00report-status report-status-v2 side-band-64k object-format=sha1\n"
-	for _, up := range updates {
-		require.NoError(t, writePktlinef(srp.In,
-			"%s %s %s%s",
-			up.OldOID, up.NewOID, up.Ref,
-			caps))
-		caps = ""
-	}
-
-	_, err := srp.In.Write([]byte("0000"))
-	require.NoError(t, err)
-
-	if _, err := io.Copy(srp.In, pack); err != nil {
-		t.Logf("error writing pack to spokes-receive-pack input: %v", err)
-	}
-
-	require.NoError(t, srp.In.Close())
+func writePushData(t *testing.T, srp *testclient.PushSession, updates []testclient.RefUpdate, pack io.Reader) {
+	require.NoError(t, srp.SendCommands(updates, "report-status report-status-v2 side-band-64k object-format=sha1\n"))
+	require.NoError(t, srp.SendPack(pack))
 }
@@ -4,7 +4,6 @@ package integration
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -14,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/github/spokes-receive-pack/internal/testclient"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -33,6 +33,8 @@ func TestNoSideBand(t *testing.T) {
 	testRepo := t.TempDir()
 	requireRun(t, "git", "init", "--bare", testRepo)
 	requireRun(t, "git", "-C", testRepo, "fetch", origin, defaultBranch+":"+defaultBranch)
+	// The tests send push options, which clients may only do if we offer them.
+	requireRun(t, "git", "-C", testRepo, "config", "receive.advertisePushOptions", "true")
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
@@ -51,19 +53,19 @@ func TestNoSideBand(t *testing.T) {
 
 	bufSRPOut := bufio.NewReader(srpOut)
 
-	refs, _, err := readAdv(bufSRPOut)
+	adv, err := testclient.ReadAdvertisement(bufSRPOut)
 	require.NoError(t, err)
-	assert.Equal(t, refs, map[string]string{
+	assert.Equal(t, adv.Refs, map[string]string{
 		defaultBranch: testCommit,
 	})
 
 	oldnew := fmt.Sprintf("%040d %s", 0, testCommit)
-	require.NoError(t, writePktlinef(srpIn,
+	require.NoError(t, testclient.WritePktlinef(srpIn,
 		"%s %s\x00report-status report-status-v2 push-options object-format=sha1\n", oldnew, createBranch))
 	_, err = srpIn.Write([]byte("0000"))
 	require.NoError(t, err)
 
-	require.NoError(t, writePktlinef(srpIn,
+	require.NoError(t, testclient.WritePktlinef(srpIn,
 		"anything i want to put in a push option\n"))
 	_, err = srpIn.Write([]byte("0000"))
 	require.NoError(t, err)
@@ -78,41 +80,10 @@ func TestNoSideBand(t *testing.T) {
 
 	require.NoError(t, srpIn.Close())
 
-	lines, err := readResultNoSideBand(t, bufSRPOut)
+	lines, err := testclient.ReadResultNoSideBand(bufSRPOut)
 	require.NoError(t, err)
 	assert.Equal(t, []string{
 		"unpack ok\n",
 		"ok refs/heads/newbranch\n",
 	}, lines)
 }
-
-func readResultNoSideBand(t *testing.T, r io.Reader) ([]string, error) {
-	var lines []string
-
-	// Read all of the output so that we can include it with errors.
-	data, err := io.ReadAll(r)
-	if err != nil {
-		if len(data) > 0 {
-			t.Logf("got data, but there was an error: %v", err)
-		} else {
-			return nil, err
-		}
-	}
-
-	// Replace r.
-	r = bytes.NewReader(data)
-
-	for {
-		pkt, err := readPktline(r)
-		switch {
-		case err != nil:
-			return nil, fmt.Errorf("%w while parsing %q", err, string(data))
-
-		case pkt == nil:
-			return lines, nil
-
-		default:
-			lines = append(lines, string(pkt))
-		}
-	}
-}
@@ -13,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/github/spokes-receive-pack/internal/testclient"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -32,6 +33,8 @@ func setupTestRepo(t *testing.T) string {
 	testRepo := t.TempDir()
 	requireRun(t, "git", "init", "--bare", testRepo)
 	requireRun(t, "git", "-C", testRepo, "fetch", origin, defaultBranch+":"+defaultBranch)
+	// The tests send push options, which clients may only do if we offer them.
+	requireRun(t, "git", "-C", testRepo, "config", "receive.advertisePushOptions", "true")
 
 	return testRepo
 }
@@ -56,19 +59,19 @@ func TestPushOptions(t *testing.T) {
 
 	bufSRPOut := bufio.NewReader(srpOut)
 
-	refs, _, err := readAdv(bufSRPOut)
+	adv, err := testclient.ReadAdvertisement(bufSRPOut)
 	require.NoError(t, err)
-	assert.Equal(t, refs, map[string]string{
+	assert.Equal(t, adv.Refs, map[string]string{
 		defaultBranch: testCommit,
 	})
 
 	oldnew := fmt.Sprintf("%040d %s", 0, testCommit)
-	require.NoError(t, writePktlinef(srpIn,
+	require.NoError(t, testclient.WritePktlinef(srpIn,
 		"%s %s\x00report-status report-status-v2 side-band-64k push-options object-format=sha1\n", oldnew, createBranch))
 	_, err = srpIn.Write([]byte("0000"))
 	require.NoError(t, err)
 
-	require.NoError(t, writePktlinef(srpIn,
+	require.NoError(t, testclient.WritePktlinef(srpIn,
 		"anything i want to put in a push option\n"))
 	_, err = srpIn.Write([]byte("0000"))
 	require.NoError(t, err)
@@ -83,12 +86,12 @@ func TestPushOptions(t *testing.T) {
 
 	require.NoError(t, srpIn.Close())
 
-	refStatus, unpackRes, _, err := readResult(t, bufSRPOut)
+	res, err := testclient.ReadResult(bufSRPOut)
 	require.NoError(t, err)
 	assert.Equal(t, map[string]string{
 		createBranch: "ok",
-	}, refStatus)
-	assert.Equal(t, "unpack ok\n", unpackRes)
+	}, res.Refs)
+	assert.Equal(t, "unpack ok\n", res.Unpack)
 }
 
 func TestPushOptionsLimitCount(t *testing.T) {
@@ -112,21 +115,21 @@ func TestPushOptionsLimitCount(t *testing.T) {
 
 	bufSRPOut := bufio.NewReader(srpOut)
 
-	refs, _, err := readAdv(bufSRPOut)
+	adv, err := testclient.ReadAdvertisement(bufSRPOut)
 	require.NoError(t, err)
-	assert.Equal(t, refs, map[string]string{
+	assert.Equal(t, adv.Refs, map[string]string{
 		defaultBranch: testCommit,
 	})
 
 	oldnew := fmt.Sprintf("%040d %s", 0, testCommit)
-	require.NoError(t, writePktlinef(srpIn,
+	require.NoError(t, testclient.WritePktlinef(srpIn,
 		"%s %s\x00report-status report-status-v2 side-band-64k push-options object-format=sha1\n", oldnew, createBranch))
 	_, err = srpIn.Write([]byte("0000"))
 	require.NoError(t, err)
 
 	// the limit is 2, let's send 3 push options
 	for i := 0; i < 3; i++ {
-		require.NoError(t, writePktlinef(srpIn,
+		require.NoError(t, testclient.WritePktlinef(srpIn,
 			fmt.Sprintf("option-%d\n", i)))
 	}
 	_, err = srpIn.Write([]byte("0000"))
@@ -142,10 +145,10 @@ func TestPushOptionsLimitCount(t *testing.T) {
 
 	require.NoError(t, srpIn.Close())
 
-	refStatus, unpackRes, _, err := readResult(t, bufSRPOut)
+	res, err := testclient.ReadResult(bufSRPOut)
 	require.NoError(t, err)
 	assert.Equal(t, map[string]string{
 		createBranch: "ng push options count exceeds maximum",
-	}, refStatus)
-	assert.Equal(t, "unpack ok\n", unpackRes)
+	}, res.Refs)
+	assert.Equal(t, "unpack ok\n", res.Unpack)
 }
@@ -0,0 +1,20 @@
+//go:build integration
+
+package integration
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requireRun(t *testing.T, program string, args ...string) {
+	t.Logf("run %s %v", program, args)
+	cmd := exec.Command(program, args...)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		t.Logf("%s", out)
+	}
+	require.NoError(t, err, "%s %v:\n%s", program, args, out)
+}
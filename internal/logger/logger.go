@@ -0,0 +1,139 @@
+// Package logger writes structured log entries as JSON lines.
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DestinationEnv is the name of an environment variable that says where log
+// entries should be written. See Open.
+const DestinationEnv = "SPOKES_LOG"
+
+// Logger writes log entries, each tagged with the logger's fields, as JSON
+// objects, one per line.
+//
+// It is safe to call any method on a nil *Logger, which discards everything.
+type Logger struct {
+	out    *output
+	fields map[string]interface{}
+}
+
+// output is shared between a logger and the loggers derived from it, so
+// that their entries don't get interleaved.
+type output struct {
+	mu  sync.Mutex
+	w   io.Writer
+	now func() time.Time
+}
+
+// New returns a logger that writes to `w`.
+func New(w io.Writer) *Logger {
+	return &Logger{
+		out: &output{w: w, now: time.Now},
+	}
+}
+
+// Open returns a logger that writes to `dest`, which is "stderr" (the
+// default if `dest` is empty), "none" to discard everything, "fd:N" for an
+// inherited file descriptor, or the path of a file to append to. The
+// returned io.Closer must be closed once the logger isn't needed anymore.
+func Open(dest string, stderr io.Writer) (*Logger, io.Closer, error) {
+	switch dest {
+	case "", "stderr":
+		return New(stderr), io.NopCloser(nil), nil
+	case "none":
+		return nil, io.NopCloser(nil), nil
+	}
+
+	var f *os.File
+	if fdStr, ok := strings.CutPrefix(dest, "fd:"); ok {
+		fd, err := strconv.ParseUint(fdStr, 10, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid log file descriptor %q: %w", fdStr, err)
+		}
+		f = os.NewFile(uintptr(fd), "log")
+		if f == nil {
+			return nil, nil, fmt.Errorf("invalid log file descriptor %d", fd)
+		}
+	} else {
+		var err error
+		f, err = os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening log file: %w", err)
+		}
+	}
+
+	return New(f), f, nil
+}
+
+// With returns a logger that adds `key` with `value` to every entry, in
+// addition to the fields of `l`.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	fields := make(map[string]interface{}, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Info logs `msg` at the "info" level. `kv` are additional key/value pairs
+// for this entry only.
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log("info", msg, kv)
+}
+
+// Warn logs `msg` at the "warn" level.
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log("warn", msg, kv)
+}
+
+// Error logs `msg` at the "error" level.
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log("error", msg, kv)
+}
+
+func (l *Logger) log(level, msg string, kv []interface{}) {
+	if l == nil {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(l.fields)+len(kv)/2+3)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		if err, ok := kv[i+1].(error); ok {
+			entry[key] = err.Error()
+		} else {
+			entry[key] = kv[i+1]
+		}
+	}
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+
+	entry["time"] = l.out.now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{
+			"level": "error",
+			"msg":   fmt.Sprintf("encoding log entry %q: %v", msg, err),
+		})
+	}
+	_, _ = l.out.w.Write(append(line, '\n'))
+}
@@ -0,0 +1,64 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf)
+	l.out.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	l = l.With("request_id", "abc").With("repo", "a/b")
+	l.Info("starting")
+	l.With("phase", "read-pack").Warn("too slow", "elapsed_ms", 1000, "error", errors.New("boom"))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t,
+		`{"level":"info","msg":"starting","repo":"a/b","request_id":"abc","time":"2024-01-02T03:04:05Z"}`,
+		lines[0])
+	assert.Equal(t,
+		`{"elapsed_ms":1000,"error":"boom","level":"warn","msg":"too slow","phase":"read-pack","repo":"a/b","request_id":"abc","time":"2024-01-02T03:04:05Z"}`,
+		lines[1])
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	assert.Nil(t, l.With("a", "b"))
+	l.Info("ignored")
+}
+
+func TestOpen(t *testing.T) {
+	var stderr bytes.Buffer
+	l, c, err := Open("", &stderr)
+	require.NoError(t, err)
+	l.Info("hello")
+	require.NoError(t, c.Close())
+	assert.Contains(t, stderr.String(), `"msg":"hello"`)
+
+	l, _, err = Open("none", &stderr)
+	require.NoError(t, err)
+	assert.Nil(t, l)
+
+	path := filepath.Join(t.TempDir(), "spokes.log")
+	l, c, err = Open(path, &stderr)
+	require.NoError(t, err)
+	l.Info("to a file")
+	require.NoError(t, c.Close())
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(contents), `"msg":"to a file"`)
+
+	_, _, err = Open("fd:nope", &stderr)
+	assert.Error(t, err)
+}
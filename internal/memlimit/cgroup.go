@@ -0,0 +1,7 @@
+//go:build !linux
+
+package memlimit
+
+func cgroupMemoryLimit() (int64, bool) {
+	return 0, false
+}
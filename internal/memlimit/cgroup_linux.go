@@ -0,0 +1,55 @@
+//go:build linux
+
+package memlimit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Anything at least this large means "no limit" in cgroup v1, which
+// reports the largest page-aligned int64 instead.
+const unlimitedV1 = 1 << 62
+
+func cgroupMemoryLimit() (int64, bool) {
+	if cgroup, err := os.ReadFile("/proc/self/cgroup"); err == nil {
+		if path, ok := parseCgroupV2Path(cgroup); ok {
+			if limit, err := os.ReadFile(filepath.Join("/sys/fs/cgroup", path, "memory.max")); err == nil {
+				return parseLimit(limit)
+			}
+		}
+	}
+
+	if limit, err := os.ReadFile("/sys/fs/cgroup/memory/memory.limit_in_bytes"); err == nil {
+		return parseLimit(limit)
+	}
+
+	return 0, false
+}
+
+// parseCgroupV2Path finds our cgroup v2 path in the contents of
+// /proc/self/cgroup, where it is on the line that starts with "0::".
+func parseCgroupV2Path(cgroup []byte) (string, bool) {
+	for _, line := range bytes.Split(cgroup, []byte("\n")) {
+		if path, ok := bytes.CutPrefix(line, []byte("0::")); ok {
+			return string(path), true
+		}
+	}
+	return "", false
+}
+
+// parseLimit parses the contents of memory.max or memory.limit_in_bytes.
+// It returns false if there's no limit.
+func parseLimit(limit []byte) (int64, bool) {
+	limit = bytes.TrimSpace(limit)
+	if string(limit) == "max" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(string(limit), 10, 64)
+	if err != nil || n <= 0 || n >= unlimitedV1 {
+		return 0, false
+	}
+	return n, true
+}
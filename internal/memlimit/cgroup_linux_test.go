@@ -0,0 +1,35 @@
+//go:build linux
+
+package memlimit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCgroupV2Path(t *testing.T) {
+	path, ok := parseCgroupV2Path([]byte("0::/system.slice/spokes.service\n"))
+	assert.True(t, ok)
+	assert.Equal(t, "/system.slice/spokes.service", path)
+
+	_, ok = parseCgroupV2Path([]byte("12:memory:/docker/abc\n11:cpu:/docker/abc\n"))
+	assert.False(t, ok)
+}
+
+func TestParseLimit(t *testing.T) {
+	for _, ex := range []struct {
+		contents string
+		limit    int64
+		ok       bool
+	}{
+		{"1073741824\n", 1073741824, true},
+		{"max\n", 0, false},
+		{"9223372036854771712\n", 0, false},
+		{"garbage", 0, false},
+	} {
+		limit, ok := parseLimit([]byte(ex.contents))
+		assert.Equal(t, ex.limit, limit, ex.contents)
+		assert.Equal(t, ex.ok, ok, ex.contents)
+	}
+}
@@ -0,0 +1,75 @@
+// Package memlimit tunes the Go runtime's memory settings to the memory
+// limit of the cgroup that we're running in.
+package memlimit
+
+import (
+	"os"
+	"runtime/debug"
+	"strconv"
+)
+
+const (
+	// defaultRatio is the share of the cgroup's memory limit that we let
+	// the Go heap use. Most of the memory of a push is used by
+	// `index-pack`, which runs in the same cgroup, so we leave it most of
+	// the room.
+	defaultRatio = 0.25
+
+	// defaultGCPercent is the GOGC value used when there is a memory
+	// limit. Since the limit keeps the heap in check when memory is
+	// tight, there's no need to collect more often than usual the rest
+	// of the time.
+	defaultGCPercent = 100
+)
+
+// Settings describes what Configure did.
+type Settings struct {
+	// CgroupLimit is the memory limit of our cgroup, or 0 if there
+	// isn't one.
+	CgroupLimit int64
+	// MemoryLimit is the memory limit that was set for the Go runtime,
+	// or 0 if it was left alone.
+	MemoryLimit int64
+	// GCPercent is the GOGC value that was set, or 0 if it was left
+	// alone.
+	GCPercent int
+}
+
+// Configure sets the Go runtime's memory limit (as if by GOMEMLIMIT) to a
+// share of the cgroup's memory limit, and sets GOGC to go with it.
+//
+// GOMEMLIMIT and GOGC in the environment take precedence, since the runtime
+// has already applied them. SPOKES_MEMLIMIT_RATIO overrides the share of the
+// cgroup's limit that is used, and SPOKES_MEMLIMIT=off disables the tuning.
+func Configure() Settings {
+	if os.Getenv("SPOKES_MEMLIMIT") == "off" {
+		return Settings{}
+	}
+
+	limit, ok := cgroupMemoryLimit()
+	if !ok {
+		return Settings{}
+	}
+
+	ratio := defaultRatio
+	if v := os.Getenv("SPOKES_MEMLIMIT_RATIO"); v != "" {
+		if r, err := strconv.ParseFloat(v, 64); err == nil && r > 0 && r <= 1 {
+			ratio = r
+		}
+	}
+
+	return apply(limit, ratio, os.Getenv("GOMEMLIMIT") != "", os.Getenv("GOGC") != "")
+}
+
+func apply(cgroupLimit int64, ratio float64, haveMemLimit, haveGOGC bool) Settings {
+	s := Settings{CgroupLimit: cgroupLimit}
+	if !haveMemLimit {
+		s.MemoryLimit = int64(float64(cgroupLimit) * ratio)
+		debug.SetMemoryLimit(s.MemoryLimit)
+	}
+	if !haveGOGC {
+		s.GCPercent = defaultGCPercent
+		debug.SetGCPercent(s.GCPercent)
+	}
+	return s
+}
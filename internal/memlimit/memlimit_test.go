@@ -0,0 +1,28 @@
+package memlimit
+
+import (
+	"math"
+	"runtime/debug"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApply(t *testing.T) {
+	origLimit := debug.SetMemoryLimit(-1)
+	origGCPercent := debug.SetGCPercent(-1)
+	debug.SetGCPercent(origGCPercent)
+	t.Cleanup(func() {
+		debug.SetMemoryLimit(origLimit)
+		debug.SetGCPercent(origGCPercent)
+	})
+
+	s := apply(4<<30, 0.25, false, false)
+	assert.Equal(t, Settings{CgroupLimit: 4 << 30, MemoryLimit: 1 << 30, GCPercent: defaultGCPercent}, s)
+	assert.Equal(t, int64(1<<30), debug.SetMemoryLimit(-1))
+
+	debug.SetMemoryLimit(math.MaxInt64)
+	s = apply(4<<30, 0.25, true, true)
+	assert.Equal(t, Settings{CgroupLimit: 4 << 30}, s)
+	assert.Equal(t, int64(math.MaxInt64), debug.SetMemoryLimit(-1))
+}
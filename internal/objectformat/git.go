@@ -1,9 +1,17 @@
 package objectformat
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
+	"hash"
+	"os"
 	"os/exec"
+	"regexp"
 	"strings"
+
+	"github.com/github/spokes-receive-pack/internal/childenv"
+	"github.com/github/spokes-receive-pack/internal/config"
 )
 
 const (
@@ -13,6 +21,11 @@ const (
 
 type ObjectFormat string
 
+var (
+	sha1OID   = regexp.MustCompile(`\A[0-9a-f]{40}\z`)
+	sha256OID = regexp.MustCompile(`\A[0-9a-f]{64}\z`)
+)
+
 // GetObjectFormat returns the object format for the repo located at repo.
 func GetObjectFormat(repo string) (ObjectFormat, error) {
 	cmd := exec.Command(
@@ -21,6 +34,7 @@ func GetObjectFormat(repo string) (ObjectFormat, error) {
 		"--show-object-format",
 	)
 	cmd.Dir = repo
+	cmd.Env = config.RepoEnviron(childenv.Environ(os.Environ()))
 
 	out, err := cmd.Output()
 	if err != nil {
@@ -36,6 +50,28 @@ func GetObjectFormat(repo string) (ObjectFormat, error) {
 	}
 }
 
+// GetObjectFormatFromConfig returns the object format for the repo located at
+// repo, using its already-loaded configuration `cfg` if it says what the
+// format is, so that we don't need to run git to find out. Otherwise, it
+// falls back to GetObjectFormat.
+func GetObjectFormatFromConfig(repo string, cfg *config.Config) (ObjectFormat, error) {
+	switch cfg.Get("core.repositoryformatversion") {
+	case "", "0":
+		// Extensions, including the object format, require version 1.
+		return "sha1", nil
+	case "1":
+		switch value := strings.ToLower(cfg.Get("extensions.objectformat")); value {
+		case "":
+			return "sha1", nil
+		case "sha1", "sha256":
+			return ObjectFormat(value), nil
+		}
+	}
+
+	// Let git decide what to make of it.
+	return GetObjectFormat(repo)
+}
+
 func (of ObjectFormat) NullOID() string {
 	switch of {
 	case "sha256":
@@ -44,3 +80,41 @@ func (of ObjectFormat) NullOID() string {
 		return NullOIDSHA1
 	}
 }
+
+// HexLength returns the length of an object ID in hex.
+func (of ObjectFormat) HexLength() int {
+	switch of {
+	case "sha256":
+		return 64
+	default:
+		return 40
+	}
+}
+
+// OIDRegexp returns a regexp that matches exactly the object IDs, in
+// lowercase hex, of this object format.
+func (of ObjectFormat) OIDRegexp() *regexp.Regexp {
+	switch of {
+	case "sha256":
+		return sha256OID
+	default:
+		return sha1OID
+	}
+}
+
+// IsValidOID reports whether `oid` is an object ID, in lowercase hex, of
+// this object format.
+func (of ObjectFormat) IsValidOID(oid string) bool {
+	return len(oid) == of.HexLength() && of.OIDRegexp().MatchString(oid)
+}
+
+// NewHash returns a hash that computes object IDs and the checksums of packs
+// and their indexes in this object format.
+func (of ObjectFormat) NewHash() hash.Hash {
+	switch of {
+	case "sha256":
+		return sha256.New()
+	default:
+		return sha1.New()
+	}
+}
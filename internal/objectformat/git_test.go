@@ -1,9 +1,13 @@
 package objectformat
 
 import (
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 
+	"github.com/github/spokes-receive-pack/internal/config"
 	"github.com/stretchr/testify/require"
 )
 
@@ -19,8 +23,106 @@ func TestNullOID(t *testing.T) {
 	require.Regexp(t, nullRE, sha256.NullOID())
 }
 
+// testRepo returns the path of a new, empty repository.
+func testRepo(t *testing.T) string {
+	repo := t.TempDir()
+	out, err := exec.Command("git", "init", "--bare", repo).CombinedOutput()
+	require.NoError(t, err, "%s", out)
+	return repo
+}
+
 func TestGetObjectFormat(t *testing.T) {
-	of, err := GetObjectFormat("../spokes/testdata/lots-of-refs.git")
+	of, err := GetObjectFormat(testRepo(t))
 	require.NoError(t, err)
 	require.Equal(t, of, ObjectFormat("sha1"))
 }
+
+func TestGetObjectFormatFromConfig(t *testing.T) {
+	repo := testRepo(t)
+	cfg := func(entries ...config.ConfigEntry) *config.Config {
+		return &config.Config{Entries: entries}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		cfg      *config.Config
+		expected ObjectFormat
+	}{
+		{"no version", cfg(), "sha1"},
+		{"version 0", cfg(config.ConfigEntry{Key: "core.repositoryformatversion", Value: "0"}), "sha1"},
+		{
+			"version 0 ignores extensions",
+			cfg(
+				config.ConfigEntry{Key: "core.repositoryformatversion", Value: "0"},
+				config.ConfigEntry{Key: "extensions.objectformat", Value: "sha256"},
+			),
+			"sha1",
+		},
+		{"version 1", cfg(config.ConfigEntry{Key: "core.repositoryformatversion", Value: "1"}), "sha1"},
+		{
+			"sha256",
+			cfg(
+				config.ConfigEntry{Key: "core.repositoryformatversion", Value: "1"},
+				config.ConfigEntry{Key: "extensions.objectformat", Value: "SHA256"},
+			),
+			"sha256",
+		},
+		{
+			// Falls back to asking git about the test repository.
+			"unknown version",
+			cfg(config.ConfigEntry{Key: "core.repositoryformatversion", Value: "2"}),
+			"sha1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			of, err := GetObjectFormatFromConfig(repo, tc.cfg)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, of)
+		})
+	}
+}
+
+func TestIsValidOID(t *testing.T) {
+	sha1 := ObjectFormat("sha1")
+	sha256 := ObjectFormat("sha256")
+
+	require.Equal(t, 40, sha1.HexLength())
+	require.Equal(t, 64, sha256.HexLength())
+
+	oid1 := "e83c5163316f89bfbde7d9ab23ca2e25604af290"
+	oid256 := "6a7d2ab0f0b2ac1e8e3f5d6f1e2a8e6c8ab1ff57f3d2e1c0b9a8f7e6d5c4b3a2"
+
+	require.True(t, sha1.IsValidOID(oid1))
+	require.False(t, sha1.IsValidOID(oid256))
+	require.True(t, sha256.IsValidOID(oid256))
+	require.False(t, sha256.IsValidOID(oid1))
+
+	require.True(t, sha1.IsValidOID(sha1.NullOID()))
+	require.False(t, sha1.IsValidOID(strings.ToUpper(oid1)))
+	require.False(t, sha1.IsValidOID(oid1+"\n"))
+	require.False(t, sha1.IsValidOID(""))
+	require.True(t, sha1.OIDRegexp().MatchString(oid1))
+}
+
+func TestNewHash(t *testing.T) {
+	for _, of := range []ObjectFormat{"sha1", "sha256"} {
+		h := of.NewHash()
+		require.Equal(t, of.HexLength(), 2*h.Size())
+	}
+}
+
+func TestGetObjectFormatIgnoresRelativeGitDir(t *testing.T) {
+	repo := t.TempDir()
+	out, err := exec.Command("git", "init", "--bare", "--object-format=sha256", repo).CombinedOutput()
+	require.NoError(t, err, "%s", out)
+
+	// A relative GIT_DIR, which git would resolve in the directory it
+	// runs in, names a sha1 repository from there.
+	other, err := filepath.Rel(repo, testRepo(t))
+	require.NoError(t, err)
+	t.Setenv("GIT_DIR", other)
+
+	of, err := GetObjectFormat(repo)
+	require.NoError(t, err)
+	require.Equal(t, ObjectFormat("sha256"), of)
+}
@@ -0,0 +1,142 @@
+package pipe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// budgetPollInterval is how often a MemoryBudget samples the memory usage
+// of its stages.
+var budgetPollInterval = time.Second
+
+// MemoryBudget limits the combined memory usage of a group of stages, which
+// will usually be all of the command stages of a pipeline. If the sum of
+// their anonymous RSS exceeds the budget, all of them are killed and fail
+// with ErrMemoryLimitExceeded.
+//
+// It is safe to call Limit with a nil *MemoryBudget, which doesn't limit
+// anything.
+type MemoryBudget struct {
+	limit        uint64
+	eventHandler func(e *Event)
+
+	mu      sync.Mutex
+	running map[*budgetStage]struct{}
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewMemoryBudget returns a budget of `byteLimit` bytes. `eventHandler`, if
+// not nil, is told when the budget is exceeded.
+func NewMemoryBudget(byteLimit uint64, eventHandler func(e *Event)) *MemoryBudget {
+	if eventHandler == nil {
+		eventHandler = func(*Event) {}
+	}
+	return &MemoryBudget{
+		limit:        byteLimit,
+		eventHandler: eventHandler,
+		running:      make(map[*budgetStage]struct{}),
+	}
+}
+
+// Limit returns a stage that runs `stage` as part of the budget.
+func (b *MemoryBudget) Limit(stage Stage) Stage {
+	if b == nil {
+		return stage
+	}
+	return &budgetStage{stageWrapper: stageWrapper{stage}, budget: b}
+}
+
+type budgetStage struct {
+	stageWrapper
+	budget *MemoryBudget
+}
+
+func (s *budgetStage) Start(ctx context.Context, env Env, stdin io.ReadCloser) (io.ReadCloser, error) {
+	stdout, err := s.Stage.Start(ctx, env, stdin)
+	if err != nil {
+		return nil, err
+	}
+	s.budget.add(s)
+	return stdout, nil
+}
+
+func (s *budgetStage) Wait() error {
+	err := s.Stage.Wait()
+	s.budget.remove(s)
+	return err
+}
+
+func (b *MemoryBudget) add(s *budgetStage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.running[s] = struct{}{}
+	if b.cancel == nil {
+		var ctx context.Context
+		ctx, b.cancel = context.WithCancel(context.Background())
+		b.done = make(chan struct{})
+		go b.watch(ctx, b.done)
+	}
+}
+
+func (b *MemoryBudget) remove(s *budgetStage) {
+	b.mu.Lock()
+	delete(b.running, s)
+	if len(b.running) > 0 || b.cancel == nil {
+		b.mu.Unlock()
+		return
+	}
+	cancel, done := b.cancel, b.done
+	b.cancel, b.done = nil, nil
+	b.mu.Unlock()
+
+	cancel()
+	<-done
+}
+
+func (b *MemoryBudget) watch(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+
+	t := time.NewTicker(budgetPollInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		b.mu.Lock()
+		stages := make([]*budgetStage, 0, len(b.running))
+		for s := range b.running {
+			stages = append(stages, s)
+		}
+		b.mu.Unlock()
+
+		var total uint64
+		for _, s := range stages {
+			// Stages that can't tell us, or that have just exited,
+			// don't count.
+			if rss, err := s.GetRSSAnon(ctx); err == nil {
+				total += rss
+			}
+		}
+
+		if total > b.limit {
+			b.eventHandler(&Event{
+				Command: "pipeline",
+				Msg:     "pipeline memory limit exceeded",
+				Err:     fmt.Errorf("%w: %d bytes used, limit is %d", ErrMemoryLimitExceeded, total, b.limit),
+			})
+			for _, s := range stages {
+				s.Kill(ErrMemoryLimitExceeded)
+			}
+			return
+		}
+	}
+}
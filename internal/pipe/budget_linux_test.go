@@ -0,0 +1,45 @@
+//go:build linux
+
+package pipe
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	orig := budgetPollInterval
+	budgetPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { budgetPollInterval = orig })
+
+	var events []*Event
+	budget := NewMemoryBudget(1, func(e *Event) { events = append(events, e) })
+
+	p := New()
+	p.Add(
+		budget.Limit(Command("sleep", "10")),
+		budget.Limit(Command("cat")),
+	)
+	start := time.Now()
+	err := p.Run(context.Background())
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrMemoryLimitExceeded), err.Error())
+	assert.Less(t, time.Since(start), 5*time.Second)
+	require.Len(t, events, 1)
+	assert.Equal(t, "pipeline memory limit exceeded", events[0].Msg)
+
+	// A generous budget doesn't get in the way.
+	budget = NewMemoryBudget(1<<40, nil)
+	p = New()
+	p.Add(budget.Limit(Command("sleep", "0.1")))
+	assert.NoError(t, p.Run(context.Background()))
+
+	var nilBudget *MemoryBudget
+	s := Command("true")
+	assert.Equal(t, s, nilBudget.Limit(s))
+}
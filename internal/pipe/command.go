@@ -0,0 +1,184 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	gopipe "github.com/github/go-pipe/pipe"
+)
+
+// Command returns a pipeline Stage that runs `command` with the given
+// `args`. Its stdin and stdout are handled as usual, and the end of its
+// stderr is included in the error that it returns if it fails. If the
+// pipeline's context is done, the command is terminated with
+// TerminateGracefully.
+func Command(command string, args ...string) Stage {
+	if len(command) == 0 {
+		panic("attempt to create command with empty command")
+	}
+	return CommandStage(command, exec.Command(command, args...))
+}
+
+// CommandStage returns a pipeline Stage with the name `name` that runs
+// `cmd`, like Command does. `cmd` shouldn't be created with
+// exec.CommandContext, because then it is killed right away when its context
+// is done instead of being given a chance to exit.
+func CommandStage(name string, cmd *exec.Cmd) Stage {
+	return CommandStageWithStderrLimit(name, cmd, DefaultStderrLimit)
+}
+
+// CommandStageWithStderrLimit is like CommandStage, but keeps up to `limit`
+// bytes of stderr. If `cmd.Stderr` has already been set, stderr goes there
+// instead and isn't captured.
+func CommandStageWithStderrLimit(name string, cmd *exec.Cmd, limit int) Stage {
+	s := &commandStage{name: name, cmd: cmd, done: make(chan struct{})}
+	if cmd.Stderr == nil {
+		s.stderr = &tailWriter{max: limit}
+		cmd.Stderr = s.stderr
+	}
+	s.stageWrapper = stageWrapper{gopipe.CommandStage(name, cmd)}
+	return s
+}
+
+type commandStage struct {
+	stageWrapper
+	name   string
+	cmd    *exec.Cmd
+	stderr *tailWriter
+	done   chan struct{}
+
+	mu sync.Mutex
+	// The error that the stage was killed with, if any.
+	killErr error
+}
+
+func (s *commandStage) Start(ctx context.Context, env Env, stdin io.ReadCloser) (io.ReadCloser, error) {
+	// go-pipe would kill the command itself when the context is done,
+	// but without giving it a configurable grace period, and only if the
+	// command itself is still running. We'd rather do it ourselves.
+	stdout, err := s.Stage.Start(withoutCancel{ctx}, env, stdin)
+	if err != nil {
+		close(s.done)
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Kill(ctx.Err())
+		case <-s.done:
+		}
+	}()
+
+	return stdout, nil
+}
+
+// Kill terminates the command's process group gracefully, and makes the
+// stage fail with `err`.
+func (s *commandStage) Kill(err error) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.killErr != nil {
+		return
+	}
+	s.killErr = err
+
+	// go-pipe runs the command in its own process group.
+	terminateProcessGroup(s.cmd.Process, GracePeriod)
+}
+
+func (s *commandStage) Wait() error {
+	err := s.Stage.Wait()
+	close(s.done)
+	if err == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	killErr := s.killErr
+	s.mu.Unlock()
+	if killErr != nil && wasTerminated(err) {
+		return killErr
+	}
+
+	if s.stderr == nil {
+		return err
+	}
+	return &StageError{
+		Stage:  s.name,
+		Err:    err,
+		Stderr: strings.TrimSpace(s.stderr.String()),
+	}
+}
+
+// wasTerminated reports whether `err` says that a command was killed by
+// SIGTERM or SIGKILL.
+func wasTerminated(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	ws, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && ws.Signaled() && (ws.Signal() == syscall.SIGTERM || ws.Signal() == syscall.SIGKILL)
+}
+
+// withoutCancel is a context with the values of its parent that is never
+// done.
+type withoutCancel struct {
+	context.Context
+}
+
+func (withoutCancel) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (withoutCancel) Done() <-chan struct{} {
+	return nil
+}
+
+func (withoutCancel) Err() error {
+	return nil
+}
+
+// WithStderr arranges for `stage`, which must be a command stage (possibly
+// wrapped by other stages from this package), to also write its stderr to
+// `w`. The end of stderr is still included in the stage's error. `w` is
+// written to from a goroutine of its own while the command runs.
+func WithStderr(stage Stage, w io.Writer) Stage {
+	s, ok := stage.(stderrRedirector)
+	if !ok || !s.redirectStderr(w) {
+		panic(fmt.Sprintf("attempt to redirect the stderr of %q, which isn't a command stage", stage.Name()))
+	}
+	return stage
+}
+
+// stderrRedirector is implemented by the stages that run a command, and by
+// the stages that wrap them.
+type stderrRedirector interface {
+	redirectStderr(w io.Writer) bool
+}
+
+func (s *commandStage) redirectStderr(w io.Writer) bool {
+	s.cmd.Stderr = io.MultiWriter(s.cmd.Stderr, w)
+	return true
+}
+
+func (w stageWrapper) redirectStderr(stderr io.Writer) bool {
+	if s, ok := w.Stage.(stderrRedirector); ok {
+		return s.redirectStderr(stderr)
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package pipe
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// WithStageEnv returns a stage that runs `stage` with the environment
+// variables `vars` on top of the pipeline's, e.g. so that only one of the
+// stages of a pipeline sees the quarantine's object directory. The
+// variables only take effect for command stages.
+func WithStageEnv(stage Stage, vars ...EnvVar) Stage {
+	return &envStage{stageWrapper: stageWrapper{stage}, vars: vars}
+}
+
+type envStage struct {
+	stageWrapper
+	vars []EnvVar
+}
+
+func (s *envStage) Start(ctx context.Context, env Env, stdin io.ReadCloser) (io.ReadCloser, error) {
+	// Don't let the stages share the pipeline's slice.
+	env.Vars = append(
+		append([]AppendVars(nil), env.Vars...),
+		func(_ context.Context, vars []EnvVar) []EnvVar {
+			return append(vars, s.vars...)
+		},
+	)
+	return s.Stage.Start(ctx, env, stdin)
+}
+
+// WithEnviron arranges for `stage`, which must be a command stage (possibly
+// wrapped by other stages from this package), to start out with the
+// environment `environ` instead of this process's. The pipeline's and
+// stages' variables still go on top of it.
+func WithEnviron(stage Stage, environ []string) Stage {
+	s, ok := stage.(environSetter)
+	if !ok || !s.setEnviron(environ) {
+		panic(fmt.Sprintf("attempt to set the environment of %q, which isn't a command stage", stage.Name()))
+	}
+	return stage
+}
+
+// environSetter is implemented by the stages that run a command, and by the
+// stages that wrap them.
+type environSetter interface {
+	setEnviron(environ []string) bool
+}
+
+func (s *commandStage) setEnviron(environ []string) bool {
+	// An empty, but non-nil, environment doesn't mean this process's.
+	s.cmd.Env = append([]string{}, environ...)
+	return true
+}
+
+func (w stageWrapper) setEnviron(environ []string) bool {
+	if s, ok := w.Stage.(environSetter); ok {
+		return s.setEnviron(environ)
+	}
+	return false
+}
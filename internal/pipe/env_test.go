@@ -0,0 +1,50 @@
+package pipe
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithStageEnv(t *testing.T) {
+	var out bytes.Buffer
+	p := New(WithStdout(&out), WithEnvVar("SHARED", "pipeline"), WithEnvVar("OVERRIDDEN", "pipeline"))
+	p.Add(
+		WithStageEnv(
+			Command("sh", "-c", `echo "first: $SHARED $OVERRIDDEN $ONLY_FIRST"; cat >/dev/null`),
+			EnvVar{Key: "OVERRIDDEN", Value: "stage"},
+			EnvVar{Key: "ONLY_FIRST", Value: "yes"},
+		),
+		Command("sh", "-c", `cat; echo "second: $SHARED $OVERRIDDEN $ONLY_FIRST"`),
+	)
+	require.NoError(t, p.Run(context.Background()))
+	assert.Equal(t, "first: pipeline stage yes\nsecond: pipeline pipeline \n", out.String())
+}
+
+func TestWithEnviron(t *testing.T) {
+	t.Setenv("INHERITED", "yes")
+
+	var out bytes.Buffer
+	p := New(WithStdout(&out), WithEnvVar("SHARED", "pipeline"))
+	p.Add(
+		WithEnviron(
+			WithStageEnv(
+				Command("sh", "-c", `echo "first: $INHERITED $GIVEN $SHARED $ONLY_FIRST"; cat >/dev/null`),
+				EnvVar{Key: "ONLY_FIRST", Value: "yes"},
+			),
+			[]string{"PATH=" + os.Getenv("PATH"), "GIVEN=yes"},
+		),
+		Command("sh", "-c", `cat; echo "second: $INHERITED $GIVEN $SHARED $ONLY_FIRST"`),
+	)
+	require.NoError(t, p.Run(context.Background()))
+	assert.Equal(t, "first:  yes pipeline yes\nsecond: yes  pipeline \n", out.String())
+
+	assert.Panics(t, func() {
+		WithEnviron(Function("f", func(context.Context, Env, io.Reader, io.Writer) error { return nil }), nil)
+	})
+}
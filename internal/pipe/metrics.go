@@ -0,0 +1,103 @@
+package pipe
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// StageMetrics describes what a stage did and the resources that it used.
+type StageMetrics struct {
+	Stage string
+
+	// WallTime is the time from the start of the stage until its Wait
+	// returned.
+	WallTime time.Duration
+
+	// UserTime, SystemTime, and MaxRSS (in bytes) are only known for
+	// command stages, and are zero for others.
+	UserTime   time.Duration
+	SystemTime time.Duration
+	MaxRSS     uint64
+
+	// BytesOut is how much of the stage's output the next stage read.
+	BytesOut int64
+
+	// Err is what the stage's Wait returned.
+	Err error
+}
+
+// WithMetrics returns a stage that runs `stage` and, once it is done, calls
+// `report` with its metrics.
+func WithMetrics(stage Stage, report func(StageMetrics)) Stage {
+	return &metricsStage{stageWrapper: stageWrapper{stage}, report: report}
+}
+
+type metricsStage struct {
+	stageWrapper
+	report   func(StageMetrics)
+	start    time.Time
+	bytesOut atomic.Int64
+}
+
+func (s *metricsStage) Start(ctx context.Context, env Env, stdin io.ReadCloser) (io.ReadCloser, error) {
+	s.start = time.Now()
+	stdout, err := s.Stage.Start(ctx, env, stdin)
+	if err != nil {
+		return nil, err
+	}
+	return countingReadCloser{ReadCloser: stdout, n: &s.bytesOut}, nil
+}
+
+func (s *metricsStage) Wait() error {
+	err := s.Stage.Wait()
+
+	m := StageMetrics{
+		Stage:    s.Name(),
+		WallTime: time.Since(s.start),
+		BytesOut: s.bytesOut.Load(),
+		Err:      err,
+	}
+	if ps := s.processState(); ps != nil {
+		m.UserTime = ps.UserTime()
+		m.SystemTime = ps.SystemTime()
+		if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+			// ru_maxrss is in kilobytes.
+			m.MaxRSS = uint64(ru.Maxrss) * 1024
+		}
+	}
+	s.report(m)
+
+	return err
+}
+
+// processStater is implemented by the stages that run a process, and by the
+// stages that wrap them.
+type processStater interface {
+	processState() *os.ProcessState
+}
+
+func (s *commandStage) processState() *os.ProcessState {
+	return s.cmd.ProcessState
+}
+
+func (w stageWrapper) processState() *os.ProcessState {
+	if ps, ok := w.Stage.(processStater); ok {
+		return ps.processState()
+	}
+	return nil
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (r countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
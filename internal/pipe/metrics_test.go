@@ -0,0 +1,53 @@
+package pipe
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithMetrics(t *testing.T) {
+	metrics := make(map[string]StageMetrics)
+	report := func(m StageMetrics) { metrics[m.Stage] = m }
+
+	var out bytes.Buffer
+	p := New(WithStdout(&out))
+	p.Add(
+		WithMetrics(WithTimeout(Command("sh", "-c", "printf hello; sleep 0.1"), time.Minute), report),
+		WithMetrics(Function("upcase", func(_ context.Context, _ Env, r io.Reader, w io.Writer) error {
+			b, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(bytes.ToUpper(b))
+			return err
+		}), report),
+	)
+	require.NoError(t, p.Run(context.Background()))
+	assert.Equal(t, "HELLO", out.String())
+
+	require.Len(t, metrics, 2)
+
+	sh := metrics["sh"]
+	assert.NoError(t, sh.Err)
+	assert.GreaterOrEqual(t, sh.WallTime, 100*time.Millisecond)
+	assert.Equal(t, int64(5), sh.BytesOut)
+	assert.NotZero(t, sh.MaxRSS)
+
+	upcase := metrics["upcase"]
+	assert.Equal(t, int64(5), upcase.BytesOut)
+	assert.Zero(t, upcase.MaxRSS)
+
+	// Failures are reported too.
+	metrics = make(map[string]StageMetrics)
+	p = New()
+	p.Add(WithMetrics(Command("false"), report))
+	require.Error(t, p.Run(context.Background()))
+	require.Len(t, metrics, 1)
+	assert.Error(t, metrics["false"].Err)
+}
@@ -0,0 +1,74 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// ErrOutputLimitExceeded is returned (wrapped) by a stage that was stopped
+// because it produced more output than it was allowed to.
+var ErrOutputLimitExceeded = errors.New("output limit exceeded")
+
+// LimitOutput returns a stage that runs `stage`, but stops it once it has
+// written more than `limit` bytes to its stdout. The next stage then reads
+// an error instead of the rest of the output, and the stage's Wait returns
+// an error wrapping ErrOutputLimitExceeded. This is meant for commands whose
+// output we don't control, so that they can't make us buffer or relay
+// unlimited amounts of it.
+func LimitOutput(stage Stage, limit int64) Stage {
+	return &outputLimitStage{stageWrapper: stageWrapper{stage}, limit: limit}
+}
+
+type outputLimitStage struct {
+	stageWrapper
+	limit    int64
+	exceeded atomic.Bool
+}
+
+func (s *outputLimitStage) Start(ctx context.Context, env Env, stdin io.ReadCloser) (io.ReadCloser, error) {
+	stdout, err := s.Stage.Start(ctx, env, stdin)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedReadCloser{ReadCloser: stdout, stage: s, remaining: s.limit}, nil
+}
+
+func (s *outputLimitStage) Wait() error {
+	err := s.Stage.Wait()
+	if s.exceeded.Load() {
+		return s.err()
+	}
+	return err
+}
+
+func (s *outputLimitStage) err() error {
+	return fmt.Errorf("%w: more than %d bytes", ErrOutputLimitExceeded, s.limit)
+}
+
+type limitedReadCloser struct {
+	io.ReadCloser
+	stage     *outputLimitStage
+	remaining int64
+}
+
+func (r *limitedReadCloser) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, r.stage.err()
+	}
+
+	// Read one byte more than allowed, to tell whether there is more.
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		r.stage.exceeded.Store(true)
+		r.stage.Kill(ErrOutputLimitExceeded)
+		return n + int(r.remaining), r.stage.err()
+	}
+	return n, err
+}
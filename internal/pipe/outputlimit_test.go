@@ -0,0 +1,36 @@
+package pipe
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitOutput(t *testing.T) {
+	ctx := context.Background()
+
+	var out bytes.Buffer
+	p := New(WithStdout(&out))
+	p.Add(LimitOutput(Command("printf", "12345"), 5))
+	require.NoError(t, p.Run(ctx))
+	assert.Equal(t, "12345", out.String())
+
+	out.Reset()
+	p = New(WithStdout(&out))
+	p.Add(LimitOutput(Command("printf", "123456"), 5))
+	err := p.Run(ctx)
+	assert.ErrorIs(t, err, ErrOutputLimitExceeded)
+	assert.Equal(t, "12345", out.String())
+
+	// A command that would go on forever is stopped.
+	start := time.Now()
+	p = New(WithStdout(&out))
+	p.Add(LimitOutput(Command("yes"), 1<<20))
+	err = p.Run(ctx)
+	assert.ErrorIs(t, err, ErrOutputLimitExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,42 @@
+// Package pipe extends github.com/github/go-pipe/pipe with the stages and
+// options that spokes-receive-pack needs. It re-exports everything that we
+// use from go-pipe, so that callers only need to import this package.
+package pipe
+
+import (
+	gopipe "github.com/github/go-pipe/pipe"
+)
+
+type (
+	Stage             = gopipe.Stage
+	Env               = gopipe.Env
+	EnvVar            = gopipe.EnvVar
+	AppendVars        = gopipe.AppendVars
+	Event             = gopipe.Event
+	Pipeline          = gopipe.Pipeline
+	Option            = gopipe.Option
+	StageFunc         = gopipe.StageFunc
+	LinewiseStageFunc = gopipe.LinewiseStageFunc
+	LimitableStage    = gopipe.LimitableStage
+	ErrorMatcher      = gopipe.ErrorMatcher
+)
+
+var (
+	New              = gopipe.New
+	Function         = gopipe.Function
+	LinewiseFunction = gopipe.LinewiseFunction
+	MemoryLimit      = gopipe.MemoryLimit
+	FilterError      = gopipe.FilterError
+	IgnoreError      = gopipe.IgnoreError
+	IsPipeError      = gopipe.IsPipeError
+
+	WithDir          = gopipe.WithDir
+	WithStdin        = gopipe.WithStdin
+	WithStdout       = gopipe.WithStdout
+	WithEnvVar       = gopipe.WithEnvVar
+	WithEnvVars      = gopipe.WithEnvVars
+	WithEventHandler = gopipe.WithEventHandler
+
+	FinishEarly            = gopipe.FinishEarly
+	ErrMemoryLimitExceeded = gopipe.ErrMemoryLimitExceeded
+)
@@ -0,0 +1,96 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// RetryPolicy says how to retry a pipeline that fails because of something
+// that is likely to go away by itself, like a lock held by concurrent
+// repository maintenance.
+type RetryPolicy struct {
+	// Attempts is the most times that the pipeline is run. Values less
+	// than 1 mean 1.
+	Attempts int
+
+	// Backoff is how long to wait before the second attempt. The wait
+	// doubles before each attempt after that, up to MaxBackoff if it is
+	// positive.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Transient matches the errors that are worth retrying. If it is nil,
+	// no errors are retried.
+	Transient ErrorMatcher
+
+	// OnRetry, if set, is called with the number of the failed attempt
+	// (starting at 1) and its error before each retry.
+	OnRetry func(attempt int, err error)
+}
+
+// Run runs the pipelines returned by `build` until one succeeds, one fails
+// with an error that isn't transient, the attempts run out, or `ctx` is
+// done. It returns the error of the last attempt.
+//
+// A pipeline can only be run once, so `build` is called for each attempt
+// and must create new stages each time. Only pipelines whose input can be
+// produced again and whose output can be thrown away should be retried;
+// in particular, not ones that write to the client.
+func (p RetryPolicy) Run(ctx context.Context, build func() *Pipeline) error {
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := build().Run(ctx)
+		if err == nil || attempt >= p.Attempts || !p.isTransient(ctx, err) {
+			return err
+		}
+
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, err)
+		}
+
+		if backoff > 0 {
+			t := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return err
+			case <-t.C:
+			}
+		}
+
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+func (p RetryPolicy) isTransient(ctx context.Context, err error) bool {
+	if p.Transient == nil || ctx.Err() != nil {
+		return false
+	}
+	// Running out of time or memory isn't going to get better.
+	if errors.Is(err, ErrStageTimeout) || errors.Is(err, ErrMemoryLimitExceeded) {
+		return false
+	}
+	return p.Transient(err)
+}
+
+// StderrContains returns an ErrorMatcher that matches the errors of command
+// stages whose stderr contains any of `substrs`.
+func StderrContains(substrs ...string) ErrorMatcher {
+	return func(err error) bool {
+		var se *StageError
+		if !errors.As(err, &se) {
+			return false
+		}
+		for _, s := range substrs {
+			if strings.Contains(se.Stderr, s) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,98 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	errTransient := errors.New("transient")
+	errFatal := errors.New("fatal")
+
+	// failing returns a build function whose pipelines fail with the
+	// errors in `errs`, in order, and then succeed.
+	failing := func(runs *int, errs ...error) func() *Pipeline {
+		return func() *Pipeline {
+			p := New()
+			p.Add(Function("fail", func(context.Context, Env, io.Reader, io.Writer) error {
+				*runs++
+				if *runs <= len(errs) {
+					return errs[*runs-1]
+				}
+				return nil
+			}))
+			return p
+		}
+	}
+
+	policy := RetryPolicy{
+		Attempts:  3,
+		Backoff:   time.Millisecond,
+		Transient: func(err error) bool { return errors.Is(err, errTransient) },
+	}
+
+	var runs int
+	var retried []int
+	withCallback := policy
+	withCallback.OnRetry = func(attempt int, _ error) { retried = append(retried, attempt) }
+	require.NoError(t, withCallback.Run(ctx, failing(&runs, errTransient, errTransient)))
+	assert.Equal(t, 3, runs)
+	assert.Equal(t, []int{1, 2}, retried)
+
+	runs = 0
+	err := policy.Run(ctx, failing(&runs, errTransient, errTransient, errTransient))
+	assert.ErrorIs(t, err, errTransient)
+	assert.Equal(t, 3, runs)
+
+	runs = 0
+	err = policy.Run(ctx, failing(&runs, errFatal))
+	assert.ErrorIs(t, err, errFatal)
+	assert.Equal(t, 1, runs)
+
+	runs = 0
+	err = RetryPolicy{}.Run(ctx, failing(&runs, errTransient))
+	assert.ErrorIs(t, err, errTransient)
+	assert.Equal(t, 1, runs)
+
+	// Timeouts are never retried.
+	runs = 0
+	err = policy.Run(ctx, failing(&runs, errors.Join(errTransient, ErrStageTimeout)))
+	assert.ErrorIs(t, err, ErrStageTimeout)
+	assert.Equal(t, 1, runs)
+
+	// Neither is anything once the context is done.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	runs = 0
+	slow := policy
+	slow.Backoff = time.Minute
+	err = slow.Run(canceled, failing(&runs, errTransient))
+	assert.Error(t, err)
+	assert.Equal(t, 1, runs)
+}
+
+func TestStderrContains(t *testing.T) {
+	isLocked := StderrContains("File exists", "cannot lock ref")
+
+	p := New()
+	p.Add(Command("sh", "-c", "echo \"fatal: Unable to create 'packed-refs.lock': File exists.\" >&2; exit 128"))
+	err := p.Run(context.Background())
+	require.Error(t, err)
+	assert.True(t, isLocked(err))
+
+	p = New()
+	p.Add(Command("sh", "-c", "echo 'fatal: bad object' >&2; exit 128"))
+	err = p.Run(context.Background())
+	require.Error(t, err)
+	assert.False(t, isLocked(err))
+
+	assert.False(t, isLocked(errors.New("File exists")))
+}
@@ -0,0 +1,53 @@
+package pipe
+
+import (
+	"fmt"
+)
+
+// DefaultStderrLimit is the most stderr output that a command stage keeps
+// in order to include it in its error.
+const DefaultStderrLimit = 4096
+
+// StageError is the error returned by a command stage that failed. It
+// includes the end of what the command wrote to stderr.
+type StageError struct {
+	Stage  string
+	Err    error
+	Stderr string
+}
+
+func (e *StageError) Error() string {
+	if e.Stderr == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v: %s", e.Err, e.Stderr)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// tailWriter remembers the last `max` bytes written to it. It is only
+// written to by the goroutine that exec.Cmd uses to copy stderr, and only
+// read after the command has been waited for.
+type tailWriter struct {
+	max       int
+	buf       []byte
+	truncated bool
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+		t.truncated = true
+	}
+	return len(p), nil
+}
+
+func (t *tailWriter) String() string {
+	if t.truncated {
+		return "..." + string(t.buf)
+	}
+	return string(t.buf)
+}
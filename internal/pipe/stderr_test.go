@@ -0,0 +1,70 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandStderr(t *testing.T) {
+	ctx := context.Background()
+
+	p := New()
+	p.Add(Command("sh", "-c", "echo 'fatal: not a git repository' >&2; exit 128"))
+	err := p.Run(ctx)
+	require.Error(t, err)
+	assert.EqualError(t, err, "sh: exit status 128: fatal: not a git repository")
+
+	var stageErr *StageError
+	require.True(t, errors.As(err, &stageErr))
+	assert.Equal(t, "sh", stageErr.Stage)
+	var exitErr *exec.ExitError
+	assert.True(t, errors.As(err, &exitErr))
+
+	// Only the end of stderr is kept.
+	p = New()
+	p.Add(CommandStageWithStderrLimit("sh", exec.Command("sh", "-c", "echo aaaaaaaaaaaaaaaaaaaa >&2; echo the end >&2; exit 1"), 8))
+	err = p.Run(ctx)
+	require.Error(t, err)
+	assert.True(t, strings.HasSuffix(err.Error(), ": ...the end"), err.Error())
+
+	// Successful commands don't report anything.
+	p = New()
+	p.Add(Command("sh", "-c", "echo warning >&2"))
+	assert.NoError(t, p.Run(ctx))
+
+	// Without stderr, the error is unchanged.
+	p = New()
+	p.Add(Command("false"))
+	assert.EqualError(t, p.Run(ctx), "false: exit status 1")
+}
+
+func TestWithStderr(t *testing.T) {
+	ctx := context.Background()
+
+	var stderr strings.Builder
+	p := New()
+	p.Add(WithStderr(
+		WithTimeout(Command("sh", "-c", "echo 'warning: one' >&2; echo 'fatal: two' >&2; exit 1"), time.Minute),
+		&stderr,
+	))
+	err := p.Run(ctx)
+	require.Error(t, err)
+	assert.Equal(t, "warning: one\nfatal: two\n", stderr.String())
+
+	// The end of stderr is still kept for the error.
+	var stageErr *StageError
+	require.True(t, errors.As(err, &stageErr))
+	assert.Equal(t, "warning: one\nfatal: two", stageErr.Stderr)
+
+	assert.Panics(t, func() {
+		WithStderr(Function("f", func(context.Context, Env, io.Reader, io.Writer) error { return nil }), &stderr)
+	})
+}
@@ -0,0 +1,33 @@
+package pipe
+
+import (
+	"context"
+	"io"
+)
+
+// TeeStage returns a stage that runs `stage`, but also writes everything
+// that it outputs to `w`, e.g. to hash or measure the output while it is
+// streamed to the next stage. `w` only sees the output that the next stage
+// reads. If writing to `w` fails, the next stage reads that error instead of
+// the rest of the output.
+func TeeStage(stage Stage, w io.Writer) Stage {
+	return &teeStage{stageWrapper: stageWrapper{stage}, w: w}
+}
+
+type teeStage struct {
+	stageWrapper
+	w io.Writer
+}
+
+func (s *teeStage) Start(ctx context.Context, env Env, stdin io.ReadCloser) (io.ReadCloser, error) {
+	stdout, err := s.Stage.Start(ctx, env, stdin)
+	if err != nil {
+		return nil, err
+	}
+	return teeReadCloser{Reader: io.TeeReader(stdout, s.w), Closer: stdout}, nil
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
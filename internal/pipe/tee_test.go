@@ -0,0 +1,52 @@
+package pipe
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTeeStage(t *testing.T) {
+	ctx := context.Background()
+
+	var out bytes.Buffer
+	h := sha256.New()
+	p := New(WithStdout(&out))
+	p.Add(TeeStage(Command("printf", "hello\\nworld\\n"), h))
+	require.NoError(t, p.Run(ctx))
+	assert.Equal(t, "hello\nworld\n", out.String())
+	sum := sha256.Sum256([]byte("hello\nworld\n"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), hex.EncodeToString(h.Sum(nil)))
+
+	// The copy gets everything that the next stage reads, even if it
+	// doesn't use all of it.
+	var copied bytes.Buffer
+	out.Reset()
+	p = New(WithStdout(&out))
+	p.Add(
+		TeeStage(Command("printf", "a\\nb\\n"), &copied),
+		Command("head", "-n", "1"),
+	)
+	require.NoError(t, p.Run(ctx))
+	assert.Equal(t, "a\n", out.String())
+	assert.Equal(t, "a\nb\n", copied.String())
+
+	errBroken := errors.New("broken")
+	p = New(WithStdout(&out))
+	p.Add(TeeStage(Command("printf", "x"), failingWriter{errBroken}))
+	assert.ErrorIs(t, p.Run(ctx), errBroken)
+}
+
+type failingWriter struct {
+	err error
+}
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
@@ -0,0 +1,53 @@
+package pipe
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// GracePeriod is how long a command is given to exit after it has been sent
+// SIGTERM, before its whole process group is sent SIGKILL.
+var GracePeriod = 2 * time.Second
+
+// TerminateGracefully changes how `cmd`, which must have been created with
+// exec.CommandContext, is stopped when its context is done. Instead of only
+// the command being killed right away, it is run in its own process group,
+// which is sent SIGTERM and then, after GracePeriod, SIGKILL, if the
+// command is still around. That way, processes that the command started,
+// like the index-pack run by git-receive-pack, don't outlive it.
+func TerminateGracefully(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	grace := GracePeriod
+	cmd.Cancel = func() error {
+		terminateProcessGroup(cmd.Process, grace)
+		return nil
+	}
+	// If something that isn't in the process group is holding the
+	// command's stdin, stdout, or stderr open, stop waiting for it
+	// eventually.
+	cmd.WaitDelay = grace + time.Second
+}
+
+// terminateProcessGroup sends SIGTERM to the process group that `proc`
+// leads and, after `grace`, SIGKILL to whatever is left of it, unless `proc`
+// has been reaped by then. Once it has, the group might be gone, and its ID
+// might be reused by an unrelated process.
+func terminateProcessGroup(proc *os.Process, grace time.Duration) {
+	pgid := proc.Pid
+	_ = syscall.Kill(-pgid, syscall.SIGTERM)
+
+	time.AfterFunc(grace, func() {
+		// Signal knows, without a race, if the process was reaped.
+		if errors.Is(proc.Signal(syscall.Signal(0)), os.ErrProcessDone) {
+			return
+		}
+		_ = syscall.Kill(-pgid, syscall.SIGKILL)
+	})
+}
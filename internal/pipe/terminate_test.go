@@ -0,0 +1,105 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubbornScript ignores SIGTERM, starts a child that ignores it too and
+// writes the child's PID to the file named by its first argument, and waits.
+const stubbornScript = `trap "" TERM; sleep 30 & echo $! >"$1"; wait`
+
+func setGracePeriod(t *testing.T, d time.Duration) {
+	old := GracePeriod
+	GracePeriod = d
+	t.Cleanup(func() { GracePeriod = old })
+}
+
+// waitForPID waits for the PID to show up in `path`.
+func waitForPID(t *testing.T, path string) int {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if b, err := os.ReadFile(path); err == nil && strings.HasSuffix(string(b), "\n") {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+			require.NoError(t, err)
+			return pid
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s wasn't written", path)
+	return 0
+}
+
+// assertGone checks that the process `pid` has exited.
+func assertGone(t *testing.T, pid int) {
+	assert.Eventually(t, func() bool {
+		stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+		if err != nil {
+			return true
+		}
+		// A zombie is waiting to be reaped by whoever inherited it.
+		fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+		return len(fields) > 0 && fields[0] == "Z"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCommandStageTermination(t *testing.T) {
+	setGracePeriod(t, 100*time.Millisecond)
+	pidFile := filepath.Join(t.TempDir(), "pid")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := New()
+	p.Add(Command("sh", "-c", stubbornScript, "sh", pidFile))
+	require.NoError(t, p.Start(ctx))
+
+	child := waitForPID(t, pidFile)
+	cancel()
+
+	start := time.Now()
+	err := p.Wait()
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assertGone(t, child)
+
+	// A command that exits when it's asked to isn't killed.
+	p = New()
+	p.Add(Command("sh", "-c", `trap "exit 3" TERM; sleep 30 & wait`))
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = p.Run(ctx)
+	var exitErr *exec.ExitError
+	require.True(t, errors.As(err, &exitErr), "%v", err)
+	assert.Equal(t, 3, exitErr.ExitCode())
+}
+
+func TestTerminateGracefully(t *testing.T) {
+	setGracePeriod(t, 100*time.Millisecond)
+	pidFile := filepath.Join(t.TempDir(), "pid")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", stubbornScript, "sh", pidFile)
+	TerminateGracefully(cmd)
+	require.NoError(t, cmd.Start())
+
+	child := waitForPID(t, pidFile)
+	cancel()
+
+	start := time.Now()
+	assert.Error(t, cmd.Wait())
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assertGone(t, child)
+}
@@ -0,0 +1,55 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrStageTimeout is returned (wrapped) by a stage that was killed because it
+// ran for longer than its timeout.
+var ErrStageTimeout = errors.New("stage timed out")
+
+// WithTimeout returns a stage that runs `stage`, but kills it if it runs for
+// longer than `timeout`, in which case its Wait returns an error wrapping
+// ErrStageTimeout. The rest of the pipeline only notices if it minds the
+// errors of the stage, or the stage's output ending early. If `timeout` isn't
+// positive, `stage` is returned unchanged.
+func WithTimeout(stage Stage, timeout time.Duration) Stage {
+	if timeout <= 0 {
+		return stage
+	}
+	return &timeoutStage{stageWrapper: stageWrapper{stage}, timeout: timeout}
+}
+
+type timeoutStage struct {
+	stageWrapper
+	timeout time.Duration
+	parent  context.Context
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (s *timeoutStage) Start(ctx context.Context, env Env, stdin io.ReadCloser) (io.ReadCloser, error) {
+	s.parent = ctx
+	s.ctx, s.cancel = context.WithTimeout(ctx, s.timeout)
+
+	stdout, err := s.Stage.Start(s.ctx, env, stdin)
+	if err != nil {
+		s.cancel()
+		return nil, err
+	}
+	return stdout, nil
+}
+
+func (s *timeoutStage) Wait() error {
+	defer s.cancel()
+
+	err := s.Stage.Wait()
+	if err != nil && s.parent.Err() == nil && errors.Is(s.ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s", ErrStageTimeout, s.timeout)
+	}
+	return err
+}
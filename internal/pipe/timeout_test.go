@@ -0,0 +1,47 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	p := New()
+	p.Add(WithTimeout(Command("sleep", "10"), 50*time.Millisecond))
+	start := time.Now()
+	err := p.Run(ctx)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrStageTimeout)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	p = New()
+	p.Add(WithTimeout(Command("true"), time.Minute))
+	assert.NoError(t, p.Run(ctx))
+
+	// A stage that ignores its context is unaffected.
+	p = New()
+	p.Add(WithTimeout(Function("quick", func(context.Context, Env, io.Reader, io.Writer) error {
+		return nil
+	}), time.Nanosecond))
+	assert.NoError(t, p.Run(ctx))
+
+	// If the pipeline's own context expires, that's not a stage timeout.
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	p = New()
+	p.Add(WithTimeout(Command("sleep", "10"), time.Minute))
+	err = p.Run(ctx)
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, ErrStageTimeout))
+
+	s := Command("true")
+	assert.Equal(t, s, WithTimeout(s, 0))
+}
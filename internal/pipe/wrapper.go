@@ -0,0 +1,31 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// errNotLimitable is returned by GetRSSAnon for a wrapped stage that can't
+// report its memory usage.
+var errNotLimitable = errors.New("stage can't report its memory usage")
+
+// stageWrapper is embedded by the stages that wrap another stage. Besides
+// the Stage methods, it forwards the methods of LimitableStage, so that a
+// wrapped command stage can still be used with MemoryLimit.
+type stageWrapper struct {
+	Stage
+}
+
+func (w stageWrapper) GetRSSAnon(ctx context.Context) (uint64, error) {
+	if ls, ok := w.Stage.(LimitableStage); ok {
+		return ls.GetRSSAnon(ctx)
+	}
+	return 0, fmt.Errorf("%s: %w", w.Name(), errNotLimitable)
+}
+
+func (w stageWrapper) Kill(err error) {
+	if ls, ok := w.Stage.(LimitableStage); ok {
+		ls.Kill(err)
+	}
+}
@@ -53,6 +53,9 @@ func newCapability(data string) (Capability, error) {
 	default:
 		return Capability{}, fmt.Errorf("unexpected Capability format %s", data)
 	}
+	if cap.name == "" {
+		return Capability{}, fmt.Errorf("unexpected Capability format %s", data)
+	}
 
 	return cap, nil
 }
@@ -78,8 +81,12 @@ func ParseCapabilities(capabilities []byte) (Capabilities, error) {
 	caps = strings.TrimSuffix(caps, "\n")
 	splitted := strings.Split(caps, " ")
 
-	parsedCaps := make(map[string]Capability, len(caps))
+	parsedCaps := make(map[string]Capability, len(splitted))
 	for _, c := range splitted {
+		// Tolerate repeated spaces, and no capabilities at all.
+		if c == "" {
+			continue
+		}
 		cap, err := newCapability(c)
 		if err != nil {
 			return Capabilities{}, fmt.Errorf("unable to parse Capability %s", c)
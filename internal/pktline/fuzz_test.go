@@ -0,0 +1,72 @@
+package pktline_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/pktline"
+)
+
+func FuzzRead(f *testing.F) {
+	f.Add([]byte("0000"))
+	f.Add([]byte("0004"))
+	f.Add([]byte("000ahello\n0000"))
+	f.Add([]byte("00820000000000000000000000000000000000000000 f9cc25952a0d66c0a388ee0decfda12a0122404d refs/heads/main\000report-status side-band-64k\n0000"))
+	f.Add([]byte("fff0"))
+	f.Add([]byte("zzzz"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pl := pktline.New()
+		r := bytes.NewReader(data)
+		for {
+			before := r.Len()
+			err := pl.Read(r)
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				return
+			}
+
+			size, err := pl.Size()
+			if err != nil {
+				t.Fatalf("Read accepted a pkt-line whose size can't be parsed: %v", err)
+			}
+			if consumed := before - r.Len(); size > pktline.HeaderSize && consumed != size {
+				t.Fatalf("size %d but consumed %d bytes", size, consumed)
+			}
+			if n := len(pl.Payload) + len(pl.CapabilitiesPayload); n > pktline.MaxPayload+1 {
+				t.Fatalf("payload of %d bytes", n)
+			}
+			if pl.IsFlush() {
+				return
+			}
+		}
+	})
+}
+
+func FuzzParseCapabilities(f *testing.F) {
+	f.Add([]byte("report-status side-band-64k agent=git/2.42.0\n"))
+	f.Add([]byte(""))
+	f.Add([]byte("a=b=c"))
+	f.Add([]byte("  push-options  "))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		caps, err := pktline.ParseCapabilities(data)
+		if err != nil {
+			return
+		}
+		for _, name := range caps.Names() {
+			if name == "" || strings.ContainsAny(name, " =") {
+				t.Fatalf("parsed capability name %q from %q", name, data)
+			}
+			c, ok := caps.Get(name)
+			if !ok || c.Name() != name {
+				t.Fatalf("capability %q isn't found by name", name)
+			}
+		}
+	})
+}
@@ -2,6 +2,7 @@ package pktline
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
@@ -15,6 +16,10 @@ const (
 var FlushPktline = []byte("0000")
 var HeartbeatPktline = []byte("0004")
 
+// ErrTooLong is returned by ReadMax for a pktline whose payload is longer
+// than allowed.
+var ErrTooLong = errors.New("pktline payload too long")
+
 type Pktline struct {
 	buf                   [HeaderSize + MaxPayload + 1]byte
 	payloadSize           []byte
@@ -80,6 +85,13 @@ func (pl *Pktline) Reset() {
 // encountered after reading part but not all the pktline, return
 // `io.ErrUnexpectedEOF`.
 func (pl *Pktline) Read(r io.Reader) error {
+	return pl.ReadMax(r, len(pl.buf)-HeaderSize)
+}
+
+// ReadMax is like Read, but if the payload of the pktline is longer than
+// `max` bytes, it returns an error wrapping ErrTooLong without reading the
+// payload, leaving `r` in the middle of the pktline.
+func (pl *Pktline) ReadMax(r io.Reader, max int) error {
 	pl.Reset()
 	// Read header
 	if _, err := io.ReadFull(r, pl.payloadSize); err != nil {
@@ -94,6 +106,10 @@ func (pl *Pktline) Read(r io.Reader) error {
 		return err
 	}
 
+	if size-HeaderSize > max {
+		return fmt.Errorf("%w: %d bytes, more than the limit of %d", ErrTooLong, size-HeaderSize, max)
+	}
+
 	if size <= HeaderSize {
 		// No payload
 		pl.Payload = pl.buf[4:4]
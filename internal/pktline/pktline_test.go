@@ -220,3 +220,16 @@ func TestReadErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestReadMax(t *testing.T) {
+	pl := pktline.New()
+	r := strings.NewReader("0009hello" + "000ahello!" + "0000")
+
+	assert.NoError(t, pl.ReadMax(r, 5))
+	assert.Equal(t, "hello", string(pl.Payload))
+
+	err := pl.ReadMax(r, 5)
+	assert.True(t, errors.Is(err, pktline.ErrTooLong), err)
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "hello!0000", string(rest))
+}
@@ -0,0 +1,209 @@
+package policy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/childenv"
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/pipe"
+)
+
+// The config settings for the blob scanner, like
+//
+//	[spokes]
+//		blobScanner = /usr/local/bin/scan-secrets --quiet
+//		blobScannerTimeout = 1m
+//		blobScannerMaxBlobSize = 1m
+//		blobScannerMaxTotalSize = 100m
+const (
+	blobScannerKey             = "spokes.blobscanner"
+	blobScannerTimeoutKey      = "spokes.blobscannertimeout"
+	blobScannerMaxBlobSizeKey  = "spokes.blobscannermaxblobsize"
+	blobScannerMaxTotalSizeKey = "spokes.blobscannermaxtotalsize"
+)
+
+// The limits of the blob scanner unless the config says otherwise.
+const (
+	DefaultBlobScannerTimeout      = 30 * time.Second
+	DefaultBlobScannerMaxBlobSize  = 1 << 20
+	DefaultBlobScannerMaxTotalSize = 100 << 20
+)
+
+// Flag is a decision of the blob scanner that lets the push through, but
+// warns the client with the verdict's message.
+const Flag = "flag"
+
+// BlobScanFailedMessage is the reason given for rejecting ref updates when
+// the blob scanner fails, since it might have denied them.
+const BlobScanFailedMessage = "blob scan failed"
+
+// defaultBlobDenyMessage is the reason given for a rejection by the blob
+// scanner that doesn't come with a message.
+const defaultBlobDenyMessage = "denied by blob scanner"
+
+// maxBlobScannerOutput is the most that the blob scanner may write to
+// stdout.
+const maxBlobScannerOutput = 1 << 20
+
+// BlobScanner is a command that the blobs that a push adds are streamed
+// to, in the format of `git cat-file --batch`, so that it can look at
+// their contents, for example for secrets. It must write a Verdict about
+// the whole push to its stdout, whose decision is Allow, Deny or Flag.
+//
+// Command is split at whitespace into the program and its arguments,
+// without any quoting, so neither may contain spaces. The scanner may stop
+// reading as soon as it has made up its mind.
+//
+// Blobs bigger than MaxBlobSize aren't sent, and neither are any more
+// blobs once MaxTotalSize bytes of them have been.
+type BlobScanner struct {
+	Command      string
+	Timeout      time.Duration
+	MaxBlobSize  int
+	MaxTotalSize int
+}
+
+// ParseBlobScanner returns the blob scanner configured in `cfg`. Its
+// Command is "" if there is none.
+func ParseBlobScanner(cfg *config.Config) (BlobScanner, error) {
+	s := BlobScanner{
+		Command:      cfg.Get(blobScannerKey),
+		Timeout:      DefaultBlobScannerTimeout,
+		MaxBlobSize:  DefaultBlobScannerMaxBlobSize,
+		MaxTotalSize: DefaultBlobScannerMaxTotalSize,
+	}
+
+	if v := cfg.Get(blobScannerTimeoutKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return BlobScanner{}, fmt.Errorf("invalid %s %q", blobScannerTimeoutKey, v)
+		}
+		s.Timeout = d
+	}
+
+	for _, limit := range []struct {
+		key string
+		n   *int
+	}{
+		{blobScannerMaxBlobSizeKey, &s.MaxBlobSize},
+		{blobScannerMaxTotalSizeKey, &s.MaxTotalSize},
+	} {
+		v := cfg.Get(limit.key)
+		if v == "" {
+			continue
+		}
+		n, err := config.ParseSigned(v)
+		if err != nil || n <= 0 {
+			return BlobScanner{}, fmt.Errorf("invalid %s %q", limit.key, v)
+		}
+		*limit.n = n
+	}
+
+	return s, nil
+}
+
+// Enabled reports whether a blob scanner is configured.
+func (s BlobScanner) Enabled() bool {
+	return strings.TrimSpace(s.Command) != ""
+}
+
+// Stage returns a stage that runs the scanner with `env` added to
+// childenv.Environ, within its timeout.
+func (s BlobScanner) Stage(env []pipe.EnvVar) pipe.Stage {
+	args := strings.Fields(s.Command)
+	return pipe.LimitOutput(
+		pipe.WithTimeout(pipe.WithStageEnv(childenv.Scrubbed(pipe.Command(args[0], args[1:]...)), env...), s.Timeout),
+		maxBlobScannerOutput,
+	)
+}
+
+// LimitStage returns a stage that copies the output of `git cat-file
+// --batch` until MaxTotalSize bytes of object contents have gone through,
+// always stopping between objects. It calls `truncated` if it stops early.
+// If the scanner stops reading first, the stage finishes early without an
+// error, so that the scanner's verdict counts.
+func (s BlobScanner) LimitStage(truncated func()) pipe.Stage {
+	return pipe.Function(
+		"limit-blobs",
+		func(_ context.Context, _ pipe.Env, input io.Reader, output io.Writer) error {
+			done, err := copyObjects(output, input, s.MaxTotalSize)
+			if pipe.IsPipeError(err) {
+				return pipe.FinishEarly
+			}
+			if err != nil {
+				return err
+			}
+			if !done {
+				truncated()
+				return pipe.FinishEarly
+			}
+			return nil
+		},
+	)
+}
+
+// copyObjects copies the objects in the output of `git cat-file --batch`
+// from `r` to `w` as long as their contents add up to at most `limit`
+// bytes. It reports whether it copied all of them.
+func copyObjects(w io.Writer, r io.Reader, limit int) (bool, error) {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	total := 0
+	for {
+		header, err := br.ReadString('\n')
+		if err == io.EOF && header == "" {
+			return true, bw.Flush()
+		}
+		if err != nil {
+			return false, fmt.Errorf("reading 'cat-file' output: %w", err)
+		}
+
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return false, fmt.Errorf("unexpected 'cat-file' output %q", header)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil || size < 0 {
+			return false, fmt.Errorf("unexpected 'cat-file' output %q", header)
+		}
+		total += size
+		if total > limit {
+			return false, bw.Flush()
+		}
+
+		if _, err := io.WriteString(bw, header); err != nil {
+			return false, err
+		}
+		// The contents are followed by a newline.
+		if _, err := io.CopyN(bw, br, int64(size)+1); err != nil {
+			return false, fmt.Errorf("copying 'cat-file' output: %w", err)
+		}
+	}
+}
+
+// ParseBlobVerdict decodes the `output` of the blob scanner. It returns an
+// error if the output isn't a verdict with a decision that we know. A
+// verdict to Deny always comes with a message.
+func ParseBlobVerdict(output []byte) (Verdict, error) {
+	var v Verdict
+	if err := json.Unmarshal(output, &v); err != nil {
+		return Verdict{}, fmt.Errorf("decoding the output of the blob scanner: %w", err)
+	}
+	switch v.Decision {
+	case Allow, Flag:
+	case Deny:
+		if v.Message == "" {
+			v.Message = defaultBlobDenyMessage
+		}
+	default:
+		return Verdict{}, fmt.Errorf("unknown blob scanner decision %q", v.Decision)
+	}
+	return v, nil
+}
@@ -0,0 +1,84 @@
+package policy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBlobScanner(t *testing.T) {
+	s, err := ParseBlobScanner(configOf(
+		"spokes.blobscanner", "/bin/scan",
+		"spokes.blobscannertimeout", "1m",
+		"spokes.blobscannermaxblobsize", "2k",
+		"spokes.blobscannermaxtotalsize", "1m",
+	))
+	require.NoError(t, err)
+	assert.Equal(t, BlobScanner{
+		Command:      "/bin/scan",
+		Timeout:      time.Minute,
+		MaxBlobSize:  2048,
+		MaxTotalSize: 1 << 20,
+	}, s)
+	assert.True(t, s.Enabled())
+
+	s, err = ParseBlobScanner(configOf("core.bare", "true"))
+	require.NoError(t, err)
+	assert.False(t, s.Enabled())
+	assert.Equal(t, DefaultBlobScannerTimeout, s.Timeout)
+	assert.Equal(t, DefaultBlobScannerMaxBlobSize, s.MaxBlobSize)
+	assert.Equal(t, DefaultBlobScannerMaxTotalSize, s.MaxTotalSize)
+	assert.False(t, BlobScanner{Command: " "}.Enabled())
+
+	for _, cfg := range []*config.Config{
+		configOf("spokes.blobscannertimeout", "soon"),
+		configOf("spokes.blobscannermaxblobsize", "0"),
+		configOf("spokes.blobscannermaxtotalsize", "big"),
+	} {
+		_, err := ParseBlobScanner(cfg)
+		assert.Error(t, err, "%v", cfg.Entries)
+	}
+}
+
+func TestCopyObjects(t *testing.T) {
+	objects := "1111 blob 3\nabc\n2222 blob 0\n\n3333 blob 4\nwxyz\n"
+
+	var out bytes.Buffer
+	done, err := copyObjects(&out, strings.NewReader(objects), 7)
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, objects, out.String())
+
+	out.Reset()
+	done, err = copyObjects(&out, strings.NewReader(objects), 6)
+	require.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, "1111 blob 3\nabc\n2222 blob 0\n\n", out.String())
+
+	_, err = copyObjects(&out, strings.NewReader("1111 missing\n"), 6)
+	assert.Error(t, err)
+}
+
+func TestParseBlobVerdict(t *testing.T) {
+	v, err := ParseBlobVerdict([]byte(`{"decision": "allow"}`))
+	require.NoError(t, err)
+	assert.Equal(t, Verdict{Decision: Allow}, v)
+
+	v, err = ParseBlobVerdict([]byte(`{"decision": "flag", "message": "looks like a key"}`))
+	require.NoError(t, err)
+	assert.Equal(t, Verdict{Decision: Flag, Message: "looks like a key"}, v)
+
+	v, err = ParseBlobVerdict([]byte(`{"decision": "deny"}`))
+	require.NoError(t, err)
+	assert.Equal(t, Verdict{Decision: Deny, Message: defaultBlobDenyMessage}, v)
+
+	_, err = ParseBlobVerdict([]byte(`{"decision": "maybe"}`))
+	assert.Error(t, err)
+	_, err = ParseBlobVerdict([]byte(`not json`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,141 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/childenv"
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/pipe"
+)
+
+// The config settings for check commands, like
+//
+//	[spokes]
+//		check = /usr/local/bin/check-large-files
+//		check = /usr/local/bin/check-secrets
+//		checkTimeout = 30s
+const (
+	checkKey        = "spokes.check"
+	checkTimeoutKey = "spokes.checktimeout"
+)
+
+// DefaultCheckTimeout is how long a check command may run unless the config
+// says otherwise.
+const DefaultCheckTimeout = 30 * time.Second
+
+// maxCheckOutput is the most that a check command may write to stdout.
+const maxCheckOutput = 1 << 20
+
+// CheckRequest is what a check command reads from its stdin: the ref
+// updates, with the same fields as a Request to the policy service, and
+// where the new objects are. The command also runs with git's environment
+// set up to read them.
+type CheckRequest struct {
+	Request
+	QuarantinePath string `json:"quarantine_path"`
+}
+
+// Checks are the commands that ref updates are checked with, in addition to
+// the push rules and the policy service.
+type Checks struct {
+	Commands []string
+	Timeout  time.Duration
+}
+
+// ParseChecks returns the check commands configured in `cfg`. If the
+// timeout is invalid, it returns the checks with DefaultCheckTimeout along
+// with the error.
+func ParseChecks(cfg *config.Config) (Checks, error) {
+	checks := Checks{
+		Commands: cfg.GetAll(checkKey),
+		Timeout:  DefaultCheckTimeout,
+	}
+	if v := cfg.Get(checkTimeoutKey); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return checks, fmt.Errorf("invalid %s %q", checkTimeoutKey, v)
+		}
+		checks.Timeout = d
+	}
+	return checks, nil
+}
+
+// RunCheck runs the check command `command` in `dir` with `req` and
+// returns the reasons for rejecting the ref updates that it denies, and the
+// warnings about the ones that it allows, by refname. The command must
+// write a Response to its stdout and exit successfully within `timeout`;
+// otherwise, RunCheck returns an error. The command starts out with
+// childenv.Environ, and `env` is added to it. If `wrap` isn't nil, the
+// command's stage is run through it, to measure or limit it.
+func RunCheck(ctx context.Context, command, dir string, req CheckRequest, timeout time.Duration, env []pipe.EnvVar, wrap func(pipe.Stage) pipe.Stage) (map[string]string, map[string][]string, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encoding check request: %w", err)
+	}
+
+	var output bytes.Buffer
+	p := pipe.New(pipe.WithDir(dir), pipe.WithStdin(bytes.NewReader(input)), pipe.WithStdout(&output))
+	stage := pipe.LimitOutput(
+		pipe.WithTimeout(pipe.WithStageEnv(childenv.Scrubbed(pipe.Command(command)), env...), timeout),
+		maxCheckOutput,
+	)
+	if wrap != nil {
+		stage = wrap(stage)
+	}
+	p.Add(stage)
+	if err := p.Run(ctx); err != nil {
+		return nil, nil, fmt.Errorf("running check %s: %w", command, err)
+	}
+
+	var resp Response
+	if err := json.Unmarshal(output.Bytes(), &resp); err != nil {
+		return nil, nil, fmt.Errorf("decoding the output of check %s: %w", command, err)
+	}
+	if err := resp.validate(); err != nil {
+		return nil, nil, fmt.Errorf("check %s: %w", command, err)
+	}
+	return resp.rejections(req.Commands), resp.warnings(req.Commands), nil
+}
+
+// CheckFailedMessage is the reason given for rejecting ref updates when a
+// check command fails, since it might have denied them.
+const CheckFailedMessage = "push check failed"
+
+// Run runs each of the check commands in `dir` with `req` and merges their
+// verdicts: a ref update is rejected if any of them denies it, with the
+// reason given by the first one that does, and gets the warnings of all of
+// them. If a command fails, all of the ref updates are rejected, and Run
+// returns the errors too. `env` and `wrap` are passed on to RunCheck.
+func (checks Checks) Run(ctx context.Context, dir string, req CheckRequest, env []pipe.EnvVar, wrap func(pipe.Stage) pipe.Stage) (map[string]string, map[string][]string, error) {
+	if len(checks.Commands) == 0 || len(req.Commands) == 0 {
+		return nil, nil, nil
+	}
+
+	rejections := make(map[string]string)
+	warnings := make(map[string][]string)
+	var errs []error
+	for _, command := range checks.Commands {
+		res, warns, err := RunCheck(ctx, command, dir, req, checks.Timeout, env, wrap)
+		if err != nil {
+			errs = append(errs, err)
+			res = make(map[string]string, len(req.Commands))
+			for _, cmd := range req.Commands {
+				res[cmd.Refname] = CheckFailedMessage
+			}
+		}
+		for refname, msg := range res {
+			if _, ok := rejections[refname]; !ok {
+				rejections[refname] = msg
+			}
+		}
+		for refname, msgs := range warns {
+			warnings[refname] = append(warnings[refname], msgs...)
+		}
+	}
+	return rejections, warnings, errors.Join(errs...)
+}
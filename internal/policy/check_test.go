@@ -0,0 +1,125 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/pipe"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCheck writes a check command that runs `script` with sh.
+func writeCheck(t *testing.T, dir, name, script string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755))
+	return path
+}
+
+func TestParseChecks(t *testing.T) {
+	checks, err := ParseChecks(configOf(
+		"spokes.check", "/bin/a",
+		"spokes.check", "/bin/b",
+		"spokes.checktimeout", "10s",
+	))
+	require.NoError(t, err)
+	assert.Equal(t, Checks{Commands: []string{"/bin/a", "/bin/b"}, Timeout: 10 * time.Second}, checks)
+
+	checks, err = ParseChecks(configOf("spokes.checktimeout", "soon"))
+	assert.Error(t, err)
+	assert.Equal(t, DefaultCheckTimeout, checks.Timeout)
+}
+
+func TestRunChecks(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.json")
+
+	req := CheckRequest{
+		Request: Request{
+			RepoName: "github/example",
+			Commands: []Command{
+				{Refname: "refs/heads/main", OldOID: "a", NewOID: "b"},
+				{Refname: "refs/heads/release", OldOID: "c", NewOID: "d"},
+				{Refname: "refs/heads/topic", OldOID: "e", NewOID: "f"},
+			},
+		},
+		QuarantinePath: "/tmp/quarantine",
+	}
+
+	checks := Checks{
+		Commands: []string{
+			writeCheck(t, dir, "first", `cat >"`+input+`"
+echo "$GIT_QUARANTINE_PATH" >"`+input+`.env"
+echo '{"decision": "allow", "refs": {"refs/heads/main": {"decision": "deny", "message": "main is protected"}}}'`),
+			writeCheck(t, dir, "second", `echo '{"decision": "deny", "message": "too big", "refs": {"refs/heads/topic": {"decision": "allow", "warning": "topic is behind main"}}}'`),
+		},
+		Timeout: 10 * time.Second,
+	}
+	env := []pipe.EnvVar{{Key: "GIT_QUARANTINE_PATH", Value: req.QuarantinePath}}
+
+	rejections, warnings, err := checks.Run(context.Background(), dir, req, env, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"refs/heads/main":    "main is protected",
+		"refs/heads/release": "too big",
+	}, rejections)
+	assert.Equal(t, map[string][]string{"refs/heads/topic": {"topic is behind main"}}, warnings)
+
+	data, err := os.ReadFile(input)
+	require.NoError(t, err)
+	var got CheckRequest
+	require.NoError(t, json.Unmarshal(data, &got))
+	assert.Equal(t, req, got)
+
+	data, err = os.ReadFile(input + ".env")
+	require.NoError(t, err)
+	assert.Equal(t, req.QuarantinePath+"\n", string(data))
+
+	// A check that fails rejects everything.
+	for _, script := range []string{
+		"exit 1",
+		"echo 'not json'",
+		`echo '{"decision": "maybe"}'`,
+		"sleep 10",
+	} {
+		failing := Checks{
+			Commands: []string{writeCheck(t, dir, "failing", script)},
+			Timeout:  100 * time.Millisecond,
+		}
+		rejections, _, err := failing.Run(context.Background(), dir, req, nil, nil)
+		assert.Error(t, err, script)
+		assert.Equal(t, map[string]string{
+			"refs/heads/main":    CheckFailedMessage,
+			"refs/heads/release": CheckFailedMessage,
+			"refs/heads/topic":   CheckFailedMessage,
+		}, rejections, script)
+	}
+
+	rejections, _, err = Checks{}.Run(context.Background(), dir, req, env, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, rejections)
+}
+
+func TestRunCheckEnvironment(t *testing.T) {
+	t.Setenv("SPOKES_POLICY_URL", "https://token@policy.example.com")
+	t.Setenv("GIT_SOCKSTAT_VAR_repo_name", "github/example")
+
+	dir := t.TempDir()
+	output := filepath.Join(dir, "env")
+	check := writeCheck(t, dir, "env", `echo "$SPOKES_POLICY_URL|$GIT_SOCKSTAT_VAR_repo_name|$GIT_QUARANTINE_PATH" >"`+output+`"
+echo '{"decision": "allow"}'`)
+
+	req := CheckRequest{Request: Request{Commands: []Command{{Refname: "refs/heads/main", OldOID: "a", NewOID: "b"}}}}
+	env := []pipe.EnvVar{{Key: "GIT_QUARANTINE_PATH", Value: "/tmp/quarantine"}}
+	_, _, err := RunCheck(context.Background(), check, dir, req, 10*time.Second, env, nil)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "|github/example|/tmp/quarantine\n", string(data))
+}
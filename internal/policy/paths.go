@@ -0,0 +1,113 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+)
+
+// The config settings for path rules, like
+//
+//	[pathpolicy]
+//		block = *.exe
+//		block = vendor/secrets/
+//		maxPathLength = 1024
+//		maxTreeEntries = 10000
+const (
+	pathBlockKey          = "pathpolicy.block"
+	pathMaxLengthKey      = "pathpolicy.maxpathlength"
+	pathMaxTreeEntriesKey = "pathpolicy.maxtreeentries"
+)
+
+// PathRules restrict the paths that the new commits of a push may add or
+// change. The zero value allows every path.
+type PathRules struct {
+	// Block are the patterns of paths that may not be added or changed.
+	// A pattern ending in "/" matches every path under it. Patterns
+	// without a "/" are matched against the last component of the path,
+	// and the others against the whole path, with path.Match.
+	Block []string
+
+	// MaxPathLength, if positive, is the longest path allowed, in bytes.
+	MaxPathLength int
+
+	// MaxTreeEntries, if positive, is the most entries that a new
+	// directory may have.
+	MaxTreeEntries int
+}
+
+// ParsePathRules returns the path rules configured in `cfg`.
+func ParsePathRules(cfg *config.Config) (PathRules, error) {
+	rules := PathRules{Block: cfg.GetAll(pathBlockKey)}
+	for _, p := range rules.Block {
+		if _, err := path.Match(strings.TrimSuffix(p, "/"), ""); err != nil || p == "" || p == "/" {
+			return PathRules{}, fmt.Errorf("invalid %s pattern %q", pathBlockKey, p)
+		}
+	}
+
+	for _, limit := range []struct {
+		key string
+		n   *int
+	}{
+		{pathMaxLengthKey, &rules.MaxPathLength},
+		{pathMaxTreeEntriesKey, &rules.MaxTreeEntries},
+	} {
+		v := cfg.Get(limit.key)
+		if v == "" {
+			continue
+		}
+		n, err := config.ParseSigned(v)
+		if err != nil || n < 0 {
+			return PathRules{}, fmt.Errorf("invalid %s %q", limit.key, v)
+		}
+		*limit.n = n
+	}
+
+	return rules, nil
+}
+
+// Enabled reports whether any path is restricted, so that the new paths of
+// a push need to be looked at.
+func (pr PathRules) Enabled() bool {
+	return len(pr.Block) > 0 || pr.MaxPathLength > 0 || pr.MaxTreeEntries > 0
+}
+
+// CheckPath returns the reason that `p`, a path added or changed by a push,
+// isn't allowed, or "" if it is.
+func (pr PathRules) CheckPath(p string) string {
+	if pr.MaxPathLength > 0 && len(p) > pr.MaxPathLength {
+		return fmt.Sprintf("path %q is longer than %d bytes", p, pr.MaxPathLength)
+	}
+	for _, pattern := range pr.Block {
+		if matchesPath(pattern, p) {
+			return fmt.Sprintf("path %q is blocked by the pattern %q", p, pattern)
+		}
+	}
+	return ""
+}
+
+// CheckTreeEntries returns the reason that a new directory at `dir` with
+// `n` entries isn't allowed, or "" if it is. `dir` is "" for the top-level
+// directory.
+func (pr PathRules) CheckTreeEntries(dir string, n int) string {
+	if pr.MaxTreeEntries <= 0 || n <= pr.MaxTreeEntries {
+		return ""
+	}
+	if dir == "" {
+		return fmt.Sprintf("the top-level directory has %d entries, more than the limit of %d", n, pr.MaxTreeEntries)
+	}
+	return fmt.Sprintf("directory %q has %d entries, more than the limit of %d", dir, n, pr.MaxTreeEntries)
+}
+
+func matchesPath(pattern, p string) bool {
+	if dir, ok := strings.CutSuffix(pattern, "/"); ok {
+		return strings.HasPrefix(p, dir+"/")
+	}
+	if !strings.Contains(pattern, "/") {
+		p = path.Base(p)
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
@@ -0,0 +1,73 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePathRules(t *testing.T) {
+	rules, err := ParsePathRules(configOf(
+		"pathpolicy.block", "*.exe",
+		"pathpolicy.block", "secrets/",
+		"pathpolicy.maxpathlength", "1k",
+		"pathpolicy.maxtreeentries", "100",
+	))
+	require.NoError(t, err)
+	assert.Equal(t, PathRules{
+		Block:          []string{"*.exe", "secrets/"},
+		MaxPathLength:  1024,
+		MaxTreeEntries: 100,
+	}, rules)
+	assert.True(t, rules.Enabled())
+
+	rules, err = ParsePathRules(configOf("core.bare", "true"))
+	require.NoError(t, err)
+	assert.False(t, rules.Enabled())
+
+	for _, cfg := range []*config.Config{
+		configOf("pathpolicy.block", "[a"),
+		configOf("pathpolicy.block", ""),
+		configOf("pathpolicy.maxpathlength", "long"),
+		configOf("pathpolicy.maxtreeentries", "-1"),
+	} {
+		_, err := ParsePathRules(cfg)
+		assert.Error(t, err, "%v", cfg.Entries)
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	rules := PathRules{
+		Block:         []string{"*.exe", "secrets/", "docs/*.pdf"},
+		MaxPathLength: 20,
+	}
+
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{"README.md", ""},
+		{"setup.exe", `path "setup.exe" is blocked by the pattern "*.exe"`},
+		{"bin/tools/setup.exe", `path "bin/tools/setup.exe" is blocked by the pattern "*.exe"`},
+		{"secrets/key", `path "secrets/key" is blocked by the pattern "secrets/"`},
+		{"secrets", ""},
+		{"lib/secrets/key", ""},
+		{"docs/manual.pdf", `path "docs/manual.pdf" is blocked by the pattern "docs/*.pdf"`},
+		{"docs/old/manual.pdf", ""},
+		{"a/very/long/path/to/a/file", `path "a/very/long/path/to/a/file" is longer than 20 bytes`},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			assert.Equal(t, tc.expected, rules.CheckPath(tc.path))
+		})
+	}
+}
+
+func TestCheckTreeEntries(t *testing.T) {
+	rules := PathRules{MaxTreeEntries: 10}
+	assert.Equal(t, "", rules.CheckTreeEntries("src", 10))
+	assert.Equal(t, `directory "src" has 11 entries, more than the limit of 10`, rules.CheckTreeEntries("src", 11))
+	assert.Equal(t, "the top-level directory has 11 entries, more than the limit of 10", rules.CheckTreeEntries("", 11))
+	assert.Equal(t, "", PathRules{}.CheckTreeEntries("src", 1000000))
+}
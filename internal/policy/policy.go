@@ -0,0 +1,235 @@
+// Package policy decides whether the ref updates of a push should be
+// accepted, using rules from the repository's config or by asking an
+// external policy service.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// The environment variables that configure the policy service. The service
+// is only consulted if URLEnv is set.
+const (
+	URLEnv        = "SPOKES_POLICY_URL"
+	TimeoutEnv    = "SPOKES_POLICY_TIMEOUT"
+	FailClosedEnv = "SPOKES_POLICY_FAIL_CLOSED"
+)
+
+// DefaultTimeout is how long to wait for the policy service unless
+// TimeoutEnv says otherwise.
+const DefaultTimeout = 5 * time.Second
+
+// The possible decisions of the policy service.
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// UnavailableMessage is the reason given for rejecting ref updates when the
+// policy service can't be reached and we fail closed.
+const UnavailableMessage = "push policy check unavailable"
+
+// defaultDenyMessage is the reason given for a rejection that doesn't come
+// with one.
+const defaultDenyMessage = "denied by push policy"
+
+// Command is a ref update that the client asked for.
+type Command struct {
+	Refname string `json:"refname"`
+	OldOID  string `json:"old_oid"`
+	NewOID  string `json:"new_oid"`
+}
+
+// Request is what is sent to the policy service.
+type Request struct {
+	RepoName  string    `json:"repo_name,omitempty"`
+	RepoID    uint32    `json:"repo_id,omitempty"`
+	NetworkID uint32    `json:"network_id,omitempty"`
+	UserID    uint32    `json:"user_id,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Commands  []Command `json:"commands"`
+}
+
+// Verdict is a decision of the policy service, with the reason to give the
+// client if it is Deny, or a warning to give it if it is Allow, like that
+// the branch is behind the default branch.
+type Verdict struct {
+	Decision string `json:"decision"`
+	Message  string `json:"message,omitempty"`
+	Warning  string `json:"warning,omitempty"`
+}
+
+// Response is what the policy service answers. The verdict in Refs for a
+// refname, if any, takes precedence over the overall one.
+type Response struct {
+	Verdict
+	Refs map[string]Verdict `json:"refs,omitempty"`
+}
+
+// Client talks to the policy service.
+//
+// It is safe to call Check with a nil *Client, which accepts everything.
+type Client struct {
+	url        string
+	timeout    time.Duration
+	failClosed bool
+	http       *http.Client
+}
+
+// New returns a client for the policy service at `url`. If the service
+// can't be reached or doesn't answer within `timeout`, the ref updates are
+// rejected if `failClosed` is set, and otherwise accepted.
+func New(url string, timeout time.Duration, failClosed bool) *Client {
+	return &Client{
+		url:        url,
+		timeout:    timeout,
+		failClosed: failClosed,
+		http:       &http.Client{},
+	}
+}
+
+// FromEnv returns a client configured by the environment variables above,
+// or nil if there is no policy service. If TimeoutEnv is invalid, it returns
+// a client using DefaultTimeout along with the error.
+func FromEnv() (*Client, error) {
+	url := os.Getenv(URLEnv)
+	if url == "" {
+		return nil, nil
+	}
+
+	var err error
+	timeout := DefaultTimeout
+	if v := os.Getenv(TimeoutEnv); v != "" {
+		var d time.Duration
+		if d, err = time.ParseDuration(v); err != nil {
+			err = fmt.Errorf("invalid %s: %w", TimeoutEnv, err)
+		} else {
+			timeout = d
+		}
+	}
+
+	return New(url, timeout, os.Getenv(FailClosedEnv) == "1"), err
+}
+
+// Check asks the policy service about `req.Commands`. It returns the
+// reasons for rejecting the ref updates that may not go ahead, and the
+// warnings about the ones that may, by refname.
+//
+// If the service can't be asked, Check returns the error, along with
+// rejections of all of the ref updates if the client fails closed.
+func (c *Client) Check(ctx context.Context, req Request) (map[string]string, map[string][]string, error) {
+	if c == nil || len(req.Commands) == 0 {
+		return nil, nil, nil
+	}
+
+	resp, err := c.ask(ctx, req)
+	if err != nil {
+		if !c.failClosed {
+			return nil, nil, err
+		}
+		rejections := make(map[string]string, len(req.Commands))
+		for _, cmd := range req.Commands {
+			rejections[cmd.Refname] = UnavailableMessage
+		}
+		return rejections, nil, err
+	}
+
+	return resp.rejections(req.Commands), resp.warnings(req.Commands), nil
+}
+
+// rejections returns the reasons for rejecting the ones of `commands` that
+// `resp` denies, by refname.
+func (resp *Response) rejections(commands []Command) map[string]string {
+	rejections := make(map[string]string)
+	for _, cmd := range commands {
+		v := resp.Verdict
+		if refVerdict, ok := resp.Refs[cmd.Refname]; ok {
+			v = refVerdict
+		}
+		if v.Decision == Deny {
+			msg := v.Message
+			if msg == "" {
+				msg = defaultDenyMessage
+			}
+			rejections[cmd.Refname] = msg
+		}
+	}
+	return rejections
+}
+
+// warnings returns the warnings that `resp` gives about the ones of
+// `commands` that it allows, by refname.
+func (resp *Response) warnings(commands []Command) map[string][]string {
+	warnings := make(map[string][]string)
+	for _, cmd := range commands {
+		v := resp.Verdict
+		if refVerdict, ok := resp.Refs[cmd.Refname]; ok {
+			v = refVerdict
+		}
+		if v.Decision == Allow && v.Warning != "" {
+			warnings[cmd.Refname] = append(warnings[cmd.Refname], v.Warning)
+		}
+	}
+	return warnings
+}
+
+// validate checks that `resp` only contains decisions that we know.
+func (resp *Response) validate() error {
+	if !isValidDecision(resp.Decision) {
+		return fmt.Errorf("unknown policy decision %q", resp.Decision)
+	}
+	for refname, v := range resp.Refs {
+		if !isValidDecision(v.Decision) {
+			return fmt.Errorf("unknown policy decision %q for %s", v.Decision, refname)
+		}
+	}
+	return nil
+}
+
+func (c *Client) ask(ctx context.Context, req Request) (*Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("encoding policy request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating policy request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := c.http.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("asking policy service: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, httpResp.Body)
+		return nil, fmt.Errorf("policy service answered %s", httpResp.Status)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("decoding policy response: %w", err)
+	}
+
+	if err := resp.validate(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func isValidDecision(decision string) bool {
+	return decision == Allow || decision == Deny
+}
@@ -0,0 +1,121 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	var got Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		_, _ = w.Write([]byte(`{
+			"decision": "allow",
+			"refs": {
+				"refs/heads/main": {"decision": "deny", "message": "main is protected"},
+				"refs/heads/release": {"decision": "deny"},
+				"refs/heads/topic": {"decision": "allow", "warning": "topic is behind main"}
+			}
+		}`))
+	}))
+	defer srv.Close()
+
+	req := Request{
+		RepoName: "github/example",
+		UserID:   42,
+		Commands: []Command{
+			{Refname: "refs/heads/main", OldOID: "a", NewOID: "b"},
+			{Refname: "refs/heads/release", OldOID: "c", NewOID: "d"},
+			{Refname: "refs/heads/topic", OldOID: "e", NewOID: "f"},
+		},
+	}
+
+	rejections, warnings, err := New(srv.URL, time.Second, false).Check(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, req, got)
+	assert.Equal(t, map[string]string{
+		"refs/heads/main":    "main is protected",
+		"refs/heads/release": defaultDenyMessage,
+	}, rejections)
+	assert.Equal(t, map[string][]string{"refs/heads/topic": {"topic is behind main"}}, warnings)
+
+	var nilClient *Client
+	rejections, _, err = nilClient.Check(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Empty(t, rejections)
+}
+
+func TestCheckDenyAll(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"decision": "deny", "message": "repository is locked", "refs": {"refs/heads/ok": {"decision": "allow"}}}`))
+	}))
+	defer srv.Close()
+
+	rejections, _, err := New(srv.URL, time.Second, false).Check(context.Background(), Request{
+		Commands: []Command{{Refname: "refs/heads/main"}, {Refname: "refs/heads/ok"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"refs/heads/main": "repository is locked"}, rejections)
+}
+
+func TestCheckUnavailable(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	bogus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"decision": "maybe"}`))
+	}))
+	defer bogus.Close()
+
+	req := Request{Commands: []Command{{Refname: "refs/heads/main"}}}
+
+	for _, url := range []string{slow.URL, broken.URL, bogus.URL} {
+		rejections, _, err := New(url, 50*time.Millisecond, false).Check(context.Background(), req)
+		assert.Error(t, err)
+		assert.Empty(t, rejections)
+
+		rejections, _, err = New(url, 50*time.Millisecond, true).Check(context.Background(), req)
+		assert.Error(t, err)
+		assert.Equal(t, map[string]string{"refs/heads/main": UnavailableMessage}, rejections)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv(URLEnv, "")
+	c, err := FromEnv()
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+
+	t.Setenv(URLEnv, "http://localhost:1234/check")
+	t.Setenv(TimeoutEnv, "2s")
+	t.Setenv(FailClosedEnv, "1")
+	c, err = FromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:1234/check", c.url)
+	assert.Equal(t, 2*time.Second, c.timeout)
+	assert.True(t, c.failClosed)
+
+	t.Setenv(TimeoutEnv, "soon")
+	c, err = FromEnv()
+	assert.Error(t, err)
+	require.NotNil(t, c)
+	assert.Equal(t, DefaultTimeout, c.timeout)
+}
@@ -0,0 +1,250 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+)
+
+// rulePrefix is the config section that rules are defined in, like
+//
+//	[pushrule "protect-main"]
+//		ref = refs/heads/main
+//		on = force
+//		on = delete
+//		action = deny
+//		message = main can't be rewritten
+const rulePrefix = "pushrule."
+
+// The kinds of ref update that a rule can be restricted to.
+const (
+	OnCreate = "create"
+	OnUpdate = "update"
+	OnDelete = "delete"
+	OnForce  = "force"
+)
+
+// Rule decides about the ref updates that it matches. A rule matches an
+// update if every one of its conditions that is set holds.
+type Rule struct {
+	Name string
+
+	// Refs are the refnames that the rule applies to. A pattern ending
+	// in "/" matches every ref under it; otherwise, patterns are matched
+	// with path.Match, so "*" doesn't match "/".
+	Refs []string
+
+	// Users are the IDs of the pushers that the rule applies to, and
+	// ExceptUsers the ones that it doesn't.
+	Users       []uint32
+	ExceptUsers []uint32
+
+	// On are the kinds of update that the rule applies to.
+	On []string
+
+	// MaxCommits, if positive, makes the rule only apply to updates that
+	// add more than that many commits.
+	MaxCommits int
+
+	// Action is Allow or Deny, and Message the reason given for Deny.
+	Action  string
+	Message string
+}
+
+// Update is a ref update to evaluate rules against. The facts that are
+// expensive to find out are only asked for if a rule needs them.
+type Update struct {
+	Refname string
+	UserID  uint32
+	Create  bool
+	Delete  bool
+
+	// Force reports whether the update isn't a fast-forward.
+	Force func() bool
+
+	// Commits returns how many commits the update adds.
+	Commits func() (int, error)
+}
+
+// ParseRules returns the rules defined in `cfg`, in the order in which they
+// first appear.
+func ParseRules(cfg *config.Config) ([]Rule, error) {
+	var rules []*Rule
+	byName := make(map[string]*Rule)
+
+	for _, entry := range cfg.Entries {
+		rest, ok := strings.CutPrefix(entry.Key, rulePrefix)
+		if !ok {
+			continue
+		}
+		dot := strings.LastIndexByte(rest, '.')
+		if dot <= 0 {
+			return nil, fmt.Errorf("push rule setting %q has no rule name", entry.Key)
+		}
+		name, key := rest[:dot], rest[dot+1:]
+
+		rule := byName[name]
+		if rule == nil {
+			rule = &Rule{Name: name}
+			byName[name] = rule
+			rules = append(rules, rule)
+		}
+		if err := rule.set(key, entry.Value); err != nil {
+			return nil, fmt.Errorf("push rule %q: %w", name, err)
+		}
+	}
+
+	res := make([]Rule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Action == "" {
+			return nil, fmt.Errorf("push rule %q has no action", rule.Name)
+		}
+		res = append(res, *rule)
+	}
+	return res, nil
+}
+
+func (rule *Rule) set(key, value string) error {
+	switch key {
+	case "ref":
+		if _, err := path.Match(value, ""); err != nil {
+			return fmt.Errorf("invalid ref pattern %q: %w", value, err)
+		}
+		rule.Refs = append(rule.Refs, value)
+	case "user", "exceptuser":
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid user ID %q", value)
+		}
+		if key == "user" {
+			rule.Users = append(rule.Users, uint32(id))
+		} else {
+			rule.ExceptUsers = append(rule.ExceptUsers, uint32(id))
+		}
+	case "on":
+		switch value {
+		case OnCreate, OnUpdate, OnDelete, OnForce:
+		default:
+			return fmt.Errorf("unknown kind of update %q", value)
+		}
+		rule.On = append(rule.On, value)
+	case "maxcommits":
+		n, err := config.ParseSigned(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid maxCommits %q", value)
+		}
+		rule.MaxCommits = n
+	case "action":
+		if value != Allow && value != Deny {
+			return fmt.Errorf("unknown action %q", value)
+		}
+		rule.Action = value
+	case "message":
+		rule.Message = value
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	return nil
+}
+
+// Evaluate applies the first of `rules` that matches `u`. It returns the
+// reason for rejecting `u`, or "" if it is allowed, which it is if no rule
+// matches.
+func Evaluate(rules []Rule, u Update) (string, error) {
+	for _, rule := range rules {
+		ok, err := rule.matches(u)
+		if err != nil {
+			return "", fmt.Errorf("evaluating push rule %q: %w", rule.Name, err)
+		}
+		if !ok {
+			continue
+		}
+		if rule.Action == Allow {
+			return "", nil
+		}
+		if rule.Message != "" {
+			return rule.Message, nil
+		}
+		return defaultDenyMessage, nil
+	}
+	return "", nil
+}
+
+func (rule *Rule) matches(u Update) (bool, error) {
+	if len(rule.Refs) > 0 && !matchesAnyRef(rule.Refs, u.Refname) {
+		return false, nil
+	}
+	if len(rule.Users) > 0 && !containsUser(rule.Users, u.UserID) {
+		return false, nil
+	}
+	if containsUser(rule.ExceptUsers, u.UserID) {
+		return false, nil
+	}
+	if len(rule.On) > 0 && !rule.matchesKind(u) {
+		return false, nil
+	}
+	if rule.MaxCommits > 0 {
+		if u.Delete {
+			return false, nil
+		}
+		n, err := u.Commits()
+		if err != nil {
+			return false, err
+		}
+		if n <= rule.MaxCommits {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (rule *Rule) matchesKind(u Update) bool {
+	for _, on := range rule.On {
+		switch on {
+		case OnCreate:
+			if u.Create {
+				return true
+			}
+		case OnDelete:
+			if u.Delete {
+				return true
+			}
+		case OnUpdate:
+			if !u.Create && !u.Delete {
+				return true
+			}
+		case OnForce:
+			if !u.Create && !u.Delete && u.Force() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchesAnyRef(patterns []string, refname string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "/") {
+			if strings.HasPrefix(refname, p) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(p, refname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUser(ids []uint32, id uint32) bool {
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
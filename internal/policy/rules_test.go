@@ -0,0 +1,102 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func configOf(kvs ...string) *config.Config {
+	cfg := &config.Config{}
+	for i := 0; i < len(kvs); i += 2 {
+		cfg.Entries = append(cfg.Entries, config.ConfigEntry{Key: kvs[i], Value: kvs[i+1]})
+	}
+	return cfg
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(configOf(
+		"core.bare", "true",
+		"pushrule.bots.user", "42",
+		"pushrule.bots.action", "allow",
+		"pushrule.protect.main.ref", "refs/heads/main",
+		"pushrule.protect.main.on", "force",
+		"pushrule.protect.main.on", "delete",
+		"pushrule.protect.main.exceptuser", "7",
+		"pushrule.protect.main.action", "deny",
+		"pushrule.protect.main.message", "main can't be rewritten",
+		"pushrule.big.maxcommits", "1k",
+		"pushrule.big.action", "deny",
+	))
+	require.NoError(t, err)
+	assert.Equal(t, []Rule{
+		{Name: "bots", Users: []uint32{42}, Action: Allow},
+		{
+			Name:        "protect.main",
+			Refs:        []string{"refs/heads/main"},
+			On:          []string{OnForce, OnDelete},
+			ExceptUsers: []uint32{7},
+			Action:      Deny,
+			Message:     "main can't be rewritten",
+		},
+		{Name: "big", MaxCommits: 1024, Action: Deny},
+	}, rules)
+
+	for _, cfg := range []*config.Config{
+		configOf("pushrule.a.ref", "refs/heads/*"),
+		configOf("pushrule.a.action", "maybe"),
+		configOf("pushrule.a.on", "rename", "pushrule.a.action", "deny"),
+		configOf("pushrule.a.user", "me", "pushrule.a.action", "deny"),
+		configOf("pushrule.a.ref", "refs/heads/[", "pushrule.a.action", "deny"),
+		configOf("pushrule.a.color", "red", "pushrule.a.action", "deny"),
+		configOf("pushrule.action", "deny"),
+	} {
+		_, err := ParseRules(cfg)
+		assert.Error(t, err, "%v", cfg.Entries)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	rules := []Rule{
+		{Name: "bots", Users: []uint32{42}, Action: Allow},
+		{Name: "protect", Refs: []string{"refs/heads/main", "refs/heads/release/"}, On: []string{OnForce, OnDelete}, Action: Deny, Message: "protected"},
+		{Name: "tags", Refs: []string{"refs/tags/*"}, On: []string{OnUpdate}, Action: Deny, Message: "tags can't move"},
+		{Name: "big", MaxCommits: 10, Action: Deny},
+	}
+
+	force := func() bool { return true }
+	noForce := func() bool { return false }
+	commits := func(n int) func() (int, error) {
+		return func() (int, error) { return n, nil }
+	}
+
+	for _, tc := range []struct {
+		name     string
+		update   Update
+		expected string
+	}{
+		{"fast-forward", Update{Refname: "refs/heads/main", Force: noForce, Commits: commits(1)}, ""},
+		{"force push", Update{Refname: "refs/heads/main", Force: force, Commits: commits(1)}, "protected"},
+		{"delete", Update{Refname: "refs/heads/release/1.0", Delete: true}, "protected"},
+		{"other branch", Update{Refname: "refs/heads/topic", Force: force, Commits: commits(1)}, ""},
+		{"bot", Update{Refname: "refs/heads/main", UserID: 42, Force: force, Commits: commits(100)}, ""},
+		{"tag creation", Update{Refname: "refs/tags/v1", Create: true, Commits: commits(1)}, ""},
+		{"tag update", Update{Refname: "refs/tags/v1", Force: noForce, Commits: commits(1)}, "tags can't move"},
+		{"nested tag", Update{Refname: "refs/tags/a/b", Force: noForce, Commits: commits(1)}, ""},
+		{"too many commits", Update{Refname: "refs/heads/topic", Create: true, Commits: commits(11)}, defaultDenyMessage},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := Evaluate(rules, tc.update)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, msg)
+		})
+	}
+
+	_, err := Evaluate(rules, Update{Refname: "refs/heads/topic", Create: true, Commits: func() (int, error) {
+		return 0, errors.New("rev-list failed")
+	}})
+	assert.Error(t, err)
+}
@@ -2,9 +2,18 @@ package receivepack
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/github/spokes-receive-pack/internal/childenv"
+	"github.com/github/spokes-receive-pack/internal/governor"
+	"github.com/github/spokes-receive-pack/internal/pipe"
+	"github.com/github/spokes-receive-pack/internal/sockstat"
 )
 
 // ReceivePack is used to model a receive-pack executor
@@ -13,28 +22,108 @@ type ReceivePack struct {
 	stdout io.Writer
 	stderr io.Writer
 	args   []string
+	vars   sockstat.Vars
 }
 
-// NewReceivePack returns a pointer to a ReceivePack executor
-func NewReceivePack(stdin io.Reader, stdout, stderr io.Writer, args []string) *ReceivePack {
+// NewReceivePack returns a pointer to a ReceivePack executor. `vars` are
+// the sockstat vars of the push, which are reported to governor. They are
+// passed in because the environment might not have them anymore, like
+// when they came from a descriptor that has already been read.
+func NewReceivePack(stdin io.Reader, stdout, stderr io.Writer, args []string, vars sockstat.Vars) *ReceivePack {
 	return &ReceivePack{
 		stdin:  stdin,
 		stdout: stdout,
 		stderr: stderr,
 		args:   args,
+		vars:   vars,
 	}
 }
 
 // Execute executes the git-receive-pack program spawning the actual Git process
+//
+// The push is reported to governor just like the ones that spokes-receive-pack
+// handles, so that it is scheduled and accounted for, too.
 func (r *ReceivePack) Execute(ctx context.Context) error {
+	gitDir := r.gitDir()
+
+	g, err := governor.StartProgram(ctx, "git-receive-pack", gitDir, r.vars)
+	if err != nil {
+		return err
+	}
+	defer g.Finish(ctx)
+
+	packDir := filepath.Join(gitDir, "objects", "pack")
+	existingPacks := listPacks(packDir)
+
 	cmd := exec.CommandContext(ctx, "git-receive-pack", r.args...)
+	pipe.TerminateGracefully(cmd)
+	// git-receive-pack, and the hooks that it runs, only get git's
+	// environment, not ours.
+	cmd.Env = childenv.Environ(os.Environ())
+	if gitDir != "" {
+		// Not a GIT_DIR that we inherited, which might be relative.
+		cmd.Env = append(cmd.Env, "GIT_DIR="+gitDir)
+	}
 	cmd.Stdin = r.stdin
 	cmd.Stdout = r.stdout
 	cmd.Stderr = r.stderr
 
 	if err := cmd.Run(); err != nil {
+		exitCode := 1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+			exitCode = exitErr.ExitCode()
+		}
+		g.SetError(uint8(exitCode), err.Error())
 		return fmt.Errorf("unexpected error executing the git-receive-pack Git command: %w", err)
 	}
 
+	g.SetReceivePackSize(newPacksSize(packDir, existingPacks))
+
 	return nil
 }
+
+// gitDir returns the absolute path of the repository that git-receive-pack
+// will operate on, which is its last non-option argument.
+func (r *ReceivePack) gitDir() string {
+	for i := len(r.args) - 1; i >= 0; i-- {
+		if strings.HasPrefix(r.args[i], "-") {
+			continue
+		}
+		if abs, err := filepath.Abs(r.args[i]); err == nil {
+			return abs
+		}
+		return r.args[i]
+	}
+	return ""
+}
+
+// listPacks returns the set of packfiles in `packDir`.
+func listPacks(packDir string) map[string]bool {
+	packs := make(map[string]bool)
+	entries, err := os.ReadDir(packDir)
+	if err != nil {
+		return packs
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".pack") {
+			packs[e.Name()] = true
+		}
+	}
+	return packs
+}
+
+// newPacksSize returns the total size of the packfiles in `packDir` that
+// aren't in `existingPacks`, i.e. the ones that git-receive-pack wrote.
+func newPacksSize(packDir string, existingPacks map[string]bool) int64 {
+	var size int64
+	for name := range listPacks(packDir) {
+		if existingPacks[name] {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(packDir, name)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
@@ -0,0 +1,80 @@
+package receivepack
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/spokes-receive-pack/internal/sockstat"
+)
+
+func TestGitDir(t *testing.T) {
+	assert.Equal(t, "/srv/repo.git", NewReceivePack(nil, nil, nil, []string{"--stateless-rpc", "/srv/repo.git"}, sockstat.Vars{}).gitDir())
+	assert.Equal(t, "", NewReceivePack(nil, nil, nil, []string{"--advertise-refs"}, sockstat.Vars{}).gitDir())
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(wd, "repo.git"), NewReceivePack(nil, nil, nil, []string{"repo.git"}, sockstat.Vars{}).gitDir())
+}
+
+func TestNewPacksSize(t *testing.T) {
+	packDir := t.TempDir()
+	write := func(name string, size int) {
+		require.NoError(t, os.WriteFile(filepath.Join(packDir, name), make([]byte, size), 0666))
+	}
+
+	write("pack-old.pack", 100)
+	write("pack-old.idx", 10)
+	existing := listPacks(packDir)
+	assert.Equal(t, map[string]bool{"pack-old.pack": true}, existing)
+
+	write("pack-new.pack", 42)
+	write("pack-new.idx", 7)
+	assert.Equal(t, int64(42), newPacksSize(packDir, existing))
+
+	assert.Equal(t, int64(0), newPacksSize(filepath.Join(packDir, "missing"), nil))
+}
+
+func TestExecuteReportsVars(t *testing.T) {
+	dir := t.TempDir()
+	repo := filepath.Join(dir, "repo.git")
+	require.NoError(t, exec.Command("git", "init", "--quiet", "--bare", repo).Run())
+
+	sockPath := filepath.Join(dir, "governor.sock")
+	l, err := net.Listen("unix", sockPath)
+	require.NoError(t, err)
+	defer l.Close()
+	updates := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		updates <- line
+	}()
+	t.Setenv("GIT_SOCKSTAT_PATH", sockPath)
+
+	// The vars that we're given count, not the ones in the environment.
+	t.Setenv("GIT_SOCKSTAT_VAR_repo_name", "from/environment")
+	vars := sockstat.Vars{RepoName: "from/caller"}
+
+	var stdout bytes.Buffer
+	rp := NewReceivePack(bytes.NewReader(nil), &stdout, io.Discard, []string{"--advertise-refs", repo}, vars)
+	require.NoError(t, rp.Execute(context.Background()))
+	assert.NotEmpty(t, stdout.String())
+
+	update := <-updates
+	assert.Contains(t, update, `"repo_name":"from/caller"`)
+	assert.NotContains(t, update, "from/environment")
+}
@@ -0,0 +1,106 @@
+package sockstat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VarsFileEnv is the name of an environment variable that can point at a
+// JSON document containing sockstat vars, as an alternative to passing each
+// one as a separate GIT_SOCKSTAT_VAR_* environment variable. Its value is
+// either a path or "fd:N" for an inherited file descriptor.
+//
+// The document is a JSON object whose keys are sockstat var names (without
+// the prefix). Values may be strings in the usual encoding (e.g. "uint:1"),
+// non-negative integers, or booleans.
+const VarsFileEnv = "GIT_SOCKSTAT_VARS_FILE"
+
+// ExpandEnviron returns `environ` with the sockstat vars from the file named
+// by VarsFileEnv (if any) added, in the GIT_SOCKSTAT_VAR_name=value form.
+// The vars from the file come first, so that an individual environment
+// variable overrides the same var in the file.
+func ExpandEnviron(environ []string) ([]string, error) {
+	var path string
+	for _, env := range environ {
+		if v, ok := strings.CutPrefix(env, VarsFileEnv+"="); ok {
+			path = v
+		}
+	}
+	if path == "" {
+		return environ, nil
+	}
+
+	fileVars, err := readVarsFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(fileVars, environ...), nil
+}
+
+func readVarsFile(path string) ([]string, error) {
+	var f *os.File
+	if fdStr, ok := strings.CutPrefix(path, "fd:"); ok {
+		fd, err := strconv.ParseUint(fdStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sockstat vars file descriptor %q: %w", fdStr, err)
+		}
+		f = os.NewFile(uintptr(fd), "sockstat-vars")
+		if f == nil {
+			return nil, fmt.Errorf("invalid sockstat vars file descriptor %d", fd)
+		}
+	} else {
+		var err error
+		f, err = os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("opening sockstat vars file: %w", err)
+		}
+	}
+	defer f.Close()
+
+	return decodeVars(f)
+}
+
+// decodeVars reads a JSON object of sockstat vars from `r` and converts it
+// into GIT_SOCKSTAT_VAR_name=value strings, sorted by name.
+func decodeVars(r io.Reader) ([]string, error) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parsing sockstat vars file: %w", err)
+	}
+
+	names := make([]string, 0, len(doc))
+	for name := range doc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := make([]string, 0, len(doc))
+	for _, name := range names {
+		var value string
+		switch v := doc[name].(type) {
+		case string:
+			value = v
+		case bool:
+			value = fmt.Sprintf("bool:%t", v)
+		case json.Number:
+			n, err := strconv.ParseUint(v.String(), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("sockstat var %q: expected a non-negative integer, got %s", name, v)
+			}
+			value = fmt.Sprintf("uint:%d", n)
+		default:
+			return nil, fmt.Errorf("sockstat var %q: unsupported value %v", name, v)
+		}
+		res = append(res, Prefix+name+"="+value)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,59 @@
+package sockstat
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeVars(t *testing.T) {
+	vars, err := decodeVars(strings.NewReader(`{
+		"repo_name": "a/b",
+		"repo_id": 1,
+		"user_id": "uint:3",
+		"is_importing": true
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"GIT_SOCKSTAT_VAR_is_importing=bool:true",
+		"GIT_SOCKSTAT_VAR_repo_id=uint:1",
+		"GIT_SOCKSTAT_VAR_repo_name=a/b",
+		"GIT_SOCKSTAT_VAR_user_id=uint:3",
+	}, vars)
+
+	_, err = decodeVars(strings.NewReader(`{"repo_id": -1}`))
+	assert.Error(t, err)
+
+	_, err = decodeVars(strings.NewReader(`{"repo_id": [1]}`))
+	assert.Error(t, err)
+
+	_, err = decodeVars(strings.NewReader(`not json`))
+	assert.Error(t, err)
+}
+
+func TestExpandEnviron(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vars.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"repo_name": "from/file", "repo_id": 1}`), 0644))
+
+	environ, err := ExpandEnviron([]string{
+		"GIT_SOCKSTAT_VARS_FILE=" + path,
+		"GIT_SOCKSTAT_VAR_repo_name=from/env",
+	})
+	require.NoError(t, err)
+
+	vars := Parse(environ)
+	assert.Equal(t, "from/env", vars.RepoName)
+	assert.Equal(t, uint32(1), vars.RepoID)
+
+	environ = []string{"PATH=/usr/bin"}
+	expanded, err := ExpandEnviron(environ)
+	require.NoError(t, err)
+	assert.Equal(t, environ, expanded)
+
+	_, err = ExpandEnviron([]string{"GIT_SOCKSTAT_VARS_FILE=" + filepath.Join(t.TempDir(), "missing.json")})
+	assert.Error(t, err)
+}
@@ -1,9 +1,11 @@
 package sockstat
 
 import (
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Prefix is the prefix that all sockstat environment variable names must have.
@@ -30,13 +32,27 @@ func GetBool(name string) bool {
 	return BoolValue(os.Getenv(Prefix + name))
 }
 
+// GetInt64 looks up the given sockstat var name in the environment and
+// interprets it as an int64. If the var isn't present or isn't an int64, 0 is
+// returned.
+func GetInt64(name string) int64 {
+	return Int64Value(os.Getenv(Prefix + name))
+}
+
+// GetDuration looks up the given sockstat var name in the environment and
+// interprets it as a time.Duration. If the var isn't present or isn't a
+// duration, 0 is returned.
+func GetDuration(name string) time.Duration {
+	return DurationValue(os.Getenv(Prefix + name))
+}
+
 // StringValue returns the string version of the given sockstat var. For the
 // most part, this means just returning the given string. However, if the input
-// has a uint or bool prefix, strip that off so that it looks like we parsed
-// the value and then stringified it.
+// has a uint, int, bool, or duration prefix, strip that off so that it looks
+// like we parsed the value and then stringified it.
 func StringValue(s string) string {
 	parts := strings.SplitN(s, ":", 2)
-	if len(parts) == 2 && (parts[0] == "uint" || parts[0] == "bool") {
+	if len(parts) == 2 && (parts[0] == "uint" || parts[0] == "int" || parts[0] == "bool" || parts[0] == "duration") {
 		return parts[1]
 	}
 	return s
@@ -45,18 +61,82 @@ func StringValue(s string) string {
 // Uint32Value parses a string like "uint32:123" and returns the parsed uint32
 // like 123. If the prefix is missing or the value isn't a uint32, return 0.
 func Uint32Value(s string) uint32 {
-	s, ok := strings.CutPrefix(s, "uint:")
+	val, _ := parseUint32(s)
+	return val
+}
+
+func parseUint32(s string) (uint32, error) {
+	v, ok := strings.CutPrefix(s, "uint:")
 	if !ok {
-		return 0
+		return 0, fmt.Errorf("expected a uint value, got %q", s)
 	}
-	val, err := strconv.ParseUint(s, 10, 32)
+	val, err := strconv.ParseUint(v, 10, 32)
 	if err != nil {
-		return 0
+		return 0, fmt.Errorf("expected a uint value, got %q", s)
 	}
-	return uint32(val)
+	return uint32(val), nil
 }
 
 // BoolValue interprets "bool:true" as true and anything else as false.
 func BoolValue(s string) bool {
-	return s == "bool:true"
+	val, _ := parseBool(s)
+	return val
+}
+
+func parseBool(s string) (bool, error) {
+	switch s {
+	case "bool:true":
+		return true, nil
+	case "bool:false":
+		return false, nil
+	default:
+		return false, fmt.Errorf("expected a bool value, got %q", s)
+	}
+}
+
+// Int64Value parses a string like "int:-123" or "uint:123" and returns the
+// parsed int64 like -123 or 123. If the prefix is missing or the value isn't an
+// int64, return 0.
+func Int64Value(s string) int64 {
+	val, _ := parseInt64(s)
+	return val
+}
+
+func parseInt64(s string) (int64, error) {
+	prefix, v, ok := strings.Cut(s, ":")
+	if !ok || (prefix != "int" && prefix != "uint") {
+		return 0, fmt.Errorf("expected an int value, got %q", s)
+	}
+	val, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || (prefix == "uint" && val < 0) {
+		return 0, fmt.Errorf("expected an int value, got %q", s)
+	}
+	return val, nil
+}
+
+// DurationValue parses a string like "duration:30s" (in the format accepted by
+// time.ParseDuration) or "uint:30000" (a number of milliseconds) and returns
+// the parsed duration. If the prefix is missing or the value isn't a valid
+// duration, return 0.
+func DurationValue(s string) time.Duration {
+	val, _ := parseDuration(s)
+	return val
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if v, ok := strings.CutPrefix(s, "duration:"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("expected a duration value, got %q", s)
+		}
+		return d, nil
+	}
+	if strings.HasPrefix(s, "uint:") {
+		ms, err := parseInt64(s)
+		if err != nil {
+			return 0, fmt.Errorf("expected a duration value, got %q", s)
+		}
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return 0, fmt.Errorf("expected a duration value, got %q", s)
 }
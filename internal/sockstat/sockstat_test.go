@@ -1,6 +1,9 @@
 package sockstat
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestUint32(t *testing.T) {
 	examples := []struct {
@@ -47,6 +50,8 @@ func TestString(t *testing.T) {
 		{"bool:uint:anything", "uint:anything"},
 		{"uint:bool:anything", "bool:anything"},
 		{"anything:uint:bool", "anything:uint:bool"},
+		{"int:-1", "-1"},
+		{"duration:30s", "30s"},
 	}
 
 	for _, ex := range examples {
@@ -86,3 +91,55 @@ func TestBool(t *testing.T) {
 		}
 	}
 }
+
+func TestInt64(t *testing.T) {
+	examples := []struct {
+		input  string
+		output int64
+	}{
+		{"", 0},
+		{"123", 0},
+		{"abc", 0},
+		{"bool:true", 0},
+		{"int:-1", -1},
+		{"int:1", 1},
+		{"uint:-1", 0},
+		{"uint:1", 1},
+		{"int:9223372036854775807", 9223372036854775807},
+		{"int:9223372036854775808", 0},
+		{"int:abc", 0},
+		{"int: 1", 0},
+	}
+
+	for _, ex := range examples {
+		actual := Int64Value(ex.input)
+		if actual != ex.output {
+			t.Errorf("Int64Value(%q): expected %d, but was %d", ex.input, ex.output, actual)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	examples := []struct {
+		input  string
+		output time.Duration
+	}{
+		{"", 0},
+		{"30s", 0},
+		{"bool:true", 0},
+		{"duration:30s", 30 * time.Second},
+		{"duration:1m30s", 90 * time.Second},
+		{"duration:250ms", 250 * time.Millisecond},
+		{"duration:abc", 0},
+		{"uint:1500", 1500 * time.Millisecond},
+		{"uint:-1", 0},
+		{"int:1500", 0},
+	}
+
+	for _, ex := range examples {
+		actual := DurationValue(ex.input)
+		if actual != ex.output {
+			t.Errorf("DurationValue(%q): expected %v, but was %v", ex.input, ex.output, actual)
+		}
+	}
+}
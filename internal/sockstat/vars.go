@@ -0,0 +1,232 @@
+package sockstat
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Vars is a typed snapshot of all of the sockstat vars that
+// spokes-receive-pack knows about.
+type Vars struct {
+	RepoName             string
+	RepoID               uint32
+	NetworkID            uint32
+	UserID               uint32
+	RealIP               string
+	RequestID            string
+	UserAgent            string
+	Features             string
+	Via                  string
+	SSHConnection        string
+	Babeld               string
+	GitProtocol          string
+	PubkeyVerifierID     uint32
+	PubkeyCreatorID      uint32
+	MaxDelay             uint32
+	CommandID            string
+	GroupID              string
+	GroupLeader          bool
+	QualityOfService     string
+	IsImporting          bool
+	ImportSkipPushLimit  bool
+	ImportSoftThrottling bool
+	AllowBadDateInImport bool
+
+	// QuarantineID is the name of the directory inside of the
+	// repository's objects directory where new objects are received.
+	QuarantineID string
+
+	// ParentRepoID is the ID of the repository this one was forked
+	// from, if any.
+	ParentRepoID string
+
+	// IsolatedReferenceDiscovery selects the variant of the reference
+	// discovery that runs every for-each-ref in its own pipeline.
+	IsolatedReferenceDiscovery bool
+
+	// KeepaliveInterval is how many seconds may pass without sending
+	// anything to an HTTP client while the push is being checked. 0
+	// means the default.
+	KeepaliveInterval uint32
+
+	// AgentSuffix is added to the agent that we advertise, to say where
+	// the push was handled, like the datacenter or the rollout ring.
+	AgentSuffix string
+
+	// Failpoints is a list of failpoints to enable for this request, in
+	// the same format as GO_FAILPOINTS. It is only honored where
+	// failpoints have been explicitly allowed.
+	Failpoints string
+
+	// PushAllowedRefs and PushDeniedRefs are space-separated ref
+	// prefixes that the pusher may, and may not, update, as decided by
+	// the layer that authorized the push. A prefix matches whole path
+	// components, so "refs/heads/feature" covers itself and
+	// "refs/heads/feature/x" but not "refs/heads/feature-x". An empty
+	// allow list allows every ref.
+	PushAllowedRefs string
+	PushDeniedRefs  string
+
+	// ForEachRefTimeout, RevListTimeout, and DiscoveryMemoryLimit
+	// override the limits of the same names that spokes-receive-pack
+	// reads from its environment, for this request only. They are
+	// given as "duration:30s" or as a number of milliseconds, and as a
+	// number of bytes. 0 means no override.
+	ForEachRefTimeout    time.Duration
+	RevListTimeout       time.Duration
+	DiscoveryMemoryLimit int64
+}
+
+// Snapshot parses all of the sockstat vars in the current environment,
+// including any from the file named by VarsFileEnv. If that file can't be
+// read, only the individual environment variables are used.
+func Snapshot() Vars {
+	environ, err := ExpandEnviron(os.Environ())
+	if err != nil {
+		environ = os.Environ()
+	}
+	return Parse(environ)
+}
+
+// Parse parses all of the sockstat vars in `environ`, which is a list of
+// "KEY=value" strings like the one returned by os.Environ(). Unknown vars are
+// ignored.
+func Parse(environ []string) Vars {
+	var res Vars
+
+	for _, env := range environ {
+		name, value, ok := cutVar(env)
+		if !ok {
+			continue
+		}
+		_ = res.set(name, value)
+	}
+
+	return res
+}
+
+// ParseStrict is like Parse, but also returns an error for every sockstat
+// var in `environ` that is unknown or whose value can't be parsed. The
+// returned Vars are the same as what Parse would return.
+func ParseStrict(environ []string) (Vars, []error) {
+	var res Vars
+	var errs []error
+
+	for _, env := range environ {
+		name, value, ok := cutVar(env)
+		if !ok {
+			if strings.HasPrefix(env, Prefix) {
+				errs = append(errs, fmt.Errorf("malformed sockstat var %q", env))
+			}
+			continue
+		}
+		if err := res.set(name, value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return res, errs
+}
+
+// StrictMode returns the value of SOCKSTAT_STRICT, which controls what
+// callers should do with the errors returned by ParseStrict: "log" means
+// they should be logged, "fail" means they should be logged and the request
+// should be refused, and anything else means they are ignored.
+func StrictMode() string {
+	return os.Getenv("SOCKSTAT_STRICT")
+}
+
+// cutVar splits a "GIT_SOCKSTAT_VAR_name=value" environment entry into its
+// name and value. It returns false if `env` isn't a sockstat var.
+func cutVar(env string) (string, string, bool) {
+	env, ok := strings.CutPrefix(env, Prefix)
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(env, "=")
+}
+
+// set stores the sockstat var `name` in `v`. It returns an error if `name`
+// isn't a var that we know about or if `value` is malformed; in the latter
+// case the field is still set, to its zero value.
+func (v *Vars) set(name, value string) error {
+	var err error
+	switch name {
+	case "repo_name":
+		v.RepoName = StringValue(value)
+	case "repo_id":
+		v.RepoID, err = parseUint32(value)
+	case "network_id":
+		v.NetworkID, err = parseUint32(value)
+	case "user_id":
+		v.UserID, err = parseUint32(value)
+	case "real_ip":
+		v.RealIP = StringValue(value)
+	case "request_id":
+		v.RequestID = StringValue(value)
+	case "user_agent":
+		v.UserAgent = StringValue(value)
+	case "features":
+		v.Features = StringValue(value)
+	case "via":
+		v.Via = StringValue(value)
+	case "ssh_connection":
+		v.SSHConnection = StringValue(value)
+	case "babeld":
+		v.Babeld = StringValue(value)
+	case "git_protocol":
+		v.GitProtocol = StringValue(value)
+	case "pubkey_verifier_id":
+		v.PubkeyVerifierID, err = parseUint32(value)
+	case "pubkey_creator_id":
+		v.PubkeyCreatorID, err = parseUint32(value)
+	case "max_delay":
+		v.MaxDelay, err = parseUint32(value)
+	case "command_id":
+		v.CommandID = StringValue(value)
+	case "group_id":
+		v.GroupID = StringValue(value)
+	case "group_leader":
+		v.GroupLeader, err = parseBool(value)
+	case "qos":
+		v.QualityOfService = StringValue(value)
+	case "is_importing":
+		v.IsImporting, err = parseBool(value)
+	case "import_skip_push_limit":
+		v.ImportSkipPushLimit, err = parseBool(value)
+	case "import_soft_throttling":
+		v.ImportSoftThrottling, err = parseBool(value)
+	case "allow_baddate_in_import":
+		v.AllowBadDateInImport, err = parseBool(value)
+	case "quarantine_id":
+		v.QuarantineID = StringValue(value)
+	case "parent_repo_id":
+		v.ParentRepoID = StringValue(value)
+	case "spokes_receive_pack_isolated_reference_discovery":
+		v.IsolatedReferenceDiscovery, err = parseBool(value)
+	case "keepalive_interval":
+		v.KeepaliveInterval, err = parseUint32(value)
+	case "agent_suffix":
+		v.AgentSuffix = StringValue(value)
+	case "failpoints":
+		v.Failpoints = StringValue(value)
+	case "push_allowed_refs":
+		v.PushAllowedRefs = StringValue(value)
+	case "push_denied_refs":
+		v.PushDeniedRefs = StringValue(value)
+	case "for_each_ref_timeout":
+		v.ForEachRefTimeout, err = parseDuration(value)
+	case "rev_list_timeout":
+		v.RevListTimeout, err = parseDuration(value)
+	case "discovery_memory_limit":
+		v.DiscoveryMemoryLimit, err = parseInt64(value)
+	default:
+		return fmt.Errorf("unknown sockstat var %s%s", Prefix, name)
+	}
+	if err != nil {
+		return fmt.Errorf("malformed sockstat var %s%s: %w", Prefix, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package sockstat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	vars := Parse([]string{
+		"PATH=/usr/bin",
+		"HTTP_X_SOCKSTAT_repo_name=ignored",
+		"GIT_SOCKSTAT_VAR_ignored=ignored",
+		"GIT_SOCKSTAT_VAR_repo_name=a/b",
+		"GIT_SOCKSTAT_VAR_repo_id=uint:1",
+		"GIT_SOCKSTAT_VAR_user_id=ignored",
+		"GIT_SOCKSTAT_VAR_group_leader=bool:true",
+		"GIT_SOCKSTAT_VAR_is_importing=bool:false",
+		"GIT_SOCKSTAT_VAR_quarantine_id=test_quarantine_id",
+		"GIT_SOCKSTAT_VAR_parent_repo_id=uint:42",
+		"GIT_SOCKSTAT_VAR_spokes_receive_pack_isolated_reference_discovery=bool:true",
+		"GIT_SOCKSTAT_VAR_failpoints=unpack-error=return(true)",
+		"GIT_SOCKSTAT_VAR_keepalive_interval=uint:10",
+		"GIT_SOCKSTAT_VAR_agent_suffix=ring-1",
+		"GIT_SOCKSTAT_VAR_push_allowed_refs=refs/heads/ refs/tags/",
+		"GIT_SOCKSTAT_VAR_push_denied_refs=refs/heads/main",
+		"GIT_SOCKSTAT_VAR_for_each_ref_timeout=duration:30s",
+		"GIT_SOCKSTAT_VAR_rev_list_timeout=uint:1500",
+		"GIT_SOCKSTAT_VAR_discovery_memory_limit=uint:1048576",
+		"GIT_SOCKSTAT_VAR_no_equals_sign",
+	})
+
+	assert.Equal(t, Vars{
+		RepoName:                   "a/b",
+		RepoID:                     1,
+		GroupLeader:                true,
+		QuarantineID:               "test_quarantine_id",
+		ParentRepoID:               "42",
+		IsolatedReferenceDiscovery: true,
+		Failpoints:                 "unpack-error=return(true)",
+		KeepaliveInterval:          10,
+		AgentSuffix:                "ring-1",
+		PushAllowedRefs:            "refs/heads/ refs/tags/",
+		PushDeniedRefs:             "refs/heads/main",
+		ForEachRefTimeout:          30 * time.Second,
+		RevListTimeout:             1500 * time.Millisecond,
+		DiscoveryMemoryLimit:       1 << 20,
+	}, vars)
+}
+
+func TestParseStrict(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"GIT_SOCKSTAT_VAR_repo_name=a/b",
+		"GIT_SOCKSTAT_VAR_repo_id=uint:1",
+		"GIT_SOCKSTAT_VAR_user_id=3",
+		"GIT_SOCKSTAT_VAR_is_importing=true",
+		"GIT_SOCKSTAT_VAR_group_leader=bool:false",
+		"GIT_SOCKSTAT_VAR_rev_list_timeout=30s",
+		"GIT_SOCKSTAT_VAR_unknown=anything",
+		"GIT_SOCKSTAT_VAR_no_equals_sign",
+	}
+
+	vars, errs := ParseStrict(environ)
+	assert.Equal(t, Parse(environ), vars)
+
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	assert.Equal(t, []string{
+		`malformed sockstat var GIT_SOCKSTAT_VAR_user_id: expected a uint value, got "3"`,
+		`malformed sockstat var GIT_SOCKSTAT_VAR_is_importing: expected a bool value, got "true"`,
+		`malformed sockstat var GIT_SOCKSTAT_VAR_rev_list_timeout: expected a duration value, got "30s"`,
+		`unknown sockstat var GIT_SOCKSTAT_VAR_unknown`,
+		`malformed sockstat var "GIT_SOCKSTAT_VAR_no_equals_sign"`,
+	}, msgs)
+}
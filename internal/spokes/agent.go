@@ -0,0 +1,60 @@
+package spokes
+
+import (
+	"fmt"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/github/spokes-receive-pack/internal/sockstat"
+)
+
+// The config settings that change the agent that we advertise:
+// spokes.agent replaces it, and spokes.agentSuffix is added to it, unless
+// the agent_suffix sockstat var is set, which is added instead.
+const (
+	agentKey       = "spokes.agent"
+	agentSuffixKey = "spokes.agentsuffix"
+)
+
+// maxAgentLength is the longest agent that we advertise.
+const maxAgentLength = 128
+
+// agent returns the value of the agent capability that we advertise.
+// Settings that would make it invalid are logged and ignored.
+func agent(version string, cfg *config.Config, vars sockstat.Vars, lg *logger.Logger) string {
+	value := "github/spokes-receive-pack-" + version
+	if v := cfg.Get(agentKey); v != "" {
+		if err := checkAgent(v); err != nil {
+			lg.Warn("ignoring "+agentKey, "error", err)
+		} else {
+			value = v
+		}
+	}
+
+	suffix, source := vars.AgentSuffix, "agent_suffix sockstat var"
+	if suffix == "" {
+		suffix, source = cfg.Get(agentSuffixKey), agentSuffixKey
+	}
+	if suffix != "" {
+		if err := checkAgent(value + "-" + suffix); err != nil {
+			lg.Warn("ignoring "+source, "error", err)
+		} else {
+			value += "-" + suffix
+		}
+	}
+	return value
+}
+
+// checkAgent returns an error unless `agent` can be advertised. Git only
+// allows printable ASCII other than spaces in it.
+func checkAgent(agent string) error {
+	if len(agent) > maxAgentLength {
+		return fmt.Errorf("agent is longer than %d characters", maxAgentLength)
+	}
+	for i := 0; i < len(agent); i++ {
+		if agent[i] <= ' ' || agent[i] > '~' {
+			return fmt.Errorf("agent %q contains %q", agent, agent[i])
+		}
+	}
+	return nil
+}
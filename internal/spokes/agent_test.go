@@ -0,0 +1,75 @@
+package spokes
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/github/spokes-receive-pack/internal/sockstat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgent(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		entries  []config.ConfigEntry
+		vars     sockstat.Vars
+		expected string
+		warning  string
+	}{
+		{
+			name:     "default",
+			expected: "github/spokes-receive-pack-1.2.3",
+		},
+		{
+			name:     "override",
+			entries:  []config.ConfigEntry{{Key: agentKey, Value: "github/receive-pack"}},
+			expected: "github/receive-pack",
+		},
+		{
+			name:     "config suffix",
+			entries:  []config.ConfigEntry{{Key: agentSuffixKey, Value: "dc1"}},
+			expected: "github/spokes-receive-pack-1.2.3-dc1",
+		},
+		{
+			name: "sockstat suffix",
+			entries: []config.ConfigEntry{
+				{Key: agentKey, Value: "github/receive-pack"},
+				{Key: agentSuffixKey, Value: "dc1"},
+			},
+			vars:     sockstat.Vars{AgentSuffix: "canary"},
+			expected: "github/receive-pack-canary",
+		},
+		{
+			name:     "invalid override",
+			entries:  []config.ConfigEntry{{Key: agentKey, Value: "has space"}},
+			expected: "github/spokes-receive-pack-1.2.3",
+			warning:  "ignoring " + agentKey,
+		},
+		{
+			name:     "invalid suffix",
+			vars:     sockstat.Vars{AgentSuffix: "ring\x001"},
+			expected: "github/spokes-receive-pack-1.2.3",
+			warning:  "ignoring agent_suffix sockstat var",
+		},
+		{
+			name:     "suffix too long",
+			entries:  []config.ConfigEntry{{Key: agentSuffixKey, Value: strings.Repeat("x", maxAgentLength)}},
+			expected: "github/spokes-receive-pack-1.2.3",
+			warning:  "ignoring " + agentSuffixKey,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			cfg := &config.Config{Entries: tc.entries}
+			assert.Equal(t, tc.expected, agent("1.2.3", cfg, tc.vars, logger.New(&buf)))
+			if tc.warning == "" {
+				assert.Empty(t, buf.String())
+			} else {
+				assert.Contains(t, buf.String(), tc.warning)
+			}
+		})
+	}
+}
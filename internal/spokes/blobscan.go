@@ -0,0 +1,127 @@
+package spokes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+
+	"github.com/github/spokes-receive-pack/internal/pipe"
+	"github.com/github/spokes-receive-pack/internal/policy"
+)
+
+// scanBlobs streams the blobs that the commands that haven't been rejected
+// yet add to the blob scanner, if there is one. If it denies the push, or
+// fails, they are all rejected; if it flags the push, its message is kept
+// to warn the client with.
+func (r *spokesReceivePack) scanBlobs(ctx context.Context, commands []command) {
+	if !r.blobScanner.Enabled() && r.blobScannerErr == nil {
+		return
+	}
+
+	var oids []string
+	for _, c := range commands {
+		if c.err == "" && !c.isDelete() {
+			oids = append(oids, c.newOID)
+		}
+	}
+	if len(oids) == 0 {
+		return
+	}
+
+	msg := ""
+	retryable := false
+	if r.blobScannerErr != nil {
+		msg = "invalid blob scanner config"
+	} else {
+		v, err := r.runBlobScanner(ctx, oids)
+		switch {
+		case err != nil:
+			r.log.With("phase", phasePolicy).Error("blob scan failed", "error", err)
+			msg = policy.BlobScanFailedMessage
+			retryable = true
+		case v.Decision == policy.Deny:
+			msg = v.Message
+		case v.Decision == policy.Flag:
+			r.log.With("phase", phasePolicy).Warn("blob scanner flagged push", "message", v.Message)
+			r.blobScanWarning = v.Message
+		}
+	}
+	if msg == "" {
+		return
+	}
+
+	for i := range commands {
+		c := &commands[i]
+		if c.err == "" && !c.isDelete() {
+			c.err = msg
+			c.reportFF = "ng"
+			c.retryable = retryable
+			if !retryable {
+				c.rejection = rejectionPolicy
+			}
+		}
+	}
+}
+
+// runBlobScanner runs the blob scanner on the blobs reachable from `oids`
+// that aren't reachable from any ref yet, and returns its verdict.
+func (r *spokesReceivePack) runBlobScanner(ctx context.Context, oids []string) (policy.Verdict, error) {
+	env := append(r.quarantineEnvVars(), pipe.EnvVar{Key: "GIT_DIR", Value: r.repoPath})
+	env = append(env, r.connectionEnvVars()...)
+
+	var output bytes.Buffer
+	truncated := false
+
+	// The filters leave only blobs that aren't too big to send, and the
+	// commits, which are the lines without an object name.
+	revList := exec.Command(
+		"git", "rev-list", "--objects", "--stdin",
+		"--filter=object:type=blob",
+		"--filter=blob:limit="+strconv.Itoa(r.blobScanner.MaxBlobSize+1),
+		"--not", "--all", "--alternate-refs",
+	)
+
+	p := r.newPipeline(pipe.WithStdout(&output))
+	p.Add(
+		pipe.Function(
+			"write-new-values",
+			func(_ context.Context, _ pipe.Env, _ io.Reader, output io.Writer) error {
+				for _, oid := range oids {
+					if _, err := fmt.Fprintln(output, oid); err != nil {
+						return fmt.Errorf("writing to 'rev-list' input: %w", err)
+					}
+				}
+				return nil
+			},
+		),
+		r.quarantined(pipe.CommandStage("rev-list", revList)),
+		pipe.LinewiseFunction(
+			"select-blobs",
+			func(_ context.Context, _ pipe.Env, line []byte, output *bufio.Writer) error {
+				oid, _, ok := bytes.Cut(line, []byte{' '})
+				if !ok {
+					return nil
+				}
+				if _, err := output.Write(oid); err != nil {
+					return err
+				}
+				return output.WriteByte('\n')
+			},
+		),
+		r.quarantined(pipe.CommandStage("cat-file", exec.Command("git", "cat-file", "--batch"))),
+		r.blobScanner.LimitStage(func() { truncated = true }),
+		r.hook(r.blobScanner.Stage(env)),
+	)
+	if err := p.Run(ctx); err != nil {
+		return policy.Verdict{}, fmt.Errorf("running blob scanner: %w", err)
+	}
+	if truncated {
+		r.log.With("phase", phasePolicy).Warn("blob scanner input truncated", "limit", r.blobScanner.MaxTotalSize)
+	}
+
+	return policy.ParseBlobVerdict(output.Bytes())
+}
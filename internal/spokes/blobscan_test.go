@@ -0,0 +1,147 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/pktline"
+	"github.com/github/spokes-receive-pack/internal/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanBlobs(t *testing.T) {
+	ctx := context.Background()
+	q := quarantinedRepo(t)
+	head := q.repo.Head
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input")
+	scanner := filepath.Join(dir, "scan")
+	require.NoError(t, os.WriteFile(scanner, []byte(`#!/bin/sh
+cat >"`+input+`"
+if grep -q "content of secret" "`+input+`"; then
+	echo '{"decision": "deny", "message": "secret found"}'
+elif grep -q "content of key" "`+input+`"; then
+	echo '{"decision": "flag", "message": "might be a key"}'
+elif grep -q "content of broken" "`+input+`"; then
+	echo 'oops'
+else
+	echo '{"decision": "allow"}'
+fi
+`), 0o755))
+
+	newReceivePack := func() *spokesReceivePack {
+		r := q.receivePack()
+		r.blobScanner = policy.BlobScanner{
+			Command:      scanner,
+			Timeout:      time.Minute,
+			MaxBlobSize:  1024,
+			MaxTotalSize: 1 << 20,
+		}
+		return r
+	}
+
+	for _, tc := range []struct {
+		name      string
+		files     []string
+		err       string
+		retryable bool
+		warning   string
+	}{
+		{name: "allowed", files: []string{"README"}},
+		{name: "denied", files: []string{"README", "secret"}, err: "secret found"},
+		{name: "flagged", files: []string{"key"}, warning: "might be a key"},
+		{name: "failed", files: []string{"broken"}, err: policy.BlobScanFailedMessage, retryable: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newReceivePack()
+			commands := []command{
+				{oldOID: head, newOID: q.commit(head, tc.files...), refname: "refs/heads/topic"},
+				{oldOID: head, newOID: nullSHA1OID, refname: "refs/heads/deleted"},
+			}
+			r.scanBlobs(ctx, commands)
+
+			assert.Equal(t, tc.err, commands[0].err)
+			assert.Equal(t, tc.retryable, commands[0].retryable)
+			assert.Equal(t, "", commands[1].err)
+			assert.Equal(t, tc.warning, r.blobScanWarning)
+		})
+	}
+
+	t.Run("limits", func(t *testing.T) {
+		// Blobs that are too big are skipped, and the ones after the
+		// total limit is reached aren't sent.
+		r := newReceivePack()
+		r.blobScanner.MaxBlobSize = len("content of a\n")
+		r.blobScanner.MaxTotalSize = 2 * len("content of a\n")
+		commands := []command{
+			{oldOID: head, newOID: q.commit(head, "a", "b", "c", "long-name"), refname: "refs/heads/topic"},
+		}
+		r.scanBlobs(ctx, commands)
+		assert.Equal(t, "", commands[0].err)
+
+		sent, err := os.ReadFile(input)
+		require.NoError(t, err)
+		assert.Contains(t, string(sent), "content of a\n")
+		assert.Contains(t, string(sent), "content of b\n")
+		assert.NotContains(t, string(sent), "content of c\n")
+		assert.NotContains(t, string(sent), "long-name")
+	})
+}
+
+func TestScanBlobsDecidedEarly(t *testing.T) {
+	ctx := context.Background()
+	q := quarantinedRepo(t)
+	head := q.repo.Head
+
+	// A scanner, with an argument, that decides as soon as it has seen
+	// the first object, while far more than fits in a pipe is still to
+	// come.
+	scanner := filepath.Join(t.TempDir(), "scan")
+	require.NoError(t, os.WriteFile(scanner, []byte(`#!/bin/sh
+read -r header
+echo "{\"decision\": \"$1\", \"message\": \"decided early\"}"
+`), 0o755))
+
+	files := make(map[string]string)
+	for i := 0; i < 64; i++ {
+		files[fmt.Sprintf("file-%d", i)] = strings.Repeat(fmt.Sprintf("line %d\n", i), 2048)
+	}
+
+	r := q.receivePack()
+	r.blobScanner = policy.BlobScanner{
+		Command:      scanner + " deny",
+		Timeout:      time.Minute,
+		MaxBlobSize:  1 << 20,
+		MaxTotalSize: 100 << 20,
+	}
+	commands := []command{
+		{oldOID: head, newOID: q.commitFiles(head, files), refname: "refs/heads/topic"},
+	}
+	r.scanBlobs(ctx, commands)
+
+	assert.Equal(t, "decided early", commands[0].err)
+	assert.False(t, commands[0].retryable)
+}
+
+func TestReportBlobScanWarning(t *testing.T) {
+	caps, err := pktline.ParseCapabilities([]byte("report-status side-band-64k"))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	r := &spokesReceivePack{output: &buf, config: &config.Config{}, blobScanWarning: "might be a key"}
+	require.NoError(t, r.report(context.Background(), true, []command{
+		{refname: "refs/heads/main", reportFF: "ok"},
+	}, caps))
+
+	warning := "warning: might be a key\n"
+	assert.True(t, strings.HasPrefix(buf.String(), fmt.Sprintf("%04x\x02%s", 5+len(warning), warning)), buf.String())
+}
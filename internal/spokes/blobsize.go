@@ -0,0 +1,203 @@
+package spokes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/pipe"
+)
+
+// maxLFSPointerSize is the size that Git LFS pointer files are smaller
+// than, so bigger blobs can't be one.
+const maxLFSPointerSize = 1024
+
+// checkBlobSizes rejects the commands that haven't been rejected yet whose
+// new commits add a blob bigger than receive.maxBlobSize, unless it is a
+// Git LFS pointer, telling the client to use Git LFS instead.
+func (r *spokesReceivePack) checkBlobSizes(ctx context.Context, commands []command) {
+	limit, err := r.getMaxBlobSize()
+	if err != nil {
+		r.log.Error("invalid receive.maxBlobSize", "error", err)
+	}
+	if limit <= 0 && err == nil {
+		return
+	}
+
+	for i := range commands {
+		c := &commands[i]
+		if c.err != "" || c.isDelete() {
+			continue
+		}
+
+		msg := ""
+		if err != nil {
+			msg = "invalid receive.maxBlobSize"
+		} else {
+			blob, scanErr := r.findOversizedBlob(ctx, c.newOID, limit)
+			switch {
+			case scanErr != nil:
+				r.log.Error("checking blob sizes", "refname", c.refname, "error", scanErr)
+				msg = "blob sizes could not be checked"
+				c.retryable = true
+			case blob != nil:
+				msg = r.message(messageBlobSize,
+					"path", blob.path,
+					"size", strconv.Itoa(blob.size),
+					"limit", strconv.Itoa(limit),
+				)
+				c.rejection = rejectionLimit
+			}
+		}
+		if msg != "" {
+			c.err = msg
+			c.reportFF = "ng"
+		}
+	}
+}
+
+func (r *spokesReceivePack) getMaxBlobSize() (int, error) {
+	limit := r.config.Get("receive.maxblobsize")
+
+	if limit != "" {
+		return config.ParseSigned(limit)
+	}
+
+	return 0, nil
+}
+
+// oversizedBlob is a new blob that is bigger than receive.maxBlobSize.
+type oversizedBlob struct {
+	oid  string
+	path string
+	size int
+}
+
+// findOversizedBlob returns the first blob reachable from `oid` that isn't
+// reachable from any ref yet, is bigger than `limit`, and isn't a Git LFS
+// pointer, or nil if there is none.
+func (r *spokesReceivePack) findOversizedBlob(ctx context.Context, oid string, limit int) (*oversizedBlob, error) {
+	var candidates []oversizedBlob
+
+	p := r.newPipeline()
+	p.Add(
+		r.quarantined(pipe.CommandStage("rev-list", exec.Command(
+			"git", "rev-list", "--objects", "--filter=object:type=blob",
+			oid, "--not", "--all", "--alternate-refs",
+		))),
+		r.quarantined(pipe.CommandStage("cat-file", exec.Command(
+			"git", "cat-file", "--batch-check=%(objecttype) %(objectsize) %(objectname) %(rest)",
+		))),
+		pipe.Function(
+			"find-oversized",
+			func(_ context.Context, _ pipe.Env, input io.Reader, _ io.Writer) error {
+				var err error
+				candidates, err = oversizedBlobs(input, limit)
+				if err == nil && len(candidates) > 0 && candidates[len(candidates)-1].size >= maxLFSPointerSize {
+					return pipe.FinishEarly
+				}
+				return err
+			},
+		),
+	)
+	if err := p.Run(ctx); err != nil {
+		return nil, fmt.Errorf("listing new blobs: %w", err)
+	}
+
+	// Only blobs that are small enough to be a pointer need to be read.
+	for i := range candidates {
+		blob := &candidates[i]
+		if blob.size >= maxLFSPointerSize {
+			return blob, nil
+		}
+		cmd := exec.CommandContext(ctx, "git", "cat-file", "blob", blob.oid)
+		r.inRepo(cmd)
+		content, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("reading blob %s: %w", blob.oid, err)
+		}
+		if !isLFSPointer(content) {
+			return blob, nil
+		}
+	}
+	return nil, nil
+}
+
+// oversizedBlobs returns the blobs bigger than `limit` in the output of
+// `git cat-file --batch-check='%(objecttype) %(objectsize) %(objectname)
+// %(rest)'`, stopping after the first one that is too big to be a Git LFS
+// pointer.
+func oversizedBlobs(input io.Reader, limit int) ([]oversizedBlob, error) {
+	var blobs []oversizedBlob
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := scanner.Text()
+		objectType, rest, _ := strings.Cut(line, " ")
+		if objectType != "blob" {
+			continue
+		}
+		sizeStr, rest, _ := strings.Cut(rest, " ")
+		oid, path, _ := strings.Cut(rest, " ")
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected 'cat-file' output %q", line)
+		}
+		if size <= limit {
+			continue
+		}
+		blobs = append(blobs, oversizedBlob{oid: oid, path: path, size: size})
+		if size >= maxLFSPointerSize {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading 'cat-file' output: %w", err)
+	}
+	return blobs, nil
+}
+
+// lfsPointerVersion is the first line of a Git LFS pointer.
+const lfsPointerVersion = "version https://git-lfs.github.com/spec/v1"
+
+var (
+	lfsPointerKey  = regexp.MustCompile(`^[a-z0-9.-]+$`)
+	lfsPointerOID  = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+	lfsPointerSize = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// isLFSPointer reports whether `content` is a valid Git LFS pointer: a
+// version line, followed by lines of keys and values sorted by key, which
+// include the OID and size of the file, each ending in a newline.
+func isLFSPointer(content []byte) bool {
+	if len(content) >= maxLFSPointerSize || !bytes.HasSuffix(content, []byte("\n")) {
+		return false
+	}
+	lines := strings.Split(string(content[:len(content)-1]), "\n")
+	if lines[0] != lfsPointerVersion {
+		return false
+	}
+
+	var hasOID, hasSize bool
+	prev := ""
+	for _, line := range lines[1:] {
+		key, value, ok := strings.Cut(line, " ")
+		if !ok || !lfsPointerKey.MatchString(key) || key <= prev || key == "version" {
+			return false
+		}
+		prev = key
+		switch key {
+		case "oid":
+			hasOID = lfsPointerOID.MatchString(value)
+		case "size":
+			hasSize = lfsPointerSize.MatchString(value)
+		}
+	}
+	return hasOID && hasSize
+}
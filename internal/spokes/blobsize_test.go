@@ -0,0 +1,85 @@
+package spokes
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testLFSPointer = "version https://git-lfs.github.com/spec/v1\n" +
+	"oid sha256:4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393\n" +
+	"size 12345\n"
+
+func TestIsLFSPointer(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		content  string
+		expected bool
+	}{
+		{"pointer", testLFSPointer, true},
+		{"extension", strings.Replace(testLFSPointer, "oid", "ext-0-foo sha256:abc\noid", 1), true},
+		{"no newline", strings.TrimSuffix(testLFSPointer, "\n"), false},
+		{"no size", strings.Replace(testLFSPointer, "size 12345\n", "", 1), false},
+		{"bad oid", strings.Replace(testLFSPointer, "sha256:4d7a", "sha1:4d7a", 1), false},
+		{"unsorted", strings.Replace(testLFSPointer, "oid", "size 1\noid", 1), false},
+		{"wrong version", strings.Replace(testLFSPointer, "v1", "v2", 1), false},
+		{"text", "just some text\n", false},
+		{"too big", testLFSPointer + "x-pad " + strings.Repeat("a", maxLFSPointerSize) + "\n", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, isLFSPointer([]byte(tc.content)))
+		})
+	}
+}
+
+func TestOversizedBlobs(t *testing.T) {
+	input := "commit 200 1111\n" +
+		"blob 10 2222 small\n" +
+		"blob 200 3333 pointer\n" +
+		"blob 5000 4444 dir/big\n" +
+		"blob 6000 5555 bigger\n"
+
+	blobs, err := oversizedBlobs(strings.NewReader(input), 100)
+	require.NoError(t, err)
+	assert.Equal(t, []oversizedBlob{
+		{oid: "3333", path: "pointer", size: 200},
+		{oid: "4444", path: "dir/big", size: 5000},
+	}, blobs)
+}
+
+func TestCheckBlobSizes(t *testing.T) {
+	ctx := context.Background()
+	q := quarantinedRepo(t)
+	head := q.repo.Head
+
+	big := strings.Repeat("x", 2000)
+	commands := []command{
+		{oldOID: head, newOID: q.commitFiles(head, map[string]string{"big.bin": big}), refname: "refs/heads/big"},
+		{oldOID: head, newOID: q.commitFiles(head, map[string]string{"small.txt": strings.Repeat("x", 200)}), refname: "refs/heads/small"},
+		{oldOID: head, newOID: q.commitFiles(head, map[string]string{"big.bin": testLFSPointer}), refname: "refs/heads/lfs"},
+		{oldOID: head, newOID: q.commitFiles(head, map[string]string{"a.txt": "short\n"}), refname: "refs/heads/fine"},
+	}
+
+	r := q.receivePack()
+	r.config = &config.Config{Entries: []config.ConfigEntry{{Key: "receive.maxblobsize", Value: "100"}}}
+	r.checkBlobSizes(ctx, commands)
+
+	assert.Equal(t, "big.bin is 2000 bytes, more than the limit of 100; use Git LFS (https://git-lfs.com) for large files", commands[0].err)
+	assert.Equal(t, "small.txt is 200 bytes, more than the limit of 100; use Git LFS (https://git-lfs.com) for large files", commands[1].err)
+	assert.Equal(t, "", commands[2].err)
+	assert.Equal(t, "", commands[3].err)
+
+	// Without a limit, nothing is checked.
+	commands[0].err = ""
+	r.config = &config.Config{}
+	r.checkBlobSizes(ctx, commands[:1])
+	assert.Equal(t, "", commands[0].err)
+
+	r.config = &config.Config{Entries: []config.ConfigEntry{{Key: "receive.maxblobsize", Value: "huge"}}}
+	r.checkBlobSizes(ctx, commands[:1])
+	assert.Equal(t, "invalid receive.maxBlobSize", commands[0].err)
+}
@@ -0,0 +1,33 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/spokes-receive-pack/internal/childenv"
+	"github.com/github/spokes-receive-pack/internal/pipe"
+)
+
+func TestChildrenDontSeeOurEnvironment(t *testing.T) {
+	t.Setenv("SPOKES_TEST_SECRET", "secret")
+	t.Setenv("GIT_TEST_VISIBLE", "visible")
+
+	r := &spokesReceivePack{repoPath: t.TempDir()}
+
+	cmd := exec.Command("sh", "-c", `echo "$SPOKES_TEST_SECRET $GIT_TEST_VISIBLE"`)
+	r.inRepo(cmd)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, " visible\n", string(out))
+
+	var buf bytes.Buffer
+	p := r.newPipeline(pipe.WithStdout(&buf))
+	p.Add(childenv.Scrubbed(pipe.Command("sh", "-c", `echo "$SPOKES_TEST_SECRET $GIT_TEST_VISIBLE $GIT_DIR"`)))
+	require.NoError(t, p.Run(context.Background()))
+	assert.Equal(t, " visible "+r.repoPath+"\n", buf.String())
+}
@@ -0,0 +1,81 @@
+package spokes
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// The buffering of the ref advertisement: it is written in chunks of up to
+// advertisementBufferSize bytes, but nothing waits for more than
+// advertisementFlushDelay to be sent, so that the client keeps getting refs
+// while a slow for-each-ref produces them.
+const (
+	advertisementBufferSize = 64 << 10
+	advertisementFlushDelay = 100 * time.Millisecond
+)
+
+// coalescingWriter buffers what is written to it, so that many small
+// packets turn into few writes to the underlying writer. The buffer is
+// written when it is full, when Flush is called, or `delay` after data
+// was first buffered, whichever comes first.
+//
+// If a write fails, every later Write and Flush returns its error.
+type coalescingWriter struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	delay time.Duration
+	timer *time.Timer
+}
+
+func newCoalescingWriter(w io.Writer, size int, delay time.Duration) *coalescingWriter {
+	return &coalescingWriter{w: bufio.NewWriterSize(w, size), delay: delay}
+}
+
+func (c *coalescingWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, err := c.w.Write(p)
+	if c.w.Buffered() > 0 && c.timer == nil {
+		c.timer = time.AfterFunc(c.delay, c.flushLater)
+	}
+	return n, err
+}
+
+// flushLater writes what is buffered when the delay has passed. An error
+// is kept by the bufio.Writer for the next Write or Flush to return.
+func (c *coalescingWriter) flushLater() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timer = nil
+	_ = c.w.Flush()
+}
+
+// Flush writes what is buffered now.
+func (c *coalescingWriter) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stopTimer()
+	return c.w.Flush()
+}
+
+// Stop discards what is buffered, if anything, and stops the delayed
+// flush, for when the rest of the output isn't going to be written.
+func (c *coalescingWriter) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stopTimer()
+	c.w.Reset(io.Discard)
+}
+
+func (c *coalescingWriter) stopTimer() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
@@ -0,0 +1,78 @@
+package spokes
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeLog records each write made to it.
+type writeLog struct {
+	mu     sync.Mutex
+	writes []string
+	err    error
+}
+
+func (w *writeLog) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func (w *writeLog) Writes() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.writes...)
+}
+
+func TestCoalescingWriter(t *testing.T) {
+	var rec writeLog
+	w := newCoalescingWriter(&rec, 8, time.Hour)
+
+	for _, s := range []string{"ab", "cd", "ef", "gh", "ij"} {
+		_, err := w.Write([]byte(s))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"abcdefgh"}, rec.Writes())
+
+	require.NoError(t, w.Flush())
+	assert.Equal(t, []string{"abcdefgh", "ij"}, rec.Writes())
+
+	// Nothing waits for long.
+	w = newCoalescingWriter(&rec, 8, time.Millisecond)
+	_, err := w.Write([]byte("kl"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(rec.Writes()) == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, "kl", rec.Writes()[2])
+
+	// What hasn't been written yet is dropped by Stop.
+	w = newCoalescingWriter(&rec, 8, time.Millisecond)
+	_, err = w.Write([]byte("mn"))
+	require.NoError(t, err)
+	w.Stop()
+	require.NoError(t, w.Flush())
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, rec.Writes(), 3)
+}
+
+func TestCoalescingWriterError(t *testing.T) {
+	rec := writeLog{err: errors.New("broken pipe")}
+	w := newCoalescingWriter(&rec, 8, time.Millisecond)
+
+	_, err := w.Write([]byte("ab"))
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	_, err = w.Write(bytes.Repeat([]byte("x"), 10))
+	assert.ErrorContains(t, err, "broken pipe")
+	assert.ErrorContains(t, w.Flush(), "broken pipe")
+}
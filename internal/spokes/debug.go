@@ -0,0 +1,125 @@
+package spokes
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/pprof"
+	"runtime/trace"
+	"syscall"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/logger"
+)
+
+// debugTraceDuration is how long an execution trace requested with SIGUSR2
+// runs for.
+const debugTraceDuration = 5 * time.Second
+
+// debugDir returns the directory that debugging dumps are written to.
+func debugDir() string {
+	if dir := os.Getenv("SPOKES_DEBUG_DIR"); dir != "" {
+		return dir
+	}
+	return os.TempDir()
+}
+
+// handleDebugSignals makes SIGUSR1 dump goroutine and heap profiles and
+// SIGUSR2 record a short execution trace, so that a stuck push can be
+// diagnosed in place. The paths of the dumps are logged. Calling the returned
+// function stops handling the signals.
+func handleDebugSignals(ctx context.Context, lg *logger.Logger) func() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-ch:
+				var paths []string
+				var err error
+				if sig == syscall.SIGUSR1 {
+					paths, err = dumpProfiles(debugDir())
+				} else {
+					var path string
+					path, err = dumpTrace(ctx, debugDir(), debugTraceDuration)
+					paths = []string{path}
+				}
+				if err != nil {
+					lg.Error("writing debugging dump", "signal", sig.String(), "error", err)
+					continue
+				}
+				lg.Info("wrote debugging dump", "signal", sig.String(), "paths", paths)
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(ch)
+		cancel()
+	}
+}
+
+// debugDumpPath returns a path in `dir` for a dump of the given kind.
+func debugDumpPath(dir, kind string) string {
+	name := fmt.Sprintf("spokes-receive-pack-%d-%d.%s", os.Getpid(), time.Now().UnixNano(), kind)
+	return filepath.Join(dir, name)
+}
+
+// dumpProfiles writes the goroutine stacks, in text form, and a heap
+// profile to `dir`, and returns their paths.
+func dumpProfiles(dir string) ([]string, error) {
+	var paths []string
+	for _, p := range []struct {
+		name  string
+		debug int
+	}{
+		{"goroutine", 2},
+		{"heap", 0},
+	} {
+		path := debugDumpPath(dir, p.name)
+		f, err := os.Create(path)
+		if err != nil {
+			return paths, err
+		}
+		err = pprof.Lookup(p.name).WriteTo(f, p.debug)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return paths, fmt.Errorf("writing %s profile: %w", p.name, err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// dumpTrace records an execution trace for `d` (or until `ctx` is done) to
+// a file in `dir`, and returns its path.
+func dumpTrace(ctx context.Context, dir string, d time.Duration) (string, error) {
+	path := debugDumpPath(dir, "trace")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := trace.Start(f); err != nil {
+		return "", fmt.Errorf("starting trace: %w", err)
+	}
+
+	timer := time.NewTimer(d)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+	}
+	trace.Stop()
+
+	return path, f.Close()
+}
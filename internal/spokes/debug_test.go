@@ -0,0 +1,37 @@
+package spokes
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpProfiles(t *testing.T) {
+	dir := t.TempDir()
+	paths, err := dumpProfiles(dir)
+	require.NoError(t, err)
+	require.Len(t, paths, 2)
+
+	goroutines, err := os.ReadFile(paths[0])
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(paths[0], ".goroutine"))
+	assert.Contains(t, string(goroutines), "TestDumpProfiles")
+
+	info, err := os.Stat(paths[1])
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(paths[1], ".heap"))
+	assert.NotZero(t, info.Size())
+}
+
+func TestDumpTrace(t *testing.T) {
+	path, err := dumpTrace(context.Background(), t.TempDir(), 10*time.Millisecond)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.NotZero(t, info.Size())
+}
@@ -0,0 +1,106 @@
+package spokes
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// defaultBranchRenameKey says what to do about a push that deletes the
+// default branch, the one HEAD points at, while creating another branch.
+// That's what renaming the default branch by pushing looks like, and it
+// leaves HEAD pointing at nothing, so clones of the repository come out
+// empty. Like git's receive.denyDeleteCurrent, it is one of "refuse",
+// which rejects the deletion; "warn", the default, which lets it through
+// with a warning; or "ignore". "true" and "false" mean "refuse" and
+// "ignore".
+const defaultBranchRenameKey = "receive.denydefaultbranchrename"
+
+// checkDefaultBranchRename rejects, or warns about, the deletion of the
+// default branch in `commands` if they also create another branch, as
+// receive.denyDefaultBranchRename says. The message names the branch that
+// looks like the default branch's new name: one created at the same commit,
+// if there is one, or else the first one created.
+func (r *spokesReceivePack) checkDefaultBranchRename(ctx context.Context, commands []command) {
+	deletes := false
+	var created []*command
+	for i := range commands {
+		c := &commands[i]
+		switch {
+		case c.err != "" || !strings.HasPrefix(c.refname, "refs/heads/"):
+		case c.isDelete():
+			deletes = true
+		case c.isCreate():
+			created = append(created, c)
+		}
+	}
+	if !deletes || len(created) == 0 {
+		return
+	}
+
+	refuse := false
+	switch v := strings.ToLower(r.config.Get(defaultBranchRenameKey)); v {
+	case "ignore", "false":
+		return
+	case "refuse", "true":
+		refuse = true
+	case "", "warn":
+	default:
+		r.log.Warn("invalid "+defaultBranchRenameKey+", warning instead", "value", v)
+	}
+
+	head, err := r.defaultBranch(ctx)
+	if err != nil {
+		r.log.Warn("finding the default branch", "error", err)
+		return
+	}
+	var deleted *command
+	for i := range commands {
+		c := &commands[i]
+		if c.err == "" && c.refname == head && c.isDelete() {
+			deleted = c
+		}
+	}
+	if deleted == nil {
+		return
+	}
+
+	renamed := created[0]
+	for _, c := range created {
+		if c.newOID == deleted.oldOID {
+			renamed = c
+			break
+		}
+	}
+
+	msg := r.message(messageDefaultBranch, "refname", deleted.refname, "newref", renamed.refname)
+	r.log.Info("default branch deleted while creating another",
+		"refname", deleted.refname,
+		"new_refname", renamed.refname,
+		"refused", refuse,
+	)
+	if refuse {
+		deleted.err = msg
+		deleted.reportFF = "ng"
+		deleted.rejection = rejectionPolicy
+		return
+	}
+	deleted.warnings = append(deleted.warnings, msg)
+}
+
+// defaultBranch returns the refname that HEAD points at, or "" if HEAD is
+// detached.
+func (r *spokesReceivePack) defaultBranch(ctx context.Context) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "symbolic-ref", "--quiet", "HEAD")
+	r.inRepo(cmd)
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,106 @@
+package spokes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+)
+
+func TestDefaultBranch(t *testing.T) {
+	ctx := context.Background()
+	q := quarantinedRepo(t)
+	r := q.receivePack()
+
+	head, err := r.defaultBranch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "refs/heads/main", head)
+
+	q.git("", "update-ref", "--no-deref", "HEAD", q.repo.Head)
+	head, err = r.defaultBranch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "", head)
+}
+
+func TestCheckDefaultBranchRename(t *testing.T) {
+	ctx := context.Background()
+	q := quarantinedRepo(t)
+	head := q.repo.Head
+	other := q.commit(head, "other.txt")
+	null := nullSHA1OID
+
+	rename := func() []command {
+		return []command{
+			{oldOID: null, newOID: other, refname: "refs/heads/first"},
+			{oldOID: head, newOID: null, refname: "refs/heads/main"},
+			{oldOID: null, newOID: head, refname: "refs/heads/trunk"},
+		}
+	}
+	const msg = "deleting the default branch leaves the repository without one; make refs/heads/trunk the default branch first"
+
+	for _, tc := range []struct {
+		name     string
+		setting  string
+		err      string
+		warnings []string
+	}{
+		{name: "default", warnings: []string{msg}},
+		{name: "warn", setting: "warn", warnings: []string{msg}},
+		{name: "refuse", setting: "refuse", err: msg},
+		{name: "true", setting: "true", err: msg},
+		{name: "ignore", setting: "ignore"},
+		{name: "false", setting: "false"},
+		{name: "invalid", setting: "sometimes", warnings: []string{msg}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := q.receivePack()
+			r.config = &config.Config{Entries: []config.ConfigEntry{{Key: defaultBranchRenameKey, Value: tc.setting}}}
+			commands := rename()
+			r.checkDefaultBranchRename(ctx, commands)
+
+			assert.Equal(t, tc.err, commands[1].err)
+			assert.Equal(t, tc.warnings, commands[1].warnings)
+			if tc.err != "" {
+				assert.Equal(t, "ng", commands[1].reportFF)
+				assert.Equal(t, rejectionPolicy, commands[1].rejection)
+			}
+			for _, i := range []int{0, 2} {
+				assert.Empty(t, commands[i].err)
+				assert.Empty(t, commands[i].warnings)
+			}
+		})
+	}
+
+	r := q.receivePack()
+	r.config = &config.Config{Entries: []config.ConfigEntry{{Key: defaultBranchRenameKey, Value: "refuse"}}}
+
+	// Without a branch at the same commit, the first one created is named.
+	commands := rename()[:2]
+	r.checkDefaultBranchRename(ctx, commands)
+	assert.Equal(t, "deleting the default branch leaves the repository without one; make refs/heads/first the default branch first", commands[1].err)
+
+	for name, commands := range map[string][]command{
+		"only a deletion": {
+			{oldOID: head, newOID: null, refname: "refs/heads/main"},
+		},
+		"another branch deleted": {
+			{oldOID: head, newOID: null, refname: "refs/heads/old"},
+			{oldOID: null, newOID: head, refname: "refs/heads/trunk"},
+		},
+		"a tag created": {
+			{oldOID: head, newOID: null, refname: "refs/heads/main"},
+			{oldOID: null, newOID: head, refname: "refs/tags/v1"},
+		},
+		"creation rejected": {
+			{oldOID: head, newOID: null, refname: "refs/heads/main"},
+			{oldOID: null, newOID: head, refname: "refs/heads/trunk", err: "denied", reportFF: "ng"},
+		},
+	} {
+		r.checkDefaultBranchRename(ctx, commands)
+		assert.Empty(t, commands[0].err, name)
+		assert.Empty(t, commands[0].warnings, name)
+	}
+}
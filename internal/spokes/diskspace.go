@@ -0,0 +1,63 @@
+package spokes
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+)
+
+// minFreeSpaceKey is the setting for how much space must be left free on
+// the filesystem of the quarantine after the largest pack that we'd accept
+// (`receive.maxSize`) is written to it. If it's set, a push that might not
+// fit is turned away before its pack is read, rather than running out of
+// space part of the way through.
+const minFreeSpaceKey = "spokes.minfreespace"
+
+// freeSpace returns how many bytes are available to us on the filesystem
+// that holds `path`.
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// checkFreeSpace makes sure that there's room in the quarantine for a pack
+// of up to `maxSize` bytes (0 meaning unlimited) plus the configured
+// margin. It returns an error in categoryDiskFull if there isn't. If the
+// check isn't configured or the free space can't be found out, the push
+// goes ahead.
+func (r *spokesReceivePack) checkFreeSpace(maxSize int) error {
+	v := r.config.Get(minFreeSpaceKey)
+	if v == "" {
+		return nil
+	}
+	minFree, err := config.ParseSigned(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", minFreeSpaceKey, err)
+	}
+	if minFree < 0 {
+		minFree = 0
+	}
+	if maxSize < 0 {
+		maxSize = 0
+	}
+	needed := uint64(minFree) + uint64(maxSize)
+	if needed == 0 {
+		return nil
+	}
+
+	avail, err := freeSpace(r.quarantineFolder)
+	if err != nil {
+		r.log.Warn("checking free space", "error", err)
+		return nil
+	}
+	if avail >= needed {
+		return nil
+	}
+
+	r.log.Warn("not enough free space for the push", "available", avail, "needed", needed)
+	return withCategory(categoryDiskFull, fmt.Errorf("%d bytes free in the quarantine, need %d", avail, needed))
+}
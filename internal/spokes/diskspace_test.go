@@ -0,0 +1,59 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreeSpace(t *testing.T) {
+	avail, err := freeSpace(t.TempDir())
+	require.NoError(t, err)
+	assert.NotZero(t, avail)
+
+	_, err = freeSpace("/does/not/exist")
+	assert.Error(t, err)
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	newRepo := func(minFree string) (*spokesReceivePack, *bytes.Buffer) {
+		var buf bytes.Buffer
+		r := &spokesReceivePack{
+			config:           &config.Config{},
+			log:              logger.New(&buf),
+			quarantineFolder: dir,
+		}
+		if minFree != "" {
+			r.config.Entries = []config.ConfigEntry{{Key: minFreeSpaceKey, Value: minFree}}
+		}
+		return r, &buf
+	}
+
+	r, _ := newRepo("")
+	assert.NoError(t, r.checkFreeSpace(1<<62))
+
+	r, _ = newRepo("1k")
+	assert.NoError(t, r.checkFreeSpace(1024))
+
+	r, buf := newRepo("1048576g")
+	err := r.checkFreeSpace(0)
+	require.Error(t, err)
+	assert.True(t, isCategory(err, categoryDiskFull))
+	assert.True(t, isRetryable(context.Background(), err))
+	assert.Contains(t, buf.String(), "not enough free space for the push")
+
+	r, _ = newRepo("many")
+	assert.ErrorContains(t, r.checkFreeSpace(0), "invalid spokes.minfreespace")
+
+	// It can't tell, so it lets the push go ahead.
+	r, buf = newRepo("1")
+	r.quarantineFolder = "/does/not/exist"
+	assert.NoError(t, r.checkFreeSpace(0))
+	assert.Contains(t, buf.String(), "checking free space")
+}
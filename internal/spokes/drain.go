@@ -0,0 +1,79 @@
+package spokes
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// The most input that we read and throw away before writing the report,
+// and the longest that we spend on it. A client that sends more than that
+// after we've stopped listening is on its own.
+const (
+	maxDrainInput   = 64 * 1024 * 1024
+	maxDrainTimeout = 10 * time.Second
+)
+
+// errDrainIncomplete is returned by drainInput if the input didn't end
+// within the limits.
+var errDrainIncomplete = errors.New("input didn't end")
+
+// drainInput reads what is left of the client's input, so that writing the
+// report doesn't race with the client still sending it. That matters for
+// HTTP, where a server that responds without reading the whole request
+// body can have the connection reset, taking the response with it. It
+// returns how much was read. If it gives up, it interrupts the read, which
+// may close `input`.
+func drainInput(input io.Reader, max int64, timeout time.Duration) (int64, error) {
+	type result struct {
+		n   int64
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := io.CopyN(io.Discard, input, max)
+		switch {
+		case errors.Is(err, io.EOF):
+			err = nil
+		case err == nil:
+			// There might be more.
+			err = errDrainIncomplete
+		}
+		done <- result{n, err}
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case res := <-done:
+		return res.n, res.err
+	case <-t.C:
+		// Nothing else reads the input after this, so don't leave the
+		// read blocked.
+		interruptRead(input)
+		return 0, errDrainIncomplete
+	}
+}
+
+// interruptRead makes a Read of `input` that is blocked return, if the
+// reader that it wraps, if any, lets it. Setting a deadline that has
+// passed does that for a net.Conn or a pipe; other readers are closed,
+// without waiting, since some only close once the Read returns.
+func interruptRead(input io.Reader) {
+	for {
+		u, ok := input.(interface{ Unwrap() io.Reader })
+		if !ok {
+			break
+		}
+		input = u.Unwrap()
+	}
+
+	if d, ok := input.(interface{ SetReadDeadline(time.Time) error }); ok {
+		if err := d.SetReadDeadline(time.Now()); err == nil {
+			return
+		}
+	}
+	if c, ok := input.(io.Closer); ok {
+		go c.Close()
+	}
+}
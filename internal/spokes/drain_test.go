@@ -0,0 +1,58 @@
+package spokes
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainInput(t *testing.T) {
+	input := strings.NewReader("PACK and the rest of it")
+	n, err := drainInput(input, 1024, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(23), n)
+	assert.Zero(t, input.Len())
+
+	// Nothing left is fine too.
+	n, err = drainInput(input, 1024, time.Second)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+
+	n, err = drainInput(strings.NewReader("too much"), 3, time.Second)
+	assert.ErrorIs(t, err, errDrainIncomplete)
+	assert.Equal(t, int64(3), n)
+
+	// A client that keeps the connection open without sending anything
+	// isn't waited for forever.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	_, err = drainInput(pr, 1024, 10*time.Millisecond)
+	assert.ErrorIs(t, err, errDrainIncomplete)
+
+	// And the input is closed, which happens in the background.
+	assert.Eventually(t, func() bool {
+		_, err := pw.Write([]byte("late"))
+		return errors.Is(err, io.ErrClosedPipe)
+	}, time.Second, time.Millisecond)
+}
+
+func TestDrainInputInterruptsRead(t *testing.T) {
+	// A connection isn't closed, but its read is still interrupted,
+	// through the reader that records the input for the shadow.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	_, err := drainInput(&recordingReader{r: server, max: 1024}, 1024, 10*time.Millisecond)
+	assert.ErrorIs(t, err, errDrainIncomplete)
+
+	require.NoError(t, client.SetWriteDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = client.Write([]byte("late"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
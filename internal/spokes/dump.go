@@ -0,0 +1,231 @@
+package spokes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/github/spokes-receive-pack/internal/childenv"
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/objectformat"
+	"github.com/github/spokes-receive-pack/internal/pipe"
+	"github.com/github/spokes-receive-pack/internal/pktline"
+)
+
+// advertisementDump describes the ref advertisement that a push would get,
+// for DumpAdvertisement.
+type advertisementDump struct {
+	// Source is where the refs come from: "repository",
+	// "repository-isolated", or "snapshot".
+	Source string `json:"source"`
+
+	ObjectFormat string   `json:"object_format"`
+	Capabilities []string `json:"capabilities"`
+
+	// RefPrefixes are the client's ref prefixes, if it gave any.
+	RefPrefixes []string `json:"ref_prefixes,omitempty"`
+
+	// Refs are the refs that are advertised, in order.
+	Refs []dumpedRef `json:"refs"`
+
+	// HaveCount is how many .have lines are advertised.
+	HaveCount int `json:"have_count"`
+
+	// HiddenRefRules are the decisions of the hideRefs rules about each
+	// ref that one of them matches, whether it hides it or not.
+	HiddenRefRules []hiddenRefDecision `json:"hidden_ref_rules"`
+}
+
+type dumpedRef struct {
+	Name string `json:"name"`
+	OID  string `json:"oid"`
+}
+
+type hiddenRefDecision struct {
+	Name   string `json:"name"`
+	Rule   string `json:"rule"`
+	Hidden bool   `json:"hidden"`
+}
+
+// DumpAdvertisement writes, as JSON to `opts.Stdout`, the ref advertisement
+// that a push to `opts.RepoPath` would get, with the same config, sockstat
+// vars, and options, along with which refs the hideRefs rules hide. It
+// doesn't speak the protocol, read from `opts.Stdin`, or ask governor
+// whether it may run.
+func DumpAdvertisement(ctx context.Context, opts Options) (int, error) {
+	lg := opts.Log
+	if lg == nil {
+		var logCloser io.Closer
+		var err error
+		lg, logCloser, err = openLogger(opts.Stderr, opts.Version, opts.Vars)
+		if err != nil {
+			return ExitInternalError, err
+		}
+		defer logCloser.Close()
+	}
+
+	cfg, err := config.GetConfig(opts.RepoPath)
+	if err != nil {
+		return ExitInternalError, err
+	}
+	objectFormat, err := objectformat.GetObjectFormatFromConfig(opts.RepoPath, cfg)
+	if err != nil {
+		return ExitInternalError, err
+	}
+
+	receiveOptions := newReceiveOptions(cfg, lg)
+	r := &spokesReceivePack{
+		capabilities:   advertisedCapabilities(opts, cfg, objectFormat, receiveOptions, lg),
+		receiveOptions: receiveOptions,
+		repoPath:       opts.RepoPath,
+		config:         cfg,
+		objectFormat:   objectFormat,
+		sockstat:       opts.Vars,
+		log:            lg,
+		refPrefixes:    parseRefPrefixes(opts.Vars.GitProtocol),
+
+		forEachRefTimeout:    stageTimeout(lg, "SPOKES_FOR_EACH_REF_TIMEOUT", opts.Vars.ForEachRefTimeout),
+		discoveryMemoryLimit: memoryLimit(lg, "SPOKES_DISCOVERY_MEMORY_LIMIT", opts.Vars.DiscoveryMemoryLimit),
+	}
+
+	if err := r.loadHiddenRefs(); err != nil {
+		return ExitInternalError, err
+	}
+
+	// The snapshot is read twice: once to advertise it, and once for the
+	// hidden ref decisions.
+	var snapshot []byte
+	if opts.Advertisement != nil {
+		if snapshot, err = io.ReadAll(opts.Advertisement); err != nil {
+			return ExitInternalError, fmt.Errorf("reading advertisement snapshot: %w", err)
+		}
+		r.advertisement = bytes.NewReader(snapshot)
+	}
+
+	dump, err := r.dumpAdvertisement(ctx, snapshot)
+	if err != nil {
+		return ExitInternalError, err
+	}
+
+	enc := json.NewEncoder(opts.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(dump); err != nil {
+		return ExitInternalError, err
+	}
+	return ExitOK, nil
+}
+
+// dumpAdvertisement produces the advertisement, the way that a push would,
+// and describes it. `snapshot` is the content of r.advertisement, if any.
+func (r *spokesReceivePack) dumpAdvertisement(ctx context.Context, snapshot []byte) (*advertisementDump, error) {
+	dump := &advertisementDump{
+		Source:         "repository",
+		ObjectFormat:   string(r.objectFormat),
+		RefPrefixes:    r.refPrefixes,
+		Refs:           []dumpedRef{},
+		HiddenRefRules: []hiddenRefDecision{},
+	}
+	switch {
+	case r.advertisement != nil:
+		dump.Source = "snapshot"
+	case r.sockstat.IsolatedReferenceDiscovery:
+		dump.Source = "repository-isolated"
+	}
+
+	var adv bytes.Buffer
+	r.output = &adv
+	if err := r.advertise(ctx); err != nil {
+		return nil, err
+	}
+	if err := dump.parse(&adv); err != nil {
+		return nil, fmt.Errorf("parsing advertisement: %w", err)
+	}
+
+	refnames, err := r.allRefnames(ctx, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	hiddenRefs := r.hiddenRefs()
+	for _, refname := range refnames {
+		if rule, hidden := hiddenRefs.match(refname); rule != "" {
+			dump.HiddenRefRules = append(dump.HiddenRefRules, hiddenRefDecision{
+				Name:   refname,
+				Rule:   rule,
+				Hidden: hidden,
+			})
+		}
+	}
+
+	return dump, nil
+}
+
+// parse fills in `d` from the pkt-lines of the advertisement in `adv`.
+func (d *advertisementDump) parse(adv io.Reader) error {
+	pl := pktline.New()
+	first := true
+	for {
+		if err := pl.Read(adv); err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("no flush packet")
+			}
+			return err
+		}
+		if pl.IsFlush() {
+			return nil
+		}
+
+		// The capabilities come with the first line, and pl takes them
+		// off it.
+		if first {
+			first = false
+			d.Capabilities = strings.Fields(string(pl.CapabilitiesPayload))
+		}
+		line := strings.TrimSuffix(string(pl.Payload), "\n")
+
+		oid, name, ok := strings.Cut(line, " ")
+		if !ok {
+			return fmt.Errorf("malformed line: %q", line)
+		}
+		switch name {
+		case ".have":
+			d.HaveCount++
+		case "capabilities^{}":
+		default:
+			d.Refs = append(d.Refs, dumpedRef{Name: name, OID: oid})
+		}
+	}
+}
+
+// allRefnames returns the names of all of the refs that could be
+// advertised: the ones in `snapshot`, if there is one, or else the ones in
+// the repository.
+func (r *spokesReceivePack) allRefnames(ctx context.Context, snapshot []byte) ([]string, error) {
+	var out []byte
+	if r.advertisement != nil {
+		out = snapshot
+	} else {
+		var buf bytes.Buffer
+		p := r.newPipeline(pipe.WithStdout(&buf))
+		p.Add(childenv.Scrubbed(pipe.Command("git", "for-each-ref", "--format=%(objectname) %(refname)")))
+		if err := p.Run(ctx); err != nil {
+			return nil, fmt.Errorf("listing references: %w", err)
+		}
+		out = buf.Bytes()
+	}
+
+	var refnames []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 0, 4096), maxSnapshotLine)
+	for scanner.Scan() {
+		_, refname, ok := strings.Cut(scanner.Text(), " ")
+		if ok && refname != ".have" {
+			refnames = append(refnames, refname)
+		}
+	}
+	return refnames, scanner.Err()
+}
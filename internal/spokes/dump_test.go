@@ -0,0 +1,95 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/github/spokes-receive-pack/internal/sockstat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpAdvertisement(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "repo.git")
+	git := func(args ...string) string {
+		out, err := exec.Command("git", append([]string{"--git-dir=" + repo}, args...)...).Output()
+		require.NoError(t, err, args)
+		return strings.TrimSpace(string(out))
+	}
+	require.NoError(t, exec.Command("git", "init", "--quiet", "--bare", repo).Run())
+	blob, err := exec.Command("sh", "-c", "echo hello | git --git-dir="+repo+" hash-object -w --stdin").Output()
+	require.NoError(t, err)
+	oid := strings.TrimSpace(string(blob))
+	for _, ref := range []string{"refs/tags/v1", "refs/pull/1/head", "refs/pull/1/merge"} {
+		git("update-ref", ref, oid)
+	}
+
+	dump := func(opts Options) advertisementDump {
+		var stdout, logs bytes.Buffer
+		opts.RepoPath = repo
+		opts.Stdout = &stdout
+		opts.Log = logger.New(&logs)
+		opts.Version = "test"
+		code, err := DumpAdvertisement(context.Background(), opts)
+		require.NoError(t, err, logs.String())
+		require.Equal(t, ExitOK, code)
+
+		var d advertisementDump
+		require.NoError(t, json.Unmarshal(stdout.Bytes(), &d), stdout.String())
+		return d
+	}
+
+	d := dump(Options{Vars: sockstat.Vars{RequestID: "abc123"}})
+	assert.Equal(t, "repository", d.Source)
+	assert.Equal(t, "sha1", d.ObjectFormat)
+	assert.Contains(t, d.Capabilities, "agent=github/spokes-receive-pack-test")
+	assert.Contains(t, d.Capabilities, "session-id=abc123")
+	assert.Equal(t, []dumpedRef{
+		{Name: "refs/pull/1/head", OID: oid},
+		{Name: "refs/pull/1/merge", OID: oid},
+		{Name: "refs/tags/v1", OID: oid},
+	}, d.Refs)
+	assert.Zero(t, d.HaveCount)
+	assert.Empty(t, d.HiddenRefRules)
+
+	// The isolated reference discovery advertises the same refs.
+	isolated := dump(Options{Vars: sockstat.Vars{IsolatedReferenceDiscovery: true}})
+	assert.Equal(t, "repository-isolated", isolated.Source)
+	assert.Equal(t, d.Refs, isolated.Refs)
+
+	// A snapshot is advertised instead, along with its .have lines, and
+	// the hidden refs and the client's ref prefixes apply. (The hidden
+	// refs are only tried with a snapshot because the for-each-ref
+	// --exclude option needs a newer git than we can count on.)
+	git("config", "--add", "receive.hideRefs", "refs/pull/")
+	git("config", "--add", "receive.hideRefs", "!refs/pull/1/head")
+	const other = "b610c0d60779c270356dde58d8286d36223ffeac"
+	snapshot := strings.Join([]string{
+		other + " refs/heads/main",
+		other + " refs/heads/topic",
+		other + " refs/pull/1/head",
+		other + " refs/pull/2/merge",
+		other + " .have",
+	}, "\n")
+	d = dump(Options{
+		Vars:          sockstat.Vars{GitProtocol: "version=0:ref-prefix=refs/heads/main:ref-prefix=refs/pull/"},
+		Advertisement: strings.NewReader(snapshot),
+	})
+	assert.Equal(t, "snapshot", d.Source)
+	assert.Equal(t, []string{"refs/heads/main", "refs/pull/"}, d.RefPrefixes)
+	assert.Equal(t, []dumpedRef{
+		{Name: "refs/heads/main", OID: other},
+		{Name: "refs/pull/1/head", OID: other},
+	}, d.Refs)
+	assert.Equal(t, 1, d.HaveCount)
+	assert.Equal(t, []hiddenRefDecision{
+		{Name: "refs/pull/1/head", Rule: "!refs/pull/1/head", Hidden: false},
+		{Name: "refs/pull/2/merge", Rule: "refs/pull/", Hidden: true},
+	}, d.HiddenRefRules)
+}
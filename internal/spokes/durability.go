@@ -0,0 +1,150 @@
+package spokes
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// syncFailedMessage is the reason given for rejecting the commands of a
+// push whose objects couldn't be synced to disk.
+const syncFailedMessage = "failed to sync received objects to disk"
+
+// fsyncComponents are the components of git's core.fsync that cover packs
+// and their indexes, and the aggregate components that include them.
+var fsyncComponents = map[string]bool{
+	"pack":             true,
+	"pack-metadata":    true,
+	"objects":          true,
+	"derived-metadata": true,
+	"committed":        true,
+	"added":            true,
+	"all":              true,
+}
+
+// shouldSyncPack returns true if the config asks for received packs to be
+// synced to disk. If core.fsync is set, that is when it covers packs or
+// their indexes, like it is for git. Otherwise, unlike git, which syncs
+// packs unless told not to, it is only when core.fsyncObjectFiles is true,
+// since syncing slows down every push.
+func (r *spokesReceivePack) shouldSyncPack() bool {
+	components := r.config.Get("core.fsync")
+	if components == "" {
+		return r.config.Get("core.fsyncObjectFiles") == "true"
+	}
+
+	// Like git, start with its default, which covers packs, and apply
+	// each of the components in turn.
+	sync := true
+	for _, c := range strings.Split(components, ",") {
+		c = strings.TrimSpace(c)
+		switch {
+		case c == "none":
+			sync = false
+		case strings.HasPrefix(c, "-") && fsyncComponents[c[1:]]:
+			sync = false
+		case fsyncComponents[c]:
+			sync = true
+		}
+	}
+	return sync
+}
+
+// syncQuarantine syncs the packs and indexes that were received into the
+// quarantine to disk, along with the directory entries that lead to them,
+// if the config asks for it. It happens before the client is told that its
+// updates were accepted, so that an accepted push can't be lost if the
+// host crashes before it is replicated. If the objects can't be synced,
+// the commands that haven't been rejected yet are.
+func (r *spokesReceivePack) syncQuarantine(commands []command) {
+	if !acceptsObjects(commands) || !r.shouldSyncPack() {
+		return
+	}
+
+	start := time.Now()
+	n, err := syncPackDir(r.quarantineFolder)
+	if err == nil {
+		r.log.Info("synced quarantine", "files", n, "elapsed_ms", time.Since(start).Milliseconds())
+		return
+	}
+
+	r.log.Error("syncing quarantine", "error", err)
+	for i := range commands {
+		c := &commands[i]
+		if c.err == "" {
+			c.err = syncFailedMessage
+			c.reportFF = "ng"
+			c.retryable = true
+		}
+	}
+}
+
+// syncPackDir syncs the packs and their indexes in the "pack" directory of
+// the object directory `objdir`, and then that directory, `objdir`, and
+// the directory that contains it, so that all of them can be found after
+// a crash. It returns the number of files that it synced.
+func syncPackDir(objdir string) (int, error) {
+	packDir := filepath.Join(objdir, "pack")
+	entries, err := os.ReadDir(packDir)
+	if err != nil {
+		return 0, fmt.Errorf("reading pack directory: %w", err)
+	}
+
+	n := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isPackFile(entry.Name()) {
+			continue
+		}
+		if err := syncPath(filepath.Join(packDir, entry.Name())); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	for _, dir := range []string{packDir, objdir, filepath.Dir(objdir)} {
+		if err := syncPath(dir); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// isPackFile reports whether `name` is the name of a pack or one of the
+// files that go with it.
+func isPackFile(name string) bool {
+	if !strings.HasPrefix(name, "pack-") {
+		return false
+	}
+	switch filepath.Ext(name) {
+	case ".pack", ".idx", ".rev", ".keep", ".promisor":
+		return true
+	default:
+		return false
+	}
+}
+
+// syncPath syncs the file or directory at `path` to disk.
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("syncing %s: %w", path, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %w", path, err)
+	}
+	return nil
+}
+
+// acceptsObjects reports whether any of `commands` that hasn't been
+// rejected needs objects from the pack.
+func acceptsObjects(commands []command) bool {
+	for _, c := range commands {
+		if c.err == "" && !c.isDelete() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package spokes
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShouldSyncPack(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		entries  []config.ConfigEntry
+		expected bool
+	}{
+		{"unset", nil, false},
+		{"fsyncObjectFiles", []config.ConfigEntry{{Key: "core.fsyncobjectfiles", Value: "true"}}, true},
+		{"fsyncObjectFiles off", []config.ConfigEntry{{Key: "core.fsyncobjectfiles", Value: "false"}}, false},
+		{"default components", []config.ConfigEntry{{Key: "core.fsync", Value: "reference"}}, true},
+		{"pack", []config.ConfigEntry{{Key: "core.fsync", Value: "none,pack"}}, true},
+		{"aggregate", []config.ConfigEntry{{Key: "core.fsync", Value: "none, committed"}}, true},
+		{"none", []config.ConfigEntry{{Key: "core.fsync", Value: "none"}}, false},
+		{"without packs", []config.ConfigEntry{{Key: "core.fsync", Value: "-pack"}}, false},
+		{"core.fsync wins", []config.ConfigEntry{
+			{Key: "core.fsyncobjectfiles", Value: "true"},
+			{Key: "core.fsync", Value: "none"},
+		}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &spokesReceivePack{config: &config.Config{Entries: tc.entries}}
+			assert.Equal(t, tc.expected, r.shouldSyncPack())
+		})
+	}
+}
+
+func TestSyncQuarantine(t *testing.T) {
+	objects := t.TempDir()
+	quarantine := filepath.Join(objects, "incoming-1")
+	require.NoError(t, os.MkdirAll(filepath.Join(quarantine, "pack"), 0777))
+	for _, name := range []string{"pack-1.pack", "pack-1.idx", "pack-1.rev", "tmp_pack_x", "README"} {
+		require.NoError(t, os.WriteFile(filepath.Join(quarantine, "pack", name), []byte("x"), 0666))
+	}
+
+	n, err := syncPackDir(quarantine)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	var buf bytes.Buffer
+	r := &spokesReceivePack{
+		config:           &config.Config{Entries: []config.ConfigEntry{{Key: "core.fsync", Value: "pack"}}},
+		log:              logger.New(&buf),
+		quarantineFolder: quarantine,
+	}
+	commands := []command{{refname: "refs/heads/main", newOID: "1111"}}
+	r.syncQuarantine(commands)
+	assert.Equal(t, "", commands[0].err)
+	assert.Contains(t, buf.String(), "synced quarantine")
+
+	// If the pack can't be synced, nothing is accepted.
+	r.quarantineFolder = filepath.Join(objects, "missing")
+	commands = []command{
+		{refname: "refs/heads/main", newOID: "1111"},
+		{refname: "refs/heads/other", newOID: "2222", err: "rejected already", reportFF: "ng"},
+	}
+	r.syncQuarantine(commands)
+	assert.Equal(t, syncFailedMessage, commands[0].err)
+	assert.True(t, commands[0].retryable)
+	assert.Equal(t, "rejected already", commands[1].err)
+
+	// Deletes don't need the pack.
+	commands = []command{{refname: "refs/heads/main", newOID: nullSHA1OID}}
+	r.syncQuarantine(commands)
+	assert.Equal(t, "", commands[0].err)
+}
@@ -0,0 +1,255 @@
+package spokes
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/github/spokes-receive-pack/internal/pipe"
+)
+
+// The exit codes that Exec returns, so that callers can react differently
+// depending on why a push failed. The same code is reported to governor as
+// the result code, along with the name of the category.
+const (
+	ExitOK            = 0
+	ExitInternalError = 1
+	ExitProtocolError = 2
+	ExitLimitExceeded = 3
+	ExitFsckFailure   = 4
+	ExitCanceled      = 5
+	ExitTerminated    = 6
+	ExitDiskFull      = 7
+	ExitBusy          = 8
+	ExitGovernorError = 75
+)
+
+// failureCategory describes a class of failure.
+type failureCategory struct {
+	name     string
+	exitCode int
+}
+
+var (
+	categoryInternal   = failureCategory{"internal", ExitInternalError}
+	categoryProtocol   = failureCategory{"protocol", ExitProtocolError}
+	categoryLimit      = failureCategory{"limit", ExitLimitExceeded}
+	categoryFsck       = failureCategory{"fsck", ExitFsckFailure}
+	categoryCanceled   = failureCategory{"canceled", ExitCanceled}
+	categoryTerminated = failureCategory{"terminated", ExitTerminated}
+
+	// categoryInterrupted is for pushes whose pack stopped arriving
+	// part-way through. That's the client's (or its connection's) doing,
+	// like a protocol error.
+	categoryInterrupted = failureCategory{"interrupted", ExitProtocolError}
+
+	// categoryCorruptPack is for pushes whose pack arrived whole but
+	// couldn't be read, which is also the client's doing.
+	categoryCorruptPack = failureCategory{"corrupt-pack", ExitProtocolError}
+
+	// categoryDiskFull is for pushes that failed because the server ran
+	// out of disk space (or quota) while writing what was pushed.
+	categoryDiskFull = failureCategory{"disk-full", ExitDiskFull}
+
+	// categoryBusy is for pushes that gave up waiting for their turn
+	// because too many others to the same repository were in progress,
+	// or that couldn't find out whether it was their turn.
+	categoryBusy = failureCategory{"busy", ExitBusy}
+)
+
+// categorizedError is an error that knows what category of failure it is.
+type categorizedError struct {
+	category failureCategory
+	err      error
+}
+
+func (e categorizedError) Error() string {
+	return e.err.Error()
+}
+
+func (e categorizedError) Unwrap() error {
+	return e.err
+}
+
+// withCategory marks `err` as belonging to `category`. It returns nil if
+// `err` is nil.
+func withCategory(category failureCategory, err error) error {
+	if err == nil {
+		return nil
+	}
+	return categorizedError{category: category, err: err}
+}
+
+// categorize determines which category `err` falls into. Cancellation takes
+// precedence over whatever error it might have caused along the way;
+// otherwise, errors that haven't been categorized are internal errors.
+func categorize(ctx context.Context, err error) failureCategory {
+	if isTerminated(ctx) {
+		return categoryTerminated
+	}
+	if ctx.Err() != nil {
+		return categoryCanceled
+	}
+
+	var ce categorizedError
+	if errors.As(err, &ce) {
+		return ce.category
+	}
+
+	return categoryInternal
+}
+
+// isCategory reports whether `err` has been marked as belonging to
+// `category`.
+func isCategory(err error, category failureCategory) bool {
+	var ce categorizedError
+	return errors.As(err, &ce) && ce.category == category
+}
+
+// isRetryable reports whether a step of the push that failed with `err`
+// might succeed if the push is tried again: it ran out of time, was
+// interrupted, lost its input, ran out of disk space, waited too long for
+// other pushes, or ran into concurrent repository maintenance. Failures
+// that are about the push itself, like exceeding a limit, failing fsck, or
+// sending a corrupt pack, are never retryable.
+func isRetryable(ctx context.Context, err error) bool {
+	if isTerminated(ctx) || errors.Is(ctx.Err(), context.DeadlineExceeded) ||
+		isCategory(err, categoryInterrupted) || isCategory(err, categoryDiskFull) ||
+		isCategory(err, categoryBusy) {
+		return true
+	}
+	if isCategory(err, categoryLimit) || isCategory(err, categoryFsck) ||
+		isCategory(err, categoryCorruptPack) || isCategory(err, categoryProtocol) {
+		return false
+	}
+	return errors.Is(err, pipe.ErrStageTimeout) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		isTransientGitError(err)
+}
+
+// indexPackError is a failure of `git index-pack`, along with the line of
+// its stderr that best explains it to the pusher.
+type indexPackError struct {
+	err    error
+	detail string
+}
+
+func (e indexPackError) Error() string {
+	return e.err.Error()
+}
+
+func (e indexPackError) Unwrap() error {
+	return e.err
+}
+
+// indexPackDetail returns the explanation that classifyIndexPackError found
+// for `err`, or "" if there is none.
+func indexPackDetail(err error) string {
+	var ie indexPackError
+	if errors.As(err, &ie) {
+		return ie.detail
+	}
+	return ""
+}
+
+// classifyIndexPackError categorizes a failure of `git index-pack` based on
+// what it wrote to stderr.
+func classifyIndexPackError(err error, stderr string) error {
+	switch {
+	case strings.Contains(stderr, "pack exceeds maximum allowed size"):
+		return withCategory(categoryLimit, err)
+	case strings.Contains(stderr, "fsck error"):
+		// The object that failed, and why, is on the first error line;
+		// the fatal line only says that something did.
+		detail := stderrLine(stderr, "error: ", false)
+		if detail == "" {
+			detail = stderrLine(stderr, "fatal: ", true)
+		}
+		return withCategory(categoryFsck, indexPackError{err: err, detail: detail})
+	case isDiskFull(stderr):
+		return withCategory(categoryDiskFull, err)
+	case isTruncatedPack(stderr):
+		return withCategory(categoryInterrupted, err)
+	case isCorruptPack(stderr):
+		return withCategory(categoryCorruptPack, indexPackError{err: err, detail: stderrLine(stderr, "fatal: ", true)})
+	default:
+		return err
+	}
+}
+
+// isTruncatedPack reports whether index-pack's `stderr` says that its input
+// ended before the whole pack was read, as opposed to the pack being bad.
+func isTruncatedPack(stderr string) bool {
+	return strings.Contains(stderr, "early EOF") ||
+		strings.Contains(stderr, "read error on input") ||
+		strings.Contains(stderr, "unexpected EOF")
+}
+
+// corruptPackSignatures are what index-pack says about a pack that it
+// received in full but couldn't make sense of.
+var corruptPackSignatures = []string{
+	"pack signature mismatch",
+	"pack version ",
+	"pack has bad object",
+	"pack has junk at the end",
+	"pack is corrupted",
+	"inflate returned",
+	"serious inflate inconsistency",
+	"unknown object type",
+	"delta base offset",
+}
+
+// isCorruptPack reports whether index-pack's `stderr` says that the pack
+// itself is malformed.
+func isCorruptPack(stderr string) bool {
+	for _, sig := range corruptPackSignatures {
+		if strings.Contains(stderr, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDiskFull reports whether index-pack's `stderr` says that it couldn't
+// write the pack because the disk, or the quota, is full.
+func isDiskFull(stderr string) bool {
+	return strings.Contains(stderr, "No space left on device") ||
+		strings.Contains(stderr, "Disk quota exceeded")
+}
+
+// stderrLine returns what follows `prefix` on the first (or, if `last`,
+// the last) line of `stderr` that has it, ignoring anything before it,
+// like "remote: ".
+func stderrLine(stderr, prefix string, last bool) string {
+	var found string
+	for _, line := range strings.Split(stderr, "\n") {
+		i := strings.Index(line, prefix)
+		if i < 0 {
+			continue
+		}
+		found = strings.TrimSpace(line[i+len(prefix):])
+		if !last && found != "" {
+			break
+		}
+	}
+	return found
+}
+
+// tailBuffer is an io.Writer that remembers the last `max` bytes that were
+// written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}
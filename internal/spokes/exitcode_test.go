@@ -0,0 +1,153 @@
+package spokes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/pipe"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCategorize(t *testing.T) {
+	background := context.Background()
+
+	canceled, cancel := context.WithCancel(background)
+	cancel()
+
+	terminated, cancelCause := context.WithCancelCause(background)
+	cancelCause(terminatedError{})
+
+	indexPackErr := errors.New("exit status 128")
+
+	for _, ex := range []struct {
+		label    string
+		ctx      context.Context
+		err      error
+		expected failureCategory
+	}{
+		{"uncategorized", background, errors.New("boom"), categoryInternal},
+		{"protocol", background, withCategory(categoryProtocol, errors.New("bogus command")), categoryProtocol},
+		{"wrapped", background, fmt.Errorf("index-pack: %w", withCategory(categoryFsck, indexPackErr)), categoryFsck},
+		{"canceled", canceled, withCategory(categoryProtocol, errors.New("reading commands")), categoryCanceled},
+		{"terminated", terminated, errors.New("signal: killed"), categoryTerminated},
+		{
+			"index-pack limit",
+			background,
+			classifyIndexPackError(indexPackErr, "remote: fatal: pack exceeds maximum allowed size\n"),
+			categoryLimit,
+		},
+		{
+			"index-pack fsck",
+			background,
+			classifyIndexPackError(indexPackErr, "error: object 1234: badDate: invalid author/committer line - bad date\nfatal: fsck error in packed object\n"),
+			categoryFsck,
+		},
+		{
+			"index-pack truncated",
+			background,
+			classifyIndexPackError(indexPackErr, "error: index-pack died of signal 13\nfatal: early EOF\n"),
+			categoryInterrupted,
+		},
+		{
+			"index-pack corrupt",
+			background,
+			classifyIndexPackError(indexPackErr, "fatal: pack has bad object at offset 12: inflate returned -3\n"),
+			categoryCorruptPack,
+		},
+		{
+			"index-pack disk full",
+			background,
+			classifyIndexPackError(indexPackErr, "fatal: sha1 file '.git/objects/pack/tmp_pack_XyZ' write error: No space left on device\n"),
+			categoryDiskFull,
+		},
+		{"index-pack other", background, classifyIndexPackError(indexPackErr, "fatal: did not receive expected object 8f7da4e89f96103db885fd8919a7dbb245e70d59\n"), categoryInternal},
+	} {
+		t.Run(ex.label, func(t *testing.T) {
+			assert.Equal(t, ex.expected, categorize(ex.ctx, ex.err))
+		})
+	}
+
+	assert.Nil(t, withCategory(categoryProtocol, nil))
+}
+
+func TestCategoryExitCodes(t *testing.T) {
+	// Callers can tell running out of disk space and waiting too long
+	// for other pushes apart from our own bugs.
+	assert.Equal(t, ExitDiskFull, categoryDiskFull.exitCode)
+	assert.Equal(t, ExitBusy, categoryBusy.exitCode)
+
+	codes := map[int]string{}
+	for _, c := range []failureCategory{
+		categoryInternal, categoryProtocol, categoryLimit, categoryFsck,
+		categoryCanceled, categoryTerminated, categoryDiskFull, categoryBusy,
+	} {
+		other, ok := codes[c.exitCode]
+		assert.False(t, ok, "%s and %s both exit with %d", c.name, other, c.exitCode)
+		codes[c.exitCode] = c.name
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	background := context.Background()
+
+	timedOut, cancel := context.WithTimeout(background, 0)
+	defer cancel()
+
+	terminated, cancelCause := context.WithCancelCause(background)
+	cancelCause(terminatedError{})
+
+	indexPackErr := errors.New("exit status 128")
+
+	assert.True(t, isRetryable(timedOut, indexPackErr))
+	assert.True(t, isRetryable(terminated, indexPackErr))
+	assert.True(t, isRetryable(background, fmt.Errorf("rev-list: %w", pipe.ErrStageTimeout)))
+	assert.True(t, isRetryable(background, &pipe.StageError{Err: indexPackErr, Stderr: "fatal: cannot lock ref 'refs/heads/main'"}))
+
+	assert.True(t, isRetryable(background, classifyIndexPackError(indexPackErr, "fatal: early EOF\n")))
+	assert.True(t, isRetryable(background, classifyIndexPackError(indexPackErr, "fatal: write error: Disk quota exceeded\n")))
+
+	assert.False(t, isRetryable(background, indexPackErr))
+	assert.False(t, isRetryable(background, classifyIndexPackError(indexPackErr, "fatal: pack exceeds maximum allowed size\n")))
+	assert.False(t, isRetryable(background, classifyIndexPackError(indexPackErr, "fatal: fsck error in packed object\n")))
+	assert.False(t, isRetryable(background, classifyIndexPackError(indexPackErr, "fatal: pack signature mismatch\n")))
+}
+
+func TestIndexPackDetail(t *testing.T) {
+	indexPackErr := errors.New("exit status 128")
+
+	for _, ex := range []struct {
+		label    string
+		stderr   string
+		expected string
+	}{
+		{
+			"fsck",
+			"remote: error: object 1234: badDate: invalid author/committer line - bad date\nremote: fatal: fsck error in packed object\n",
+			"object 1234: badDate: invalid author/committer line - bad date",
+		},
+		{"fsck without details", "fatal: fsck error in packed object\n", "fsck error in packed object"},
+		{
+			"corrupt",
+			"error: inflate: data stream error (incorrect header check)\nfatal: pack has bad object at offset 12: inflate returned -3\n",
+			"pack has bad object at offset 12: inflate returned -3",
+		},
+		{"disk full", "fatal: write error: No space left on device\n", ""},
+		{"other", "fatal: did not receive expected object 1234\n", ""},
+	} {
+		t.Run(ex.label, func(t *testing.T) {
+			err := classifyIndexPackError(indexPackErr, ex.stderr)
+			assert.Equal(t, ex.expected, indexPackDetail(err))
+			assert.Equal(t, "exit status 128", err.Error())
+		})
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	tb := &tailBuffer{max: 8}
+	_, _ = tb.Write([]byte("hello"))
+	assert.Equal(t, "hello", tb.String())
+	_, _ = tb.Write([]byte(", world"))
+	assert.Equal(t, "o, world", tb.String())
+}
@@ -0,0 +1,46 @@
+package spokes
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pingcap/failpoint"
+)
+
+// failpointPackage is the prefix of the names of the failpoints in this
+// package, which may be left out when enabling them.
+const failpointPackage = "github.com/github/spokes-receive-pack/internal/spokes/"
+
+// failpointsAllowed returns true if failpoints may be enabled through the
+// `failpoints` sockstat var. This must only be set in non-production
+// environments, since anyone who can set sockstat vars could otherwise break
+// pushes on purpose.
+func failpointsAllowed() bool {
+	return os.Getenv("SPOKES_ALLOW_FAILPOINTS") == "1"
+}
+
+// enableFailpoints enables the failpoints in `spec`, which has the same
+// format as GO_FAILPOINTS: `<failpoint>=<terms>[;<failpoint>=<terms>...]`.
+// Failpoint names without a package are taken to be in this package.
+//
+// Failpoints only have an effect in binaries that were built after running
+// `failpoint-ctl enable`.
+func enableFailpoints(spec string) error {
+	for _, fp := range strings.Split(spec, ";") {
+		if fp == "" {
+			continue
+		}
+		name, terms, ok := strings.Cut(fp, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("malformed failpoint %q", fp)
+		}
+		if !strings.Contains(name, "/") {
+			name = failpointPackage + name
+		}
+		if err := failpoint.Enable(name, terms); err != nil {
+			return fmt.Errorf("enabling failpoint %q: %w", name, err)
+		}
+	}
+	return nil
+}
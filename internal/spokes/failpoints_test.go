@@ -0,0 +1,34 @@
+package spokes
+
+import (
+	"testing"
+
+	"github.com/pingcap/failpoint"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnableFailpoints(t *testing.T) {
+	const (
+		short = failpointPackage + "unpack-error"
+		full  = "github.com/github/spokes-receive-pack/internal/governor/some-failpoint"
+	)
+	t.Cleanup(func() {
+		_ = failpoint.Disable(short)
+		_ = failpoint.Disable(full)
+	})
+
+	require.NoError(t, enableFailpoints("unpack-error=return(true);"+full+"=sleep(10)"))
+
+	status, err := failpoint.Status(short)
+	require.NoError(t, err)
+	assert.Equal(t, "return(true)", status)
+
+	status, err = failpoint.Status(full)
+	require.NoError(t, err)
+	assert.Equal(t, "sleep(10)", status)
+
+	assert.Error(t, enableFailpoints("unpack-error"))
+	assert.Error(t, enableFailpoints("=return(true)"))
+	assert.Error(t, enableFailpoints("unpack-error=bogus(terms"))
+}
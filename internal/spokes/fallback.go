@@ -0,0 +1,97 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+
+	"github.com/github/spokes-receive-pack/internal/receivepack"
+	"github.com/github/spokes-receive-pack/internal/sockstat"
+)
+
+// maxFallbackInput is the most input that we're willing to hold on to so
+// that we can replay it to git-receive-pack.
+const maxFallbackInput = 64 * 1024 * 1024
+
+// fallbackEnabled returns true if we should re-run the push that `opts`
+// describe with git-receive-pack when spokes-receive-pack fails because of
+// an internal error. Like shadowing, that only works for stateless-rpc
+// pushes whose pack comes after the commands on stdin, since that's all
+// git-receive-pack can be given.
+func fallbackEnabled(opts Options) bool {
+	return os.Getenv("SPOKES_FALLBACK_ON_ERROR") == "1" && opts.StatelessRPC && opts.Pack == nil
+}
+
+// fallback keeps track of what we've read and written, so that a failed push
+// can be handed over to git-receive-pack as long as the client hasn't seen
+// anything from us yet.
+//
+// This only works with `--stateless-rpc`, where stdin is a request body that
+// ends with EOF. Otherwise, index-pack couldn't be given our recorded input
+// without us waiting for the client to hang up.
+type fallback struct {
+	input  *recordingReader
+	output *trackingWriter
+}
+
+func newFallback(stdin io.Reader, stdout io.Writer) *fallback {
+	return &fallback{
+		input:  &recordingReader{r: stdin, max: maxFallbackInput},
+		output: &trackingWriter{w: stdout},
+	}
+}
+
+// possible returns false if the client has already seen some of our output
+// or if we couldn't keep all of its input.
+func (fb *fallback) possible() bool {
+	return !fb.output.written && !fb.input.overflowed
+}
+
+// run runs git-receive-pack with `args` on the original input, reporting
+// `vars` to governor.
+func (fb *fallback) run(ctx context.Context, stderr io.Writer, args []string, vars sockstat.Vars) error {
+	input := io.MultiReader(bytes.NewReader(fb.input.buf.Bytes()), fb.input.r)
+	rp := receivepack.NewReceivePack(input, fb.output.w, stderr, args, vars)
+	return rp.Execute(ctx)
+}
+
+// recordingReader remembers what has been read through it, up to `max`
+// bytes.
+type recordingReader struct {
+	r          io.Reader
+	buf        bytes.Buffer
+	max        int
+	overflowed bool
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if !rr.overflowed {
+		if rr.buf.Len()+n > rr.max {
+			rr.overflowed = true
+			rr.buf = bytes.Buffer{}
+		} else {
+			rr.buf.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+// Unwrap returns the reader that `rr` reads from.
+func (rr *recordingReader) Unwrap() io.Reader {
+	return rr.r
+}
+
+// trackingWriter remembers whether anything has been written through it.
+type trackingWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (tw *trackingWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		tw.written = true
+	}
+	return tw.w.Write(p)
+}
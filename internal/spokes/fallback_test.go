@@ -0,0 +1,60 @@
+package spokes
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFallbackPossible(t *testing.T) {
+	var out bytes.Buffer
+	fb := newFallback(strings.NewReader("0000PACK..."), &out)
+	assert.True(t, fb.possible())
+
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(fb.input, buf)
+	require.NoError(t, err)
+	assert.True(t, fb.possible())
+	assert.Equal(t, "0000", fb.input.buf.String())
+
+	_, err = fb.output.Write(nil)
+	require.NoError(t, err)
+	assert.True(t, fb.possible())
+
+	_, err = fb.output.Write([]byte("0000"))
+	require.NoError(t, err)
+	assert.False(t, fb.possible())
+	assert.Equal(t, "0000", out.String())
+}
+
+func TestRecordingReaderOverflow(t *testing.T) {
+	rr := &recordingReader{r: strings.NewReader("0123456789"), max: 8}
+
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(rr, buf)
+	require.NoError(t, err)
+	assert.False(t, rr.overflowed)
+	assert.Equal(t, "01234", rr.buf.String())
+
+	_, err = io.ReadFull(rr, buf)
+	require.NoError(t, err)
+	assert.True(t, rr.overflowed)
+	assert.Equal(t, 0, rr.buf.Len())
+}
+
+func TestFallbackEnabled(t *testing.T) {
+	opts := Options{StatelessRPC: true}
+	assert.False(t, fallbackEnabled(opts))
+
+	t.Setenv("SPOKES_FALLBACK_ON_ERROR", "1")
+	assert.True(t, fallbackEnabled(opts))
+	assert.False(t, fallbackEnabled(Options{}))
+
+	// git-receive-pack would only get the commands, not the pack.
+	opts.Pack = strings.NewReader("PACK")
+	assert.False(t, fallbackEnabled(opts))
+}
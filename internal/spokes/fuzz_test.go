@@ -0,0 +1,53 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+)
+
+// pkt formats `s` as a pkt-line.
+func pkt(s string) string {
+	return fmt.Sprintf("%04x%s", 4+len(s), s)
+}
+
+func FuzzReadCommands(f *testing.F) {
+	oid := strings.Repeat("1", 40)
+	f.Add([]byte("00820000000000000000000000000000000000000000 f9cc25952a0d66c0a388ee0decfda12a0122404d refs/heads/main\000report-status side-band-64k\n0000"))
+	f.Add([]byte(pkt(oid+" "+oid+" refs/heads/a\x00report-status\n") +
+		pkt(oid+" "+oid+" refs/heads/b\x00report-status\n") + "0000"))
+	f.Add([]byte("0035shallow " + oid + "\n0000"))
+	f.Add([]byte("0000"))
+	f.Add([]byte("0010shallow\x00caps0000"))
+	f.Add([]byte("0009 \x00\x00 \n0000"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := &spokesReceivePack{
+			input:        bytes.NewReader(data),
+			config:       &config.Config{Entries: []config.ConfigEntry{{Key: "receive.hiderefs", Value: "refs/pull/"}}},
+			objectFormat: "sha1",
+			capabilities: supportedCapabilities("sha1", receiveOptions{}),
+		}
+		commands, shallow, _, err := r.readCommands(context.Background())
+		if err != nil {
+			return
+		}
+		for _, c := range commands {
+			if !r.objectFormat.IsValidOID(c.oldOID) || !r.objectFormat.IsValidOID(c.newOID) {
+				t.Fatalf("command with invalid OIDs: %+v", c)
+			}
+			if c.refname == "" || strings.ContainsAny(c.refname, "\x00\n") {
+				t.Fatalf("command with invalid refname %q", c.refname)
+			}
+		}
+		for _, s := range shallow {
+			if !r.objectFormat.IsValidOID(s) {
+				t.Fatalf("invalid shallow OID %q", s)
+			}
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package spokes
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// hiddenRefMatcher decides which refs are hidden by the receive.hideRefs
+// and transfer.hideRefs rules. A ref is hidden if it starts with the prefix
+// of a rule, unless the last rule that matches it is negated with "!".
+//
+// The prefixes are kept in a trie, so that a ref is checked in one pass
+// over its name, however many rules there are.
+type hiddenRefMatcher struct {
+	// hidden and unhidden are the prefixes of the rules, without "!",
+	// in the order in which they were given.
+	hidden   []string
+	unhidden []string
+
+	// rules are the rules as given.
+	rules []string
+
+	root hiddenRefNode
+}
+
+type hiddenRefNode struct {
+	// children are the nodes for the next byte, sorted by it.
+	children []hiddenRefEdge
+
+	// rule is 1 plus the index of the last rule whose prefix ends
+	// here, or 0 if there is none.
+	rule    int
+	negated bool
+}
+
+type hiddenRefEdge struct {
+	b    byte
+	node *hiddenRefNode
+}
+
+// newHiddenRefMatcher compiles `rules`, which look like the values of
+// receive.hideRefs. Empty rules are ignored.
+func newHiddenRefMatcher(rules []string) *hiddenRefMatcher {
+	m := &hiddenRefMatcher{rules: rules}
+	for i, rule := range rules {
+		if rule == "" {
+			continue
+		}
+		neg, prefix := isNegativeRef(rule)
+		if neg {
+			m.unhidden = append(m.unhidden, prefix)
+		} else {
+			m.hidden = append(m.hidden, prefix)
+		}
+
+		node := &m.root
+		for j := 0; j < len(prefix); j++ {
+			node = node.child(prefix[j])
+		}
+		node.rule = i + 1
+		node.negated = neg
+	}
+	return m
+}
+
+// child returns the child of `n` for `b`, adding it if there is none.
+func (n *hiddenRefNode) child(b byte) *hiddenRefNode {
+	i := 0
+	for i < len(n.children) && n.children[i].b < b {
+		i++
+	}
+	if i < len(n.children) && n.children[i].b == b {
+		return n.children[i].node
+	}
+	child := &hiddenRefNode{}
+	n.children = append(n.children, hiddenRefEdge{})
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = hiddenRefEdge{b: b, node: child}
+	return child
+}
+
+// lookup returns the child of `n` for `b`, or nil.
+func (n *hiddenRefNode) lookup(b byte) *hiddenRefNode {
+	lo, hi := 0, len(n.children)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		switch c := n.children[mid].b; {
+		case c == b:
+			return n.children[mid].node
+		case c < b:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return nil
+}
+
+// isHidden reports whether `refname` is hidden. It is safe to call with a
+// nil *hiddenRefMatcher, which hides nothing.
+func (m *hiddenRefMatcher) isHidden(refname string) bool {
+	_, hidden := m.match(refname)
+	return hidden
+}
+
+// match returns the rule that applies to `refname`, if any, and whether it
+// hides it. It is safe to call with a nil *hiddenRefMatcher.
+func (m *hiddenRefMatcher) match(refname string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+
+	// The rule that applies is the last one given among those whose
+	// prefix `refname` starts with.
+	last, hidden := 0, false
+	node := &m.root
+	for i := 0; i < len(refname); i++ {
+		node = node.lookup(refname[i])
+		if node == nil {
+			break
+		}
+		if node.rule > last {
+			last, hidden = node.rule, !node.negated
+		}
+	}
+	if last == 0 {
+		return "", false
+	}
+	return m.rules[last-1], hidden
+}
+
+// hiddenRefs returns the matcher for the hidden refs of the repository,
+// which is only compiled once per push.
+func (r *spokesReceivePack) hiddenRefs() *hiddenRefMatcher {
+	if r.hiddenRefMatcher == nil {
+		if err := r.loadHiddenRefs(); err != nil {
+			// Pushes load the rules before they start, and fail if
+			// they can't, so a rules file must have gone away
+			// since. Hide too much rather than too little.
+			r.log.Error("loading hidden refs, hiding all refs", "error", err)
+			r.hiddenRefMatcher = newHiddenRefMatcher([]string{"refs/"})
+		}
+	}
+	return r.hiddenRefMatcher
+}
+
+// loadHiddenRefs compiles the matcher for the hidden refs of the
+// repository, from the config and the files that hideRefsFileKey names.
+func (r *spokesReceivePack) loadHiddenRefs() error {
+	rules, err := r.getHiddenRefs()
+	if err != nil {
+		return err
+	}
+	r.hiddenRefMatcher = newHiddenRefMatcher(rules)
+	return nil
+}
+
+// gitHiddenRefs returns the rules that the git commands that hide refs
+// themselves must be told about to hide the same refs as we do, or nil if
+// the config already tells git all of them. git doesn't know about the
+// rules in the files that hideRefsFileKey names. The last rule that matches
+// a ref decides, so repeating all of our rules after the ones in the config
+// makes git apply them in our order.
+func (r *spokesReceivePack) gitHiddenRefs() []string {
+	if len(r.config.GetAll(hideRefsFileKey)) == 0 {
+		return nil
+	}
+	return r.hiddenRefs().rules
+}
+
+// hiddenRefsConfig returns the `-c` options that make git hide the same
+// refs as we do, which point at a config file in the quarantine, and a
+// function that removes the file. It returns no options if git doesn't
+// need any.
+func (r *spokesReceivePack) hiddenRefsConfig() ([]string, func(), error) {
+	rules := r.gitHiddenRefs()
+	if rules == nil {
+		return nil, func() {}, nil
+	}
+	path, args, err := writeHiddenRefsConfig(r.quarantineFolder, rules)
+	if err != nil {
+		return nil, nil, err
+	}
+	return args, func() { _ = os.Remove(path) }, nil
+}
+
+// writeHiddenRefsConfig writes `rules` to a new config file in `dir`, as
+// values of receive.hideRefs, and returns its path and the `-c` option
+// that makes git include it after the repository's own config. There can
+// be too many rules to pass each of them in a `-c` option of its own.
+func writeHiddenRefsConfig(dir string, rules []string) (string, []string, error) {
+	var content strings.Builder
+	content.WriteString("[receive]\n")
+	for _, rule := range rules {
+		fmt.Fprintf(&content, "\thideRefs = %s\n", quoteConfigValue(rule))
+	}
+
+	f, err := os.CreateTemp(dir, "spokes-hidden-refs-*.config")
+	if err != nil {
+		return "", nil, fmt.Errorf("writing hidden refs config: %w", err)
+	}
+	if _, err := f.WriteString(content.String()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", nil, fmt.Errorf("writing hidden refs config: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", nil, fmt.Errorf("writing hidden refs config: %w", err)
+	}
+	return f.Name(), []string{"-c", "include.path=" + f.Name()}, nil
+}
+
+// quoteConfigValue quotes `value` for a git config file, so that git reads
+// it back as it is.
+func quoteConfigValue(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+	return `"` + r.Replace(value) + `"`
+}
+
+// hideRefsFileKey names files of more rules like receive.hideRefs, for
+// repositories with too many of them to list in their config. The rules
+// from the files come before the ones in the config, so that the config
+// can unhide refs that the files hide. Relative paths are relative to the
+// repository.
+const hideRefsFileKey = "receive.hiderefsfile"
+
+// readHideRefsFile reads the rules in the file at `path`, one per line.
+// Surrounding whitespace, blank lines, and lines starting with "#" are
+// ignored.
+func readHideRefsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", hideRefsFileKey, err)
+	}
+	defer f.Close()
+
+	var rules []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules = append(rules, line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s %s: %w", hideRefsFileKey, path, err)
+	}
+	return rules, nil
+}
@@ -0,0 +1,207 @@
+package spokes
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHiddenRefMatcher(t *testing.T) {
+	m := newHiddenRefMatcher([]string{
+		"refs/pull/",
+		"",
+		"!refs/pull/1/",
+		"refs/pull/1/merge",
+		"!refs/pull/",
+		"refs/pull/2",
+	})
+	assert.Equal(t, []string{"refs/pull/", "refs/pull/1/merge", "refs/pull/2"}, m.hidden)
+	assert.Equal(t, []string{"refs/pull/1/", "refs/pull/"}, m.unhidden)
+
+	for _, tc := range []struct {
+		refname string
+		hidden  bool
+	}{
+		{"refs/heads/main", false},
+		{"refs/pull/1/head", false},
+		{"refs/pull/1/merge", false},
+		{"refs/pull/3/head", false},
+		{"refs/pull/2/head", true},
+		{"refs/pull/20/head", true},
+		{"refs/pul", false},
+	} {
+		assert.Equal(t, tc.hidden, m.isHidden(tc.refname), tc.refname)
+	}
+
+	var nilMatcher *hiddenRefMatcher
+	assert.False(t, nilMatcher.isHidden("refs/pull/1/head"))
+}
+
+func TestHiddenRefMatcherMatchesRuleOrder(t *testing.T) {
+	// The matcher agrees with applying the rules one after another.
+	rules := []string{"refs/a", "!refs/ab", "refs/abc/", "!refs/", "refs/b", "!refs/b/x", "refs/abc/d"}
+	naive := func(refname string) bool {
+		hidden := false
+		for _, rule := range rules {
+			neg, prefix := isNegativeRef(rule)
+			if strings.HasPrefix(refname, prefix) {
+				hidden = !neg
+			}
+		}
+		return hidden
+	}
+
+	m := newHiddenRefMatcher(rules)
+	for _, refname := range []string{
+		"refs/a", "refs/ab", "refs/abc", "refs/abc/", "refs/abc/d", "refs/abc/e",
+		"refs/b", "refs/b/x", "refs/b/xy", "refs/b/y", "refs/c", "refs", "",
+	} {
+		assert.Equal(t, naive(refname), m.isHidden(refname), refname)
+	}
+}
+
+func TestHiddenRefsCompiledOnce(t *testing.T) {
+	r := &spokesReceivePack{config: &config.Config{Entries: []config.ConfigEntry{
+		{Key: "receive.hiderefs", Value: "refs/pull/"},
+		{Key: "transfer.hiderefs", Value: "!refs/pull/1/"},
+	}}}
+
+	m := r.hiddenRefs()
+	assert.Same(t, m, r.hiddenRefs())
+	assert.True(t, m.isHidden("refs/pull/2/head"))
+	assert.False(t, m.isHidden("refs/pull/1/head"))
+}
+
+func TestHiddenRefMatcherMatch(t *testing.T) {
+	m := newHiddenRefMatcher([]string{"refs/pull/", "", "!refs/pull/1/"})
+	rule, hidden := m.match("refs/pull/1/head")
+	assert.Equal(t, "!refs/pull/1/", rule)
+	assert.False(t, hidden)
+	rule, hidden = m.match("refs/pull/2/head")
+	assert.Equal(t, "refs/pull/", rule)
+	assert.True(t, hidden)
+	rule, hidden = m.match("refs/heads/main")
+	assert.Empty(t, rule)
+	assert.False(t, hidden)
+}
+
+func TestHiddenRefsFromFile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hidden-refs"), []byte(
+		"# Review refs\n"+
+			"refs/pull/\n"+
+			"\n"+
+			"  refs/merge-queue/  \n"+
+			"#refs/keep/\n",
+	), 0o644))
+
+	r := &spokesReceivePack{repoPath: dir, config: &config.Config{Entries: []config.ConfigEntry{
+		{Key: "receive.hiderefs", Value: "!refs/pull/1/"},
+		{Key: hideRefsFileKey, Value: "hidden-refs"},
+	}}}
+	rules, err := r.getHiddenRefs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"refs/pull/", "refs/merge-queue/", "!refs/pull/1/"}, rules)
+
+	require.NoError(t, r.loadHiddenRefs())
+	m := r.hiddenRefs()
+	assert.True(t, m.isHidden("refs/pull/2/head"))
+	assert.True(t, m.isHidden("refs/merge-queue/main"))
+	assert.False(t, m.isHidden("refs/pull/1/head"))
+	assert.False(t, m.isHidden("refs/keep/a"))
+
+	// A missing file fails the push, or, if it goes away after the push
+	// started, hides everything.
+	r = &spokesReceivePack{repoPath: dir, config: &config.Config{Entries: []config.ConfigEntry{
+		{Key: hideRefsFileKey, Value: filepath.Join(dir, "missing")},
+	}}}
+	assert.ErrorIs(t, r.loadHiddenRefs(), os.ErrNotExist)
+	assert.True(t, r.hiddenRefs().isHidden("refs/heads/main"))
+}
+
+func TestConnectivityCheckSeesHiddenRefsFromFile(t *testing.T) {
+	ctx := context.Background()
+	q := quarantinedRepo(t)
+	head := q.repo.Head
+	q.git("", "update-ref", "refs/pull/1/head", head)
+	q.git("", "update-ref", "refs/heads/main", head+"^")
+	// Otherwise the repository's refs would be tips again as the refs of
+	// the quarantine's alternate.
+	q.git("", "config", "core.alternateRefsPrefixes", "refs/heads/")
+	require.NoError(t, os.WriteFile(filepath.Join(q.repo.Path, "hidden-refs"), []byte("refs/pull/\n"), 0o644))
+
+	commands := []command{{oldOID: nullSHA1OID, newOID: head, refname: "refs/heads/topic"}}
+
+	r := q.receivePack()
+	newCommits, err := r.performCheckConnectivity(ctx, commands, "")
+	require.NoError(t, err)
+	assert.Equal(t, 0, newCommits)
+
+	// The commit is only reachable from a hidden ref, so it's new to the
+	// client, and must be walked.
+	r = q.receivePack()
+	r.config = &config.Config{Entries: []config.ConfigEntry{{Key: hideRefsFileKey, Value: "hidden-refs"}}}
+	require.NoError(t, r.loadHiddenRefs())
+	assert.Equal(t, []string{"refs/pull/"}, r.gitHiddenRefs())
+	newCommits, err = r.performCheckConnectivity(ctx, commands, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, newCommits)
+
+	// The config file that told git about them is gone.
+	entries, err := os.ReadDir(q.path)
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.NotContains(t, e.Name(), "hidden-refs", "left behind in the quarantine")
+	}
+}
+
+func TestConnectivityCheckSeesManyHiddenRefsFromFile(t *testing.T) {
+	ctx := context.Background()
+	q := quarantinedRepo(t)
+	head := q.repo.Head
+	q.git("", "update-ref", "refs/pull/1/head", head)
+	q.git("", "update-ref", "refs/heads/main", head+"^")
+	q.git("", "config", "core.alternateRefsPrefixes", "refs/heads/")
+
+	// More rules than fit on a command line, at one per option, with
+	// the one that matters last.
+	var rules strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&rules, "refs/archived/%d/%s/\n", i, strings.Repeat("x", 500))
+	}
+	rules.WriteString("refs/pull/\n")
+	require.NoError(t, os.WriteFile(filepath.Join(q.repo.Path, "hidden-refs"), []byte(rules.String()), 0o644))
+
+	commands := []command{{oldOID: nullSHA1OID, newOID: head, refname: "refs/heads/topic"}}
+	r := q.receivePack()
+	r.config = &config.Config{Entries: []config.ConfigEntry{{Key: hideRefsFileKey, Value: "hidden-refs"}}}
+	require.NoError(t, r.loadHiddenRefs())
+	require.Len(t, r.gitHiddenRefs(), 5001)
+
+	newCommits, err := r.performCheckConnectivity(ctx, commands, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, newCommits)
+}
+
+func TestWriteHiddenRefsConfig(t *testing.T) {
+	dir := t.TempDir()
+	rules := []string{"refs/pull/", "!refs/pull/1/", `refs/odd"name\`, "refs/a b"}
+	path, args, err := writeHiddenRefsConfig(dir, rules)
+	require.NoError(t, err)
+	assert.Equal(t, dir, filepath.Dir(path))
+	assert.Equal(t, []string{"-c", "include.path=" + path}, args)
+
+	cmd := exec.Command("git", append(args, "config", "--get-all", "receive.hideRefs")...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, strings.Join(rules, "\n")+"\n", string(out))
+}
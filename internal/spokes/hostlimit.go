@@ -0,0 +1,77 @@
+package spokes
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/github/spokes-receive-pack/internal/logger"
+)
+
+// The environment variables that limit how many pushes may be processed at
+// once on this host, whatever repositories they are to. Unlike governor,
+// which can do the same and more, the limit is enforced by the pushes
+// themselves, with locks in a directory that all of them share, so that it
+// holds even where governor is unavailable. There is no limit unless
+// maxHostPushesEnv is set.
+const (
+	maxHostPushesEnv   = "SPOKES_MAX_HOST_PUSHES"
+	hostPushLockDirEnv = "SPOKES_HOST_PUSH_LOCK_DIR"
+)
+
+// defaultHostPushLockDir is the directory, under os.TempDir(), that holds
+// the host's push slots unless hostPushLockDirEnv says otherwise.
+const defaultHostPushLockDir = "spokes-receive-pack-slots"
+
+// errHostBusy is returned by acquireHostSlot if all of the host's slots
+// are taken. Pushes don't wait for one, since the client can try again
+// sooner, maybe on another host. Run tells the client in an ERR packet.
+var errHostBusy = errors.New("too many pushes on this host at once, try again later" + retryableHint)
+
+// maxHostPushes returns how many pushes may be processed on this host at
+// once, or 0 for no limit.
+func maxHostPushes(lg *logger.Logger) int {
+	v := os.Getenv(maxHostPushesEnv)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		lg.Warn("ignoring "+maxHostPushesEnv, "value", v)
+		return 0
+	}
+	return n
+}
+
+// acquireHostSlot takes one of the host's push slots, which keeps this push
+// counted until it's released. It returns a nil lock if there is no limit,
+// or if a slot couldn't be taken for a reason other than other pushes
+// holding all of them, in which case the push goes ahead anyway. It
+// returns errHostBusy if all of the slots are taken.
+func acquireHostSlot(lg *logger.Logger) (*pushLock, error) {
+	n := maxHostPushes(lg)
+	if n == 0 {
+		return nil, nil
+	}
+
+	dir := os.Getenv(hostPushLockDirEnv)
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), defaultHostPushLockDir)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		lg.Warn("taking host push slot", "error", err)
+		return nil, nil
+	}
+
+	lock, err := tryPushSlots(dir, n)
+	if err != nil {
+		lg.Warn("taking host push slot", "error", err)
+		return nil, nil
+	}
+	if lock == nil {
+		lg.Warn("host push slots are all taken", "slots", n)
+		return nil, errHostBusy
+	}
+	return lock, nil
+}
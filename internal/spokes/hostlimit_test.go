@@ -0,0 +1,68 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/github/spokes-receive-pack/internal/sockstat"
+)
+
+func TestAcquireHostSlot(t *testing.T) {
+	t.Setenv(hostPushLockDirEnv, t.TempDir())
+
+	t.Setenv(maxHostPushesEnv, "")
+	lock, err := acquireHostSlot(nil)
+	require.NoError(t, err)
+	assert.Nil(t, lock)
+
+	t.Setenv(maxHostPushesEnv, "2")
+	first, err := acquireHostSlot(nil)
+	require.NoError(t, err)
+	require.NotNil(t, first)
+	second, err := acquireHostSlot(nil)
+	require.NoError(t, err)
+	require.NotNil(t, second)
+
+	_, err = acquireHostSlot(nil)
+	assert.ErrorIs(t, err, errHostBusy)
+
+	second.release()
+	third, err := acquireHostSlot(nil)
+	require.NoError(t, err)
+	assert.NotNil(t, third)
+	third.release()
+	first.release()
+
+	t.Setenv(maxHostPushesEnv, "lots")
+	lock, err = acquireHostSlot(nil)
+	require.NoError(t, err)
+	assert.Nil(t, lock)
+}
+
+func TestRunRefusesWhenHostIsBusy(t *testing.T) {
+	t.Setenv(hostPushLockDirEnv, t.TempDir())
+	t.Setenv(maxHostPushesEnv, "1")
+	slot, err := acquireHostSlot(nil)
+	require.NoError(t, err)
+	defer slot.release()
+
+	var stdout, stderr bytes.Buffer
+	code, err := Run(context.Background(), Options{
+		Stdin:    strings.NewReader(""),
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		RepoPath: t.TempDir(),
+		Vars:     sockstat.Vars{QuarantineID: "q"},
+		Log:      logger.New(io.Discard),
+	})
+	assert.ErrorIs(t, err, errHostBusy)
+	assert.Equal(t, ExitGovernorError, code)
+	assert.Equal(t, "004aERR "+errHostBusy.Error()+"\n", stdout.String())
+}
@@ -0,0 +1,63 @@
+package spokes
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// defaultKeepaliveInterval is how long we let an HTTP client go without
+// hearing from us while the push is checked, unless the caller says
+// otherwise. It is the same as git's receive.keepAlive default.
+const defaultKeepaliveInterval = 5 * time.Second
+
+// keepalivePacket is an empty packet on the data sideband, which clients
+// ignore, like git-receive-pack sends.
+const keepalivePacket = "0005\x01"
+
+// keepaliveInterval returns how often to send keepalives, or 0 if they
+// shouldn't be sent. They are only needed for HTTP, where proxies cut
+// connections that are silent for too long.
+func (r *spokesReceivePack) keepaliveInterval() time.Duration {
+	if !r.statelessRPC {
+		return 0
+	}
+	if r.sockstat.KeepaliveInterval > 0 {
+		return time.Duration(r.sockstat.KeepaliveInterval) * time.Second
+	}
+	return defaultKeepaliveInterval
+}
+
+// startKeepalive writes keepalivePacket to `w` every `interval` until the
+// returned function is called, which waits for the writes to stop. Nothing
+// else may write to `w` in between. If `interval` isn't positive, nothing
+// is written.
+func startKeepalive(w io.Writer, interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if _, err := io.WriteString(w, keepalivePacket); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,60 @@
+package spokes
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/sockstat"
+	"github.com/stretchr/testify/assert"
+)
+
+// lockedBuffer is a bytes.Buffer that can be read while it's written to.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestStartKeepalive(t *testing.T) {
+	var buf lockedBuffer
+	stop := startKeepalive(&buf, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return strings.Count(buf.String(), keepalivePacket) >= 2
+	}, time.Second, time.Millisecond)
+	stop()
+
+	// Nothing is written once it has stopped.
+	out := buf.String()
+	assert.Equal(t, strings.Repeat(keepalivePacket, len(out)/len(keepalivePacket)), out)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, out, buf.String())
+
+	var none lockedBuffer
+	startKeepalive(&none, 0)()
+	assert.Empty(t, none.String())
+}
+
+func TestKeepaliveInterval(t *testing.T) {
+	r := &spokesReceivePack{}
+	assert.Zero(t, r.keepaliveInterval())
+
+	r.statelessRPC = true
+	assert.Equal(t, defaultKeepaliveInterval, r.keepaliveInterval())
+
+	r.sockstat = sockstat.Vars{KeepaliveInterval: 20}
+	assert.Equal(t, 20*time.Second, r.keepaliveInterval())
+}
@@ -0,0 +1,103 @@
+package spokes
+
+import (
+	"strings"
+)
+
+// The kinds of rejection whose message can be customized. Each one is the
+// name of the setting, in the `rejectmessage` config section, that holds
+// the template for it, like
+//
+//	[rejectmessage]
+//		docsURL = https://docs.example.com/pushing
+//		maxSize = pushes are limited to %(limit) bytes; see %(docs)
+//
+// The message for hidden refs can also be set for the refs under a prefix,
+// the same way that they are hidden, like
+//
+//	[receive]
+//		hideRefs = refs/merge-queue/
+//	[rejectmessage "refs/merge-queue/"]
+//		hiddenRef = use the merge queue API to update %(refname)
+const (
+	messageHiddenRef   = "hiddenref"
+	messageMaxSize     = "maxsize"
+	messageRefLimit    = "reflimit"
+	messageCommitLimit = "commitlimit"
+	messageBlobSize    = "blobsize"
+	messageFsck        = "fsck"
+	messageCorruptPack = "corruptpack"
+	messageDiskFull    = "diskfull"
+	messageBusy        = "busy"
+	messageRefDenied   = "refdenied"
+
+	messageDefaultBranch = "defaultbranch"
+)
+
+// docsURLKey is the setting whose value is substituted for %(docs).
+const docsURLKey = "rejectmessage.docsurl"
+
+// defaultMessages are the templates used for the kinds of rejection that
+// haven't been customized.
+var defaultMessages = map[string]string{
+	messageHiddenRef:   "deny updating a hidden ref",
+	messageMaxSize:     "error processing packfiles: %(error)",
+	messageRefLimit:    "maximum ref updates exceeded: %(count) commands sent but max allowed is %(limit)",
+	messageCommitLimit: "push adds %(count) commits, more than the limit of %(limit)",
+	messageBlobSize:    "%(path) is %(size) bytes, more than the limit of %(limit); use Git LFS (https://git-lfs.com) for large files",
+	messageFsck:        "pushed objects failed fsck: %(error)",
+	messageCorruptPack: "pushed pack is corrupt: %(error)",
+	messageDiskFull:    "insufficient storage, try again later",
+	messageBusy:        "too many pushes to this repository at once, try again later",
+	messageRefDenied:   "permission denied to update %(refname)",
+
+	messageDefaultBranch: "deleting the default branch leaves the repository without one; make %(newref) the default branch first",
+}
+
+// message returns the message for a rejection of kind `kind`. Its
+// template, from the config or the default, is expanded by replacing each
+// %(name) placeholder with the value that follows `name` in `vars`, and
+// %(docs) with the configured docs URL. Unknown placeholders are left
+// alone.
+func (r *spokesReceivePack) message(kind string, vars ...string) string {
+	tmpl := r.config.Get("rejectmessage." + kind)
+	if tmpl == "" {
+		tmpl = defaultMessages[kind]
+	}
+	return r.expand(tmpl, vars...)
+}
+
+// hiddenRefMessage returns the message for rejecting an update of the
+// hidden ref `refname`. The template for the longest prefix of `refname`
+// that has one takes precedence over the general one.
+func (r *spokesReceivePack) hiddenRefMessage(refname string) string {
+	var tmpl, prefix string
+	for _, entry := range r.config.Entries {
+		rest, ok := strings.CutPrefix(entry.Key, "rejectmessage.")
+		if !ok {
+			continue
+		}
+		p, ok := strings.CutSuffix(rest, "."+messageHiddenRef)
+		if !ok || !strings.HasPrefix(refname, p) || len(p) < len(prefix) {
+			continue
+		}
+		tmpl, prefix = entry.Value, p
+	}
+	if tmpl == "" {
+		return r.message(messageHiddenRef, "refname", refname)
+	}
+	return r.expand(tmpl, "refname", refname)
+}
+
+// expand expands the placeholders in `tmpl`, as described for message.
+func (r *spokesReceivePack) expand(tmpl string, vars ...string) string {
+	if !strings.Contains(tmpl, "%(") {
+		return tmpl
+	}
+
+	oldnew := []string{"%(docs)", r.config.Get(docsURLKey)}
+	for i := 0; i+1 < len(vars); i += 2 {
+		oldnew = append(oldnew, "%("+vars[i]+")", vars[i+1])
+	}
+	return strings.NewReplacer(oldnew...).Replace(tmpl)
+}
@@ -0,0 +1,55 @@
+package spokes
+
+import (
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessage(t *testing.T) {
+	r := &spokesReceivePack{config: &config.Config{}}
+	assert.Equal(t, "deny updating a hidden ref", r.message(messageHiddenRef, "refname", "refs/pull/1/head"))
+	assert.Equal(t,
+		"maximum ref updates exceeded: 12 commands sent but max allowed is 10",
+		r.message(messageRefLimit, "count", "12", "limit", "10"),
+	)
+	assert.Equal(t,
+		"pushed pack is corrupt: pack signature mismatch",
+		r.message(messageCorruptPack, "error", "pack signature mismatch"),
+	)
+	assert.Equal(t, "insufficient storage, try again later", r.message(messageDiskFull))
+
+	r.config = &config.Config{Entries: []config.ConfigEntry{
+		{Key: "rejectmessage.docsurl", Value: "https://docs.example.com/limits"},
+		{Key: "rejectmessage.maxsize", Value: "pushes are limited to %(limit) bytes; see %(docs)"},
+		{Key: "rejectmessage.hiddenref", Value: "%(refname) is read-only %(unknown)"},
+	}}
+	assert.Equal(t,
+		"pushes are limited to 1024 bytes; see https://docs.example.com/limits",
+		r.message(messageMaxSize, "error", "fatal: pack exceeds maximum allowed size", "limit", "1024"),
+	)
+	assert.Equal(t, "refs/pull/1/head is read-only %(unknown)", r.message(messageHiddenRef, "refname", "refs/pull/1/head"))
+	assert.Equal(t,
+		"maximum ref updates exceeded: 12 commands sent but max allowed is 10",
+		r.message(messageRefLimit, "count", "12", "limit", "10"),
+	)
+}
+
+func TestHiddenRefMessage(t *testing.T) {
+	r := &spokesReceivePack{config: &config.Config{}}
+	assert.Equal(t, "deny updating a hidden ref", r.hiddenRefMessage("refs/merge-queue/main"))
+
+	r.config = &config.Config{Entries: []config.ConfigEntry{
+		{Key: "rejectmessage.hiddenref", Value: "%(refname) is hidden"},
+		{Key: "rejectmessage.refs/merge-queue/.hiddenref", Value: "use the merge queue API to update %(refname)"},
+		{Key: "rejectmessage.refs/merge-queue/Special/.hiddenref", Value: "%(refname) is special; see %(docs)"},
+		{Key: "rejectmessage.docsurl", Value: "https://docs.example.com/merge-queue"},
+	}}
+	assert.Equal(t, "use the merge queue API to update refs/merge-queue/main", r.hiddenRefMessage("refs/merge-queue/main"))
+	assert.Equal(t,
+		"refs/merge-queue/Special/x is special; see https://docs.example.com/merge-queue",
+		r.hiddenRefMessage("refs/merge-queue/Special/x"),
+	)
+	assert.Equal(t, "refs/pull/1/head is hidden", r.hiddenRefMessage("refs/pull/1/head"))
+}
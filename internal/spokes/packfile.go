@@ -0,0 +1,44 @@
+package spokes
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// openPackFile opens the pack that the --pack-file option names, which is
+// either a path or "fd:N" for an inherited file descriptor, like the
+// sockstat vars file. It lets a frontend, like the HTTP one, spool the pack
+// and enforce its limits before we start, and hand it to us separately
+// from the commands on stdin.
+func openPackFile(spec string) (*os.File, error) {
+	fdStr, ok := strings.CutPrefix(spec, "fd:")
+	if !ok {
+		f, err := os.Open(spec)
+		if err != nil {
+			return nil, fmt.Errorf("opening pack file: %w", err)
+		}
+		return f, nil
+	}
+
+	fd, err := strconv.ParseUint(fdStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pack file descriptor %q: %w", fdStr, err)
+	}
+	f := os.NewFile(uintptr(fd), "pack")
+	if f == nil {
+		return nil, fmt.Errorf("invalid pack file descriptor %d", fd)
+	}
+	return f, nil
+}
+
+// packInput returns where to read the pack from: r.pack, if the pack was
+// handed to us separately, or else the rest of the client's input.
+func (r *spokesReceivePack) packInput() io.Reader {
+	if r.pack != nil {
+		return r.pack
+	}
+	return r.input
+}
@@ -0,0 +1,55 @@
+package spokes
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenPackFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pack")
+	require.NoError(t, os.WriteFile(path, []byte("PACK"), 0644))
+
+	f, err := openPackFile(path)
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "PACK", string(data))
+	require.NoError(t, f.Close())
+
+	// Hand openPackFile a descriptor that nothing else owns, as if it had
+	// been inherited, so that closing it doesn't close anyone else's.
+	inherited, err := os.Open(path)
+	require.NoError(t, err)
+	fd, err := syscall.Dup(int(inherited.Fd()))
+	require.NoError(t, inherited.Close())
+	require.NoError(t, err)
+	f, err = openPackFile(fmt.Sprintf("fd:%d", fd))
+	require.NoError(t, err)
+	data, err = io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "PACK", string(data))
+	require.NoError(t, f.Close())
+
+	for _, spec := range []string{filepath.Join(t.TempDir(), "missing"), "fd:", "fd:x"} {
+		_, err := openPackFile(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestPackInput(t *testing.T) {
+	input := strings.NewReader("0000PACK")
+	r := &spokesReceivePack{input: input}
+	assert.Equal(t, input, r.packInput())
+
+	pack := strings.NewReader("PACK")
+	r.pack = pack
+	assert.Equal(t, pack, r.packInput())
+}
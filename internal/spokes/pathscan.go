@@ -0,0 +1,215 @@
+package spokes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/github/spokes-receive-pack/internal/childenv"
+	"github.com/github/spokes-receive-pack/internal/pipe"
+	"github.com/github/spokes-receive-pack/internal/policy"
+)
+
+// scanPathsFailedMessage is the reason given for rejecting a ref update
+// whose new paths couldn't be checked against the path rules.
+const scanPathsFailedMessage = "path policy could not be checked"
+
+// applyPathRules rejects the commands whose new commits add or change
+// paths that the path rules don't allow. Each command is scanned on its
+// own, so that every one is told about its own violation.
+func (r *spokesReceivePack) applyPathRules(ctx context.Context, commands []command) {
+	if !r.pathRules.Enabled() && r.pathRulesErr == nil {
+		return
+	}
+
+	for i := range commands {
+		c := &commands[i]
+		if c.err != "" || c.isDelete() {
+			continue
+		}
+
+		if r.pathRulesErr != nil {
+			c.err = "invalid path policy"
+			c.reportFF = "ng"
+			continue
+		}
+
+		msg, err := r.scanNewPaths(ctx, c.newOID)
+		if err != nil {
+			r.log.With("phase", phasePolicy).Error("path scan failed", "refname", c.refname, "error", err)
+			msg = scanPathsFailedMessage
+			c.retryable = true
+		}
+		if msg != "" {
+			c.err = msg
+			c.reportFF = "ng"
+			if !c.retryable {
+				c.rejection = rejectionPolicy
+			}
+		}
+	}
+}
+
+// scanNewPaths returns the first violation of the path rules by the
+// commits reachable from `oid` that aren't reachable from any ref yet, or
+// "" if there is none.
+func (r *spokesReceivePack) scanNewPaths(ctx context.Context, oid string) (string, error) {
+	var violation string
+
+	if len(r.pathRules.Block) > 0 || r.pathRules.MaxPathLength > 0 {
+		p := r.newPipeline()
+		p.Add(
+			r.quarantined(pipe.CommandStage("rev-list", exec.Command(
+				"git", "rev-list", oid, "--not", "--all", "--alternate-refs",
+			))),
+			// A merge's paths that match one of its parents come from
+			// that parent, which is either scanned itself or already
+			// in the repository, so `-c` leaves them out.
+			r.quarantined(pipe.CommandStage("diff-tree", exec.Command(
+				"git", "diff-tree", "--stdin", "-r", "-c", "--root",
+				"--no-commit-id", "--name-only", "-z", "--diff-filter=d",
+			))),
+			pipe.Function(
+				"check-paths",
+				func(_ context.Context, _ pipe.Env, input io.Reader, _ io.Writer) error {
+					var err error
+					violation, err = checkPaths(input, r.pathRules)
+					if err == nil && violation != "" {
+						return pipe.FinishEarly
+					}
+					return err
+				},
+			),
+		)
+		if err := p.Run(ctx); err != nil {
+			return "", fmt.Errorf("scanning new paths: %w", err)
+		}
+		if violation != "" {
+			return violation, nil
+		}
+	}
+
+	if r.pathRules.MaxTreeEntries > 0 {
+		// Only the new trees can have more entries than before. The
+		// filter leaves the commits in the list, which are skipped.
+		p := r.newPipeline()
+		p.Add(
+			r.quarantined(pipe.CommandStage("rev-list", exec.Command(
+				"git", "rev-list", "--objects", "--filter=object:type=tree",
+				oid, "--not", "--all", "--alternate-refs",
+			))),
+			r.quarantined(pipe.CommandStage("cat-file", exec.Command(
+				"git", "cat-file", "--batch=%(objecttype) %(objectsize) %(rest)",
+			))),
+			pipe.Function(
+				"check-trees",
+				func(_ context.Context, _ pipe.Env, input io.Reader, _ io.Writer) error {
+					var err error
+					violation, err = checkTrees(input, r.objectFormat.HexLength()/2, r.pathRules)
+					if err == nil && violation != "" {
+						return pipe.FinishEarly
+					}
+					return err
+				},
+			),
+		)
+		if err := p.Run(ctx); err != nil {
+			return "", fmt.Errorf("scanning new trees: %w", err)
+		}
+	}
+
+	return violation, nil
+}
+
+// quarantined makes `stage` see the objects of the push, and nothing of
+// our environment but childenv.Environ.
+func (r *spokesReceivePack) quarantined(stage pipe.Stage) pipe.Stage {
+	return r.measure(childenv.Scrubbed(pipe.WithStageEnv(stage, r.quarantineEnvVars()...)))
+}
+
+// checkPaths checks the NUL-terminated paths that `git diff-tree -z
+// --name-only` writes to `input` against `rules`, and returns the first
+// violation.
+func checkPaths(input io.Reader, rules policy.PathRules) (string, error) {
+	br := bufio.NewReader(input)
+	for {
+		p, err := br.ReadString(0)
+		if len(p) > 0 && err == nil {
+			if msg := rules.CheckPath(p[:len(p)-1]); msg != "" {
+				return msg, nil
+			}
+		}
+		switch {
+		case err == io.EOF:
+			return "", nil
+		case err != nil:
+			return "", fmt.Errorf("reading 'diff-tree' output: %w", err)
+		}
+	}
+}
+
+// checkTrees checks the number of entries of the trees that `git cat-file
+// --batch='%(objecttype) %(objectsize) %(rest)'` writes to `input`, whose
+// rest is their path, against `rules`, and returns the first violation.
+// `hashLen` is the length of a binary object ID.
+func checkTrees(input io.Reader, hashLen int, rules policy.PathRules) (string, error) {
+	br := bufio.NewReader(input)
+	var content []byte
+	for {
+		header, err := br.ReadString('\n')
+		if err == io.EOF && header == "" {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("reading 'cat-file' output: %w", err)
+		}
+
+		objectType, rest, _ := strings.Cut(header[:len(header)-1], " ")
+		sizeStr, dir, _ := strings.Cut(rest, " ")
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil {
+			return "", fmt.Errorf("unexpected 'cat-file' output %q", header)
+		}
+
+		if cap(content) < size+1 {
+			content = make([]byte, size+1)
+		}
+		content = content[:size+1]
+		if _, err := io.ReadFull(br, content); err != nil {
+			return "", fmt.Errorf("reading 'cat-file' output: %w", err)
+		}
+		if objectType != "tree" {
+			continue
+		}
+
+		n, err := countTreeEntries(content[:size], hashLen)
+		if err != nil {
+			return "", fmt.Errorf("tree at %q: %w", dir, err)
+		}
+		if msg := rules.CheckTreeEntries(dir, n); msg != "" {
+			return msg, nil
+		}
+	}
+}
+
+// countTreeEntries counts the entries of a tree object, each of which is a
+// mode and a name ending in NUL, followed by a binary object ID that may
+// itself contain NULs.
+func countTreeEntries(tree []byte, hashLen int) (int, error) {
+	n := 0
+	for len(tree) > 0 {
+		nul := bytes.IndexByte(tree, 0)
+		if nul < 0 || len(tree) < nul+1+hashLen {
+			return n, errors.New("truncated tree entry")
+		}
+		tree = tree[nul+1+hashLen:]
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,114 @@
+package spokes
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountTreeEntries(t *testing.T) {
+	// The second OID contains a NUL, which mustn't end the entry.
+	oid1 := strings.Repeat("\x01", 20)
+	oid2 := "\x00" + strings.Repeat("\x02", 19)
+	tree := "100644 a\x00" + oid1 + "40000 b\x00" + oid2
+
+	n, err := countTreeEntries([]byte(tree), 20)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	_, err = countTreeEntries([]byte(tree[:len(tree)-1]), 20)
+	assert.Error(t, err)
+}
+
+func TestCheckPaths(t *testing.T) {
+	rules := policy.PathRules{Block: []string{"*.exe"}}
+
+	msg, err := checkPaths(strings.NewReader("README\x00src/main.go\x00"), rules)
+	require.NoError(t, err)
+	assert.Equal(t, "", msg)
+
+	msg, err = checkPaths(strings.NewReader("README\x00bin/setup.exe\x00src/main.go\x00"), rules)
+	require.NoError(t, err)
+	assert.Equal(t, `path "bin/setup.exe" is blocked by the pattern "*.exe"`, msg)
+}
+
+func TestCheckTrees(t *testing.T) {
+	rules := policy.PathRules{MaxTreeEntries: 1}
+	oid := strings.Repeat("\x01", 20)
+	small := "100644 a\x00" + oid
+	big := small + "100644 b\x00" + oid
+
+	msg, err := checkTrees(strings.NewReader("commit 4 \nabcd\ntree 29 \n"+small+"\n"), 20, rules)
+	require.NoError(t, err)
+	assert.Equal(t, "", msg)
+
+	msg, err = checkTrees(strings.NewReader("tree 29 \n"+small+"\ntree 58 src/lib\n"+big+"\n"), 20, rules)
+	require.NoError(t, err)
+	assert.Equal(t, `directory "src/lib" has 2 entries, more than the limit of 1`, msg)
+
+	_, err = checkTrees(strings.NewReader("tree 58 \n"+small+"\n"), 20, rules)
+	assert.Error(t, err)
+}
+
+func TestApplyPathRulesToMerges(t *testing.T) {
+	ctx := context.Background()
+	q := quarantinedRepo(t)
+	head := q.repo.Head
+
+	side := q.commit(head, "file", "setup.exe")
+	q.git("", "update-ref", "refs/heads/side", side)
+	merge := func(tree string) string {
+		return q.git("", "-c", "user.name=a", "-c", "user.email=a@example.com",
+			"commit-tree", "-p", head, "-p", side, "-m", "merge", tree)
+	}
+	evil := q.commit(head, "file", "setup.exe", "tool.exe")
+
+	r := q.receivePack()
+	r.pathRules = policy.PathRules{Block: []string{"*.exe"}}
+	commands := []command{
+		// The blocked file is already in the repository, on the
+		// branch that is merged.
+		{oldOID: head, newOID: merge(side + "^{tree}"), refname: "refs/heads/merged"},
+		// But the merge can't add one of its own.
+		{oldOID: head, newOID: merge(evil + "^{tree}"), refname: "refs/heads/evil"},
+	}
+	r.applyPathRules(ctx, commands)
+
+	assert.Equal(t, "", commands[0].err)
+	assert.Equal(t, `path "tool.exe" is blocked by the pattern "*.exe"`, commands[1].err)
+}
+
+func TestApplyPathRules(t *testing.T) {
+	ctx := context.Background()
+	q := quarantinedRepo(t)
+	head := q.repo.Head
+
+	// The blocked file is only in the parent of the tip, so only a
+	// scan of every new commit finds it.
+	blocked := q.commit(q.commit(head, "file", "setup.exe"), "file")
+	wide := q.commit(head, "a", "b", "c")
+	fine := q.commit(head, "file", "README")
+
+	r := q.receivePack()
+	r.pathRules = policy.PathRules{Block: []string{"*.exe"}, MaxTreeEntries: 2}
+	commands := []command{
+		{oldOID: head, newOID: blocked, refname: "refs/heads/blocked"},
+		{oldOID: head, newOID: wide, refname: "refs/heads/wide"},
+		{oldOID: head, newOID: fine, refname: "refs/heads/fine"},
+		{oldOID: head, newOID: nullSHA1OID, refname: "refs/heads/deleted"},
+	}
+	r.applyPathRules(ctx, commands)
+
+	assert.Equal(t, `path "setup.exe" is blocked by the pattern "*.exe"`, commands[0].err)
+	assert.Equal(t, "the top-level directory has 3 entries, more than the limit of 2", commands[1].err)
+	assert.Equal(t, "", commands[2].err)
+	assert.Equal(t, "", commands[3].err)
+	for _, c := range commands[:2] {
+		assert.Equal(t, "ng", c.reportFF)
+		assert.False(t, c.retryable)
+	}
+}
@@ -0,0 +1,141 @@
+package spokes
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/pipe"
+)
+
+// slowPhasesEnv is the name of an environment variable that overrides how
+// long each phase of a push may take before we log a warning about it. Its
+// value looks like "connectivity=30s,read-pack=2m"; a threshold of 0
+// disables the warning for that phase.
+const slowPhasesEnv = "SPOKES_SLOW_PHASE_THRESHOLDS"
+
+// The phases of a push. The startup phase is the time between being
+// admitted by governor and starting the reference discovery, which is
+// mostly spent reading the config; together with the reference discovery,
+// it is how long the client waits for the advertisement.
+const (
+	phaseStartup            = "startup"
+	phaseReferenceDiscovery = "reference-discovery"
+	phaseReadCommands       = "read-commands"
+	phasePushLock           = "push-lock"
+	phaseReadPack           = "read-pack"
+	phaseConnectivity       = "connectivity"
+	phasePolicy             = "policy"
+	phaseReport             = "report"
+)
+
+// defaultSlowPhases are the thresholds used unless overridden. The phases
+// that mostly wait for the client aren't included, since they're slow
+// whenever the client's connection is.
+var defaultSlowPhases = map[string]time.Duration{
+	phaseStartup:            time.Second,
+	phaseReferenceDiscovery: 10 * time.Second,
+	phaseConnectivity:       30 * time.Second,
+}
+
+// parseSlowPhases returns the slow-phase thresholds described by `spec`,
+// on top of the defaults.
+func parseSlowPhases(spec string) (map[string]time.Duration, error) {
+	thresholds := make(map[string]time.Duration, len(defaultSlowPhases))
+	for phase, d := range defaultSlowPhases {
+		thresholds[phase] = d
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		phase, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed slow phase threshold %q", item)
+		}
+		switch phase {
+		case phaseStartup, phaseReferenceDiscovery, phaseReadCommands, phasePushLock, phaseReadPack, phaseConnectivity, phasePolicy, phaseReport:
+		default:
+			return nil, fmt.Errorf("unknown phase %q", phase)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("malformed slow phase threshold %q: %w", item, err)
+		}
+		thresholds[phase] = d
+	}
+
+	return thresholds, nil
+}
+
+// startPhase notes the beginning of `phase`. Calling the returned function
+// ends it, logging a warning if it took longer than its threshold, along
+// with the metrics of the pipeline stages that ran during it.
+func (r *spokesReceivePack) startPhase(phase string) func() {
+	return r.startPhaseAt(phase, time.Now())
+}
+
+// startPhaseAt is like startPhase, for a phase that began at `start`.
+func (r *spokesReceivePack) startPhaseAt(phase string, start time.Time) func() {
+	r.stageMetricsMu.Lock()
+	firstStage := len(r.stageMetrics)
+	r.stageMetricsMu.Unlock()
+
+	return func() {
+		threshold := r.slowPhases[phase]
+		elapsed := time.Since(start)
+		if threshold <= 0 || elapsed <= threshold {
+			return
+		}
+		r.log.With("phase", phase).Warn(
+			"slow phase",
+			"elapsed_ms", elapsed.Milliseconds(),
+			"threshold_ms", threshold.Milliseconds(),
+			"ref_count", r.refCount,
+			"pack_size", r.packSize,
+		)
+
+		r.stageMetricsMu.Lock()
+		defer r.stageMetricsMu.Unlock()
+		for _, m := range r.stageMetrics[firstStage:] {
+			r.log.With("phase", phase).Info(
+				"slow phase stage",
+				"stage", m.Stage,
+				"elapsed_ms", m.WallTime.Milliseconds(),
+				"user_ms", m.UserTime.Milliseconds(),
+				"system_ms", m.SystemTime.Milliseconds(),
+				"max_rss", m.MaxRSS,
+				"bytes_out", m.BytesOut,
+				"error", m.Err,
+			)
+		}
+	}
+}
+
+// measure returns a stage that runs `stage`, recording its metrics for
+// startPhase.
+func (r *spokesReceivePack) measure(stage pipe.Stage) pipe.Stage {
+	return pipe.WithMetrics(stage, func(m pipe.StageMetrics) {
+		r.stageMetricsMu.Lock()
+		defer r.stageMetricsMu.Unlock()
+		r.stageMetrics = append(r.stageMetrics, m)
+	})
+}
+
+// hook is like measure, for the commands that the repository's config
+// says to run, like the blob scanner and the check commands, whose resource
+// usage governor is told about too. If SPOKES_HOOK_MEMORY_LIMIT is set, a
+// command that uses more memory than that is killed.
+func (r *spokesReceivePack) hook(stage pipe.Stage) pipe.Stage {
+	stage = r.measure(pipe.WithMetrics(stage, func(m pipe.StageMetrics) {
+		r.governor.AddHookUsage(m.UserTime+m.SystemTime, m.MaxRSS)
+	}))
+	if r.hookMemoryLimit == 0 {
+		return stage
+	}
+	return pipe.MemoryLimit(stage, r.hookMemoryLimit, func(e *pipe.Event) {
+		r.log.Warn(e.Msg, "command", e.Command, "error", e.Err)
+	})
+}
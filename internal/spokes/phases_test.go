@@ -0,0 +1,89 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/github/spokes-receive-pack/internal/pipe"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSlowPhases(t *testing.T) {
+	thresholds, err := parseSlowPhases("")
+	require.NoError(t, err)
+	assert.Equal(t, defaultSlowPhases, thresholds)
+
+	thresholds, err = parseSlowPhases("connectivity=1m, read-pack=90s,reference-discovery=0")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{
+		phaseStartup:            time.Second,
+		phaseReferenceDiscovery: 0,
+		phaseConnectivity:       time.Minute,
+		phaseReadPack:           90 * time.Second,
+	}, thresholds)
+
+	_, err = parseSlowPhases("connectivity")
+	assert.Error(t, err)
+	_, err = parseSlowPhases("connectivity=soon")
+	assert.Error(t, err)
+	_, err = parseSlowPhases("unknown=1s")
+	assert.Error(t, err)
+}
+
+func TestStartPhase(t *testing.T) {
+	var buf bytes.Buffer
+	r := &spokesReceivePack{
+		log:        logger.New(&buf),
+		slowPhases: map[string]time.Duration{phaseConnectivity: time.Nanosecond},
+		refCount:   3,
+		packSize:   1024,
+	}
+
+	r.startPhase(phaseReadPack)()
+	assert.Empty(t, buf.String())
+
+	endPhase := r.startPhase(phaseConnectivity)
+	p := pipe.New()
+	p.Add(r.measure(pipe.Command("true")))
+	require.NoError(t, p.Run(context.Background()))
+	time.Sleep(time.Millisecond)
+	endPhase()
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(lines[0], &entry))
+	assert.Equal(t, "slow phase", entry["msg"])
+	assert.Equal(t, phaseConnectivity, entry["phase"])
+	assert.Equal(t, float64(3), entry["ref_count"])
+	assert.Equal(t, float64(1024), entry["pack_size"])
+
+	entry = nil
+	require.NoError(t, json.Unmarshal(lines[1], &entry))
+	assert.Equal(t, "slow phase stage", entry["msg"])
+	assert.Equal(t, phaseConnectivity, entry["phase"])
+	assert.Equal(t, "true", entry["stage"])
+	assert.Contains(t, entry, "max_rss")
+}
+
+func TestStartPhaseAt(t *testing.T) {
+	var buf bytes.Buffer
+	r := &spokesReceivePack{
+		log:        logger.New(&buf),
+		slowPhases: map[string]time.Duration{phaseStartup: time.Second},
+	}
+
+	r.startPhaseAt(phaseStartup, time.Now().Add(-time.Minute))()
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &entry))
+	assert.Equal(t, "slow phase", entry["msg"])
+	assert.Equal(t, phaseStartup, entry["phase"])
+	assert.GreaterOrEqual(t, entry["elapsed_ms"], float64(time.Minute.Milliseconds()))
+}
@@ -0,0 +1,129 @@
+package spokes
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// progressInterval is the least time between two progress updates that
+// we relay to the client. Git redraws a progress meter whenever its
+// percentage changes, which can be many times a second, and every redraw
+// costs a packet on what may be a slow connection.
+const progressInterval = 250 * time.Millisecond
+
+// progressLimiter relays the output of a git command, thinning out its
+// progress updates, which are the lines that end with "\r" so that the
+// next one replaces them. An update is dropped if a newer one arrives
+// less than `interval` after the last one that was written; the newest is
+// written once `interval` has passed, unless something else supersedes it
+// first. Lines that end with "\n" are written straight away.
+type progressLimiter struct {
+	w        io.Writer
+	interval time.Duration
+
+	mu sync.Mutex
+	// partial is what has been written since the last "\r" or "\n".
+	partial []byte
+	// pending is the newest progress update, if it hasn't been written.
+	pending []byte
+	// last is when the last progress update was written.
+	last  time.Time
+	timer *time.Timer
+	err   error
+}
+
+func newProgressLimiter(w io.Writer, interval time.Duration) *progressLimiter {
+	return &progressLimiter{w: w, interval: interval}
+}
+
+func (l *progressLimiter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		return 0, l.err
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexAny(p, "\r\n")
+		if i < 0 {
+			l.partial = append(l.partial, p...)
+			break
+		}
+		l.partial = append(l.partial, p[:i+1]...)
+		p = p[i+1:]
+
+		if l.partial[len(l.partial)-1] == '\n' {
+			// Whatever progress was pending is out of date now.
+			l.pending = l.pending[:0]
+			l.write(l.partial)
+		} else {
+			l.progress(l.partial)
+		}
+		l.partial = l.partial[:0]
+	}
+	return n, l.err
+}
+
+// progress writes the progress update `line`, or keeps it to be written
+// later. Its caller must hold `l.mu`.
+func (l *progressLimiter) progress(line []byte) {
+	wait := l.interval - time.Since(l.last)
+	if wait <= 0 {
+		l.pending = l.pending[:0]
+		l.write(line)
+		l.last = time.Now()
+		return
+	}
+	l.pending = append(l.pending[:0], line...)
+	if l.timer == nil {
+		l.timer = time.AfterFunc(wait, l.writePending)
+	}
+}
+
+// writePending writes the pending progress update, if there is one, once
+// its turn has come.
+func (l *progressLimiter) writePending() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.timer = nil
+	if len(l.pending) > 0 && l.err == nil {
+		l.write(l.pending)
+		l.pending = l.pending[:0]
+		l.last = time.Now()
+	}
+}
+
+// write writes `b`, remembering the error if it fails. Its caller must
+// hold `l.mu`.
+func (l *progressLimiter) write(b []byte) {
+	if l.err != nil {
+		return
+	}
+	_, l.err = l.w.Write(b)
+}
+
+// Flush writes what hasn't been written yet: the pending progress update
+// and anything after it, and stops waiting to write them later.
+func (l *progressLimiter) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	if len(l.pending) > 0 {
+		l.write(l.pending)
+		l.pending = l.pending[:0]
+	}
+	if len(l.partial) > 0 {
+		l.write(l.partial)
+		l.partial = l.partial[:0]
+	}
+	return l.err
+}
@@ -0,0 +1,68 @@
+package spokes
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressLimiter(t *testing.T) {
+	var rec writeLog
+	l := newProgressLimiter(&rec, time.Hour)
+
+	// The first update goes out, but the ones that follow it too soon
+	// are held back, and only the newest of them is kept.
+	for _, s := range []string{"Resolving: 1%\r", "Resolving: 2%\rResolv", "ing: 3%\r"} {
+		_, err := l.Write([]byte(s))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"Resolving: 1%\r"}, rec.Writes())
+
+	// A line that ends with "\n" goes out straight away and supersedes
+	// the held back update.
+	_, err := l.Write([]byte("Resolving: 100%, done.\nremote: hi"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Resolving: 1%\r", "Resolving: 100%, done.\n"}, rec.Writes())
+
+	require.NoError(t, l.Flush())
+	assert.Equal(t, []string{"Resolving: 1%\r", "Resolving: 100%, done.\n", "remote: hi"}, rec.Writes())
+}
+
+func TestProgressLimiterDelayed(t *testing.T) {
+	var rec writeLog
+	l := newProgressLimiter(&rec, 20*time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		_, err := l.Write([]byte(strings.Repeat("x", i) + "\r"))
+		require.NoError(t, err)
+	}
+	assert.Len(t, rec.Writes(), 1)
+
+	// The newest update is written when its turn comes.
+	assert.Eventually(t, func() bool { return len(rec.Writes()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, "xxxx\r", rec.Writes()[1])
+
+	// Flushing writes what is held back.
+	_, err := l.Write([]byte("a\rb\r"))
+	require.NoError(t, err)
+	require.NoError(t, l.Flush())
+	assert.Equal(t, "b\r", rec.Writes()[len(rec.Writes())-1])
+	time.Sleep(30 * time.Millisecond)
+	assert.NotContains(t, rec.Writes(), "a\r")
+	assert.Equal(t, "b\r", rec.Writes()[len(rec.Writes())-1])
+}
+
+func TestProgressLimiterError(t *testing.T) {
+	rec := writeLog{err: errors.New("broken pipe")}
+	l := newProgressLimiter(&rec, time.Hour)
+
+	_, err := l.Write([]byte("fatal: oops\n"))
+	assert.ErrorContains(t, err, "broken pipe")
+	_, err = l.Write([]byte("more\n"))
+	assert.ErrorContains(t, err, "broken pipe")
+	assert.ErrorContains(t, l.Flush(), "broken pipe")
+}
@@ -0,0 +1,320 @@
+package spokes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/pktline"
+)
+
+// The settings that limit how many pushes to a repository may be processed
+// at once. The pushes past the limit wait, in the order in which they
+// arrived, for up to the timeout, and are told where they are in the queue
+// on the sideband. There is no limit unless maxConcurrentPushes is set.
+//
+//	[spokes]
+//		maxConcurrentPushes = 2
+//		pushLockTimeout = 2m
+const (
+	maxConcurrentPushesKey = "spokes.maxconcurrentpushes"
+	pushLockTimeoutKey     = "spokes.pushlocktimeout"
+)
+
+// pushLockDirEnv is the directory that holds the push locks of every
+// repository on the host, each in a directory of its own. It is outside of
+// the repositories, where git would take the lock files for refs or
+// objects. It defaults to defaultPushLockDir, under os.TempDir().
+const (
+	pushLockDirEnv     = "SPOKES_PUSH_LOCK_DIR"
+	defaultPushLockDir = "spokes-receive-pack-locks"
+)
+
+const (
+	defaultPushLockTimeout = 5 * time.Minute
+
+	// pushLockPoll is how often a waiting push checks whether it can go
+	// ahead, and pushLockReport how often it tells the client that it's
+	// still waiting when its place in the queue hasn't changed.
+	pushLockPoll   = 250 * time.Millisecond
+	pushLockReport = 5 * time.Second
+
+	// In a repository's lock directory, each push that is being
+	// processed holds a lock on one of the "slot-<n>" files, and each
+	// push that is waiting holds a lock on a "waiting-<time>-<pid>" file,
+	// whose name sorts by when it started to wait.
+	pushLockSlot     = "slot-"
+	pushLockTicket   = "waiting-"
+	staleTicketAfter = time.Minute
+)
+
+// errPushLockTimeout is returned by acquirePushLock when it gave up
+// waiting.
+var errPushLockTimeout = errors.New("timed out waiting for other pushes to the repository to finish")
+
+// pushLock is held by a push while it is processed.
+type pushLock struct {
+	f *os.File
+}
+
+// release lets the next push go ahead. It is safe to call with a nil
+// *pushLock.
+func (l *pushLock) release() {
+	if l == nil {
+		return
+	}
+	_ = syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	_ = l.f.Close()
+}
+
+// maxConcurrentPushes returns how many pushes to the repository may be
+// processed at once, or 0 for no limit.
+func (r *spokesReceivePack) maxConcurrentPushes() int {
+	v := r.config.Get(maxConcurrentPushesKey)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		r.log.Warn("ignoring "+maxConcurrentPushesKey, "value", v)
+		return 0
+	}
+	return n
+}
+
+// pushLockTimeout returns how long a push may wait for its turn.
+func (r *spokesReceivePack) pushLockTimeout() time.Duration {
+	v := r.config.Get(pushLockTimeoutKey)
+	if v == "" {
+		return defaultPushLockTimeout
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		r.log.Warn("ignoring "+pushLockTimeoutKey, "error", err)
+		return defaultPushLockTimeout
+	}
+	return d
+}
+
+// acquirePushLock waits until fewer than the configured number of pushes
+// to the repository are being processed, and returns the lock that keeps
+// this one counted until it's released. It returns a nil lock if there is
+// no limit. If it gave up waiting, or couldn't take the lock at all, it
+// returns an error in categoryBusy, since letting the push go ahead would
+// break the limit.
+func (r *spokesReceivePack) acquirePushLock(ctx context.Context, capabilities pktline.Capabilities) (*pushLock, error) {
+	n := r.maxConcurrentPushes()
+	if n == 0 {
+		return nil, nil
+	}
+
+	lock, err := r.waitForPushLock(ctx, n, capabilities)
+	if err != nil && !isCategory(err, categoryBusy) {
+		r.log.Warn("taking push lock", "error", err)
+		return nil, withCategory(categoryBusy, fmt.Errorf("taking push lock: %w", err))
+	}
+	return lock, err
+}
+
+// pushLockDir returns the directory that holds the push locks of the
+// repository.
+func (r *spokesReceivePack) pushLockDir() string {
+	dir := os.Getenv(pushLockDirEnv)
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), defaultPushLockDir)
+	}
+	sum := sha256.Sum256([]byte(r.repoPath))
+	return filepath.Join(dir, hex.EncodeToString(sum[:]))
+}
+
+func (r *spokesReceivePack) waitForPushLock(ctx context.Context, n int, capabilities pktline.Capabilities) (*pushLock, error) {
+	dir := r.pushLockDir()
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	// Get in line, so that the pushes that are already waiting go first.
+	ticket, tf, err := takeTicket(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.Remove(tf.Name())
+		_ = tf.Close()
+	}()
+
+	var progress io.Writer = io.Discard
+	if useSideBand(capabilities) && !isQuiet(capabilities) {
+		progress = newSidebandWriter(r.output, capabilities)
+	}
+
+	start := time.Now()
+	deadline := time.NewTimer(r.pushLockTimeout())
+	defer deadline.Stop()
+	poll := time.NewTicker(pushLockPoll)
+	defer poll.Stop()
+
+	var waited bool
+	var reported time.Time
+	lastPos := -1
+	for {
+		ahead, err := ticketsAhead(dir, ticket)
+		if err != nil {
+			return nil, err
+		}
+		if ahead < n {
+			lock, err := tryPushSlots(dir, n)
+			if err != nil {
+				return nil, err
+			}
+			if lock != nil {
+				if waited {
+					fmt.Fprintf(progress, "Waiting for other pushes to finish: done.\n")
+					r.log.Info("waited for push lock", "elapsed_ms", time.Since(start).Milliseconds())
+				}
+				return lock, nil
+			}
+		}
+
+		if ahead != lastPos || time.Since(reported) >= pushLockReport {
+			fmt.Fprintf(progress, "Waiting for other pushes to finish: %d ahead in the queue\r", ahead)
+			lastPos, reported = ahead, time.Now()
+		}
+		waited = true
+
+		select {
+		case <-ctx.Done():
+			return nil, withCategory(categoryBusy, context.Cause(ctx))
+		case <-deadline.C:
+			fmt.Fprintf(progress, "Waiting for other pushes to finish: gave up.\n")
+			r.log.Warn("gave up waiting for push lock", "elapsed_ms", time.Since(start).Milliseconds(), "ahead", ahead)
+			return nil, withCategory(categoryBusy, errPushLockTimeout)
+		case <-poll.C:
+		}
+	}
+}
+
+// takeTicket creates and locks a ticket in `dir` for a push that starts
+// to wait now. Tickets are named after the time, so pushes from the same
+// process can race for one; the loser tries again with a later time.
+func takeTicket(dir string) (string, *os.File, error) {
+	for i := 0; i < 10; i++ {
+		ticket := fmt.Sprintf("%s%020d-%d", pushLockTicket, time.Now().UnixNano(), os.Getpid())
+		tf, err := tryLock(filepath.Join(dir, ticket))
+		if err != nil {
+			return "", nil, err
+		}
+		if tf != nil {
+			return ticket, tf, nil
+		}
+	}
+	return "", nil, errors.New("couldn't get in line for the push lock")
+}
+
+// tryPushSlots tries to lock each of the `n` slots in `dir` in turn. It
+// returns nil if all of them are taken.
+func tryPushSlots(dir string, n int) (*pushLock, error) {
+	for i := 0; i < n; i++ {
+		f, err := tryLock(filepath.Join(dir, pushLockSlot+strconv.Itoa(i)))
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			return &pushLock{f: f}, nil
+		}
+	}
+	return nil, nil
+}
+
+// ticketsAhead returns how many pushes are waiting in `dir` that started
+// to wait before the one with `ticket`. The tickets of pushes that died
+// while waiting are cleaned up along the way.
+func ticketsAhead(dir, ticket string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	ahead := 0
+	for _, e := range entries {
+		name := e.Name()
+		if name >= ticket {
+			// ReadDir sorts by name.
+			break
+		}
+		if !strings.HasPrefix(name, pushLockTicket) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		locked, err := isLocked(path)
+		switch {
+		case err != nil:
+			continue
+		case locked:
+			ahead++
+		case isStaleTicket(name):
+			// A ticket that was just created isn't locked yet, so only
+			// old ones can be taken for dead.
+			_ = os.Remove(path)
+		}
+	}
+	return ahead, nil
+}
+
+// isStaleTicket reports whether the ticket `name` is old enough that the
+// push that made it must have locked it by now, if it's still alive.
+func isStaleTicket(name string) bool {
+	ts, _, ok := strings.Cut(strings.TrimPrefix(name, pushLockTicket), "-")
+	if !ok {
+		return false
+	}
+	nanos, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Since(time.Unix(0, nanos)) > staleTicketAfter
+}
+
+// tryLock creates the file at `path` if need be and takes an exclusive
+// lock on it, without waiting. It returns nil if someone else holds the
+// lock.
+func tryLock(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// isLocked reports whether someone holds a lock on the file at `path`.
+func isLocked(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return true, nil
+		}
+		return false, err
+	}
+	_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return false, nil
+}
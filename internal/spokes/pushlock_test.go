@@ -0,0 +1,148 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/github/spokes-receive-pack/internal/pktline"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquirePushLock(t *testing.T) {
+	ctx := context.Background()
+	repo := t.TempDir()
+	locks := t.TempDir()
+	t.Setenv(pushLockDirEnv, locks)
+	caps, err := pktline.ParseCapabilities([]byte("report-status side-band-64k"))
+	require.NoError(t, err)
+
+	newRepo := func(entries ...config.ConfigEntry) (*spokesReceivePack, *bytes.Buffer) {
+		var out bytes.Buffer
+		return &spokesReceivePack{
+			config:   &config.Config{Entries: entries},
+			log:      logger.New(&bytes.Buffer{}),
+			repoPath: repo,
+			output:   &out,
+		}, &out
+	}
+
+	// There's no limit unless one is set.
+	r, _ := newRepo()
+	lock, err := r.acquirePushLock(ctx, caps)
+	require.NoError(t, err)
+	assert.Nil(t, lock)
+	lock.release()
+
+	limit := config.ConfigEntry{Key: maxConcurrentPushesKey, Value: "1"}
+	timeout := config.ConfigEntry{Key: pushLockTimeoutKey, Value: "100ms"}
+
+	r, _ = newRepo(limit)
+	first, err := r.acquirePushLock(ctx, caps)
+	require.NoError(t, err)
+	require.NotNil(t, first)
+
+	// The second push has to wait for the first one, and gives up.
+	r, out := newRepo(limit, timeout)
+	_, err = r.acquirePushLock(ctx, caps)
+	require.Error(t, err)
+	assert.True(t, isCategory(err, categoryBusy))
+	assert.True(t, isRetryable(ctx, err))
+	assert.Contains(t, out.String(), "Waiting for other pushes to finish: 0 ahead in the queue\r")
+	assert.Contains(t, out.String(), "Waiting for other pushes to finish: gave up.\n")
+
+	// It goes ahead once the first one is done.
+	r, out = newRepo(limit, config.ConfigEntry{Key: pushLockTimeoutKey, Value: "5s"})
+	time.AfterFunc(100*time.Millisecond, first.release)
+	second, err := r.acquirePushLock(ctx, caps)
+	require.NoError(t, err)
+	require.NotNil(t, second)
+	assert.Contains(t, out.String(), "Waiting for other pushes to finish: done.\n")
+	second.release()
+
+	// Nobody is left waiting.
+	entries, err := os.ReadDir(r.pushLockDir())
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.NotContains(t, e.Name(), pushLockTicket)
+	}
+
+	// The locks are kept out of the repository.
+	entries, err = os.ReadDir(repo)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Equal(t, locks, filepath.Dir(r.pushLockDir()))
+
+	// Two pushes may go ahead at once if the limit is 2.
+	r, _ = newRepo(config.ConfigEntry{Key: maxConcurrentPushesKey, Value: "2"}, timeout)
+	a, err := r.acquirePushLock(ctx, caps)
+	require.NoError(t, err)
+	b, err := r.acquirePushLock(ctx, caps)
+	require.NoError(t, err)
+	assert.NotNil(t, a)
+	assert.NotNil(t, b)
+	_, err = r.acquirePushLock(ctx, caps)
+	assert.True(t, isCategory(err, categoryBusy))
+	a.release()
+	b.release()
+
+	// If the lock can't be taken, the push doesn't go ahead without it.
+	notDir := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(notDir, nil, 0666))
+	t.Setenv(pushLockDirEnv, notDir)
+	r, _ = newRepo(limit)
+	lock, err = r.acquirePushLock(ctx, caps)
+	assert.Nil(t, lock)
+	assert.True(t, isCategory(err, categoryBusy))
+	assert.True(t, isRetryable(ctx, err))
+}
+
+func TestTakeTicket(t *testing.T) {
+	dir := t.TempDir()
+	first, f, err := takeTicket(dir)
+	require.NoError(t, err)
+	defer f.Close()
+	second, g, err := takeTicket(dir)
+	require.NoError(t, err)
+	defer g.Close()
+	assert.NotEqual(t, first, second)
+}
+
+func TestTicketsAhead(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ticket := func(at time.Time, pid int) string {
+		return fmt.Sprintf("%s%020d-%d", pushLockTicket, at.UnixNano(), pid)
+	}
+
+	// Two pushes are waiting ahead of us, one of them died a while ago,
+	// and one just got in line without having locked its ticket yet.
+	f, err := tryLock(filepath.Join(dir, ticket(now.Add(-2*time.Second), 1)))
+	require.NoError(t, err)
+	defer f.Close()
+	g, err := tryLock(filepath.Join(dir, ticket(now.Add(-time.Second), 2)))
+	require.NoError(t, err)
+	defer g.Close()
+	dead := ticket(now.Add(-time.Hour), 3)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, dead), nil, 0666))
+	fresh := ticket(now.Add(-time.Millisecond), 4)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, fresh), nil, 0666))
+	behind := ticket(now.Add(time.Second), 5)
+	h, err := tryLock(filepath.Join(dir, behind))
+	require.NoError(t, err)
+	defer h.Close()
+
+	ahead, err := ticketsAhead(dir, ticket(now, 6))
+	require.NoError(t, err)
+	assert.Equal(t, 2, ahead)
+
+	assert.NoFileExists(t, filepath.Join(dir, dead))
+	assert.FileExists(t, filepath.Join(dir, fresh))
+}
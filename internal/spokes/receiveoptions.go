@@ -0,0 +1,65 @@
+package spokes
+
+import (
+	"strings"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/logger"
+)
+
+// disableCapabilityKey is the setting that turns off capabilities that we
+// would otherwise advertise, like
+//
+//	[spokes]
+//		disableCapability = atomic ofs-delta
+//
+// so that a part of the protocol that misbehaves can be taken out of use
+// with config, like the system config of every host, rather than with a new
+// build. It may be given more than once. Clients can't ask for a capability
+// that isn't advertised.
+const disableCapabilityKey = "spokes.disablecapability"
+
+// disableableCapabilities are the capabilities that can be turned off.
+// object-format and agent describe us rather than offer something, so they
+// can't be.
+var disableableCapabilities = map[string]bool{
+	"report-status":    true,
+	"report-status-v2": true,
+	"delete-refs":      true,
+	"side-band-64k":    true,
+	"ofs-delta":        true,
+	"atomic":           true,
+	"quiet":            true,
+	"push-options":     true,
+}
+
+// receiveOptions are the parts of the protocol that are turned on for a
+// push.
+type receiveOptions struct {
+	// disabled are the capabilities that are turned off.
+	disabled map[string]bool
+}
+
+// newReceiveOptions returns the receive options that `cfg` asks for.
+// Capabilities that can't be turned off are ignored with a warning.
+func newReceiveOptions(cfg *config.Config, lg *logger.Logger) receiveOptions {
+	var ro receiveOptions
+	for _, value := range cfg.GetAll(disableCapabilityKey) {
+		for _, name := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+			if !disableableCapabilities[name] {
+				lg.Warn("ignoring "+disableCapabilityKey, "capability", name)
+				continue
+			}
+			if ro.disabled == nil {
+				ro.disabled = make(map[string]bool)
+			}
+			ro.disabled[name] = true
+		}
+	}
+	return ro
+}
+
+// enabled reports whether the capability `name` may be advertised.
+func (ro receiveOptions) enabled(name string) bool {
+	return !ro.disabled[name]
+}
@@ -0,0 +1,74 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewReceiveOptions(t *testing.T) {
+	var logs bytes.Buffer
+	cfg := &config.Config{Entries: []config.ConfigEntry{
+		{Key: disableCapabilityKey, Value: "atomic ofs-delta"},
+		{Key: disableCapabilityKey, Value: "push-options,object-format"},
+	}}
+	ro := newReceiveOptions(cfg, logger.New(&logs))
+	assert.False(t, ro.enabled("atomic"))
+	assert.False(t, ro.enabled("ofs-delta"))
+	assert.False(t, ro.enabled("push-options"))
+	assert.True(t, ro.enabled("side-band-64k"))
+	assert.Contains(t, logs.String(), "object-format")
+
+	assert.Equal(t,
+		"report-status report-status-v2 delete-refs side-band-64k object-format=sha256 quiet",
+		supportedCapabilities("sha256", ro),
+	)
+	assert.Equal(t,
+		"report-status report-status-v2 delete-refs side-band-64k ofs-delta atomic object-format=sha1 quiet",
+		supportedCapabilities("sha1", receiveOptions{}),
+	)
+
+	// push-options stays off even if receive.advertisePushOptions is on.
+	pushOptions := true
+	caps := advertisedCapabilities(Options{PushOptions: &pushOptions}, cfg, "sha1", ro, logger.New(&logs))
+	assert.NotContains(t, caps, "push-options")
+	assert.NotContains(t, caps, "atomic")
+}
+
+func TestReadCommandsDisabledCapabilities(t *testing.T) {
+	oid := "e83c5163316f89bfbde7d9ab23ca2e25604af290"
+	ro := receiveOptions{disabled: map[string]bool{"atomic": true, "delete-refs": true}}
+
+	newRepo := func(input *bytes.Buffer) *spokesReceivePack {
+		return &spokesReceivePack{
+			input:          input,
+			config:         &config.Config{},
+			objectFormat:   "sha1",
+			capabilities:   supportedCapabilities("sha1", ro),
+			receiveOptions: ro,
+		}
+	}
+
+	// A client can't ask for a capability that is turned off.
+	var input bytes.Buffer
+	require.NoError(t, writePacketf(&input, "%s %s refs/heads/main\x00report-status atomic\n", nullSHA1OID, oid))
+	input.WriteString("0000")
+	_, _, _, err := newRepo(&input).readCommands(context.Background())
+	assert.ErrorContains(t, err, "not advertised")
+
+	// Nor delete refs if delete-refs is.
+	input.Reset()
+	require.NoError(t, writePacketf(&input, "%s %s refs/heads/main\x00report-status\n", oid, nullSHA1OID))
+	require.NoError(t, writePacketf(&input, "%s %s refs/heads/topic\n", nullSHA1OID, oid))
+	input.WriteString("0000")
+	commands, _, _, err := newRepo(&input).readCommands(context.Background())
+	require.NoError(t, err)
+	require.Len(t, commands, 2)
+	assert.Equal(t, "deleting refs is disabled", commands[0].err)
+	assert.Empty(t, commands[1].err)
+}
@@ -0,0 +1,64 @@
+package spokes
+
+import (
+	"strings"
+)
+
+// refnameError returns why a push may not update `refname`, or "" if it
+// may. Like git-receive-pack, only refs under "refs/" whose names git
+// considers well-formed (see git-check-ref-format(1)) can be pushed to. A
+// ref right under "refs/", like "refs/foo", which git doesn't create, may
+// only be deleted, if `isDelete`.
+// Pseudo-refs, like HEAD and FETCH_HEAD, describe the state of a
+// repository rather than hold history, and are called out separately.
+func refnameError(refname string, isDelete bool) string {
+	rest, ok := strings.CutPrefix(refname, "refs/")
+	switch {
+	case !ok && isPseudoRef(refname):
+		return "refusing to update pseudo-ref " + refname
+	case !ok:
+		return "refusing to update ref outside of refs/"
+	case !isWellFormedRefname(rest, isDelete):
+		return "funny refname"
+	}
+	return ""
+}
+
+// isPseudoRef reports whether `refname` is named like a pseudo-ref, all
+// uppercase letters and underscores, like HEAD, ORIG_HEAD, or FETCH_HEAD.
+func isPseudoRef(refname string) bool {
+	if refname == "" {
+		return false
+	}
+	for i := 0; i < len(refname); i++ {
+		if c := refname[i]; (c < 'A' || c > 'Z') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// isWellFormedRefname reports whether `name`, the part of a refname after
+// "refs/", follows the rules of git's check_refname_format. Unless
+// `allowOneLevel`, it must have at least two components, like
+// "heads/main", as with REFNAME_ALLOW_ONELEVEL unset.
+func isWellFormedRefname(name string, allowOneLevel bool) bool {
+	if name == "" || name == "@" || strings.HasSuffix(name, ".") || strings.Contains(name, "@{") {
+		return false
+	}
+	if !allowOneLevel && !strings.Contains(name, "/") {
+		return false
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") ||
+			strings.Contains(component, "..") {
+			return false
+		}
+		for i := 0; i < len(component); i++ {
+			if c := component[i]; c < 0x20 || c == 0x7f || strings.IndexByte(" ~^:?*[\\", c) >= 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefnameError(t *testing.T) {
+	for _, refname := range []string{
+		"refs/heads/main",
+		"refs/heads/feature/x-1.2",
+		"refs/tags/v1.0",
+		"refs/pull/1/head",
+		"refs/heads/a@b",
+	} {
+		assert.Empty(t, refnameError(refname, false), refname)
+	}
+
+	// Like git, a ref right under refs/ may only be deleted.
+	assert.Equal(t, "funny refname", refnameError("refs/foo", false))
+	assert.Empty(t, refnameError("refs/foo", true))
+	assert.Equal(t, "funny refname", refnameError("refs/foo.lock", true))
+
+	for refname, expected := range map[string]string{
+		"HEAD":                 "refusing to update pseudo-ref HEAD",
+		"FETCH_HEAD":           "refusing to update pseudo-ref FETCH_HEAD",
+		"main":                 "refusing to update ref outside of refs/",
+		"heads/main":           "refusing to update ref outside of refs/",
+		"refs":                 "refusing to update ref outside of refs/",
+		"refs/":                "funny refname",
+		"refs/heads/":          "funny refname",
+		"refs//heads/main":     "funny refname",
+		"refs/heads/.hidden":   "funny refname",
+		"refs/heads/main.lock": "funny refname",
+		"refs/heads/a..b":      "funny refname",
+		"refs/heads/main.":     "funny refname",
+		"refs/heads/a@{1}":     "funny refname",
+		"refs/@":               "funny refname",
+		"refs/heads/a b":       "funny refname",
+		"refs/heads/a~1":       "funny refname",
+		"refs/heads/a^":        "funny refname",
+		"refs/heads/a:b":       "funny refname",
+		"refs/heads/a?":        "funny refname",
+		"refs/heads/*":         "funny refname",
+		"refs/heads/[a]":       "funny refname",
+		"refs/heads/a\\b":      "funny refname",
+		"refs/heads/a\tb":      "funny refname",
+		"refs/heads/a\x7fb":    "funny refname",
+	} {
+		assert.Equal(t, expected, refnameError(refname, false), refname)
+		assert.Equal(t, expected, refnameError(refname, true), refname)
+	}
+}
+
+func TestReadCommandsRefnames(t *testing.T) {
+	oid := "e83c5163316f89bfbde7d9ab23ca2e25604af290"
+
+	var input bytes.Buffer
+	require.NoError(t, writePacketf(&input, "%s %s refs/heads/main\x00report-status\n", nullSHA1OID, oid))
+	require.NoError(t, writePacketf(&input, "%s %s HEAD\n", nullSHA1OID, oid))
+	require.NoError(t, writePacketf(&input, "%s %s refs/heads/a..b\n", nullSHA1OID, oid))
+	require.NoError(t, writePacketf(&input, "%s %s refs/foo\n", nullSHA1OID, oid))
+	require.NoError(t, writePacketf(&input, "%s %s refs/bar\n", oid, nullSHA1OID))
+	input.WriteString("0000")
+
+	r := &spokesReceivePack{
+		input:        &input,
+		config:       &config.Config{},
+		objectFormat: "sha1",
+		capabilities: supportedCapabilities("sha1", receiveOptions{}),
+	}
+	commands, _, _, err := r.readCommands(context.Background())
+	require.NoError(t, err)
+	require.Len(t, commands, 5)
+	assert.Empty(t, commands[0].err)
+	assert.Equal(t, "refusing to update pseudo-ref HEAD", commands[1].err)
+	assert.Equal(t, "ng", commands[1].reportFF)
+	assert.Equal(t, "funny refname", commands[2].err)
+	assert.Equal(t, "funny refname", commands[3].err)
+	assert.Empty(t, commands[4].err)
+}
@@ -0,0 +1,53 @@
+package spokes
+
+import (
+	"strings"
+
+	"github.com/github/spokes-receive-pack/internal/sockstat"
+)
+
+// refPermissions are the refs that the pusher may update, as decided by the
+// layer that authorized the push and passed on in the push_allowed_refs and
+// push_denied_refs sockstat vars. That layer should already have turned
+// away pushes that it doesn't allow, so these are checked again here, per
+// command, in case a push got past it.
+type refPermissions struct {
+	// allowed are the prefixes of the refs that may be updated, which
+	// match whole path components, as in hasAnyPrefix. If there are
+	// none, every ref may be.
+	allowed []string
+
+	// denied are the prefixes of the refs that may not be updated, even
+	// if they are also allowed.
+	denied []string
+}
+
+// newRefPermissions returns the permissions given in `vars`.
+func newRefPermissions(vars sockstat.Vars) refPermissions {
+	return refPermissions{
+		allowed: strings.Fields(vars.PushAllowedRefs),
+		denied:  strings.Fields(vars.PushDeniedRefs),
+	}
+}
+
+// allows reports whether `refname` may be updated.
+func (p refPermissions) allows(refname string) bool {
+	if hasAnyPrefix(refname, p.denied) {
+		return false
+	}
+	return len(p.allowed) == 0 || hasAnyPrefix(refname, p.allowed)
+}
+
+// hasAnyPrefix reports whether `refname` starts with one of `prefixes`, a
+// whole number of path components at a time: "refs/heads/feature" is a
+// prefix of itself and of "refs/heads/feature/x", but not of
+// "refs/heads/feature-x".
+func hasAnyPrefix(refname string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		rest, ok := strings.CutPrefix(refname, prefix)
+		if ok && (rest == "" || strings.HasSuffix(prefix, "/") || rest[0] == '/') {
+			return true
+		}
+	}
+	return false
+}
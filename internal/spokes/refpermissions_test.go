@@ -0,0 +1,69 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/sockstat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefPermissions(t *testing.T) {
+	var all refPermissions
+	assert.True(t, all.allows("refs/heads/main"))
+
+	p := newRefPermissions(sockstat.Vars{
+		PushAllowedRefs: "refs/heads/ refs/tags/",
+		PushDeniedRefs:  " refs/heads/main  refs/heads/release/",
+	})
+	assert.True(t, p.allows("refs/heads/topic"))
+	assert.True(t, p.allows("refs/tags/v1"))
+	assert.False(t, p.allows("refs/heads/main"))
+	assert.False(t, p.allows("refs/heads/release/1.0"))
+	assert.False(t, p.allows("refs/pull/1/head"))
+
+	p = newRefPermissions(sockstat.Vars{PushDeniedRefs: "refs/tags/"})
+	assert.True(t, p.allows("refs/heads/main"))
+	assert.False(t, p.allows("refs/tags/v1"))
+
+	// Prefixes match whole path components.
+	p = newRefPermissions(sockstat.Vars{
+		PushAllowedRefs: "refs/heads/feature refs/tags/v1/",
+		PushDeniedRefs:  "refs/heads/feature/locked",
+	})
+	assert.True(t, p.allows("refs/heads/feature"))
+	assert.True(t, p.allows("refs/heads/feature/x"))
+	assert.False(t, p.allows("refs/heads/feature-evil"))
+	assert.False(t, p.allows("refs/heads/featurex/y"))
+	assert.True(t, p.allows("refs/tags/v1/rc1"))
+	assert.False(t, p.allows("refs/tags/v1"))
+	assert.False(t, p.allows("refs/heads/feature/locked"))
+	assert.False(t, p.allows("refs/heads/feature/locked/x"))
+	assert.True(t, p.allows("refs/heads/feature/locked-not"))
+}
+
+func TestReadCommandsRefPermissions(t *testing.T) {
+	oid := "e83c5163316f89bfbde7d9ab23ca2e25604af290"
+
+	var input bytes.Buffer
+	require.NoError(t, writePacketf(&input, "%s %s refs/heads/topic\x00report-status\n", nullSHA1OID, oid))
+	require.NoError(t, writePacketf(&input, "%s %s refs/heads/main\n", nullSHA1OID, oid))
+	input.WriteString("0000")
+
+	r := &spokesReceivePack{
+		input:        &input,
+		config:       &config.Config{},
+		objectFormat: "sha1",
+		capabilities: supportedCapabilities("sha1", receiveOptions{}),
+		sockstat:     sockstat.Vars{PushDeniedRefs: "refs/heads/main"},
+	}
+	commands, _, _, err := r.readCommands(context.Background())
+	require.NoError(t, err)
+	require.Len(t, commands, 2)
+	assert.Empty(t, commands[0].err)
+	assert.Equal(t, "permission denied to update refs/heads/main", commands[1].err)
+	assert.Equal(t, "ng", commands[1].reportFF)
+}
@@ -0,0 +1,89 @@
+package spokes
+
+import (
+	"bytes"
+	"strings"
+)
+
+// refPrefixParam is the GIT_PROTOCOL parameter with which a client can say
+// which refs it cares about, like protocol v2's "ref-prefix" argument to
+// ls-refs. It can be given more than once, like
+//
+//	GIT_PROTOCOL=version=0:ref-prefix=refs/heads/main:ref-prefix=refs/tags/
+//
+// Only the refs that start with one of the prefixes are advertised. The
+// client hasn't seen the others, so it may not update them either. The
+// parameter has to come before the advertisement, which is why it isn't a
+// capability or a push option.
+const refPrefixParam = "ref-prefix"
+
+// maxRefPrefixes is the most prefixes that a client may give. If it gives
+// more, all refs are advertised.
+const maxRefPrefixes = 64
+
+// refPrefixFilter is the set of ref prefixes that a client asked for. A nil
+// filter lets every ref through.
+type refPrefixFilter []string
+
+// parseRefPrefixes returns the ref prefixes given in `gitProtocol`, the
+// value of GIT_PROTOCOL. Prefixes that don't start with "refs/" are
+// ignored.
+func parseRefPrefixes(gitProtocol string) refPrefixFilter {
+	var f refPrefixFilter
+	for _, param := range strings.Split(gitProtocol, ":") {
+		prefix, ok := strings.CutPrefix(param, refPrefixParam+"=")
+		if !ok || !strings.HasPrefix(prefix, "refs/") {
+			continue
+		}
+		f = append(f, prefix)
+	}
+	if len(f) > maxRefPrefixes {
+		return nil
+	}
+	return f
+}
+
+// allows reports whether `refname` starts with one of the prefixes.
+func (f refPrefixFilter) allows(refname string) bool {
+	if f == nil {
+		return true
+	}
+	for _, prefix := range f {
+		if strings.HasPrefix(refname, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsLine reports whether the advertisement line `line`, which looks
+// like "<oid> <refname>", is for a ref that the filter lets through. Other
+// lines, like ".have" lines, always are.
+func (f refPrefixFilter) allowsLine(line []byte) bool {
+	if f == nil {
+		return true
+	}
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		return true
+	}
+	refname := line[i+1:]
+	if !bytes.HasPrefix(refname, []byte("refs/")) {
+		return true
+	}
+	return f.allows(string(refname))
+}
+
+// forEachRefPatterns returns patterns for `git for-each-ref` that list no
+// more refs than the filter lets through, so that the rest don't have to
+// be read at all. for-each-ref matches whole path components, and globs,
+// so that's only possible if every prefix ends with "/" and has no glob
+// characters.
+func (f refPrefixFilter) forEachRefPatterns() []string {
+	for _, prefix := range f {
+		if !strings.HasSuffix(prefix, "/") || strings.ContainsAny(prefix, "*?[\\") {
+			return nil
+		}
+	}
+	return f
+}
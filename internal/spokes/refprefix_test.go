@@ -0,0 +1,114 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/genrepo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRefPrefixes(t *testing.T) {
+	assert.Nil(t, parseRefPrefixes(""))
+	assert.Nil(t, parseRefPrefixes("version=2"))
+	assert.Equal(t,
+		refPrefixFilter{"refs/heads/main", "refs/tags/"},
+		parseRefPrefixes("version=0:ref-prefix=refs/heads/main:ref-prefix=HEAD:ref-prefix=refs/tags/"),
+	)
+
+	tooMany := strings.Repeat("ref-prefix=refs/heads/x:", maxRefPrefixes+1)
+	assert.Nil(t, parseRefPrefixes(tooMany))
+}
+
+func TestRefPrefixFilter(t *testing.T) {
+	var all refPrefixFilter
+	assert.True(t, all.allows("refs/pull/1/head"))
+	assert.True(t, all.allowsLine([]byte("1111 refs/pull/1/head")))
+
+	f := refPrefixFilter{"refs/heads/main", "refs/tags/"}
+	assert.True(t, f.allows("refs/heads/main"))
+	assert.True(t, f.allows("refs/heads/main2"))
+	assert.True(t, f.allows("refs/tags/v1"))
+	assert.False(t, f.allows("refs/pull/1/head"))
+
+	assert.False(t, f.allowsLine([]byte("1111 refs/pull/1/head")))
+	assert.True(t, f.allowsLine([]byte("1111 refs/tags/v1")))
+	assert.True(t, f.allowsLine([]byte("1111 .have")))
+
+	assert.Nil(t, f.forEachRefPatterns())
+	assert.Equal(t, []string{"refs/tags/"}, refPrefixFilter{"refs/tags/"}.forEachRefPatterns())
+	assert.Nil(t, refPrefixFilter{"refs/tags/*/"}.forEachRefPatterns())
+}
+
+func TestReferenceDiscoveryRefPrefixes(t *testing.T) {
+	repo, err := genrepo.Generate(context.Background(), filepath.Join(t.TempDir(), "lots-of-refs.git"), lotsOfRefs)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name     string
+		prefixes refPrefixFilter
+		expected int
+	}{
+		{"partial component", refPrefixFilter{"refs/tags/tag-aaaa-l"}, 100},
+		{"whole components", refPrefixFilter{"refs/tags/"}, 200},
+		{"nothing", refPrefixFilter{"refs/pull/"}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, isolated := range []bool{false, true} {
+				var buf bytes.Buffer
+				r := &spokesReceivePack{
+					config:       &config.Config{},
+					output:       &buf,
+					repoPath:     repo.Path,
+					capabilities: "anything",
+					refPrefixes:  tc.prefixes,
+				}
+				if isolated {
+					require.NoError(t, r.performReferenceDiscoveryIsolatedPipes(context.Background()))
+				} else {
+					require.NoError(t, r.performReferenceDiscovery(context.Background()))
+				}
+
+				if tc.expected == 0 {
+					assert.Contains(t, buf.String(), "capabilities^{}")
+					assert.NotContains(t, buf.String(), " refs/")
+					continue
+				}
+				lines := strings.Split(strings.TrimSuffix(buf.String(), "0000"), "\n")
+				lines = lines[:len(lines)-1]
+				assert.Len(t, lines, tc.expected)
+				for _, line := range lines {
+					assert.Contains(t, line, " "+tc.prefixes[0])
+				}
+			}
+		})
+	}
+}
+
+func TestReadCommandsRefPrefixes(t *testing.T) {
+	oid := "e83c5163316f89bfbde7d9ab23ca2e25604af290"
+
+	var input bytes.Buffer
+	require.NoError(t, writePacketf(&input, "%s %s refs/heads/main\x00report-status\n", nullSHA1OID, oid))
+	require.NoError(t, writePacketf(&input, "%s %s refs/heads/other\n", nullSHA1OID, oid))
+	input.WriteString("0000")
+
+	r := &spokesReceivePack{
+		input:        &input,
+		config:       &config.Config{},
+		objectFormat: "sha1",
+		capabilities: supportedCapabilities("sha1", receiveOptions{}),
+		refPrefixes:  refPrefixFilter{"refs/heads/main"},
+	}
+	commands, _, _, err := r.readCommands(context.Background())
+	require.NoError(t, err)
+	require.Len(t, commands, 2)
+	assert.Empty(t, commands[0].err)
+	assert.Equal(t, "ref is outside of the requested ref prefixes", commands[1].err)
+	assert.Equal(t, "ng", commands[1].reportFF)
+}
@@ -0,0 +1,131 @@
+package spokes
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// findRepo works out which repository we were asked to operate on, being as
+// tolerant as git-receive-pack is about how it was invoked:
+//
+//   - "." with GIT_DIR set means the repository in GIT_DIR;
+//   - trailing slashes are ignored;
+//   - like git's `enter_repo()`, "foo" may refer to "foo/.git", "foo",
+//     "foo.git/.git", or "foo.git".
+func findRepo(path string, gitDir string) (string, error) {
+	if (path == "." || path == "./") && gitDir != "" {
+		path = gitDir
+	}
+
+	if path != "/" {
+		path = strings.TrimRight(path, "/")
+	}
+	if path == "" {
+		return "", errors.New("empty repository path")
+	}
+
+	for _, suffix := range []string{"/.git", "", ".git/.git", ".git"} {
+		candidate := path + suffix
+		if isGitDir(candidate) {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("'%s' does not appear to be a git repository", path)
+}
+
+// isGitDir reports whether `path` looks like a git directory.
+func isGitDir(path string) bool {
+	fi, err := os.Stat(filepath.Join(path, "objects"))
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(path, "HEAD"))
+	return err == nil
+}
+
+// maxQuarantineIDLength is the longest quarantine ID that we accept.
+const maxQuarantineIDLength = 128
+
+// checkQuarantineID returns an error unless `id` is a safe name for the
+// quarantine directory, which is created in the repository's objects
+// directory and removed, with everything in it, if the push fails. So it
+// must only be a plain file name, with nothing that would take it outside
+// of the objects directory, and not one of the names that git uses there.
+func checkQuarantineID(id string) error {
+	if id == "" || len(id) > maxQuarantineIDLength {
+		return fmt.Errorf("quarantine ID must be 1 to %d characters long", maxQuarantineIDLength)
+	}
+	if id[0] == '.' || id[0] == '-' {
+		return fmt.Errorf("quarantine ID %q must start with a letter, digit, or underscore", id)
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("quarantine ID %q may only contain letters, digits, '-', '_', and '.'", id)
+		}
+	}
+	if id == "pack" || id == "info" || isLooseObjectDir(id) {
+		return fmt.Errorf("quarantine ID %q is the name of a directory that git uses", id)
+	}
+	return nil
+}
+
+// isLooseObjectDir reports whether `name` is like the names of the
+// directories that git keeps loose objects in, two hex digits.
+func isLooseObjectDir(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// alternateObjectDirs returns the value of GIT_ALTERNATE_OBJECT_DIRECTORIES
+// that lets git, writing to the quarantine, read the objects of the
+// repository in `objects`. If we were run with objects already hidden from
+// the repository, like from inside another push's quarantine, our children
+// need to keep seeing them too, so, like git does, the object directory and
+// alternates that we were given, according to `getenv`, come first.
+func alternateObjectDirs(objects string, getenv func(string) string) string {
+	var dirs []string
+	if inherited := getenv("GIT_ALTERNATE_OBJECT_DIRECTORIES"); inherited != "" {
+		dirs = append(dirs, inherited)
+	}
+	if objdir := getenv("GIT_OBJECT_DIRECTORY"); objdir != "" && filepath.Clean(objdir) != filepath.Clean(objects) {
+		dirs = append(dirs, quoteAlternate(objdir))
+	}
+	dirs = append(dirs, quoteAlternate(objects))
+	return strings.Join(dirs, string(os.PathListSeparator))
+}
+
+// quoteAlternate quotes `dir` for GIT_ALTERNATE_OBJECT_DIRECTORIES if it
+// has to be, the way that git's env_append does: if it starts with a quote
+// or contains the separator, it is C-quoted.
+func quoteAlternate(dir string) string {
+	if !strings.HasPrefix(dir, `"`) && !strings.ContainsRune(dir, os.PathListSeparator) {
+		return dir
+	}
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(dir); i++ {
+		switch c := dir[i]; {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&sb, "\\%03o", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,111 @@
+package spokes
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindRepo(t *testing.T) {
+	dir := t.TempDir()
+
+	makeGitDir := func(path string) string {
+		path = filepath.Join(dir, path)
+		require.NoError(t, os.MkdirAll(filepath.Join(path, "objects"), 0777))
+		require.NoError(t, os.WriteFile(filepath.Join(path, "HEAD"), []byte("ref: refs/heads/main\n"), 0666))
+		return path
+	}
+
+	bare := makeGitDir("bare.git")
+	spaces := makeGitDir("with some spaces.git")
+	nonBare := makeGitDir("worktree/.git")
+
+	for _, ex := range []struct {
+		label    string
+		path     string
+		gitDir   string
+		expected string
+	}{
+		{"plain path", bare, "", bare},
+		{"trailing slash", bare + "/", "", bare},
+		{"implicit .git suffix", filepath.Join(dir, "bare"), "", bare},
+		{"non-bare repository", filepath.Join(dir, "worktree"), "", nonBare},
+		{"path with spaces", spaces, "", spaces},
+		{"dot with GIT_DIR", ".", bare, bare},
+		{"dot-slash with GIT_DIR", "./", bare + "/", bare},
+	} {
+		t.Run(ex.label, func(t *testing.T) {
+			actual, err := findRepo(ex.path, ex.gitDir)
+			require.NoError(t, err)
+			assert.Equal(t, ex.expected, actual)
+		})
+	}
+
+	_, err := findRepo(filepath.Join(dir, "missing"), "")
+	assert.Error(t, err)
+
+	// Spaces aren't guessed at.
+	_, err = findRepo(filepath.Join(dir, "with  some spaces"), "")
+	assert.Error(t, err)
+}
+
+func TestCheckQuarantineID(t *testing.T) {
+	for _, id := range []string{
+		"q1",
+		"tmp_objdir-incoming-Ab3dEf",
+		"incoming.1234",
+		"_x",
+		strings.Repeat("a", maxQuarantineIDLength),
+	} {
+		assert.NoError(t, checkQuarantineID(id), id)
+	}
+
+	for _, id := range []string{
+		"",
+		".",
+		"..",
+		"../../etc",
+		"a/b",
+		"/tmp",
+		"a\\b",
+		".hidden",
+		"-rf",
+		"with space",
+		"nul\x00",
+		"pack",
+		"info",
+		"ab",
+		"0f",
+		strings.Repeat("a", maxQuarantineIDLength+1),
+	} {
+		assert.Error(t, checkQuarantineID(id), id)
+	}
+}
+
+func TestAlternateObjectDirs(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(key string) string { return vars[key] }
+	}
+
+	assert.Equal(t, "/repo.git/objects",
+		alternateObjectDirs("/repo.git/objects", env(nil)))
+	assert.Equal(t, "/repo.git/objects",
+		alternateObjectDirs("/repo.git/objects", env(map[string]string{"GIT_OBJECT_DIRECTORY": "/repo.git/objects/"})))
+	assert.Equal(t, "/network.git/objects:/repo.git/objects/incoming-1:/repo.git/objects",
+		alternateObjectDirs("/repo.git/objects", env(map[string]string{
+			"GIT_OBJECT_DIRECTORY":             "/repo.git/objects/incoming-1",
+			"GIT_ALTERNATE_OBJECT_DIRECTORIES": "/network.git/objects",
+		})))
+	assert.Equal(t, `"/a:b/objects":/repo.git/objects`,
+		alternateObjectDirs("/repo.git/objects", env(map[string]string{"GIT_OBJECT_DIRECTORY": "/a:b/objects"})))
+}
+
+func TestQuoteAlternate(t *testing.T) {
+	assert.Equal(t, "/repo.git/objects", quoteAlternate("/repo.git/objects"))
+	assert.Equal(t, `"/a:b"`, quoteAlternate("/a:b"))
+	assert.Equal(t, `"\"q\\\011"`, quoteAlternate("\"q\\\t"))
+}
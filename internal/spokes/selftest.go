@@ -0,0 +1,138 @@
+package spokes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/governor"
+	"github.com/github/spokes-receive-pack/internal/objectformat"
+)
+
+// selfTestTimeout is how long each check of the self-test may take.
+const selfTestTimeout = 10 * time.Second
+
+// errSkipped is the result of a check that couldn't run because one that
+// it depends on failed.
+var errSkipped = errors.New("skipped")
+
+// selfTestResult is the outcome of one check of the self-test.
+type selfTestResult struct {
+	Name      string `json:"name"`
+	OK        bool   `json:"ok"`
+	Skipped   bool   `json:"skipped,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ElapsedMS int64  `json:"elapsed_ms"`
+}
+
+// selfTestReport is what SelfTest writes.
+type selfTestReport struct {
+	Repo    string           `json:"repo"`
+	Version string           `json:"version"`
+	OK      bool             `json:"ok"`
+	Checks  []selfTestResult `json:"checks"`
+}
+
+// SelfTest checks that pushes to the repository at `repoPath` could be
+// handled on this host: that git runs, the repository's config can be read
+// and names an object format that we support, a quarantine can be written,
+// and governor can be reached. It writes the results to `w` as JSON, and
+// returns ExitOK if every check passed.
+func SelfTest(ctx context.Context, w io.Writer, repoPath, version string) (int, error) {
+	report := selfTestReport{Repo: repoPath, Version: version, OK: true}
+	check := func(name string, f func(ctx context.Context) (string, error)) {
+		ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+		defer cancel()
+
+		start := time.Now()
+		detail, err := f(ctx)
+		res := selfTestResult{
+			Name:      name,
+			OK:        err == nil,
+			Detail:    detail,
+			ElapsedMS: time.Since(start).Milliseconds(),
+		}
+		switch {
+		case errors.Is(err, errSkipped):
+			res.Skipped = true
+		case err != nil:
+			res.Error = err.Error()
+		}
+		report.OK = report.OK && res.OK
+		report.Checks = append(report.Checks, res)
+	}
+
+	check("git", func(ctx context.Context) (string, error) {
+		out, err := exec.CommandContext(ctx, "git", "version").Output()
+		return strings.TrimSpace(string(out)), err
+	})
+
+	var cfg *config.Config
+	check("config", func(ctx context.Context) (string, error) {
+		var err error
+		if cfg, err = config.GetConfig(repoPath); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d entries", len(cfg.Entries)), nil
+	})
+
+	check("object-format", func(ctx context.Context) (string, error) {
+		if cfg == nil {
+			return "", errSkipped
+		}
+		of, err := objectformat.GetObjectFormatFromConfig(repoPath, cfg)
+		return string(of), err
+	})
+
+	check("quarantine", func(ctx context.Context) (string, error) {
+		return checkQuarantineWritable(repoPath)
+	})
+
+	check("governor", governor.Ping)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return ExitInternalError, err
+	}
+	if !report.OK {
+		return ExitInternalError, errors.New("self-test failed")
+	}
+	return ExitOK, nil
+}
+
+// checkQuarantineWritable makes a quarantine in the repository, the way
+// that a push would, writes a file into its pack directory, and removes it
+// again.
+func checkQuarantineWritable(repoPath string) (string, error) {
+	dir := filepath.Join(repoPath, "objects", fmt.Sprintf("spokes-self-test-%d", os.Getpid()))
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "pack"), 0777); err != nil {
+		return "", err
+	}
+	f, err := os.Create(filepath.Join(dir, "pack", "self-test"))
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString("self-test\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return filepath.Dir(dir), nil
+}
@@ -0,0 +1,75 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTest(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "repo.git")
+	require.NoError(t, exec.Command("git", "init", "--quiet", "--bare", repo).Run())
+
+	run := func() (int, selfTestReport) {
+		var buf bytes.Buffer
+		code, _ := SelfTest(context.Background(), &buf, repo, "test")
+		var report selfTestReport
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &report), buf.String())
+		return code, report
+	}
+
+	t.Setenv("GOVERNOR_LOG_ONLY", "1")
+	code, report := run()
+	assert.Equal(t, ExitOK, code)
+	assert.True(t, report.OK)
+	assert.Equal(t, repo, report.Repo)
+	var names []string
+	for _, c := range report.Checks {
+		names = append(names, c.Name)
+		assert.True(t, c.OK, c)
+	}
+	assert.Equal(t, []string{"git", "config", "object-format", "quarantine", "governor"}, names)
+	assert.Equal(t, "sha1", report.Checks[2].Detail)
+
+	// Nothing is left behind.
+	entries, err := os.ReadDir(filepath.Join(repo, "objects"))
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.NotContains(t, e.Name(), "self-test")
+	}
+
+	// Governor can't be reached, and the quarantine can't be written.
+	t.Setenv("GOVERNOR_LOG_ONLY", "")
+	t.Setenv("GIT_SOCKSTAT_PATH", filepath.Join(t.TempDir(), "missing.sock"))
+	blocker := filepath.Join(repo, "objects", fmt.Sprintf("spokes-self-test-%d", os.Getpid()))
+	require.NoError(t, os.WriteFile(blocker, nil, 0666))
+
+	code, report = run()
+	assert.Equal(t, ExitInternalError, code)
+	assert.False(t, report.OK)
+	governor := report.Checks[4]
+	assert.False(t, governor.OK)
+	assert.NotEmpty(t, governor.Error)
+	assert.False(t, report.Checks[3].OK)
+}
+
+func TestSelfTestSkipsDependentChecks(t *testing.T) {
+	t.Setenv("GOVERNOR_LOG_ONLY", "1")
+	var buf bytes.Buffer
+	code, err := SelfTest(context.Background(), &buf, filepath.Join(t.TempDir(), "missing.git"), "test")
+	assert.Equal(t, ExitInternalError, code)
+	assert.Error(t, err)
+
+	var report selfTestReport
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &report))
+	assert.False(t, report.Checks[1].OK)
+	assert.True(t, report.Checks[2].Skipped)
+}
@@ -0,0 +1,280 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/github/spokes-receive-pack/internal/childenv"
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/github/spokes-receive-pack/internal/objectformat"
+	"github.com/github/spokes-receive-pack/internal/pktline"
+)
+
+// maxShadowRecording is the most input, and the most output, that we're
+// willing to hold on to in order to verify a push.
+const maxShadowRecording = 64 * 1024 * 1024
+
+// shadowEnabled returns true if the push that `opts` describe should be
+// verified by replaying it to git-receive-pack. Only stateless-rpc pushes
+// can be replayed, and only if the pack comes after the commands on stdin,
+// where the shadow records it.
+func shadowEnabled(opts Options) bool {
+	return os.Getenv("SPOKES_SHADOW_VERIFY") == "1" && opts.StatelessRPC && !opts.AdvertiseRefs && opts.Pack == nil
+}
+
+// shadow records the protocol stream of a push so that, once we're done
+// with it, it can be replayed to `git receive-pack` in a throwaway
+// repository and the two reports can be compared.
+//
+// Like fallback, this only works with `--stateless-rpc`.
+type shadow struct {
+	input  *recordingReader
+	output *recordingWriter
+
+	// hiddenRefs are the rules that git-receive-pack must be told about
+	// to hide the refs that it can't find in the config.
+	hiddenRefs []string
+}
+
+func newShadow(stdin io.Reader, stdout io.Writer) *shadow {
+	return &shadow{
+		input:  &recordingReader{r: stdin, max: maxShadowRecording},
+		output: &recordingWriter{w: stdout, max: maxShadowRecording},
+	}
+}
+
+// verify replays the push to git-receive-pack and logs any difference
+// between its report and ours.
+func (s *shadow) verify(ctx context.Context, repoPath string, of objectformat.ObjectFormat, lg *logger.Logger) {
+	if ctx.Err() != nil {
+		return
+	}
+	if s.input.overflowed || s.output.overflowed {
+		lg.Info("shadow verification skipped", "reason", "push too large to record")
+		return
+	}
+
+	input := s.input.buf.Bytes()
+	commands, caps, err := parseShadowCommands(input, of)
+	if err != nil {
+		lg.Warn("shadow verification skipped", "error", err)
+		return
+	}
+	if len(commands) == 0 || !(caps.IsDefined(pktline.ReportStatus) || caps.IsDefined(pktline.ReportStatusV2)) {
+		// There's nothing to compare.
+		return
+	}
+	sideband := useSideBand(caps)
+
+	ours, err := parseReport(s.output.buf.Bytes(), sideband)
+	if err != nil {
+		lg.Warn("shadow verification failed: parsing our report", "error", err)
+		return
+	}
+
+	theirs, err := runShadow(ctx, repoPath, of, s.hiddenRefs, commands, input, sideband)
+	if err != nil {
+		lg.Warn("shadow verification failed: running git-receive-pack", "error", err)
+		return
+	}
+
+	if ours.String() != theirs.String() {
+		lg.Warn("shadow verification report mismatch",
+			"spokes_receive_pack", ours.String(),
+			"git_receive_pack", theirs.String())
+	}
+}
+
+// runShadow runs `git receive-pack` on `input` in a temporary repository
+// that borrows the objects of the repository at `repoPath` and starts out
+// with the refs that the commands expect, and returns its report. The git
+// commands also hide the refs that `hiddenRefs` says to.
+func runShadow(ctx context.Context, repoPath string, of objectformat.ObjectFormat, hiddenRefs []string, commands []command, input []byte, sideband bool) (report, error) {
+	dir, err := os.MkdirTemp("", "spokes-shadow-")
+	if err != nil {
+		return report{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	var gitConfig []string
+	if len(hiddenRefs) > 0 {
+		if _, gitConfig, err = writeHiddenRefsConfig(dir, hiddenRefs); err != nil {
+			return report{}, err
+		}
+	}
+
+	git := func(stdin io.Reader, stdout io.Writer, args ...string) error {
+		name := args[0]
+		args = append(append([]string{"-c", "core.hooksPath=" + os.DevNull}, gitConfig...), args...)
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(childenv.Environ(os.Environ()), "GIT_DIR="+dir)
+		cmd.Stdin = stdin
+		cmd.Stdout = stdout
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("git %s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+
+	if err := git(nil, nil, "init", "--quiet", "--bare", "--object-format="+string(of), "."); err != nil {
+		return report{}, err
+	}
+	if err := git(nil, nil, "config", "include.path", filepath.Join(repoPath, "config")); err != nil {
+		return report{}, err
+	}
+	alternates := filepath.Join(repoPath, "objects") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "objects", "info", "alternates"), []byte(alternates), 0666); err != nil {
+		return report{}, err
+	}
+
+	var refs bytes.Buffer
+	for _, c := range commands {
+		if c.oldOID != of.NullOID() {
+			fmt.Fprintf(&refs, "create %s %s\n", c.refname, c.oldOID)
+		}
+	}
+	if refs.Len() > 0 {
+		if err := git(&refs, nil, "update-ref", "--stdin"); err != nil {
+			return report{}, err
+		}
+	}
+
+	var out bytes.Buffer
+	if err := git(bytes.NewReader(input), &out, "receive-pack", "--stateless-rpc", "."); err != nil {
+		// A failed push still produces a report that we want to compare.
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return report{}, err
+		}
+	}
+
+	return parseReport(out.Bytes(), sideband)
+}
+
+// parseShadowCommands reads the commands and the client's capabilities from
+// the start of a recorded push.
+func parseShadowCommands(input []byte, objectFormat objectformat.ObjectFormat) ([]command, pktline.Capabilities, error) {
+	r := bytes.NewReader(input)
+	pl := pktline.New()
+
+	var commands []command
+	var caps pktline.Capabilities
+	for first := true; ; {
+		if err := pl.Read(r); err != nil {
+			return nil, caps, fmt.Errorf("reading commands: %w", err)
+		}
+		if pl.IsFlush() {
+			return commands, caps, nil
+		}
+		if first {
+			var err error
+			if caps, err = pl.Capabilities(); err != nil {
+				return nil, caps, err
+			}
+			first = false
+		}
+		if c, ok := parseCommand(objectFormat, string(pl.Payload)); ok {
+			commands = append(commands, c)
+		}
+	}
+}
+
+// report is the outcome of a push, as far as the client can tell.
+type report struct {
+	unpack string
+	refs   map[string]string
+}
+
+// String returns a canonical representation of `rep`, for comparison.
+func (rep report) String() string {
+	lines := make([]string, 0, len(rep.refs))
+	for ref, status := range rep.refs {
+		lines = append(lines, status+" "+ref)
+	}
+	sort.Strings(lines)
+	return strings.Join(append([]string{"unpack " + rep.unpack}, lines...), ", ")
+}
+
+// parseReport extracts the report-status from the output of a push. Ref
+// statuses are reduced to "ok" or "ng", since the reasons for rejecting an
+// update are worded differently, and `ff`/`nf` are our own extension.
+// Likewise, a failed unpack is just an "error".
+func parseReport(output []byte, sideband bool) (report, error) {
+	if sideband {
+		var primary bytes.Buffer
+		r := bytes.NewReader(output)
+		pl := pktline.New()
+		for {
+			err := pl.Read(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return report{}, err
+			}
+			if len(pl.Payload) > 0 && pl.Payload[0] == 1 {
+				primary.Write(pl.Payload[1:])
+			}
+		}
+		output = primary.Bytes()
+	}
+
+	rep := report{refs: make(map[string]string)}
+	r := bytes.NewReader(output)
+	pl := pktline.New()
+	for {
+		if err := pl.Read(r); err != nil {
+			return report{}, err
+		}
+		if pl.IsFlush() {
+			return rep, nil
+		}
+
+		line := strings.TrimSuffix(string(pl.Payload), "\n")
+		status, rest, _ := strings.Cut(line, " ")
+		switch status {
+		case "unpack":
+			rep.unpack = rest
+			if rest != "ok" {
+				rep.unpack = "error"
+			}
+		case "ok", "ff", "nf":
+			rep.refs[rest] = "ok"
+		case "ng":
+			ref, _, _ := strings.Cut(rest, " ")
+			rep.refs[ref] = "ng"
+		}
+	}
+}
+
+// recordingWriter remembers what has been written through it, up to `max`
+// bytes.
+type recordingWriter struct {
+	w          io.Writer
+	buf        bytes.Buffer
+	max        int
+	overflowed bool
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if !rw.overflowed {
+		if rw.buf.Len()+len(p) > rw.max {
+			rw.overflowed = true
+			rw.buf = bytes.Buffer{}
+		} else {
+			rw.buf.Write(p)
+		}
+	}
+	return rw.w.Write(p)
+}
@@ -0,0 +1,100 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/objectformat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReport(t *testing.T) {
+	var plain bytes.Buffer
+	require.NoError(t, writeReport(&plain, true, []command{
+		{refname: "refs/heads/main", reportFF: "nf", forced: true},
+		{refname: "refs/heads/new", reportFF: "ok"},
+		{refname: "refs/heads/hidden", reportFF: "ng", err: "deny updating a hidden ref"},
+	}, true))
+
+	rep, err := parseReport(plain.Bytes(), false)
+	require.NoError(t, err)
+	assert.Equal(t, "unpack ok, ng refs/heads/hidden, ok refs/heads/main, ok refs/heads/new", rep.String())
+
+	var muxed bytes.Buffer
+	require.NoError(t, writePacketf(&muxed, "\x02remote: progress\n"))
+	require.NoError(t, writePacketf(&muxed, "\x01%s", plain.Bytes()[:20]))
+	require.NoError(t, writePacketf(&muxed, "\x01%s", plain.Bytes()[20:]))
+	muxed.WriteString("0000")
+
+	muxedRep, err := parseReport(muxed.Bytes(), true)
+	require.NoError(t, err)
+	assert.Equal(t, rep.String(), muxedRep.String())
+
+	var failed bytes.Buffer
+	require.NoError(t, writePacketf(&failed, "unpack index-pack abnormal exit\n"))
+	failed.WriteString("0000")
+	failedRep, err := parseReport(failed.Bytes(), false)
+	require.NoError(t, err)
+	assert.Equal(t, "unpack error", failedRep.String())
+}
+
+func TestRunShadow(t *testing.T) {
+	dir := t.TempDir()
+	git := func(stdin string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Stdin = strings.NewReader(stdin)
+		out, err := cmd.Output()
+		require.NoError(t, err, "git %v", args)
+		return string(out)
+	}
+
+	git("", "init", "--quiet", "--bare", "target.git")
+	git("", "init", "--quiet", "--bare", "source.git")
+	tree := strings.TrimSpace(git("", "--git-dir=source.git", "mktree"))
+	commit := strings.TrimSpace(git("", "--git-dir=source.git",
+		"-c", "user.name=a", "-c", "user.email=a@example.com", "commit-tree", "-m", "initial", tree))
+	pack := git(commit+"\n", "--git-dir=source.git", "pack-objects", "--revs", "--stdout")
+
+	var input bytes.Buffer
+	require.NoError(t, writePacketf(&input, "%s %s refs/heads/main\x00report-status\n", nullSHA1OID, commit))
+	input.WriteString("0000")
+	input.WriteString(pack)
+
+	commands, caps, err := parseShadowCommands(input.Bytes(), objectformat.ObjectFormat("sha1"))
+	require.NoError(t, err)
+	require.Len(t, commands, 1)
+	assert.Equal(t, "refs/heads/main", commands[0].refname)
+	assert.False(t, useSideBand(caps))
+
+	rep, err := runShadow(context.Background(), fmt.Sprintf("%s/target.git", dir), objectformat.ObjectFormat("sha1"), nil, commands, input.Bytes(), false)
+	require.NoError(t, err)
+	assert.Equal(t, "unpack ok, ok refs/heads/main", rep.String())
+
+	// git-receive-pack gets told about the refs hidden by files.
+	rep, err = runShadow(context.Background(), fmt.Sprintf("%s/target.git", dir), objectformat.ObjectFormat("sha1"), []string{"refs/heads/"}, commands, input.Bytes(), false)
+	require.NoError(t, err)
+	assert.Equal(t, "unpack ok, ng refs/heads/main", rep.String())
+
+	// The target repository must not have been touched.
+	assert.Empty(t, git("", "--git-dir=target.git", "for-each-ref"))
+}
+
+func TestShadowEnabled(t *testing.T) {
+	opts := Options{StatelessRPC: true}
+	assert.False(t, shadowEnabled(opts))
+
+	t.Setenv("SPOKES_SHADOW_VERIFY", "1")
+	assert.True(t, shadowEnabled(opts))
+	assert.False(t, shadowEnabled(Options{}))
+	assert.False(t, shadowEnabled(Options{StatelessRPC: true, AdvertiseRefs: true}))
+
+	// The shadow would only record the commands, not the pack.
+	opts.Pack = strings.NewReader("PACK")
+	assert.False(t, shadowEnabled(opts))
+}
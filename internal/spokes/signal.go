@@ -0,0 +1,66 @@
+package spokes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+)
+
+// terminatedError is the cause of the context cancellation when we receive a
+// termination signal.
+type terminatedError struct {
+	sig os.Signal
+}
+
+func (e terminatedError) Error() string {
+	return fmt.Sprintf("terminated by signal: %s", e.sig)
+}
+
+// notifyTermination returns a context that is canceled, with a
+// terminatedError as its cause, when one of `signals` is received.
+//
+// Unlike `signal.NotifyContext`, this lets us tell a termination apart from
+// other cancellations, so that we can still send the client a proper report
+// and tell governor what happened before exiting. Only the first signal is
+// handled gracefully: after it, the default behavior is restored, so a second
+// signal kills the process immediately.
+func notifyTermination(ctx context.Context, signals ...os.Signal) (context.Context, context.CancelFunc) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	go watchSignals(ctx, cancel, ch)
+
+	return ctx, func() {
+		signal.Stop(ch)
+		cancel(nil)
+	}
+}
+
+func watchSignals(ctx context.Context, cancel context.CancelCauseFunc, ch chan os.Signal) {
+	select {
+	case sig := <-ch:
+		signal.Stop(ch)
+		cancel(terminatedError{sig: sig})
+	case <-ctx.Done():
+	}
+}
+
+// isTerminated returns true iff `ctx` was canceled because we received a
+// termination signal.
+func isTerminated(ctx context.Context) bool {
+	var te terminatedError
+	return errors.As(context.Cause(ctx), &te)
+}
+
+// markTerminated rejects every command, since nothing that we received will
+// be kept once we've been terminated.
+func markTerminated(commands []command) {
+	for i := range commands {
+		commands[i].err = "terminated"
+		commands[i].reportFF = "ng"
+		commands[i].retryable = true
+	}
+}
@@ -0,0 +1,54 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchSignals(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	ch := make(chan os.Signal, 1)
+	ch <- syscall.SIGTERM
+	watchSignals(ctx, cancel, ch)
+
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	assert.True(t, isTerminated(ctx))
+	assert.EqualError(t, context.Cause(ctx), "terminated by signal: terminated")
+}
+
+func TestIsTerminated(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	assert.False(t, isTerminated(ctx))
+
+	cancel(errors.New("something else"))
+	assert.False(t, isTerminated(ctx))
+
+	ctx, cancel = context.WithCancelCause(context.Background())
+	cancel(nil)
+	assert.False(t, isTerminated(ctx))
+}
+
+func TestMarkTerminated(t *testing.T) {
+	commands := []command{
+		{refname: "refs/heads/main", reportFF: "ok"},
+		{refname: "refs/heads/hidden", reportFF: "ng", err: "deny updating a hidden ref"},
+	}
+	markTerminated(commands)
+
+	var buf bytes.Buffer
+	assert.NoError(t, writeReport(&buf, true, commands, false))
+	assert.Equal(t,
+		"000eunpack ok\n"+
+			"002eng refs/heads/main terminated (retryable)\n"+
+			"0030ng refs/heads/hidden terminated (retryable)\n"+
+			"0000",
+		buf.String())
+}
@@ -0,0 +1,83 @@
+package spokes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// maxSnapshotLine is the longest line that an advertisement snapshot may
+// have.
+const maxSnapshotLine = 64 * 1024
+
+// advertiseSnapshot writes the ref advertisement from r.advertisement,
+// instead of reading the refs of the repository. The snapshot has a line
+// for each ref, like "<oid> <refname>", and for each extra object that the
+// client may assume we have, like "<oid> .have", in the order in which
+// they should be advertised. The caller decides what it holds, like the
+// refs of the authoritative replica of the repository, when ours might be
+// behind; hidden refs, and refs outside the client's ref prefixes, are
+// still left out.
+func (r *spokesReceivePack) advertiseSnapshot(ctx context.Context) error {
+	hiddenRefs := r.hiddenRefs()
+
+	// Refs are small, and there can be many of them, so they are written
+	// in chunks instead of one by one.
+	out := newCoalescingWriter(r.advertisementOutput(), advertisementBufferSize, advertisementFlushDelay)
+	defer out.Stop()
+
+	var wroteCapabilities bool
+	scanner := bufio.NewScanner(r.advertisement)
+	scanner.Buffer(make([]byte, 0, 4096), maxSnapshotLine)
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		oid, refname, ok := bytes.Cut(line, []byte(" "))
+		if !ok || !r.objectFormat.IsValidOID(string(oid)) || len(refname) == 0 || bytes.ContainsAny(refname, " \x00") {
+			return fmt.Errorf("malformed advertisement snapshot line: %q", line)
+		}
+		if string(refname) != ".have" && hiddenRefs.isHidden(string(refname)) {
+			continue
+		}
+		if !r.refPrefixes.allowsLine(line) {
+			continue
+		}
+
+		if wroteCapabilities {
+			if err := writePacketf(out, "%s\n", line); err != nil {
+				return fmt.Errorf("writing ref advertisement packet: %w", err)
+			}
+		} else {
+			wroteCapabilities = true
+			if err := writePacketf(out, "%s\x00%s\n", line, r.capabilities); err != nil {
+				return fmt.Errorf("writing capability packet: %w", err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading advertisement snapshot: %w", err)
+	}
+
+	if !wroteCapabilities {
+		if err := writePacketf(out, "%s capabilities^{}\x00%s", r.objectFormat.NullOID(), r.capabilities); err != nil {
+			return fmt.Errorf("writing lonely capability packet: %w", err)
+		}
+	}
+
+	if _, err := fmt.Fprintf(out, "0000"); err != nil {
+		return fmt.Errorf("writing flush packet: %w", err)
+	}
+
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("writing ref advertisement: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdvertiseSnapshot(t *testing.T) {
+	const (
+		oid1 = "e83c5163316f89bfbde7d9ab23ca2e25604af290"
+		oid2 = "b610c0d60779c270356dde58d8286d36223ffeac"
+	)
+	snapshot := strings.Join([]string{
+		oid1 + " refs/heads/main",
+		oid2 + " refs/pull/1/head",
+		"",
+		oid2 + " refs/tags/v1",
+		oid2 + " .have",
+	}, "\n") + "\n"
+
+	var buf bytes.Buffer
+	r := &spokesReceivePack{
+		config: &config.Config{Entries: []config.ConfigEntry{
+			{Key: "receive.hiderefs", Value: "refs/pull/"},
+		}},
+		output:        &buf,
+		objectFormat:  "sha1",
+		capabilities:  "anything",
+		advertisement: strings.NewReader(snapshot),
+	}
+	require.NoError(t, r.advertiseSnapshot(context.Background()))
+	assert.Equal(t,
+		"0046"+oid1+" refs/heads/main\x00anything\n"+
+			"003a"+oid2+" refs/tags/v1\n"+
+			"0033"+oid2+" .have\n"+
+			"0000",
+		buf.String(),
+	)
+
+	// The client's ref prefixes apply too.
+	buf.Reset()
+	r.hiddenRefMatcher = nil
+	r.refPrefixes = refPrefixFilter{"refs/heads/"}
+	r.advertisement = strings.NewReader(snapshot)
+	require.NoError(t, r.advertiseSnapshot(context.Background()))
+	assert.Equal(t,
+		"0046"+oid1+" refs/heads/main\x00anything\n"+
+			"0033"+oid2+" .have\n"+
+			"0000",
+		buf.String(),
+	)
+
+	// An empty snapshot gets the lonely capabilities line.
+	buf.Reset()
+	r.advertisement = strings.NewReader("")
+	require.NoError(t, r.advertiseSnapshot(context.Background()))
+	assert.Contains(t, buf.String(), nullSHA1OID+" capabilities^{}\x00anything")
+
+	for _, bad := range []string{
+		"refs/heads/main\n",
+		"1234 refs/heads/main\n",
+		oid1 + " \n",
+		oid1 + " refs/heads/a b\n",
+	} {
+		buf.Reset()
+		r.advertisement = strings.NewReader(bad)
+		assert.ErrorContains(t, r.advertiseSnapshot(context.Background()), "malformed advertisement snapshot line", bad)
+	}
+}
@@ -8,21 +8,28 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
-	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/github/go-pipe/pipe"
+	"github.com/github/spokes-receive-pack/internal/audit"
+	"github.com/github/spokes-receive-pack/internal/childenv"
 	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/events"
 	"github.com/github/spokes-receive-pack/internal/governor"
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/github/spokes-receive-pack/internal/memlimit"
 	"github.com/github/spokes-receive-pack/internal/objectformat"
+	"github.com/github/spokes-receive-pack/internal/pipe"
 	"github.com/github/spokes-receive-pack/internal/pktline"
+	"github.com/github/spokes-receive-pack/internal/policy"
 	"github.com/github/spokes-receive-pack/internal/sockstat"
 	"github.com/pingcap/failpoint"
 	"golang.org/x/sync/errgroup"
@@ -37,62 +44,343 @@ const (
 
 // Exec is similar to a main func for the new version of receive-pack.
 func Exec(ctx context.Context, stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string, version string) (int, error) {
-	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	ctx, stop := notifyTermination(ctx, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	defer stop()
 
+	memlimit.Configure()
+
 	statelessRPC := flag.Bool("stateless-rpc", false, "Indicates we are using the HTTP protocol")
 	httpBackendInfoRefs := flag.Bool("http-backend-info-refs", false, "Indicates we only need to announce the references")
 	flag.BoolVar(httpBackendInfoRefs, "advertise-refs", *httpBackendInfoRefs, "alias of --http-backend-info-refs")
+	advertisementFile := flag.String("advertisement-file", "", "Read the ref advertisement from this file instead of the repository")
+	packFile := flag.String("pack-file", "", "Read the pack from this file, or \"fd:N\", instead of after the commands on stdin")
+	dumpAdvertisement := flag.Bool("dump-advertisement", false, "Print the ref advertisement as JSON instead of handling a push")
+	selfTest := flag.Bool("self-test", false, "Check that pushes to the repository could be handled, print the results as JSON, and exit")
+	showVersion := flag.Bool("version", false, "Print version information and exit")
+	flag.BoolVar(showVersion, "V", *showVersion, "alias of --version")
 	flag.Parse()
 
+	if *showVersion {
+		if err := writeVersion(stdout, version); err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
+
 	if flag.NArg() != 1 {
 		return 1, fmt.Errorf("Unexpected number of keyword args (%d). Expected repository name, got %s ", flag.NArg(), flag.Args())
 	}
 
-	// Assume that this is a bare repository. chdir to it and take the full
-	// path to use when setting up the quarantine dir.
-	if err := os.Chdir(flag.Args()[0]); err != nil {
+	repoArg, err := findRepo(flag.Arg(0), os.Getenv("GIT_DIR"))
+	if err != nil {
 		return 1, fmt.Errorf("error entering repo: %w", err)
 	}
 
-	repoPath, err := os.Getwd()
+	// Assume that this is a bare repository, and use its full path, with
+	// symlinks resolved, for everything, including the quarantine dir.
+	repoPath, err := filepath.Abs(repoArg)
+	if err == nil {
+		repoPath, err = filepath.EvalSymlinks(repoPath)
+	}
+	if err != nil {
+		return 1, fmt.Errorf("error entering repo: %w", err)
+	}
+
+	// A GIT_DIR that we were invoked with may be relative to a directory
+	// that our children don't run in, so make sure that any of them that
+	// look at it see the repository that we found.
+	if os.Getenv("GIT_DIR") != "" {
+		if err := os.Setenv("GIT_DIR", repoPath); err != nil {
+			return 1, err
+		}
+	}
+
+	if *selfTest {
+		return SelfTest(ctx, stdout, repoPath, version)
+	}
+
+	environ, err := sockstat.ExpandEnviron(os.Environ())
+	if err != nil {
+		return 1, err
+	}
+
+	vars, sockstatErrs := sockstat.ParseStrict(environ)
+
+	lg, logCloser, err := openLogger(stderr, version, vars)
 	if err != nil {
 		return 1, err
 	}
+	defer logCloser.Close()
+
+	stopDebugSignals := handleDebugSignals(ctx, lg)
+	defer stopDebugSignals()
+
+	if trace2Enabled() {
+		relay, err := startTrace2Relay(lg.With("phase", "trace2"))
+		if err != nil {
+			lg.Warn("not relaying trace2 events", "error", err)
+		} else {
+			defer relay.stop()
+			for _, kv := range relay.env() {
+				name, value, _ := strings.Cut(kv, "=")
+				if err := os.Setenv(name, value); err != nil {
+					return 1, err
+				}
+			}
+		}
+	}
+
+	if mode := sockstat.StrictMode(); mode == "log" || mode == "fail" {
+		for _, err := range sockstatErrs {
+			lg.Warn("invalid sockstat var", "error", err)
+		}
+		if mode == "fail" && len(sockstatErrs) > 0 {
+			return 1, fmt.Errorf("refusing to run with %d invalid sockstat vars", len(sockstatErrs))
+		}
+	}
+
+	if vars.Failpoints != "" {
+		if !failpointsAllowed() {
+			lg.Warn("ignoring failpoints sockstat var", "reason", "failpoints are not allowed")
+		} else if err := enableFailpoints(vars.Failpoints); err != nil {
+			lg.Warn("ignoring failpoints sockstat var", "error", err)
+		}
+	}
+
+	if grace := stageTimeout(lg, "SPOKES_TERMINATION_GRACE_PERIOD", 0); grace > 0 {
+		pipe.GracePeriod = grace
+	}
+
+	var advertisement io.Reader
+	if *advertisementFile != "" {
+		f, err := os.Open(*advertisementFile)
+		if err != nil {
+			return 1, fmt.Errorf("opening advertisement snapshot: %w", err)
+		}
+		defer f.Close()
+		advertisement = f
+	}
+
+	var pack io.Reader
+	if *packFile != "" {
+		f, err := openPackFile(*packFile)
+		if err != nil {
+			return 1, err
+		}
+		defer f.Close()
+		pack = f
+	}
+
+	opts := Options{
+		Stdin:         stdin,
+		Stdout:        stdout,
+		Stderr:        stderr,
+		RepoPath:      repoPath,
+		Vars:          vars,
+		StatelessRPC:  *statelessRPC,
+		AdvertiseRefs: *httpBackendInfoRefs,
+		Advertisement: advertisement,
+		Pack:          pack,
+		Version:       version,
+		Log:           lg,
+		Started:       processStart,
+	}
+	if *dumpAdvertisement {
+		return DumpAdvertisement(ctx, opts)
+	}
+	return Run(ctx, opts)
+}
+
+// Options say what Run should do.
+type Options struct {
+	// The client's input and where to send it output and errors.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// RepoPath is the absolute path of the bare repository to push to.
+	RepoPath string
+
+	// Vars are the sockstat vars of the push. Vars.QuarantineID is
+	// required.
+	Vars sockstat.Vars
+
+	// StatelessRPC and AdvertiseRefs are like the --stateless-rpc and
+	// --advertise-refs options.
+	StatelessRPC  bool
+	AdvertiseRefs bool
+
+	// Advertisement, if set, is where to read the ref advertisement from
+	// instead of the repository. See advertiseSnapshot for its format.
+	Advertisement io.Reader
+
+	// Pack, if set, is where to read the pack from, instead of from Stdin
+	// after the commands and push options.
+	Pack io.Reader
+
+	// Version is advertised to the client in the agent capability.
+	Version string
+
+	// PushOptions, if set, says whether to advertise the push-options
+	// capability, instead of receive.advertisePushOptions.
+	PushOptions *bool
+
+	// Log is where to log to. If it is nil, the log goes wherever
+	// logger.DestinationEnv says, or Stderr.
+	Log *logger.Logger
+
+	// Started is when the push started, for measuring how long the
+	// client waits for the ref advertisement. If it is zero, the push
+	// starts when Run is called.
+	Started time.Time
+}
+
+// Run handles a push to the repository in `opts.RepoPath`, like Exec, but
+// without touching any of the state of the process, like the working
+// directory, flags, or signal handlers. It returns the exit code that the
+// push would have in Exec.
+func Run(ctx context.Context, opts Options) (int, error) {
+	started := opts.Started
+	if started.IsZero() {
+		started = time.Now()
+	}
+	stdin, stdout, stderr := opts.Stdin, opts.Stdout, opts.Stderr
+	repoPath, vars, version := opts.RepoPath, opts.Vars, opts.Version
+
+	lg := opts.Log
+	if lg == nil {
+		var logCloser io.Closer
+		var err error
+		lg, logCloser, err = openLogger(stderr, version, vars)
+		if err != nil {
+			return 1, err
+		}
+		defer logCloser.Close()
+	}
+
+	// The shadow runs a whole git-receive-pack, so it waits until
+	// governor has been told that we're done and the host's slot is free
+	// again, which the later defers take care of.
+	var verifyShadow func()
+	defer func() {
+		if verifyShadow != nil {
+			verifyShadow()
+		}
+	}()
 
-	g, err := governor.Start(ctx, repoPath)
+	g, err := governor.Start(ctx, repoPath, vars)
 	if err != nil {
 		return 75, err
 	}
 	defer g.Finish(ctx)
 
-	config, err := config.GetConfig(".")
+	// Advertisement-only requests are cheap, so only pushes count
+	// against the host's limit.
+	if !opts.AdvertiseRefs {
+		slot, err := acquireHostSlot(lg)
+		if err != nil {
+			// The client shows an ERR packet as a "remote error", which
+			// tells it more than the connection closing would.
+			if err := writePacketf(stdout, "ERR %s\n", err); err != nil {
+				lg.Warn("refusing push", "error", err)
+			}
+			g.SetError(ExitGovernorError, err.Error())
+			g.SetCategory(categoryBusy.name)
+			return ExitGovernorError, err
+		}
+		defer slot.release()
+	}
+	admitted := time.Now()
+
+	config, err := config.GetConfig(repoPath)
 	if err != nil {
 		g.SetError(1, err.Error())
 		return 1, err
 	}
 
-	objectFormat, err := objectformat.GetObjectFormat(".")
+	objectFormat, err := objectformat.GetObjectFormatFromConfig(repoPath, config)
 	if err != nil {
 		g.SetError(1, err.Error())
 		return 1, err
 	}
+	configured := time.Now()
 
-	quarantineID := sockstat.GetString("quarantine_id")
+	quarantineID := vars.QuarantineID
 	if quarantineID == "" {
 		err := fmt.Errorf("missing required sockstat var quarantine_id")
 		g.SetError(1, err.Error())
 		return 1, err
 	}
+	if err := checkQuarantineID(quarantineID); err != nil {
+		err = fmt.Errorf("invalid sockstat var quarantine_id: %w", err)
+		g.SetError(1, err.Error())
+		return 1, err
+	}
 
-	capabilitiesLine := supportedCapabilities(objectFormat) + fmt.Sprintf(" agent=github/spokes-receive-pack-%s", version)
-	if requestID := sockstat.GetString("request_id"); requestID != "" && pktline.IsSafeCapabilityValue(requestID) {
-		capabilitiesLine += " session-id=" + requestID
+	receiveOptions := newReceiveOptions(config, lg)
+	capabilitiesLine := advertisedCapabilities(opts, config, objectFormat, receiveOptions, lg)
+
+	var sh *shadow
+	if shadowEnabled(opts) {
+		sh = newShadow(stdin, stdout)
+		stdin, stdout = sh.input, sh.output
+		verifyShadow = func() {
+			sh.verify(ctx, repoPath, objectFormat, lg.With("phase", "shadow"))
+		}
 	}
 
-	// Announce the `push-options` capability if the config option is set
-	if config.Get("receive.advertisePushOptions") == "true" {
-		capabilitiesLine = capabilitiesLine + " push-options"
+	journal, err := audit.OpenIn(repoPath, os.Getenv(audit.DestinationEnv))
+	if err != nil {
+		lg.Error("not recording ref update decisions", "error", err)
+	}
+	defer journal.Close()
+
+	replication, replicationErr := audit.OpenIn(repoPath, os.Getenv(audit.ReplicationDestinationEnv))
+	if replicationErr != nil {
+		lg.Error("not able to record pushes for replication", "error", replicationErr)
+	}
+	defer replication.Close()
+
+	emitter, err := events.New(os.Getenv(events.DestinationEnv))
+	if err != nil {
+		lg.Warn("not emitting push events", "error", err)
+	}
+
+	policyClient, err := policy.FromEnv()
+	if err != nil {
+		lg.Warn("policy service misconfigured", "error", err)
+	}
+
+	pushRules, pushRulesErr := policy.ParseRules(config)
+	if pushRulesErr != nil {
+		lg.Error("invalid push rules", "error", pushRulesErr)
+	}
+
+	pathRules, pathRulesErr := policy.ParsePathRules(config)
+	if pathRulesErr != nil {
+		lg.Error("invalid path policy", "error", pathRulesErr)
+	}
+
+	blobScanner, blobScannerErr := policy.ParseBlobScanner(config)
+	if blobScannerErr != nil {
+		lg.Error("invalid blob scanner config", "error", blobScannerErr)
+	}
+
+	checks, err := policy.ParseChecks(config)
+	if err != nil {
+		lg.Warn("push checks misconfigured", "error", err)
+	}
+
+	slowPhases, err := parseSlowPhases(os.Getenv(slowPhasesEnv))
+	if err != nil {
+		lg.Warn("ignoring "+slowPhasesEnv, "error", err)
+		slowPhases = defaultSlowPhases
+	}
+
+	var fb *fallback
+	if fallbackEnabled(opts) {
+		fb = newFallback(stdin, stdout)
+		stdin, stdout = fb.input, fb.output
 	}
 
 	rp := &spokesReceivePack{
@@ -100,22 +388,115 @@ func Exec(ctx context.Context, stdin io.Reader, stdout io.Writer, stderr io.Writ
 		output:           stdout,
 		err:              stderr,
 		capabilities:     capabilitiesLine,
+		receiveOptions:   receiveOptions,
 		repoPath:         repoPath,
 		config:           config,
 		objectFormat:     objectFormat,
-		statelessRPC:     *statelessRPC,
-		advertiseRefs:    *httpBackendInfoRefs,
+		statelessRPC:     opts.StatelessRPC,
+		advertiseRefs:    opts.AdvertiseRefs,
+		advertisement:    opts.Advertisement,
+		pack:             opts.Pack,
 		quarantineFolder: filepath.Join(repoPath, "objects", quarantineID),
 		governor:         g,
+		sockstat:         vars,
+		log:              lg,
+		audit:            journal,
+		replication:      replication,
+		replicationErr:   replicationErr,
+		policy:           policyClient,
+		pushRules:        pushRules,
+		pushRulesErr:     pushRulesErr,
+		pathRules:        pathRules,
+		pathRulesErr:     pathRulesErr,
+		blobScanner:      blobScanner,
+		blobScannerErr:   blobScannerErr,
+		checks:           checks,
+		refPrefixes:      parseRefPrefixes(vars.GitProtocol),
+		events:           emitter,
+		slowPhases:       slowPhases,
+
+		forEachRefTimeout: stageTimeout(lg, "SPOKES_FOR_EACH_REF_TIMEOUT", vars.ForEachRefTimeout),
+		revListTimeout:    stageTimeout(lg, "SPOKES_REV_LIST_TIMEOUT", vars.RevListTimeout),
+
+		discoveryMemoryLimit: memoryLimit(lg, "SPOKES_DISCOVERY_MEMORY_LIMIT", vars.DiscoveryMemoryLimit),
+		hookMemoryLimit:      memoryLimit(lg, "SPOKES_HOOK_MEMORY_LIMIT", 0),
+
+		connectivityRetry: connectivityRetryPolicy(lg),
+
+		startup: startupTimes{
+			started:    started,
+			admitted:   admitted,
+			configured: configured,
+		},
+		startupBudget: startupBudget(lg),
+
+		childEnv: append(
+			literalHistoryEnvVars(),
+			trace2ParentEnvVars(trace2SessionID(vars.RequestID, started, os.Getpid()))...,
+		),
 	}
 
-	if err := rp.execute(ctx); err != nil {
+	if err := rp.loadHiddenRefs(); err != nil {
 		g.SetError(1, err.Error())
+		return 1, err
+	}
+	if sh != nil {
+		sh.hiddenRefs = rp.gitHiddenRefs()
+	}
+
+	if err := rp.execute(ctx); err != nil {
+		category := categorize(ctx, err)
+		lg.Error("push failed", "category", category.name, "error", err)
+		g.SetError(uint8(category.exitCode), err.Error())
+		g.SetCategory(category.name)
 		rp.RemoveQuarantine()
-		return 1, fmt.Errorf("unexpected error running spokes receive pack: %w", err)
+
+		// Policy rejections and client errors would fail the same way in
+		// git-receive-pack, but our own bugs shouldn't fail the push.
+		if fb != nil && category == categoryInternal {
+			if code, ok, fbErr := rp.fallBack(ctx, fb, err); ok {
+				return code, fbErr
+			}
+		}
+
+		return category.exitCode, fmt.Errorf("unexpected error running spokes receive pack: %w", err)
 	}
 
-	return 0, nil
+	return ExitOK, nil
+}
+
+// advertisedCapabilities returns the capabilities that we advertise for the
+// push described by `opts`.
+func advertisedCapabilities(opts Options, cfg *config.Config, objectFormat objectformat.ObjectFormat, ro receiveOptions, lg *logger.Logger) string {
+	vars := opts.Vars
+	capabilitiesLine := supportedCapabilities(objectFormat, ro) + " agent=" + agent(opts.Version, cfg, vars, lg)
+	if requestID := vars.RequestID; requestID != "" && pktline.IsSafeCapabilityValue(requestID) {
+		capabilitiesLine += " session-id=" + requestID
+	}
+
+	// Announce the `push-options` capability if the config option is set
+	advertisePushOptions := cfg.Get("receive.advertisePushOptions") == "true"
+	if opts.PushOptions != nil {
+		advertisePushOptions = *opts.PushOptions
+	}
+	if advertisePushOptions && ro.enabled("push-options") {
+		capabilitiesLine = capabilitiesLine + " push-options"
+	}
+	return capabilitiesLine
+}
+
+// openLogger opens the log that logger.DestinationEnv says to use, with the
+// fields that identify the push.
+func openLogger(stderr io.Writer, version string, vars sockstat.Vars) (*logger.Logger, io.Closer, error) {
+	lg, logCloser, err := logger.Open(os.Getenv(logger.DestinationEnv), stderr)
+	if err != nil {
+		return nil, nil, err
+	}
+	lg = lg.With("version", version).
+		With("request_id", vars.RequestID).
+		With("repo", vars.RepoName).
+		With("quarantine_id", vars.QuarantineID)
+	return lg, logCloser, nil
 }
 
 // spokesReceivePack is used to model our own impl of the git-receive-pack
@@ -124,13 +505,106 @@ type spokesReceivePack struct {
 	output           io.Writer
 	err              io.Writer
 	capabilities     string
+	receiveOptions   receiveOptions
 	repoPath         string
 	config           *config.Config
 	objectFormat     objectformat.ObjectFormat
 	statelessRPC     bool
 	advertiseRefs    bool
+	advertisement    io.Reader
+	pack             io.Reader
 	quarantineFolder string
 	governor         *governor.Conn
+	sockstat         sockstat.Vars
+	log              *logger.Logger
+	audit            *audit.Journal
+	replication      *audit.Journal
+	replicationErr   error
+	policy           *policy.Client
+	pushRules        []policy.Rule
+	pushRulesErr     error
+	pathRules        policy.PathRules
+	pathRulesErr     error
+	blobScanner      policy.BlobScanner
+	blobScannerErr   error
+	blobScanWarning  string
+	checks           policy.Checks
+	hiddenRefMatcher *hiddenRefMatcher
+	refPrefixes      refPrefixFilter
+	events           *events.Emitter
+	slowPhases       map[string]time.Duration
+
+	// Timeouts for the for-each-ref stages of the reference discovery
+	// and the rev-list stage of the connectivity check, or 0 for none.
+	forEachRefTimeout time.Duration
+	revListTimeout    time.Duration
+
+	// The most memory that the git processes of the reference discovery
+	// may use together, or 0 for no limit.
+	discoveryMemoryLimit uint64
+
+	// The most memory that each of the commands that the repository's
+	// config says to run may use, or 0 for no limit.
+	hookMemoryLimit uint64
+
+	// How to retry the connectivity check when it fails for a reason that
+	// is likely to go away by itself.
+	connectivityRetry pipe.RetryPolicy
+
+	// The metrics of the pipeline stages that have finished, so that we
+	// can tell which of them made a phase slow.
+	stageMetricsMu sync.Mutex
+	stageMetrics   []pipe.StageMetrics
+
+	// When the push got to each point before the ref advertisement, and
+	// how long the client may wait for it before we warn about it.
+	startup       startupTimes
+	startupBudget time.Duration
+
+	// childEnv tells our children which push they belong to, so that
+	// their traces can be put together with ours and the client's, and
+	// that they must read history as it is (see literalHistoryEnvVars).
+	childEnv []pipe.EnvVar
+
+	// Facts about the push, for logging, telemetry, and the push summary.
+	start            time.Time
+	refCount         int
+	packSize         int64
+	objectCount      uint32
+	pushOptionsCount int
+	spoolTime        time.Duration
+}
+
+// fallBack hands the push over to git-receive-pack after spokes-receive-pack
+// failed with `cause`. It returns false if that isn't possible anymore.
+func (r *spokesReceivePack) fallBack(ctx context.Context, fb *fallback, cause error) (int, bool, error) {
+	if !fb.possible() {
+		return 0, false, nil
+	}
+	if len(r.config.GetAll(hideRefsFileKey)) > 0 {
+		// git-receive-pack wouldn't hide the refs that the files do.
+		return 0, false, nil
+	}
+
+	args := []string{"--stateless-rpc"}
+	if r.advertiseRefs {
+		args = append(args, "--advertise-refs")
+	}
+	args = append(args, r.repoPath)
+
+	r.log.Warn("falling back to git-receive-pack", "error", cause)
+	r.governor.SetCategory("fallback")
+	// Let governor know that we're done before git-receive-pack starts.
+	r.governor.Finish(ctx)
+
+	if err := fb.run(ctx, r.err, args, r.sockstat); err != nil {
+		var failErr governor.FailError
+		if errors.As(err, &failErr) {
+			return ExitGovernorError, true, err
+		}
+		return ExitInternalError, true, fmt.Errorf("falling back to git-receive-pack: %w", err)
+	}
+	return ExitOK, true, nil
 }
 
 func (r *spokesReceivePack) RemoveQuarantine() {
@@ -144,18 +618,23 @@ func (r *spokesReceivePack) RemoveQuarantine() {
 // It tries to model the behaviour described in the "Pushing Data To a Server" section of the
 // https://github.com/github/git/blob/github/Documentation/technical/pack-protocol.txt document
 func (r *spokesReceivePack) execute(ctx context.Context) error {
+	r.start = time.Now()
+	if !r.startup.admitted.IsZero() {
+		r.startPhaseAt(phaseStartup, r.startup.admitted)()
+	}
+
 	// Reference discovery phase
 	// We only need to perform the references discovery when we are not using the HTTP protocol or, if we are using it,
 	// we only run the discovery phase when the http-backend-info-refs/advertise-refs option has been set
 	if r.advertiseRefs || !r.statelessRPC {
-		if sockstat.GetBool("spokes_receive_pack_isolated_reference_discovery") {
-			if err := r.performReferenceDiscoveryIsolatedPipes(ctx); err != nil {
-				return err
-			}
-		} else {
-			if err := r.performReferenceDiscovery(ctx); err != nil {
-				return err
-			}
+		endPhase := r.startPhase(phaseReferenceDiscovery)
+		r.startup.discovering = time.Now()
+		r.startup.advertisement = &firstWriteTimer{w: r.output}
+		err := r.advertise(ctx)
+		endPhase()
+		r.reportStartup()
+		if err != nil {
+			return err
 		}
 	}
 
@@ -170,13 +649,30 @@ func (r *spokesReceivePack) execute(ctx context.Context) error {
 	//that it wants to update, it sends a line listing the obj-id currently on
 	//the server, the obj-id the client would like to update it to and the name
 	//of the reference.
-	commands, _, capabilities, err := r.readCommands(ctx)
+	readStart := time.Now()
+	endPhase := r.startPhase(phaseReadCommands)
+	commands, shallow, capabilities, err := r.readCommands(ctx)
+	endPhase()
 	if err != nil {
 		return err
 	}
+	r.refCount = len(commands)
 	if len(commands) == 0 {
+		// The client had nothing to push, or changed its mind. Say so,
+		// so that these don't look like pushes that did nothing.
+		waited := time.Since(readStart)
+		r.governor.SetNoCommands(waited)
+		r.log.Info("no commands", "command_wait_ms", waited.Milliseconds())
 		return nil
 	}
+	defer r.logTelemetry(commands, capabilities)
+
+	cc := clientCapabilities(capabilities)
+	r.governor.UpdateClientCapabilities(cc)
+	if cc.SessionID != "" {
+		r.log = r.log.With("client_session_id", cc.SessionID)
+		r.childEnv = append(r.childEnv, pipe.EnvVar{Key: "GIT_PUSH_SESSION_ID", Value: cc.SessionID})
+	}
 
 	pushOptionsCount := 0
 	if capabilities.IsDefined(pktline.PushOptions) {
@@ -185,6 +681,7 @@ func (r *spokesReceivePack) execute(ctx context.Context) error {
 			return err
 		}
 	}
+	r.pushOptionsCount = pushOptionsCount
 
 	optionsCountLimit, err := r.getPushOptionsCountLimit()
 	if err != nil {
@@ -195,6 +692,7 @@ func (r *spokesReceivePack) execute(ctx context.Context) error {
 		for i := range commands {
 			commands[i].err = "push options count exceeds maximum"
 			commands[i].reportFF = "ng"
+			commands[i].rejection = rejectionLimit
 		}
 	}
 
@@ -206,51 +704,113 @@ func (r *spokesReceivePack) execute(ctx context.Context) error {
 		return err
 	}
 
-	var unpackErr error
-	if unpackErr = r.readPack(ctx, commands, capabilities); unpackErr != nil {
+	// Wait for our turn if the repository only takes so many pushes at
+	// once.
+	endPhase = r.startPhase(phasePushLock)
+	lock, unpackErr := r.acquirePushLock(ctx, capabilities)
+	endPhase()
+	defer lock.release()
+
+	if unpackErr == nil {
+		endPhase = r.startPhase(phaseReadPack)
+		unpackErr = r.readPack(ctx, commands, capabilities)
+		endPhase()
+	}
+	if unpackErr != nil {
+		msg := fmt.Sprintf("error processing packfiles: %s", unpackErr.Error())
+		switch {
+		case isCategory(unpackErr, categoryInterrupted):
+			msg = interruptedMessage
+		case isCategory(unpackErr, categoryLimit):
+			limit, _ := r.getMaxInputSize()
+			msg = r.message(messageMaxSize, "error", unpackErr.Error(), "limit", strconv.Itoa(limit))
+		case isCategory(unpackErr, categoryFsck):
+			msg = r.message(messageFsck, "error", indexPackDetail(unpackErr))
+		case isCategory(unpackErr, categoryCorruptPack):
+			msg = r.message(messageCorruptPack, "error", indexPackDetail(unpackErr))
+		case isCategory(unpackErr, categoryDiskFull):
+			msg = r.message(messageDiskFull)
+		case isCategory(unpackErr, categoryBusy):
+			msg = r.message(messageBusy)
+		}
+		retryable := isRetryable(ctx, unpackErr)
+		rejection := ""
+		if isCategory(unpackErr, categoryLimit) {
+			rejection = rejectionLimit
+		}
 		for i := range commands {
-			commands[i].err = fmt.Sprintf("error processing packfiles: %s", unpackErr.Error())
+			commands[i].err = msg
 			commands[i].reportFF = "ng"
+			commands[i].retryable = retryable
+			commands[i].rejection = rejection
 		}
-	} else {
+	} else if !isTerminated(ctx) {
+		// Checking the push can take a while, during which the client
+		// wouldn't hear from us otherwise.
+		stopKeepalive := func() {}
+		if useSideBand(capabilities) {
+			stopKeepalive = startKeepalive(r.output, r.keepaliveInterval())
+		}
+
 		// We have successfully processed the pack-files, let's check their connectivity
-		err := r.performCheckConnectivity(ctx, commands)
+		endPhase := r.startPhase(phaseConnectivity)
+		shallowFile, removeShallowFile := r.writeShallowFile(r.knownShallowCommits(ctx, shallow))
+		r.checkConnectivity(ctx, commands, shallowFile)
+		removeShallowFile()
+		r.checkBlobSizes(ctx, commands)
+		endPhase()
 
-		// Let's check two different things for every single command:
-		// * If we found a general check-connectivity error, let's check every individual command
-		// * If no individual error has been found and the reportStatusFF settings is true, let's see if the reference update could be a fast-forward
-		for i := range commands {
-			c := &commands[i]
-			if c.err != "" {
-				continue
-			}
-			var singleObjectErr error
-			c.reportFF = "ok"
-			if err != nil && !c.isDelete() {
-				singleObjectErr = r.performCheckConnectivityOnObject(ctx, c.newOID)
-				if singleObjectErr != nil {
-					c.err = "missing necessary objects"
-					c.reportFF = "ng"
-				}
-			}
+		endPhase = r.startPhase(phasePolicy)
+		r.checkPolicy(ctx, commands)
+		endPhase()
+		r.governor.SetForcedUpdates(countForced(commands))
 
-			if singleObjectErr == nil && c.isUpdate() && r.isReportStatusFFConfigEnabled() {
-				// check if a fast-forward could be performed
-				if r.isFastForward(c, ctx) {
-					c.reportFF = "ff"
-				} else {
-					c.reportFF = "nf"
-				}
-			}
+		stopKeepalive()
+	}
+
+	// If we've been asked to stop, whatever was running has been
+	// interrupted, so tell the client that none of its updates made it
+	// rather than leaving it with a broken pipe.
+	terminated := isTerminated(ctx)
+	if terminated {
+		markTerminated(commands)
+	}
+
+	if unpackErr == nil && !terminated {
+		r.verifyQuarantine(commands)
+		r.syncQuarantine(commands)
+		r.recordForReplication(commands)
+	}
+
+	r.recordDecisions(commands)
+
+	if r.statelessRPC {
+		// The pack might not have been read, or only in part.
+		n, err := drainInput(r.input, maxDrainInput, maxDrainTimeout)
+		if err != nil {
+			r.log.Warn("draining input", "error", err, "drained", n)
+		} else if n > 0 {
+			r.log.Info("drained input", "drained", n)
 		}
 	}
 
 	if capabilities.IsDefined(pktline.ReportStatusV2) || capabilities.IsDefined(pktline.ReportStatus) {
-		if err := r.report(ctx, unpackErr == nil, commands, capabilities); err != nil {
+		endPhase := r.startPhase(phaseReport)
+		err := r.report(ctx, unpackErr == nil && !terminated, commands, capabilities)
+		endPhase()
+		if err != nil {
 			return err
 		}
 	}
 
+	if terminated {
+		return context.Cause(ctx)
+	}
+
+	if unpackErr == nil {
+		r.emitAcceptedPush(ctx, commands)
+	}
+
 	failpoint.Inject("unpack-error", func(val failpoint.Value) {
 		if val.(bool) {
 			failpoint.Return(errors.New("error performing the unpack process"))
@@ -264,11 +824,489 @@ func (r *spokesReceivePack) execute(ctx context.Context) error {
 	return nil
 }
 
-func supportedCapabilities(of objectformat.ObjectFormat) string {
-	return fmt.Sprintf(
-		"report-status report-status-v2 delete-refs side-band-64k ofs-delta atomic object-format=%s quiet",
-		of,
-	)
+// stageTimeout returns the pipeline stage timeout in the environment
+// variable `name`, or 0 if it isn't set or is invalid. A positive
+// `override`, from a sockstat var, takes precedence, so that the timeout
+// can be set per request.
+func stageTimeout(lg *logger.Logger, name string, override time.Duration) time.Duration {
+	if override > 0 {
+		return override
+	}
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		lg.Warn("ignoring "+name, "error", err)
+		return 0
+	}
+	return d
+}
+
+// memoryLimit returns the memory limit, in bytes, in the environment
+// variable `name`, which may use git's "k", "m", and "g" suffixes, or 0 if
+// it isn't set or is invalid. A positive `override`, from a sockstat var,
+// takes precedence, like for stageTimeout.
+func memoryLimit(lg *logger.Logger, name string, override int64) uint64 {
+	if override > 0 {
+		return uint64(override)
+	}
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	n, err := config.ParseSigned(v)
+	if err != nil || n < 0 {
+		lg.Warn("ignoring "+name, "value", v, "error", err)
+		return 0
+	}
+	return uint64(n)
+}
+
+// isTransientGitError matches the errors of git commands that are caused
+// by concurrent repository maintenance, like a repack that removes a
+// packfile or a lock held on packed-refs, and that are worth retrying.
+var isTransientGitError = pipe.StderrContains(
+	".lock': File exists",
+	"cannot lock ref",
+	"packfile cannot be accessed",
+	"unable to open pack",
+)
+
+// connectivityRetryPolicy returns how to retry the connectivity check. The
+// number of attempts can be set in SPOKES_CONNECTIVITY_ATTEMPTS.
+func connectivityRetryPolicy(lg *logger.Logger) pipe.RetryPolicy {
+	attempts := 3
+	if v := os.Getenv("SPOKES_CONNECTIVITY_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			lg.Warn("ignoring SPOKES_CONNECTIVITY_ATTEMPTS", "error", err)
+		} else {
+			attempts = n
+		}
+	}
+
+	return pipe.RetryPolicy{
+		Attempts:   attempts,
+		Backoff:    100 * time.Millisecond,
+		MaxBackoff: time.Second,
+		Transient:  isTransientGitError,
+		OnRetry: func(attempt int, err error) {
+			lg.With("phase", phaseConnectivity).Warn("retrying", "attempt", attempt, "error", err)
+		},
+	}
+}
+
+// discoveryMemoryBudget returns the budget that the git processes of the
+// reference discovery share, or nil if they aren't limited.
+func (r *spokesReceivePack) discoveryMemoryBudget() *pipe.MemoryBudget {
+	if r.discoveryMemoryLimit == 0 {
+		return nil
+	}
+	return pipe.NewMemoryBudget(r.discoveryMemoryLimit, func(e *pipe.Event) {
+		r.log.With("phase", phaseReferenceDiscovery).Warn(e.Msg, "error", e.Err)
+	})
+}
+
+// recordForReplication writes the ref updates in `commands` that were
+// accepted to the replication journal, if there is one. The replication
+// layer relies on the journal, so if they can't be recorded, they are
+// rejected instead.
+func (r *spokesReceivePack) recordForReplication(commands []command) {
+	if r.replication == nil && r.replicationErr == nil {
+		return
+	}
+
+	entry := audit.ReplicationEntry{
+		Time:         time.Now().UTC(),
+		RepoName:     r.sockstat.RepoName,
+		RepoID:       r.sockstat.RepoID,
+		NetworkID:    r.sockstat.NetworkID,
+		QuarantineID: r.sockstat.QuarantineID,
+		RequestID:    r.sockstat.RequestID,
+		UserID:       r.sockstat.UserID,
+	}
+	for _, c := range commands {
+		if c.err == "" {
+			entry.Updates = append(entry.Updates, audit.RefUpdate{Refname: c.refname, OldOID: c.oldOID, NewOID: c.newOID})
+		}
+	}
+	if len(entry.Updates) == 0 {
+		return
+	}
+
+	err := r.replicationErr
+	if err == nil {
+		err = r.replication.WriteReplicationEntry(entry)
+	}
+	if err == nil {
+		return
+	}
+
+	r.log.Error("recording push for replication", "error", err)
+	for i := range commands {
+		c := &commands[i]
+		if c.err == "" {
+			c.err = "failed to record push for replication"
+			c.reportFF = "ng"
+			c.retryable = true
+		}
+	}
+}
+
+// recordDecisions writes what we decided about each of `commands` to the
+// audit journal.
+func (r *spokesReceivePack) recordDecisions(commands []command) {
+	if r.audit == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	records := make([]audit.Record, 0, len(commands))
+	for _, c := range commands {
+		record := audit.Record{
+			Time:      now,
+			RepoName:  r.sockstat.RepoName,
+			Refname:   c.refname,
+			OldOID:    c.oldOID,
+			NewOID:    c.newOID,
+			Decision:  audit.Accepted,
+			UserID:    r.sockstat.UserID,
+			RequestID: r.sockstat.RequestID,
+			Forced:    c.forced,
+		}
+		if c.err != "" {
+			record.Decision = audit.Rejected
+			record.Reason = c.err
+		}
+		records = append(records, record)
+	}
+
+	if err := r.audit.Write(records); err != nil {
+		r.log.Error("recording ref update decisions", "error", err)
+	}
+}
+
+// checkPolicy applies the push rules and path rules from the config, checks
+// for renames of the default branch, and then runs the blob scanner and the
+// check commands and asks the policy service, if there are any, about the
+// commands that haven't been rejected yet. It rejects the ones that any of
+// them denies.
+func (r *spokesReceivePack) checkPolicy(ctx context.Context, commands []command) {
+	r.applyPushRules(ctx, commands)
+	r.applyPathRules(ctx, commands)
+	r.checkDefaultBranchRename(ctx, commands)
+	r.scanBlobs(ctx, commands)
+	r.runChecks(ctx, commands)
+
+	if r.policy == nil {
+		return
+	}
+
+	rejections, warnings, err := r.policy.Check(ctx, r.policyRequest(commands))
+	if err != nil {
+		r.log.With("phase", phasePolicy).Error("policy check failed", "error", err, "rejected", len(rejections) > 0)
+	}
+	reject(commands, rejections)
+	warn(commands, warnings)
+}
+
+// runChecks rejects the commands that the check commands deny.
+func (r *spokesReceivePack) runChecks(ctx context.Context, commands []command) {
+	if len(r.checks.Commands) == 0 {
+		return
+	}
+
+	req := policy.CheckRequest{
+		Request:        r.policyRequest(commands),
+		QuarantinePath: r.quarantineFolder,
+	}
+	env := append(r.quarantineEnvVars(), pipe.EnvVar{Key: "GIT_DIR", Value: r.repoPath})
+	env = append(env, r.connectionEnvVars()...)
+	env = append(env, r.childEnv...)
+	rejections, warnings, err := r.checks.Run(ctx, r.repoPath, req, env, r.hook)
+	if err != nil {
+		r.log.With("phase", phasePolicy).Error("push check failed", "error", err)
+	}
+	reject(commands, rejections)
+	warn(commands, warnings)
+}
+
+// policyRequest describes the commands that haven't been rejected yet.
+func (r *spokesReceivePack) policyRequest(commands []command) policy.Request {
+	req := policy.Request{
+		RepoName:  r.sockstat.RepoName,
+		RepoID:    r.sockstat.RepoID,
+		NetworkID: r.sockstat.NetworkID,
+		UserID:    r.sockstat.UserID,
+		RequestID: r.sockstat.RequestID,
+	}
+	for _, c := range commands {
+		if c.err == "" {
+			req.Commands = append(req.Commands, policy.Command{Refname: c.refname, OldOID: c.oldOID, NewOID: c.newOID})
+		}
+	}
+	return req
+}
+
+// reject rejects the commands that haven't been rejected yet and that
+// `rejections` gives a reason for. The rejections that only happened
+// because the policy couldn't be checked are retryable.
+func reject(commands []command, rejections map[string]string) {
+	for i := range commands {
+		c := &commands[i]
+		if msg, ok := rejections[c.refname]; ok && c.err == "" {
+			c.err = msg
+			c.reportFF = "ng"
+			c.retryable = msg == policy.UnavailableMessage || msg == policy.CheckFailedMessage
+			if !c.retryable {
+				c.rejection = rejectionPolicy
+			}
+		}
+	}
+}
+
+// warn adds the warnings that `warnings` has for the commands that haven't
+// been rejected yet to them.
+func warn(commands []command, warnings map[string][]string) {
+	for i := range commands {
+		c := &commands[i]
+		if msgs, ok := warnings[c.refname]; ok && c.err == "" {
+			c.warnings = append(c.warnings, msgs...)
+		}
+	}
+}
+
+// emitAcceptedPush tells whoever subscribes to push events about the ref
+// updates in `commands` that were accepted, if there are any. Our caller
+// still has to update the refs, so it's up to the subscribers to check that
+// it did.
+func (r *spokesReceivePack) emitAcceptedPush(ctx context.Context, commands []command) {
+	if r.events == nil {
+		return
+	}
+
+	ev := events.AcceptedPush{
+		Event:     events.PushAccepted,
+		Time:      time.Now().UTC(),
+		RepoName:  r.sockstat.RepoName,
+		RepoID:    r.sockstat.RepoID,
+		UserID:    r.sockstat.UserID,
+		RequestID: r.sockstat.RequestID,
+		PackSize:  r.packSize,
+	}
+	for _, c := range commands {
+		if c.err == "" {
+			ev.Refs = append(ev.Refs, events.RefUpdate{Refname: c.refname, OldOID: c.oldOID, NewOID: c.newOID})
+		}
+	}
+	if len(ev.Refs) == 0 {
+		return
+	}
+
+	if err := r.events.Emit(ctx, ev); err != nil {
+		r.log.Warn("emitting push event", "error", err)
+	}
+}
+
+// applyPushRules rejects the commands that the push rules deny. If the
+// rules are invalid, or can't be evaluated for a command, it is rejected
+// too, since it might have been denied.
+func (r *spokesReceivePack) applyPushRules(ctx context.Context, commands []command) {
+	if len(r.pushRules) == 0 && r.pushRulesErr == nil {
+		return
+	}
+
+	for i := range commands {
+		c := &commands[i]
+		if c.err != "" {
+			continue
+		}
+
+		if r.pushRulesErr != nil {
+			c.err = "invalid push rules"
+			c.reportFF = "ng"
+			continue
+		}
+
+		msg, err := policy.Evaluate(r.pushRules, policy.Update{
+			Refname: c.refname,
+			UserID:  r.sockstat.UserID,
+			Create:  c.isCreate(),
+			Delete:  c.isDelete(),
+			Force:   func() bool { return r.isForced(ctx, c) },
+			Commits: func() (int, error) { return r.countNewCommits(ctx, "", []string{c.newOID}) },
+		})
+		if err != nil {
+			r.log.With("phase", phasePolicy).Error("push rules failed", "refname", c.refname, "error", err)
+			msg = "push rules could not be evaluated"
+			c.retryable = true
+		}
+		if msg != "" {
+			c.err = msg
+			c.reportFF = "ng"
+			if !c.retryable {
+				c.rejection = rejectionPolicy
+			}
+		}
+	}
+}
+
+// countNewCommits returns how many commits reachable from `oids` aren't
+// reachable from any ref yet. If `shallowFile` isn't empty, the history
+// stops at the shallow commits in it.
+func (r *spokesReceivePack) countNewCommits(ctx context.Context, shallowFile string, oids []string) (int, error) {
+	args := append(shallowFileArgs(shallowFile), "rev-list", "--count", "--stdin", "--not", "--all", "--alternate-refs")
+	cmd := exec.CommandContext(ctx, "git", args...)
+	r.inRepo(cmd)
+	cmd.Stdin = strings.NewReader(strings.Join(oids, "\n") + "\n")
+
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("counting new commits: %w", err)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+// writeVersion writes the build version, the Go version, and the capabilities
+// that we advertise for each object format to `w`.
+func writeVersion(w io.Writer, version string) error {
+	if version == "" {
+		version = "unknown"
+	}
+	if _, err := fmt.Fprintf(w, "spokes-receive-pack version %s\n", version); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "go version %s\n", runtime.Version()); err != nil {
+		return err
+	}
+	for _, of := range []objectformat.ObjectFormat{"sha1", "sha256"} {
+		if _, err := fmt.Fprintf(w, "capabilities (%s): %s\n", of, supportedCapabilities(of, receiveOptions{})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supportedCapabilities returns the capabilities that we support for
+// repositories in the object format `of`, apart from those that `ro` turns
+// off.
+func supportedCapabilities(of objectformat.ObjectFormat, ro receiveOptions) string {
+	var caps []string
+	for _, name := range []string{"report-status", "report-status-v2", "delete-refs", "side-band-64k", "ofs-delta", "atomic", "object-format", "quiet"} {
+		switch {
+		case name == "object-format":
+			caps = append(caps, "object-format="+string(of))
+		case ro.enabled(name):
+			caps = append(caps, name)
+		}
+	}
+	return strings.Join(caps, " ")
+}
+
+// findForcedUpdates works out which of the updates in `commands` that
+// haven't been rejected are forced. It walks the history of all of them
+// with a single rev-list, from their old and new values down to the
+// parents of the old ones, which is as far as it has to go to find each
+// old value from its new one, unless that old value is also an ancestor
+// of another one. The updates that the walk can't tell about, like those,
+// or all of them if it fails, are left to isForced.
+func (r *spokesReceivePack) findForcedUpdates(ctx context.Context, commands []command, shallowFile string) {
+	var updates []*command
+	for i := range commands {
+		c := &commands[i]
+		if c.err == "" && c.isUpdate() && !c.forcedKnown {
+			updates = append(updates, c)
+		}
+	}
+	if len(updates) == 0 {
+		return
+	}
+
+	parents, err := r.walkUpdates(ctx, updates, shallowFile)
+	if err != nil {
+		r.log.With("phase", phaseConnectivity).Warn("finding forced updates failed", "updates", len(updates), "error", err)
+	}
+	for _, c := range updates {
+		if err == nil {
+			if forced, ok := isForcedIn(parents, c); ok {
+				c.forced = forced
+				c.forcedKnown = true
+				continue
+			}
+		}
+		r.isForced(ctx, c)
+	}
+}
+
+// walkUpdates returns the parents of the commits reachable from the old and
+// new values of `updates`, but not from the parents of the old values. If
+// `shallowFile` isn't empty, the history stops at the shallow commits in
+// it.
+func (r *spokesReceivePack) walkUpdates(ctx context.Context, updates []*command, shallowFile string) (map[string][]string, error) {
+	var input strings.Builder
+	for _, c := range updates {
+		fmt.Fprintf(&input, "%s\n%s\n^%s^@\n", c.newOID, c.oldOID, c.oldOID)
+	}
+
+	args := append(shallowFileArgs(shallowFile), "rev-list", "--parents", "--stdin")
+	cmd := exec.CommandContext(ctx, "git", args...)
+	r.inRepo(cmd)
+	cmd.Stdin = strings.NewReader(input.String())
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("walking the updated history: %w", err)
+	}
+	parents := make(map[string][]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if oids := strings.Fields(line); len(oids) > 0 {
+			parents[oids[0]] = oids[1:]
+		}
+	}
+	return parents, nil
+}
+
+// isForcedIn returns whether `c` is a forced update, going by the history
+// that walkUpdates returned, and whether that history could tell. It can't
+// if either of the values of `c` isn't in it, because it isn't a commit or
+// because it is an ancestor of the old value of another update. Otherwise,
+// every path from the new value to the old one is in the history.
+func isForcedIn(parents map[string][]string, c *command) (bool, bool) {
+	if _, ok := parents[c.oldOID]; !ok {
+		return false, false
+	}
+	if _, ok := parents[c.newOID]; !ok {
+		return false, false
+	}
+
+	seen := map[string]bool{c.newOID: true}
+	queue := []string{c.newOID}
+	for len(queue) > 0 {
+		oid := queue[0]
+		queue = queue[1:]
+		if oid == c.oldOID {
+			return false, true
+		}
+		for _, p := range parents[oid] {
+			if _, ok := parents[p]; ok && !seen[p] {
+				seen[p] = true
+				queue = append(queue, p)
+			}
+		}
+	}
+	return true, true
+}
+
+// isForced returns whether `c` is a forced update, finding it out with a
+// git process of its own if findForcedUpdates didn't.
+func (r *spokesReceivePack) isForced(ctx context.Context, c *command) bool {
+	if !c.forcedKnown {
+		c.forced = !r.isFastForward(c, ctx)
+		c.forcedKnown = true
+	}
+	return c.forced
 }
 
 func (r *spokesReceivePack) isFastForward(c *command, ctx context.Context) bool {
@@ -280,8 +1318,7 @@ func (r *spokesReceivePack) isFastForward(c *command, ctx context.Context) bool
 		c.oldOID,
 		c.newOID,
 	)
-	cmd.Env = append([]string{}, os.Environ()...)
-	cmd.Env = append(cmd.Env, r.getAlternateObjectDirsEnv()...)
+	r.inRepo(cmd)
 
 	if err := cmd.Run(); err != nil {
 		return false
@@ -294,6 +1331,18 @@ const (
 	refAdvertisementFmtArg = "--format=%(objectname) %(refname)"
 )
 
+// advertise writes the ref advertisement, from wherever it comes from.
+func (r *spokesReceivePack) advertise(ctx context.Context) error {
+	switch {
+	case r.advertisement != nil:
+		return r.advertiseSnapshot(ctx)
+	case r.sockstat.IsolatedReferenceDiscovery:
+		return r.performReferenceDiscoveryIsolatedPipes(ctx)
+	default:
+		return r.performReferenceDiscovery(ctx)
+	}
+}
+
 // performReferenceDiscoveryIsolatedPipes performs the reference discovery bits of the protocol
 // It writes back to the client the capability listing and a packet-line for every reference
 // terminated with a flush-pkt.
@@ -306,8 +1355,6 @@ func (r *spokesReceivePack) performReferenceDiscoveryIsolatedPipes(ctx context.C
 		}
 	})
 
-	var hidden, unhidden []string
-
 	// NOTE: this assumes that the list of hidden ref rules is flat, i.e.
 	// that there is at most one level of unhiding taking place. So we will
 	// honor something like:
@@ -322,34 +1369,32 @@ func (r *spokesReceivePack) performReferenceDiscoveryIsolatedPipes(ctx context.C
 	//     hideRefs = refs/heads/
 	//     hideRefs = !refs/heads/unhide
 	//     hideRefs = refs/heads/unhide/rehide
-	for _, rule := range r.getHiddenRefs() {
-		if len(rule) == 0 {
-			continue
-		}
+	hidden, unhidden := r.hiddenRefs().hidden, r.hiddenRefs().unhidden
 
-		if rule[0] == '!' {
-			unhidden = append(unhidden, rule[1:])
-		} else {
-			hidden = append(hidden, rule)
-		}
-	}
+	// Refs are small, and there can be many of them, so they are written
+	// in chunks instead of one by one.
+	out := newCoalescingWriter(r.advertisementOutput(), advertisementBufferSize, advertisementFlushDelay)
+	defer out.Stop()
 
 	var wroteCapabilities bool
 	advertiseRef := func(line []byte) error {
 		if len(line) < 41 {
 			return fmt.Errorf("malformed ref line: %q", string(line))
 		}
+		if !r.refPrefixes.allowsLine(line) {
+			return nil
+		}
 
 		if wroteCapabilities {
 			// NOTE: hidden references have already been removed, so
 			// any reference that gets to this point is safe to
 			// advertise.
-			if err := writePacketf(r.output, "%s\n", line); err != nil {
+			if err := writePacketf(out, "%s\n", line); err != nil {
 				return fmt.Errorf("writing ref advertisement packet: %w", err)
 			}
 		} else {
 			wroteCapabilities = true
-			if err := writePacketf(r.output, "%s\x00%s\n", line, r.capabilities); err != nil {
+			if err := writePacketf(out, "%s\x00%s\n", line, r.capabilities); err != nil {
 				return fmt.Errorf("writing capability packet: %w", err)
 			}
 		}
@@ -357,14 +1402,17 @@ func (r *spokesReceivePack) performReferenceDiscoveryIsolatedPipes(ctx context.C
 		return nil
 	}
 
+	budget := r.discoveryMemoryBudget()
+
 	excludeArgv := []string{"for-each-ref", refAdvertisementFmtArg}
 	for _, ref := range hidden {
 		excludeArgv = append(excludeArgv, fmt.Sprintf("--exclude=%s", ref))
 	}
+	excludeArgv = append(excludeArgv, r.refPrefixes.forEachRefPatterns()...)
 
-	p := pipe.New(pipe.WithDir("."), pipe.WithStdout(r.output))
+	p := r.newPipeline(pipe.WithStdout(r.output))
 	p.Add(
-		pipe.Command("git", excludeArgv...),
+		r.measure(budget.Limit(pipe.WithTimeout(childenv.Scrubbed(pipe.Command("git", excludeArgv...)), r.forEachRefTimeout))),
 		pipe.LinewiseFunction(
 			"collect-references",
 			func(ctx context.Context, _ pipe.Env, line []byte, stdout *bufio.Writer) error {
@@ -378,13 +1426,13 @@ func (r *spokesReceivePack) performReferenceDiscoveryIsolatedPipes(ctx context.C
 	}
 
 	if len(unhidden) > 0 {
-		p = pipe.New(pipe.WithDir("."), pipe.WithStdout(r.output))
+		p = r.newPipeline(pipe.WithStdout(r.output))
 
 		unhiddenArgv := []string{"for-each-ref", refAdvertisementFmtArg}
 		unhiddenArgv = append(unhiddenArgv, unhidden...)
 
 		p.Add(
-			pipe.Command("git", unhiddenArgv...),
+			r.measure(budget.Limit(pipe.WithTimeout(childenv.Scrubbed(pipe.Command("git", unhiddenArgv...)), r.forEachRefTimeout))),
 			pipe.LinewiseFunction(
 				"collect-references",
 				func(ctx context.Context, _ pipe.Env, line []byte, stdout *bufio.Writer) error {
@@ -399,27 +1447,29 @@ func (r *spokesReceivePack) performReferenceDiscoveryIsolatedPipes(ctx context.C
 	}
 
 	// Collect the reference tips present in the parent repo in case this is a fork
-	parentRepoId := sockstat.GetUint32("parent_repo_id")
+	parentRepoId := r.sockstat.ParentRepoID
 	advertiseTags := os.Getenv("GIT_NW_ADVERTISE_TAGS")
 
-	if parentRepoId != 0 {
-		patterns := fmt.Sprintf("refs/remotes/%d/heads", parentRepoId)
+	if parentRepoId != "" {
+		patterns := fmt.Sprintf("refs/remotes/%s/heads", parentRepoId)
 		if advertiseTags != "" {
-			patterns += fmt.Sprintf(" refs/remotes/%d/tags", parentRepoId)
+			patterns += fmt.Sprintf(" refs/remotes/%s/tags", parentRepoId)
 		}
 
 		network, err := r.networkRepoPath()
 		// if the path in the objects/info/alternates is correct
 		if err == nil {
-			p = pipe.New(pipe.WithDir("."), pipe.WithStdout(r.output))
+			p = r.newPipeline(pipe.WithStdout(r.output))
 
 			p.Add(
-				pipe.Command(
-					"git",
-					fmt.Sprintf("--git-dir=%s", network),
-					"for-each-ref",
-					"--format=%(objectname) .have",
-					patterns),
+				r.measure(budget.Limit(pipe.WithTimeout(
+					childenv.Scrubbed(pipe.Command(
+						"git",
+						fmt.Sprintf("--git-dir=%s", network),
+						"for-each-ref",
+						"--format=%(objectname) .have",
+						patterns)),
+					r.forEachRefTimeout))),
 				pipe.LinewiseFunction(
 					"collect-alternates-references",
 					func(ctx context.Context, _ pipe.Env, line []byte, stdout *bufio.Writer) error {
@@ -435,15 +1485,19 @@ func (r *spokesReceivePack) performReferenceDiscoveryIsolatedPipes(ctx context.C
 	}
 
 	if !wroteCapabilities {
-		if err := writePacketf(r.output, "%s capabilities^{}\x00%s", r.objectFormat.NullOID(), r.capabilities); err != nil {
+		if err := writePacketf(out, "%s capabilities^{}\x00%s", r.objectFormat.NullOID(), r.capabilities); err != nil {
 			return fmt.Errorf("writing lonely capability packet: %w", err)
 		}
 	}
 
-	if _, err := fmt.Fprintf(r.output, "0000"); err != nil {
+	if _, err := fmt.Fprintf(out, "0000"); err != nil {
 		return fmt.Errorf("writing flush packet: %w", err)
 	}
 
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("writing ref advertisement: %w", err)
+	}
+
 	return nil
 }
 
@@ -457,8 +1511,6 @@ func (r *spokesReceivePack) performReferenceDiscovery(ctx context.Context) error
 		}
 	})
 
-	var hidden, unhidden []string
-
 	// NOTE: this assumes that the list of hidden ref rules is flat, i.e.
 	// that there is at most one level of unhiding taking place. So we will
 	// honor something like:
@@ -473,34 +1525,32 @@ func (r *spokesReceivePack) performReferenceDiscovery(ctx context.Context) error
 	//     hideRefs = refs/heads/
 	//     hideRefs = !refs/heads/unhide
 	//     hideRefs = refs/heads/unhide/rehide
-	for _, rule := range r.getHiddenRefs() {
-		if len(rule) == 0 {
-			continue
-		}
+	hidden, unhidden := r.hiddenRefs().hidden, r.hiddenRefs().unhidden
 
-		if rule[0] == '!' {
-			unhidden = append(unhidden, rule[1:])
-		} else {
-			hidden = append(hidden, rule)
-		}
-	}
+	// Refs are small, and there can be many of them, so they are written
+	// in chunks instead of one by one.
+	out := newCoalescingWriter(r.advertisementOutput(), advertisementBufferSize, advertisementFlushDelay)
+	defer out.Stop()
 
 	var wroteCapabilities bool
 	advertiseRef := func(line []byte) error {
 		if len(line) < 41 {
 			return fmt.Errorf("malformed ref line: %q", string(line))
 		}
+		if !r.refPrefixes.allowsLine(line) {
+			return nil
+		}
 
 		if wroteCapabilities {
 			// NOTE: hidden references have already been removed, so
 			// any reference that gets to this point is safe to
 			// advertise.
-			if err := writePacketf(r.output, "%s\n", line); err != nil {
+			if err := writePacketf(out, "%s\n", line); err != nil {
 				return fmt.Errorf("writing ref advertisement packet: %w", err)
 			}
 		} else {
 			wroteCapabilities = true
-			if err := writePacketf(r.output, "%s\x00%s\n", line, r.capabilities); err != nil {
+			if err := writePacketf(out, "%s\x00%s\n", line, r.capabilities); err != nil {
 				return fmt.Errorf("writing capability packet: %w", err)
 			}
 		}
@@ -508,14 +1558,17 @@ func (r *spokesReceivePack) performReferenceDiscovery(ctx context.Context) error
 		return nil
 	}
 
+	budget := r.discoveryMemoryBudget()
+
 	excludeArgv := []string{"for-each-ref", refAdvertisementFmtArg}
 	for _, ref := range hidden {
 		excludeArgv = append(excludeArgv, fmt.Sprintf("--exclude=%s", ref))
 	}
+	excludeArgv = append(excludeArgv, r.refPrefixes.forEachRefPatterns()...)
 
-	p := pipe.New(pipe.WithDir("."), pipe.WithStdout(r.output))
+	p := r.newPipeline(pipe.WithStdout(r.output))
 	p.Add(
-		pipe.Command("git", excludeArgv...),
+		r.measure(budget.Limit(pipe.WithTimeout(childenv.Scrubbed(pipe.Command("git", excludeArgv...)), r.forEachRefTimeout))),
 		pipe.LinewiseFunction(
 			"collect-references",
 			func(ctx context.Context, _ pipe.Env, line []byte, stdout *bufio.Writer) error {
@@ -529,7 +1582,7 @@ func (r *spokesReceivePack) performReferenceDiscovery(ctx context.Context) error
 		unhiddenArgv = append(unhiddenArgv, unhidden...)
 
 		p.Add(
-			pipe.Command("git", unhiddenArgv...),
+			r.measure(budget.Limit(pipe.WithTimeout(childenv.Scrubbed(pipe.Command("git", unhiddenArgv...)), r.forEachRefTimeout))),
 			pipe.LinewiseFunction(
 				"collect-references",
 				func(ctx context.Context, _ pipe.Env, line []byte, stdout *bufio.Writer) error {
@@ -540,7 +1593,7 @@ func (r *spokesReceivePack) performReferenceDiscovery(ctx context.Context) error
 	}
 
 	// Collect the reference tips present in the parent repo in case this is a fork
-	parentRepoId := os.Getenv("GIT_SOCKSTAT_VAR_parent_repo_id")
+	parentRepoId := r.sockstat.ParentRepoID
 	advertiseTags := os.Getenv("GIT_NW_ADVERTISE_TAGS")
 
 	if parentRepoId != "" {
@@ -553,12 +1606,14 @@ func (r *spokesReceivePack) performReferenceDiscovery(ctx context.Context) error
 		// if the path in the objects/info/alternates is correct
 		if err == nil {
 			p.Add(
-				pipe.Command(
-					"git",
-					fmt.Sprintf("--git-dir=%s", network),
-					"for-each-ref",
-					"--format=%(objectname) .have",
-					patterns),
+				r.measure(budget.Limit(pipe.WithTimeout(
+					childenv.Scrubbed(pipe.Command(
+						"git",
+						fmt.Sprintf("--git-dir=%s", network),
+						"for-each-ref",
+						"--format=%(objectname) .have",
+						patterns)),
+					r.forEachRefTimeout))),
 				pipe.LinewiseFunction(
 					"collect-alternates-references",
 					func(ctx context.Context, _ pipe.Env, line []byte, stdout *bufio.Writer) error {
@@ -574,23 +1629,37 @@ func (r *spokesReceivePack) performReferenceDiscovery(ctx context.Context) error
 	}
 
 	if !wroteCapabilities {
-		if err := writePacketf(r.output, "%s capabilities^{}\x00%s", r.objectFormat.NullOID(), r.capabilities); err != nil {
+		if err := writePacketf(out, "%s capabilities^{}\x00%s", r.objectFormat.NullOID(), r.capabilities); err != nil {
 			return fmt.Errorf("writing lonely capability packet: %w", err)
 		}
 	}
 
-	if _, err := fmt.Fprintf(r.output, "0000"); err != nil {
+	if _, err := fmt.Fprintf(out, "0000"); err != nil {
 		return fmt.Errorf("writing flush packet: %w", err)
 	}
 
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("writing ref advertisement: %w", err)
+	}
+
 	return nil
 }
 
-func (r *spokesReceivePack) getHiddenRefs() []string {
+func (r *spokesReceivePack) getHiddenRefs() ([]string, error) {
 	var hiddenRefs []string
+	for _, path := range r.config.GetAll(hideRefsFileKey) {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(r.repoPath, path)
+		}
+		rules, err := readHideRefsFile(path)
+		if err != nil {
+			return nil, err
+		}
+		hiddenRefs = append(hiddenRefs, rules...)
+	}
 	hiddenRefs = append(hiddenRefs, r.config.GetAll("receive.hiderefs")...)
 	hiddenRefs = append(hiddenRefs, r.config.GetAll("transfer.hiderefs")...)
-	return hiddenRefs
+	return hiddenRefs, nil
 }
 
 func (r *spokesReceivePack) networkRepoPath() (string, error) {
@@ -624,26 +1693,6 @@ func (r *spokesReceivePack) networkRepoPath() (string, error) {
 	return filepath.Dir(alternates), nil
 }
 
-// isHiddenRef determines if the line passed as the first argument belongs to the list of
-// potential references that we don't want to advertise
-// This method assumes the config entries passed as a second argument are the ones in the `receive.hiderefs` section
-func isHiddenRef(ref string, hiddenRefs []string) bool {
-	isHidden := false
-	for _, hr := range hiddenRefs {
-		neg, strippedRef := isNegativeRef(hr)
-
-		if strings.HasPrefix(ref, strippedRef) {
-			if neg {
-				isHidden = false
-			} else {
-				isHidden = true
-			}
-
-		}
-	}
-	return isHidden
-}
-
 func isNegativeRef(ref string) (bool, string) {
 	if strings.HasPrefix(ref, "!") {
 		return true, ref[1:]
@@ -688,6 +1737,119 @@ type command struct {
 	newOID   string
 	err      string
 	reportFF string
+
+	// retryable is set if the command was rejected for a reason that
+	// might go away if the push is tried again.
+	retryable bool
+
+	// forced is set if the command updates a ref to a commit that isn't
+	// a descendant of its old value. It is known, and forcedKnown set,
+	// for the updates whose objects passed the connectivity check.
+	forced      bool
+	forcedKnown bool
+
+	// rejection is the kind of the command's rejection, if it is one of
+	// the kinds that are counted separately.
+	rejection string
+
+	// warnings are what the policy service and the check commands had
+	// to say about the command, if they allowed it.
+	warnings []string
+}
+
+// The kinds of rejection that are counted separately in the telemetry and
+// governor's finish message, so that a push whose commands were rejected
+// doesn't only look like one that succeeded.
+const (
+	// rejectionHiddenRef is for updates of hidden refs.
+	rejectionHiddenRef = "hidden-ref"
+
+	// rejectionLimit is for pushes over one of the limits.
+	rejectionLimit = "limit"
+
+	// rejectionPolicy is for updates that a policy doesn't allow, like
+	// the push rules, permissions, checks, and scans.
+	rejectionPolicy = "policy"
+)
+
+// interruptedMessage is the reason given for rejecting the commands of a
+// push whose pack didn't arrive in full.
+const interruptedMessage = "pack upload interrupted; please retry"
+
+// retryableHint is appended to the reasons for rejections that are
+// retryable, so that whatever is pushing can tell them apart from the
+// ones that will keep happening.
+const retryableHint = " (retryable)"
+
+// retryableNote is sent to the client on the sideband if any of its ref
+// updates were rejected for reasons that are retryable.
+const retryableNote = "note: some ref updates failed for reasons that may be temporary; retrying the push may succeed\n"
+
+// checkCommitCount rejects the commands that haven't been rejected yet if
+// the push adds more than receive.maxCommitCount commits, `newCommits`. If
+// the commits couldn't be counted, `countErr` says why, and they are
+// rejected as retryable, since they might have been over the limit.
+func (r *spokesReceivePack) checkCommitCount(commands []command, newCommits int, countErr error) {
+	msg := ""
+	retryable := false
+	limit, err := r.getMaxCommitCount()
+	switch {
+	case err != nil:
+		r.log.Error("invalid receive.maxCommitCount", "error", err)
+		msg = "invalid receive.maxCommitCount"
+	case limit > 0 && countErr != nil:
+		r.log.Error("counting new commits", "error", countErr)
+		msg = "new commits could not be counted"
+		retryable = true
+	case limit > 0 && newCommits > limit:
+		msg = r.message(messageCommitLimit,
+			"count", strconv.Itoa(newCommits),
+			"limit", strconv.Itoa(limit),
+		)
+	default:
+		return
+	}
+
+	for i := range commands {
+		c := &commands[i]
+		if c.err == "" {
+			c.err = msg
+			c.reportFF = "ng"
+			c.retryable = retryable
+			if limit > 0 && !retryable {
+				c.rejection = rejectionLimit
+			}
+		}
+	}
+}
+
+// countRemainingCommits counts the new commits of the `commands` that
+// haven't been rejected, for when the batched connectivity check couldn't.
+// It only does so if receive.maxCommitCount is set, since nothing else
+// needs the count.
+func (r *spokesReceivePack) countRemainingCommits(ctx context.Context, commands []command, shallowFile string) (int, error) {
+	if limit, err := r.getMaxCommitCount(); err != nil || limit <= 0 {
+		return 0, nil
+	}
+	var oids []string
+	for _, c := range commandsForConnectivityCheck(commands) {
+		oids = append(oids, c.newOID)
+	}
+	if len(oids) == 0 {
+		return 0, nil
+	}
+	return r.countNewCommits(ctx, shallowFile, oids)
+}
+
+// countForced returns how many of `commands` are forced updates.
+func countForced(commands []command) int {
+	n := 0
+	for _, c := range commands {
+		if c.forced {
+			n++
+		}
+	}
+	return n
 }
 
 func (c *command) isUpdate() bool {
@@ -698,7 +1860,23 @@ func (c *command) isDelete() bool {
 	return c.newOID == nullSHA1OID || c.newOID == nullSHA256OID
 }
 
-var validReferenceName = regexp.MustCompile(`^([0-9a-f]{40,64}) ([0-9a-f]{40,64}) (.+)`)
+func (c *command) isCreate() bool {
+	return c.oldOID == nullSHA1OID || c.oldOID == nullSHA256OID
+}
+
+// parseCommand parses a ref update command line, "<old-oid> <new-oid>
+// <refname>", whose object IDs must be of the object format `of`. Only the
+// first line may carry capabilities after a NUL, and pktline.Read has
+// already split them off, so a NUL left in the refname is bogus.
+func parseCommand(of objectformat.ObjectFormat, line string) (command, bool) {
+	oldOID, rest, _ := strings.Cut(line, " ")
+	newOID, refname, _ := strings.Cut(rest, " ")
+	refname, _, _ = strings.Cut(refname, "\n")
+	if !of.IsValidOID(oldOID) || !of.IsValidOID(newOID) || refname == "" || strings.IndexByte(refname, 0) >= 0 {
+		return command{}, false
+	}
+	return command{oldOID: oldOID, newOID: newOID, refname: refname}, true
+}
 
 // readCommands reads the set of ref update commands sent by the client side.
 func (r *spokesReceivePack) readCommands(_ context.Context) ([]command, []string, pktline.Capabilities, error) {
@@ -711,57 +1889,87 @@ func (r *spokesReceivePack) readCommands(_ context.Context) ([]command, []string
 	var commands []command
 	var shallowInfo []string
 
-	first := true
 	pl := pktline.New()
 	var capabilities pktline.Capabilities
+	sawCapabilities := false
+
+	hiddenRefs := r.hiddenRefs()
+	refPermissions := newRefPermissions(r.sockstat)
 
-	hiddenRefs := r.getHiddenRefs()
+	shallowCountLimit, err := r.getShallowCountLimit()
+	if err != nil {
+		return nil, nil, capabilities, err
+	}
 
 	for {
 		err := pl.Read(r.input)
 		if err != nil {
-			return nil, nil, pktline.Capabilities{}, fmt.Errorf("reading commands: %w", err)
+			return nil, nil, pktline.Capabilities{}, withCategory(categoryProtocol, fmt.Errorf("reading commands: %w", err))
 		}
 
 		if pl.IsFlush() {
 			break
 		}
 
+		// The capabilities come after a NUL on the first command, but
+		// clients of shallow repositories send shallow lines before the
+		// commands, so take them from whichever line carries them first.
+		// pl.Read only splits them off once; a NUL on any later line is
+		// left in the payload and makes it bogus.
+		if !sawCapabilities && pl.CapabilitiesPayload != nil {
+			capabilities, err = pl.Capabilities()
+			if err != nil {
+				return nil, nil, capabilities, withCategory(categoryProtocol, fmt.Errorf("processing capabilities: %w", err))
+			}
+			if err := r.checkClientCapabilities(capabilities); err != nil {
+				return nil, nil, capabilities, withCategory(categoryProtocol, err)
+			}
+			sawCapabilities = true
+		}
+
 		// Parse the shallow "commands" the client could have sent
 		payload := string(pl.Payload)
 		if strings.HasPrefix(payload, "shallow") {
-			payloadParts := strings.Split(payload, " ")
-			if len(payloadParts) != 2 {
-				return nil, nil, pktline.Capabilities{}, fmt.Errorf("wrong shallow structure: %s", payload)
+			oid, ok := strings.CutPrefix(strings.TrimSuffix(payload, "\n"), "shallow ")
+			if !ok || !r.objectFormat.IsValidOID(oid) {
+				return nil, nil, pktline.Capabilities{}, withCategory(categoryProtocol, fmt.Errorf("wrong shallow structure: %s", payload))
 			}
-			shallowInfo = append(shallowInfo, payloadParts[1])
-			continue
-		}
-
-		if first {
-			capabilities, err = pl.Capabilities()
-			if err != nil {
-				return nil, nil, capabilities, fmt.Errorf("processing capabilities: %w", err)
+			if shallowCountLimit > 0 && len(shallowInfo) >= shallowCountLimit {
+				return nil, nil, pktline.Capabilities{}, withCategory(categoryLimit, fmt.Errorf("too many shallow lines (limit is %d)", shallowCountLimit))
 			}
-			first = false
+			shallowInfo = append(shallowInfo, oid)
+			continue
 		}
 
-		if m := validReferenceName.FindStringSubmatch(payload); m != nil {
-			c := command{
-				oldOID:  m[1],
-				newOID:  m[2],
-				refname: m[3],
-			}
-			if isHiddenRef(c.refname, hiddenRefs) {
+		if c, ok := parseCommand(r.objectFormat, payload); ok {
+			if msg := refnameError(c.refname, c.isDelete()); msg != "" {
+				c.reportFF = "ng"
+				c.err = msg
+			} else if !refPermissions.allows(c.refname) {
 				c.reportFF = "ng"
-				c.err = "deny updating a hidden ref"
+				c.err = r.message(messageRefDenied, "refname", c.refname)
+				c.rejection = rejectionPolicy
+				r.log.Info("ref update denied by push permissions", "refname", c.refname)
+			} else if hiddenRefs.isHidden(c.refname) {
+				c.reportFF = "ng"
+				c.err = r.hiddenRefMessage(c.refname)
+				c.rejection = rejectionHiddenRef
+			} else if !r.refPrefixes.allows(c.refname) {
+				// The client didn't see the ref's current value.
+				c.reportFF = "ng"
+				c.err = "ref is outside of the requested ref prefixes"
+			} else if c.isDelete() && !r.receiveOptions.enabled("delete-refs") {
+				// A client that noticed that we didn't advertise
+				// delete-refs wouldn't have sent this.
+				c.reportFF = "ng"
+				c.err = "deleting refs is disabled"
 			}
 
 			commands = append(commands, c)
 			continue
 		}
 
-		return nil, nil, capabilities, fmt.Errorf("bogus command: %s", pl.Payload)
+		return nil, nil, capabilities, withCategory(categoryProtocol, fmt.Errorf("bogus command: %s", pl.Payload))
 	}
 
 	updateCommandLimit, err := r.getRefUpdateCommandLimit()
@@ -770,20 +1978,60 @@ func (r *spokesReceivePack) readCommands(_ context.Context) ([]command, []string
 	}
 
 	if (updateCommandLimit > 0) && len(commands) > updateCommandLimit {
-		return nil, nil, capabilities, fmt.Errorf("maximum ref updates exceeded: %d commands sent but max allowed is %d", len(commands), updateCommandLimit)
+		return nil, nil, capabilities, withCategory(categoryLimit, errors.New(r.message(messageRefLimit,
+			"count", strconv.Itoa(len(commands)),
+			"limit", strconv.Itoa(updateCommandLimit),
+		)))
 	}
 
 	return commands, shallowInfo, capabilities, nil
 }
 
+// checkClientCapabilities returns an error if the client asked for any
+// capability that we didn't advertise in `r.capabilities`, like
+// push-options when receive.advertisePushOptions is off.
+func (r *spokesReceivePack) checkClientCapabilities(caps pktline.Capabilities) error {
+	advertised, err := pktline.ParseCapabilities([]byte(r.capabilities))
+	if err != nil {
+		return fmt.Errorf("parsing advertised capabilities: %w", err)
+	}
+	for _, name := range caps.Names() {
+		if !advertised.IsDefined(name) {
+			return fmt.Errorf("client requested capability %q, which was not advertised", name)
+		}
+	}
+	return nil
+}
+
+// dumpPushOptions reads the push options, which we don't use, and returns
+// how many there were. An option longer than receive.pushOptionSizeLimit,
+// or options adding up to more than receive.pushOptionsTotalSizeLimit,
+// fail the push as soon as they are seen, instead of after all of them
+// have been read.
 func (r *spokesReceivePack) dumpPushOptions(ctx context.Context) (int, error) {
+	sizeLimit, err := r.getPushOptionSizeLimit()
+	if err != nil {
+		return 0, err
+	}
+	totalLimit, err := r.getPushOptionsTotalSizeLimit()
+	if err != nil {
+		return 0, err
+	}
+	if sizeLimit <= 0 {
+		sizeLimit = pktline.MaxPayload + 1
+	}
+
 	pl := pktline.New()
 
 	optionsCount := 0
+	total := 0
 	for {
-		err := pl.Read(r.input)
+		err := pl.ReadMax(r.input, sizeLimit)
+		if errors.Is(err, pktline.ErrTooLong) {
+			return optionsCount, withCategory(categoryLimit, fmt.Errorf("push option too long: %w", err))
+		}
 		if err != nil {
-			return optionsCount, fmt.Errorf("error reading push-options: %w", err)
+			return optionsCount, withCategory(categoryProtocol, fmt.Errorf("error reading push-options: %w", err))
 		}
 
 		if pl.IsFlush() {
@@ -791,12 +2039,17 @@ func (r *spokesReceivePack) dumpPushOptions(ctx context.Context) (int, error) {
 		}
 
 		optionsCount += 1
+		total += len(pl.Payload)
+		if totalLimit > 0 && total > totalLimit {
+			return optionsCount, withCategory(categoryLimit,
+				fmt.Errorf("push options exceed the limit of %d bytes in total", totalLimit))
+		}
 	}
 
 	return optionsCount, nil
 }
 
-// readPack reads a packfile from `r.input` (if one is needed) and pipes it into `git index-pack`.
+// readPack reads a packfile from `r.packInput()` (if one is needed) and pipes it into `git index-pack`.
 // Report errors to the error sideband in `w`.
 func (r *spokesReceivePack) readPack(ctx context.Context, commands []command, capabilities pktline.Capabilities) error {
 	// We only get a pack if there are non-deletes.
@@ -825,14 +2078,14 @@ func (r *spokesReceivePack) readPack(ctx context.Context, commands []command, ca
 
 	if r.isFsckConfigEnabled() {
 		prefix := r.config.GetPrefix("receive.fsck.")
-		if len(prefix) > 0 || allowBadDate() {
+		if len(prefix) > 0 || r.allowBadDate() {
 			var result string
 			for key, values := range prefix {
 				for _, value := range values {
 					result += key + "=" + value + ","
 				}
 			}
-			if allowBadDate() {
+			if r.allowBadDate() {
 				result += "baddate=warn,"
 			}
 			result = strings.TrimSuffix(result, ",")
@@ -852,6 +2105,10 @@ func (r *spokesReceivePack) readPack(ctx context.Context, commands []command, ca
 		args = append(args, fmt.Sprintf("--max-input-size=%d", maxSize))
 	}
 
+	if err := r.checkFreeSpace(maxSize); err != nil {
+		return err
+	}
+
 	warnObjectSize, err := r.getWarnObjectSize()
 	if err != nil {
 		return err
@@ -861,18 +2118,29 @@ func (r *spokesReceivePack) readPack(ctx context.Context, commands []command, ca
 		args = append(args, fmt.Sprintf("--warn-object-size=%d", warnObjectSize))
 	}
 
+	packInput := r.packInput()
+	if r.shouldSpoolPack() {
+		f, err := r.spoolPack(packInput, maxSize)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		packInput = f
+	}
+
 	// Index-pack will read directly from our input!
 	cmd := exec.CommandContext(
 		ctx,
 		"git",
 		args...,
 	)
+	pipe.TerminateGracefully(cmd)
 
-	cmd.Env = append([]string{}, os.Environ()...)
-	cmd.Env = append(cmd.Env, r.getAlternateObjectDirsEnv()...)
+	r.inRepo(cmd)
 
-	// index-pack will read the rest of spokes-receive-pack's stdin.
-	cmd.Stdin = r.input
+	// index-pack will read the rest of spokes-receive-pack's stdin, unless
+	// the pack was handed to us separately, or we spooled it first.
+	cmd.Stdin = packInput
 
 	// Forward stderr to `w`.
 	// Depending on the sideband capability we would need to do it in a sideband
@@ -894,41 +2162,55 @@ func (r *spokesReceivePack) readPack(ctx context.Context, commands []command, ca
 		indexPackOut <- out
 	}(stdout, indexPackOut)
 
+	// Keep the end of index-pack's stderr around so that we can tell why
+	// it failed.
+	stderrTail := &tailBuffer{max: 4096}
+	stderr = readCloser{io.TeeReader(stderr, stderrTail), stderr}
+
 	eg, err := startSidebandMultiplexer(stderr, r.output, capabilities)
 	if err != nil {
 		// Sideband has been requested, but we haven't been able to deal with it
 		return err
 	}
+	if eg == nil {
+		// Without a sideband, there's nowhere to send stderr, but we
+		// still want to see it.
+		eg = &errgroup.Group{}
+		eg.Go(func() error {
+			_, err := io.Copy(io.Discard, stderr)
+			return err
+		})
+	}
 
 	if err = cmd.Start(); err != nil {
-		if eg != nil {
-			_ = eg.Wait()
-		}
+		_ = eg.Wait()
 		return fmt.Errorf("starting 'index-pack': %w", err)
 	}
 
-	if eg != nil {
-		_ = eg.Wait()
-	}
+	_ = eg.Wait()
 
 	if waitErr := cmd.Wait(); waitErr != nil {
-		return waitErr
+		return classifyIndexPackError(waitErr, stderrTail.String())
 	}
 
 	select {
 	case out, ok := <-indexPackOut:
 		if ok && (bytes.HasPrefix(out, []byte("pack\t")) || bytes.HasPrefix(out, []byte("keep\t"))) {
 			packID := string(bytes.TrimSpace(out[5:]))
-			if isHex(packID) {
+			if r.objectFormat.IsValidOID(packID) {
 				packPath := filepath.Join(r.quarantineFolder, "pack", "pack-"+packID+".pack")
 				if info, err := os.Stat(packPath); err == nil {
 					r.governor.SetReceivePackSize(info.Size())
+					r.packSize = info.Size()
+				}
+				if n, err := packObjectCount(packPath); err == nil {
+					r.objectCount = n
 				}
 			}
 		}
 	case <-time.After(time.Second):
 		// For some reason, index-pack's output isn't available. Just move on...
-		log.Print("index-pack output was too slow")
+		r.log.With("phase", "read-pack").Warn("index-pack output was too slow")
 	}
 
 	failpoint.Inject("slow-down-read-pack", func() {})
@@ -959,7 +2241,7 @@ func (r *spokesReceivePack) getMaxInputSize() (int, error) {
 	// stat is set only.
 	// We keep using the `is_import` here for backward compatibility only,
 	// which should be removed on a subsequent PR.
-	if isImporting() || skipPushLimit() {
+	if r.sockstat.IsImporting || r.sockstat.ImportSkipPushLimit {
 		return 80 * 1024 * 1024 * 1024, nil /* 80 GB */
 	}
 
@@ -991,6 +2273,34 @@ func (r *spokesReceivePack) getRefUpdateCommandLimit() (int, error) {
 	return 0, nil
 }
 
+// defaultShallowCountLimit is the most shallow lines that a client may send
+// unless receive.shallowCountLimit says otherwise.
+const defaultShallowCountLimit = 10000
+
+// getShallowCountLimit returns the most shallow lines that a client may
+// send, or 0 if there is no limit.
+func (r *spokesReceivePack) getShallowCountLimit() (int, error) {
+	limit := r.config.Get("receive.shallowcountlimit")
+
+	if limit != "" {
+		return config.ParseSigned(limit)
+	}
+
+	return defaultShallowCountLimit, nil
+}
+
+// getMaxCommitCount returns the most commits that a push may add, or 0 if
+// there is no limit.
+func (r *spokesReceivePack) getMaxCommitCount() (int, error) {
+	limit := r.config.Get("receive.maxcommitcount")
+
+	if limit != "" {
+		return config.ParseSigned(limit)
+	}
+
+	return 0, nil
+}
+
 func (r *spokesReceivePack) getPushOptionsCountLimit() (int, error) {
 	limit := r.config.Get("receive.pushoptionscountlimit")
 
@@ -1001,6 +2311,41 @@ func (r *spokesReceivePack) getPushOptionsCountLimit() (int, error) {
 	return 0, nil
 }
 
+// defaultPushOptionsTotalSizeLimit is the most bytes that all of a push's
+// options may add up to unless receive.pushOptionsTotalSizeLimit says
+// otherwise.
+const defaultPushOptionsTotalSizeLimit = 1 << 20
+
+// getPushOptionSizeLimit returns the most bytes that one push option may
+// have, or 0 if only the pkt-line length limits it.
+func (r *spokesReceivePack) getPushOptionSizeLimit() (int, error) {
+	limit := r.config.Get("receive.pushoptionsizelimit")
+
+	if limit != "" {
+		return config.ParseSigned(limit)
+	}
+
+	return 0, nil
+}
+
+// getPushOptionsTotalSizeLimit returns the most bytes that all of a push's
+// options may add up to, or 0 if there is no limit.
+func (r *spokesReceivePack) getPushOptionsTotalSizeLimit() (int, error) {
+	limit := r.config.Get("receive.pushoptionstotalsizelimit")
+
+	if limit != "" {
+		return config.ParseSigned(limit)
+	}
+
+	return defaultPushOptionsTotalSizeLimit, nil
+}
+
+// readCloser combines a Reader with the Closer of the stream it reads from.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
 // startSidebandMultiplexer checks if a sideband capability has been required and, in that case, starts multiplexing the
 // stderr of the command `cmd` into the indicated `output`
 func startSidebandMultiplexer(stderr io.ReadCloser, output io.Writer, capabilities pktline.Capabilities) (*errgroup.Group, error) {
@@ -1010,27 +2355,31 @@ func startSidebandMultiplexer(stderr io.ReadCloser, output io.Writer, capabiliti
 	}
 
 	var eg errgroup.Group
+	sideband := newProgressLimiter(newSidebandWriter(output, capabilities), progressInterval)
 
 	eg.Go(
 		func() error {
 			defer func() {
 				_ = stderr.Close()
 			}()
+			// Read no more than fits in a packet, into the same
+			// buffer every time.
+			buf := make([]byte, sideBandMaxData(capabilities))
 			for {
-				bufferSize := sideBandBufSize(capabilities)
-				buf := make([]byte, bufferSize)
-
-				n, err := stderr.Read(buf[:])
+				n, err := stderr.Read(buf)
 				if n != 0 {
-					if err := writePacketf(output, "\x02%s", buf[:n]); err != nil {
-						return fmt.Errorf("writing to error sideband: %w", err)
+					if _, err := sideband.Write(buf[:n]); err != nil {
+						return err
 					}
 				}
 				if err != nil {
-					if err == io.EOF {
-						return nil
+					// Whatever progress is held back goes out now,
+					// before anything else is written.
+					flushErr := sideband.Flush()
+					if err != io.EOF {
+						return fmt.Errorf("reading 'index-pack' stderr: %w", err)
 					}
-					return fmt.Errorf("reading 'index-pack' stderr: %w", err)
+					return flushErr
 				}
 			}
 		},
@@ -1039,13 +2388,138 @@ func startSidebandMultiplexer(stderr io.ReadCloser, output io.Writer, capabiliti
 	return &eg, nil
 }
 
+// sidebandWriter sends what is written to it to the client on the
+// progress/error sideband, so that it can be used as the stderr of a
+// command, e.g. with pipe.WithStderr, or on another sideband.
+type sidebandWriter struct {
+	output io.Writer
+	band   byte
+
+	// packet is where each packet is put together before it is
+	// written. Its capacity is the size of the largest packet.
+	packet []byte
+}
+
+func newSidebandWriter(output io.Writer, capabilities pktline.Capabilities) *sidebandWriter {
+	return newBandWriter(output, 2, capabilities)
+}
+
+func newBandWriter(output io.Writer, band byte, capabilities pktline.Capabilities) *sidebandWriter {
+	return &sidebandWriter{output: output, band: band, packet: make([]byte, 0, sideBandPacketSize(capabilities))}
+}
+
+// newReportWriter returns a writer that sends what is written to it to the
+// client on the primary sideband, in packets that are as full as they can
+// be. It must be flushed at the end.
+func newReportWriter(output io.Writer, capabilities pktline.Capabilities) *bufio.Writer {
+	return bufio.NewWriterSize(newBandWriter(output, 1, capabilities), sideBandMaxData(capabilities))
+}
+
+func (w *sidebandWriter) Write(p []byte) (int, error) {
+	const hex = "0123456789abcdef"
+
+	maxData := cap(w.packet) - 5
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxData {
+			chunk = chunk[:maxData]
+		}
+
+		n := 5 + len(chunk)
+		packet := append(w.packet[:0], hex[n>>12&0xf], hex[n>>8&0xf], hex[n>>4&0xf], hex[n&0xf], w.band)
+		packet = append(packet, chunk...)
+		if _, err := w.output.Write(packet); err != nil {
+			return written, fmt.Errorf("writing to sideband %d: %w", w.band, err)
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// inRepo makes `cmd` run in the repository, whatever the working directory
+// and GIT_DIR of this process are, and see the objects in the quarantine,
+// but nothing of our environment but childenv.Environ.
+func (r *spokesReceivePack) inRepo(cmd *exec.Cmd) {
+	cmd.Dir = r.repoPath
+	cmd.Env = childenv.Environ(os.Environ())
+	cmd.Env = append(cmd.Env, "GIT_DIR="+r.repoPath)
+	cmd.Env = append(cmd.Env, r.getAlternateObjectDirsEnv()...)
+	cmd.Env = append(cmd.Env, r.getChildEnv()...)
+}
+
+// newPipeline returns a pipeline whose commands run in the repository,
+// whatever the working directory and GIT_DIR of this process are. Its
+// command stages should be scrubbed, or quarantined, so that they don't see
+// all of our environment.
+func (r *spokesReceivePack) newPipeline(opts ...pipe.Option) *pipe.Pipeline {
+	return pipe.New(append([]pipe.Option{
+		pipe.WithDir(r.repoPath),
+		pipe.WithEnvVar("GIT_DIR", r.repoPath),
+		pipe.WithEnvVars(r.childEnv),
+	}, opts...)...)
+}
+
+func (r *spokesReceivePack) getChildEnv() []string {
+	env := make([]string, 0, len(r.childEnv))
+	for _, v := range r.childEnv {
+		env = append(env, fmt.Sprintf("%s=%s", v.Key, v.Value))
+	}
+	return env
+}
+
 func (r *spokesReceivePack) getAlternateObjectDirsEnv() []string {
+	vars := r.quarantineEnvVars()
+	env := make([]string, 0, len(vars))
+	for _, v := range vars {
+		env = append(env, fmt.Sprintf("%s=%s", v.Key, v.Value))
+	}
+	return env
+}
+
+// quarantineEnvVars returns the environment variables that make git write
+// objects to the quarantine and read them from both it and the repository.
+func (r *spokesReceivePack) quarantineEnvVars() []pipe.EnvVar {
 	// mimic https://github.com/git/git/blob/950264636c68591989456e3ba0a5442f93152c1a/tmp-objdir.c#L149-L153
-	return []string{
-		fmt.Sprintf("GIT_ALTERNATE_OBJECT_DIRECTORIES=%s", filepath.Join(r.repoPath, "objects")),
-		fmt.Sprintf("GIT_OBJECT_DIRECTORY=%s", r.quarantineFolder),
-		fmt.Sprintf("GIT_QUARANTINE_PATH=%s", r.quarantineFolder),
+	return append([]pipe.EnvVar{
+		{Key: "GIT_ALTERNATE_OBJECT_DIRECTORIES", Value: alternateObjectDirs(filepath.Join(r.repoPath, "objects"), os.Getenv)},
+		{Key: "GIT_OBJECT_DIRECTORY", Value: r.quarantineFolder},
+		{Key: "GIT_QUARANTINE_PATH", Value: r.quarantineFolder},
+	}, literalHistoryEnvVars()...)
+}
+
+// literalHistoryEnvVars returns the environment variables that stop git
+// from rewriting history as it reads it, with replace refs or grafts. Those
+// are under the control of whoever can push to the repository, so if they
+// were honored, a push could make objects that it doesn't include look
+// connected, or make a rewrite look like a fast-forward.
+func literalHistoryEnvVars() []pipe.EnvVar {
+	return []pipe.EnvVar{
+		{Key: "GIT_NO_REPLACE_OBJECTS", Value: "1"},
+		{Key: "GIT_GRAFT_FILE", Value: os.DevNull},
+	}
+}
+
+// connectionEnvVars returns environment variables describing the client's
+// connection, for check commands that want to make decisions based on the
+// network. Only the ones that we know are returned. The protocol and user
+// agent get a GIT_PUSH_ prefix because GIT_PROTOCOL and GIT_USER_AGENT
+// would change how git commands run by the checks behave.
+func (r *spokesReceivePack) connectionEnvVars() []pipe.EnvVar {
+	var vars []pipe.EnvVar
+	for _, v := range []pipe.EnvVar{
+		{Key: "GIT_SSH_CONNECTION", Value: r.sockstat.SSHConnection},
+		{Key: "GIT_REAL_IP", Value: r.sockstat.RealIP},
+		{Key: "GIT_PUSH_PROTOCOL", Value: r.sockstat.GitProtocol},
+		{Key: "GIT_PUSH_USER_AGENT", Value: r.sockstat.UserAgent},
+		{Key: "GIT_VIA", Value: r.sockstat.Via},
+	} {
+		if v.Value != "" {
+			vars = append(vars, v)
+		}
 	}
+	return vars
 }
 
 func (r *spokesReceivePack) makeQuarantineDirs() error {
@@ -1057,69 +2531,245 @@ func (r *spokesReceivePack) makeQuarantineDirs() error {
 	return os.MkdirAll(filepath.Join(r.quarantineFolder, "pack"), 0777)
 }
 
+// checkConnectivity rejects the commands whose new objects aren't all in
+// the repository or the quarantine, with the history stopping at the
+// commits in `shallowFile`, if it isn't empty, and then the push if it adds
+// more than receive.maxCommitCount commits. It also works out how to
+// report the commands that pass.
+func (r *spokesReceivePack) checkConnectivity(ctx context.Context, commands []command, shallowFile string) {
+	newCommits, err := r.performCheckConnectivity(ctx, commands, shallowFile)
+
+	// If we found a general check-connectivity error, let's check every
+	// individual command.
+	for i := range commands {
+		c := &commands[i]
+		if c.err != "" {
+			continue
+		}
+		c.reportFF = "ok"
+		if err != nil && !c.isDelete() {
+			if r.performCheckConnectivityOnObject(ctx, c.newOID, shallowFile) != nil {
+				c.err = "missing necessary objects"
+				c.reportFF = "ng"
+			}
+		}
+	}
+
+	// Then let's see which of the updates that passed are fast-forwards,
+	// and report it if the reportStatusFF setting is true.
+	r.findForcedUpdates(ctx, commands, shallowFile)
+	if r.isReportStatusFFConfigEnabled() {
+		for i := range commands {
+			c := &commands[i]
+			if c.err != "" || !c.isUpdate() {
+				continue
+			}
+			if c.forced {
+				c.reportFF = "nf"
+			} else {
+				c.reportFF = "ff"
+			}
+		}
+	}
+	var countErr error
+	if err != nil {
+		// The batched check gave up, so its count is missing the
+		// commands that it didn't get to. The ones that are left
+		// mustn't get past the limit uncounted.
+		newCommits, countErr = r.countRemainingCommits(ctx, commands, shallowFile)
+	}
+	r.checkCommitCount(commands, newCommits, countErr)
+}
+
 // performCheckConnectivity checks that the "new" oid provided in `commands` are
 // closed under reachability, stopping the traversal at any objects
-// reachable from the pre-existing reference values.
-func (r *spokesReceivePack) performCheckConnectivity(ctx context.Context, commands []command) error {
+// reachable from the pre-existing reference values. It returns how many
+// commits the traversal found, which are the ones that the push adds.
+func (r *spokesReceivePack) performCheckConnectivity(ctx context.Context, commands []command, shallowFile string) (int, error) {
 	nonRejectedCommands := commandsForConnectivityCheck(commands)
 	if len(nonRejectedCommands) == 0 {
 		// all the commands have been previously rejected so there is no need to perform
 		// a connectivity check
+		return 0, nil
+	}
+
+	hideConfig, removeHideConfig, err := r.hiddenRefsConfig()
+	if err != nil {
+		return 0, err
+	}
+	defer removeHideConfig()
+
+	var newCommits int
+	build := func() *pipe.Pipeline {
+		// The object names tell commits, which have none, apart from
+		// trees and blobs.
+		args := append(
+			append(hideConfig, shallowFileArgs(shallowFile)...),
+			"rev-list",
+			"--objects",
+			"--stdin",
+			"--not",
+			"--exclude-hidden=receive",
+			"--all",
+			"--alternate-refs",
+		)
+		cmd := exec.Command("git", args...)
+
+		p := r.newPipeline()
+		p.Add(
+			pipe.Function(
+				"write-new-values",
+				func(ctx context.Context, _ pipe.Env, input io.Reader, output io.Writer) error {
+					w := bufio.NewWriter(output)
+
+					for _, c := range commands {
+						if _, err := fmt.Fprintln(w, c.newOID); err != nil {
+							return fmt.Errorf("writing to 'rev-list' input: %w", err)
+						}
+					}
+
+					if err := w.Flush(); err != nil {
+						return fmt.Errorf("flushing stdin to 'rev-list': %w", err)
+					}
+
+					return nil
+				},
+			),
+			r.measure(pipe.WithTimeout(
+				childenv.Scrubbed(pipe.WithStageEnv(pipe.CommandStage("rev-list", cmd), r.quarantineEnvVars()...)),
+				r.revListTimeout,
+			)),
+			pipe.Function(
+				"count-commits",
+				func(_ context.Context, _ pipe.Env, input io.Reader, _ io.Writer) error {
+					var err error
+					newCommits, err = countCommits(input)
+					return err
+				},
+			),
+		)
+
+		return p
+	}
+
+	if err := r.connectivityRetry.Run(ctx, build); err != nil {
+		return 0, fmt.Errorf("performCheckConnectivity error: %w", err)
+	}
+
+	return newCommits, nil
+}
+
+// countCommits counts the commits in the output of `git rev-list
+// --objects`, which are the lines without an object name.
+func countCommits(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	n := 0
+	continued := false
+	for {
+		line, err := br.ReadSlice('\n')
+		// Only the start of a line that doesn't fit in the buffer
+		// can be the line of a commit, and it never is.
+		if !continued && len(line) > 0 && bytes.IndexByte(line, ' ') < 0 {
+			n++
+		}
+		continued = err == bufio.ErrBufferFull
+		switch {
+		case err == io.EOF:
+			return n, nil
+		case err != nil && !continued:
+			return n, fmt.Errorf("reading 'rev-list' output: %w", err)
+		}
+	}
+}
+
+// knownShallowCommits returns the ones of the client's shallow commits,
+// `shallow`, that the repository already had before this push. Their
+// history is already in the repository, so the connectivity checks can stop
+// at them instead of failing where the client's history ends. Commits that
+// only arrived in the pack aren't trusted like that. If they can't be
+// looked up, it returns none, which is always safe.
+func (r *spokesReceivePack) knownShallowCommits(ctx context.Context, shallow []string) []string {
+	if len(shallow) == 0 {
 		return nil
 	}
 
-	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	// Not r.inRepo, which would let cat-file see the quarantine.
+	cmd := exec.CommandContext(ctx, "git", "cat-file", "--batch-check=%(objectname) %(objecttype)")
+	cmd.Dir = r.repoPath
+	cmd.Env = append(childenv.Environ(os.Environ()), "GIT_DIR="+r.repoPath)
+	cmd.Env = append(cmd.Env, r.getChildEnv()...)
+	cmd.Stdin = strings.NewReader(strings.Join(shallow, "\n") + "\n")
+
+	out, err := cmd.Output()
 	if err != nil {
-		return fmt.Errorf("opening %s: %w", os.DevNull, err)
+		r.log.Warn("looking up shallow commits", "error", err)
+		return nil
 	}
-	defer func() {
-		_ = devNull.Close()
-	}()
 
-	cmd := exec.CommandContext(
-		ctx,
-		"git",
-		"rev-list",
-		"--objects",
-		"--no-object-names",
-		"--stdin",
-		"--not",
-		"--exclude-hidden=receive",
-		"--all",
-		"--alternate-refs",
-	)
-	cmd.Stderr = devNull
-	cmd.Env = append([]string{}, os.Environ()...)
-	cmd.Env = append(cmd.Env, r.getAlternateObjectDirsEnv()...)
+	var known []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if oid, ok := strings.CutSuffix(line, " commit"); ok {
+			known = append(known, oid)
+		}
+	}
+	return known
+}
 
-	p := pipe.New(pipe.WithDir("."), pipe.WithStdout(devNull))
-	p.Add(
-		pipe.Function(
-			"write-new-values",
-			func(ctx context.Context, _ pipe.Env, input io.Reader, output io.Writer) error {
-				w := bufio.NewWriter(output)
-
-				for _, c := range commands {
-					if _, err := fmt.Fprintln(w, c.newOID); err != nil {
-						return fmt.Errorf("writing to 'rev-list' input: %w", err)
-					}
-				}
+// writeShallowFile writes the repository's own shallow commits and
+// `shallowTips` to a temporary file for the connectivity checks to pass to
+// git with --shallow-file, as git-receive-pack does. git then treats
+// `shallowTips` as having no parents, but still checks that their trees are
+// complete. It returns "", which leaves git to use the repository's own
+// shallow file, if there are no tips or the file can't be written, and a
+// function that removes the file.
+func (r *spokesReceivePack) writeShallowFile(shallowTips []string) (string, func()) {
+	if len(shallowTips) == 0 {
+		return "", func() {}
+	}
 
-				if err := w.Flush(); err != nil {
-					return fmt.Errorf("flushing stdin to 'rev-list': %w", err)
-				}
+	path, err := writeTempShallowFile(filepath.Join(r.repoPath, "shallow"), shallowTips)
+	if err != nil {
+		r.log.Warn("writing shallow file", "error", err)
+		return "", func() {}
+	}
+	return path, func() { _ = os.Remove(path) }
+}
 
-				return nil
-			},
-		),
-		pipe.CommandStage("rev-list", cmd),
-	)
+// writeTempShallowFile writes the contents of `repoShallow`, if it exists,
+// followed by `shallowTips` to a new temporary file and returns its name.
+func writeTempShallowFile(repoShallow string, shallowTips []string) (string, error) {
+	content, err := os.ReadFile(repoShallow)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	content = append(content, strings.Join(shallowTips, "\n")+"\n"...)
 
-	if err := p.Run(ctx); err != nil {
-		return fmt.Errorf("performCheckConnectivity error: %w", err)
+	f, err := os.CreateTemp("", "spokes-shallow-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
 	}
+	return f.Name(), nil
+}
 
-	return nil
+// shallowFileArgs returns the git options that make it use `shallowFile`,
+// if there is one.
+func shallowFileArgs(shallowFile string) []string {
+	if shallowFile == "" {
+		return nil
+	}
+	return []string{"--shallow-file", shallowFile}
 }
 
 func commandsForConnectivityCheck(commands []command) []command {
@@ -1132,10 +2782,9 @@ func commandsForConnectivityCheck(commands []command) []command {
 	return res
 }
 
-func (r *spokesReceivePack) performCheckConnectivityOnObject(ctx context.Context, oid string) error {
-	cmd := exec.CommandContext(
-		ctx,
-		"git",
+func (r *spokesReceivePack) performCheckConnectivityOnObject(ctx context.Context, oid string, shallowFile string) error {
+	args := append(
+		shallowFileArgs(shallowFile),
 		"rev-list",
 		"--objects",
 		"--no-object-names",
@@ -1144,8 +2793,8 @@ func (r *spokesReceivePack) performCheckConnectivityOnObject(ctx context.Context
 		"--all",
 		"--alternate-refs",
 	)
-	cmd.Env = append([]string{}, os.Environ()...)
-	cmd.Env = append(cmd.Env, r.getAlternateObjectDirsEnv()...)
+	cmd := exec.CommandContext(ctx, "git", args...)
+	r.inRepo(cmd)
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
@@ -1155,8 +2804,10 @@ func (r *spokesReceivePack) performCheckConnectivityOnObject(ctx context.Context
 	return nil
 }
 
-// report the success/failure of the push operation to the client
-func writeReport(w io.Writer, unpackOK bool, commands []command) error {
+// report the success/failure of the push operation to the client. With
+// report-status-v2, `v2`, forced updates are followed by an option line
+// that says so.
+func writeReport(w io.Writer, unpackOK bool, commands []command, v2 bool) error {
 	if unpackOK {
 		if err := writePacketLine(w, []byte("unpack ok\n")); err != nil {
 			return err
@@ -1168,14 +2819,22 @@ func writeReport(w io.Writer, unpackOK bool, commands []command) error {
 	}
 	for _, c := range commands {
 		if c.err != "" {
-			if err := writePacketf(w, "ng %s %s\n", c.refname, c.err); err != nil {
+			msg := c.err
+			if c.retryable {
+				msg += retryableHint
+			}
+			if err := writePacketf(w, "ng %s %s\n", c.refname, msg); err != nil {
 				return err
 			}
 		} else {
 			if err := writePacketf(w, "%s %s\n", c.reportFF, c.refname); err != nil {
 				return err
 			}
-			// FIXME? if statusV2, maybe also write option refname, option old-oid, option new-oid, option forced-update
+			if v2 && c.forced {
+				if err := writePacketf(w, "option forced-update\n"); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
@@ -1188,28 +2847,49 @@ func writeReport(w io.Writer, unpackOK bool, commands []command) error {
 
 func (r *spokesReceivePack) report(_ context.Context, unpackOK bool, commands []command, capabilities pktline.Capabilities) error {
 	if !useSideBand(capabilities) {
-		return writeReport(r.output, unpackOK, commands)
+		return writeReport(r.output, unpackOK, commands, capabilities.IsDefined(pktline.ReportStatusV2))
 	}
 
-	var buf bytes.Buffer
+	if anyRetryable(commands) {
+		if _, err := io.WriteString(newSidebandWriter(r.output, capabilities), retryableNote); err != nil {
+			return fmt.Errorf("writing output to client: %w", err)
+		}
+	}
 
-	if err := writeReport(&buf, unpackOK, commands); err != nil {
-		return err
+	if r.blobScanWarning != "" {
+		if _, err := fmt.Fprintf(newSidebandWriter(r.output, capabilities), "warning: %s\n", r.blobScanWarning); err != nil {
+			return fmt.Errorf("writing output to client: %w", err)
+		}
 	}
 
-	output := buf.Bytes()
+	// The warnings about the ref updates that were accepted, before the
+	// report, so that the client shows them with the push's output.
+	for _, c := range commands {
+		if c.err != "" {
+			continue
+		}
+		for _, msg := range c.warnings {
+			if _, err := fmt.Fprintf(newSidebandWriter(r.output, capabilities), "warning: %s: %s\n", c.refname, msg); err != nil {
+				return fmt.Errorf("writing output to client: %w", err)
+			}
+		}
+	}
 
-	packetMax := sideBandBufSize(capabilities)
+	// The report is streamed, since it can be big for pushes of many
+	// refs.
+	w := newReportWriter(r.output, capabilities)
+	if err := writeReport(w, unpackOK, commands, capabilities.IsDefined(pktline.ReportStatusV2)); err != nil {
+		return fmt.Errorf("writing output to client: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("writing output to client: %w", err)
+	}
 
-	for len(output) > 0 {
-		n := packetMax - 5
-		if len(output) < n {
-			n = len(output)
-		}
-		if err := writePacketf(r.output, "\x01%s", output[:n]); err != nil {
+	if r.isPushSummaryEnabled() && !isQuiet(capabilities) {
+		summary := pushSummary(commands, r.packSize, time.Since(r.start))
+		if _, err := io.WriteString(newSidebandWriter(r.output, capabilities), summary); err != nil {
 			return fmt.Errorf("writing output to client: %w", err)
 		}
-		output = output[n:]
 	}
 
 	if _, err := fmt.Fprintf(r.output, "0000"); err != nil {
@@ -1219,6 +2899,17 @@ func (r *spokesReceivePack) report(_ context.Context, unpackOK bool, commands []
 	return nil
 }
 
+// anyRetryable returns true iff any of `commands` was rejected for a reason
+// that is retryable.
+func anyRetryable(commands []command) bool {
+	for _, c := range commands {
+		if c.err != "" && c.retryable {
+			return true
+		}
+	}
+	return false
+}
+
 // includeNonDeletes returns true iff `commands` includes any
 // non-delete commands.
 func includeNonDeletes(commands []command) bool {
@@ -1230,39 +2921,55 @@ func includeNonDeletes(commands []command) bool {
 	return false
 }
 
-func isQuiet(c pktline.Capabilities) bool {
-	return c.IsDefined(pktline.Quiet)
-}
-
-func isImporting() bool {
-	return sockstat.GetBool("is_importing")
+// clientCapabilities summarizes what the client negotiated, for governor.
+func clientCapabilities(c pktline.Capabilities) governor.ClientCapabilities {
+	cc := governor.ClientCapabilities{
+		Agent:       c.Agent().Value(),
+		Atomic:      c.IsDefined(pktline.Atomic),
+		PushOptions: c.IsDefined(pktline.PushOptions),
+	}
+	switch {
+	case c.IsDefined(pktline.SideBand64k):
+		cc.Sideband = pktline.SideBand64k
+	case c.IsDefined(pktline.SideBand):
+		cc.Sideband = pktline.SideBand
+	}
+	if sid := c.SessionId().Value(); sid != "" && pktline.IsSafeCapabilityValue(sid) {
+		cc.SessionID = sid
+	}
+	return cc
 }
 
-func skipPushLimit() bool {
-	return sockstat.GetBool("import_skip_push_limit")
+func isQuiet(c pktline.Capabilities) bool {
+	return c.IsDefined(pktline.Quiet)
 }
 
-func allowBadDate() bool {
-	return isImporting() && sockstat.GetBool("allow_baddate_in_import")
+func (r *spokesReceivePack) allowBadDate() bool {
+	return r.sockstat.IsImporting && r.sockstat.AllowBadDateInImport
 }
 
 func useSideBand(c pktline.Capabilities) bool {
 	return c.IsDefined(pktline.SideBand) || c.IsDefined(pktline.SideBand64k)
 }
 
-func sideBandBufSize(capabilities pktline.Capabilities) int {
+// The largest packets that a client accepts on the sideband, including the
+// 4-byte length and the band, depending on the sideband capability that it
+// chose. They are git's LARGE_PACKET_MAX and DEFAULT_PACKET_MAX.
+const (
+	sideBand64kMaxPacket = 65520
+	sideBandMaxPacket    = 1000
+)
+
+// sideBandPacketSize returns the size of the largest packet that we may
+// send on the sideband that the client chose.
+func sideBandPacketSize(capabilities pktline.Capabilities) int {
 	if capabilities.IsDefined(pktline.SideBand64k) {
-		return 65519
+		return sideBand64kMaxPacket
 	}
-	return 999
+	return sideBandMaxPacket
 }
 
-func isHex(s string) bool {
-	for i := 0; i < len(s); i++ {
-		c := s[i]
-		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f')) {
-			return false
-		}
-	}
-	return len(s) > 0
+// sideBandMaxData returns how much data fits in one sideband packet.
+func sideBandMaxData(capabilities pktline.Capabilities) int {
+	return sideBandPacketSize(capabilities) - 5
 }
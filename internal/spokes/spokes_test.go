@@ -3,15 +3,111 @@ package spokes
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/github/spokes-receive-pack/internal/audit"
 	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/events"
+	"github.com/github/spokes-receive-pack/internal/genrepo"
+	"github.com/github/spokes-receive-pack/internal/governor"
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/github/spokes-receive-pack/internal/objectformat"
+	"github.com/github/spokes-receive-pack/internal/pktline"
+	"github.com/github/spokes-receive-pack/internal/policy"
+	"github.com/github/spokes-receive-pack/internal/sockstat"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// testQuarantine is a generated repository with a quarantine directory
+// that objects can be written to.
+type testQuarantine struct {
+	t    *testing.T
+	repo *genrepo.Repo
+	path string
+}
+
+// quarantinedRepo returns a quarantine for a small generated repository.
+func quarantinedRepo(t *testing.T) *testQuarantine {
+	t.Helper()
+	return quarantinedSpec(t, genrepo.Spec{Commits: 2, BlobSize: 10})
+}
+
+// quarantinedSpec returns a quarantine for a repository generated from
+// `spec`.
+func quarantinedSpec(t *testing.T, spec genrepo.Spec) *testQuarantine {
+	t.Helper()
+
+	repo, err := genrepo.Generate(context.Background(), filepath.Join(t.TempDir(), "repo.git"), spec)
+	require.NoError(t, err)
+	q := &testQuarantine{t: t, repo: repo, path: filepath.Join(repo.Path, "objects", "incoming-test")}
+	require.NoError(t, os.MkdirAll(filepath.Join(q.path, "pack"), 0o755))
+	return q
+}
+
+// git runs git with the objects of the quarantine.
+func (q *testQuarantine) git(stdin string, args ...string) string {
+	q.t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(),
+		"GIT_DIR="+q.repo.Path,
+		"GIT_OBJECT_DIRECTORY="+q.path,
+		"GIT_ALTERNATE_OBJECT_DIRECTORIES="+filepath.Join(q.repo.Path, "objects"))
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.Output()
+	require.NoError(q.t, err, "git %v", args)
+	return strings.TrimSpace(string(out))
+}
+
+// commitFiles writes a commit on top of `parent` whose files are `files`,
+// by name, to the quarantine.
+func (q *testQuarantine) commitFiles(parent string, files map[string]string) string {
+	q.t.Helper()
+	var entries strings.Builder
+	for name, content := range files {
+		blob := q.git(content, "hash-object", "-w", "--stdin")
+		entries.WriteString("100644 blob " + blob + "\t" + name + "\n")
+	}
+	tree := q.git(entries.String(), "mktree")
+	return q.git("", "-c", "user.name=a", "-c", "user.email=a@example.com",
+		"commit-tree", "-p", parent, "-m", "pushed", tree)
+}
+
+// commit is like commitFiles, with files whose content is "content of "
+// and their name.
+func (q *testQuarantine) commit(parent string, names ...string) string {
+	q.t.Helper()
+	files := make(map[string]string, len(names))
+	for _, name := range names {
+		files[name] = "content of " + name + "\n"
+	}
+	return q.commitFiles(parent, files)
+}
+
+// receivePack returns a receive-pack for the repository and quarantine.
+func (q *testQuarantine) receivePack() *spokesReceivePack {
+	return &spokesReceivePack{
+		config:           &config.Config{},
+		repoPath:         q.repo.Path,
+		objectFormat:     "sha1",
+		quarantineFolder: q.path,
+		log:              logger.New(io.Discard),
+	}
+}
+
 func TestCheckHiddenRefs(t *testing.T) {
 	hiddenRefs := []string{"refs/pull/", "refs/gh/", "refs/__gh__", "!refs/__gh__/svn"}
 	for _, p := range []struct {
@@ -39,7 +135,7 @@ func TestCheckHiddenRefs(t *testing.T) {
 		t.Run(
 			fmt.Sprintf("TestCheckHiddenRefs(%q, %q)", p.line, p.hiddenRefs),
 			func(t *testing.T) {
-				ok := isHiddenRef(p.line, p.hiddenRefs)
+				ok := newHiddenRefMatcher(p.hiddenRefs).isHidden(p.line)
 				assert.Equal(t, p.expected, ok)
 			},
 		)
@@ -47,227 +143,1144 @@ func TestCheckHiddenRefs(t *testing.T) {
 }
 
 // Generate like this:
-// git -C internal/spokes/testdata/lots-of-refs.git for-each-ref --format='%(objectname) %(refname)' | ruby -ne 'printf "%04x%s", 4+$_.size, $_'
+// go run ./cmd/genrepo -refs 'refs/tags/tag-aaaa-%d=100' -refs 'refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-%d=100' /tmp/lots-of-refs.git
+// git -C /tmp/lots-of-refs.git for-each-ref --format='%(objectname) %(refname)' | ruby -ne 'printf "%04x%s", 4+$_.size, $_'
 // then add capabilities to the first line and a 0000 at the end
-const expectedReferenceList = `00466a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/heads/main` + "\x00" + `anything
-00426a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-1
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-10
-00446a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-100
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-11
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-12
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-13
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-14
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-15
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-16
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-17
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-18
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-19
-00426a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-2
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-20
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-21
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-22
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-23
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-24
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-25
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-26
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-27
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-28
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-29
-00426a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-3
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-30
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-31
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-32
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-33
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-34
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-35
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-36
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-37
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-38
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-39
-00426a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-4
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-40
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-41
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-42
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-43
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-44
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-45
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-46
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-47
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-48
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-49
-00426a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-5
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-50
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-51
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-52
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-53
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-54
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-55
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-56
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-57
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-58
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-59
-00426a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-6
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-60
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-61
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-62
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-63
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-64
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-65
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-66
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-67
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-68
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-69
-00426a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-7
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-70
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-71
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-72
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-73
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-74
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-75
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-76
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-77
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-78
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-79
-00426a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-8
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-80
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-81
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-82
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-83
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-84
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-85
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-86
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-87
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-88
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-89
-00426a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-9
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-90
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-91
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-92
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-93
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-94
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-95
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-96
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-97
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-98
-00436a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-99
-005f6a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-1
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-10
-00616a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-100
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-11
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-12
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-13
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-14
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-15
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-16
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-17
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-18
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-19
-005f6a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-2
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-20
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-21
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-22
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-23
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-24
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-25
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-26
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-27
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-28
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-29
-005f6a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-3
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-30
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-31
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-32
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-33
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-34
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-35
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-36
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-37
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-38
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-39
-005f6a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-4
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-40
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-41
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-42
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-43
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-44
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-45
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-46
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-47
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-48
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-49
-005f6a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-5
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-50
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-51
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-52
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-53
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-54
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-55
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-56
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-57
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-58
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-59
-005f6a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-6
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-60
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-61
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-62
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-63
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-64
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-65
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-66
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-67
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-68
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-69
-005f6a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-7
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-70
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-71
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-72
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-73
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-74
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-75
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-76
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-77
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-78
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-79
-005f6a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-8
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-80
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-81
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-82
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-83
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-84
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-85
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-86
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-87
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-88
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-89
-005f6a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-9
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-90
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-91
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-92
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-93
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-94
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-95
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-96
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-97
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-98
-00606a9ee41101de417acd4db5b7a18b66a5e1b54496 refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-99
+const expectedReferenceList = `0046b610c0d60779c270356dde58d8286d36223ffeac refs/heads/main` + "\x00" + `anything
+0042b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-1
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-10
+0044b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-100
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-11
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-12
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-13
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-14
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-15
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-16
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-17
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-18
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-19
+0042b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-2
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-20
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-21
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-22
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-23
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-24
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-25
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-26
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-27
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-28
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-29
+0042b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-3
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-30
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-31
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-32
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-33
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-34
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-35
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-36
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-37
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-38
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-39
+0042b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-4
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-40
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-41
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-42
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-43
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-44
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-45
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-46
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-47
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-48
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-49
+0042b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-5
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-50
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-51
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-52
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-53
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-54
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-55
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-56
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-57
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-58
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-59
+0042b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-6
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-60
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-61
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-62
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-63
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-64
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-65
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-66
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-67
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-68
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-69
+0042b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-7
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-70
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-71
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-72
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-73
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-74
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-75
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-76
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-77
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-78
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-79
+0042b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-8
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-80
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-81
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-82
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-83
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-84
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-85
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-86
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-87
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-88
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-89
+0042b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-9
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-90
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-91
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-92
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-93
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-94
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-95
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-96
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-97
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-98
+0043b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-99
+005fb610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-1
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-10
+0061b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-100
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-11
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-12
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-13
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-14
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-15
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-16
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-17
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-18
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-19
+005fb610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-2
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-20
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-21
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-22
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-23
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-24
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-25
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-26
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-27
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-28
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-29
+005fb610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-3
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-30
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-31
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-32
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-33
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-34
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-35
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-36
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-37
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-38
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-39
+005fb610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-4
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-40
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-41
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-42
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-43
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-44
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-45
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-46
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-47
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-48
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-49
+005fb610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-5
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-50
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-51
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-52
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-53
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-54
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-55
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-56
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-57
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-58
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-59
+005fb610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-6
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-60
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-61
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-62
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-63
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-64
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-65
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-66
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-67
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-68
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-69
+005fb610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-7
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-70
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-71
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-72
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-73
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-74
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-75
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-76
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-77
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-78
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-79
+005fb610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-8
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-80
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-81
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-82
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-83
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-84
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-85
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-86
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-87
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-88
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-89
+005fb610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-9
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-90
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-91
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-92
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-93
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-94
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-95
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-96
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-97
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-98
+0060b610c0d60779c270356dde58d8286d36223ffeac refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-99
 0000`
 
+// lotsOfRefs describes the repository that expectedReferenceList is for.
+var lotsOfRefs = genrepo.Spec{
+	Refs: []genrepo.RefSet{
+		{Format: "refs/tags/tag-aaaa-%d", Count: 100},
+		{Format: "refs/tags/tag-aaaa-lakdjsf-asdfjkasdklfj-asdkfj-%d", Count: 100},
+	},
+}
+
 func TestPerformReferenceDiscovery(t *testing.T) {
-	// spokesReceivePack assumes that we've already done a chdir into the repo.
-	origwd, err := os.Getwd()
+	// The repository doesn't need to be the working directory.
+	repo, err := genrepo.Generate(context.Background(), filepath.Join(t.TempDir(), "lots-of-refs.git"), lotsOfRefs)
 	require.NoError(t, err)
-	require.NoError(t, os.Chdir("testdata/lots-of-refs.git"))
-	t.Cleanup(func() { _ = os.Chdir(origwd) })
+	repoPath := repo.Path
 
 	var buf bytes.Buffer
-	wd, _ := os.Getwd()
 	r := &spokesReceivePack{
 		config:       &config.Config{},
 		output:       &buf,
-		repoPath:     wd,
+		repoPath:     repoPath,
 		capabilities: "anything",
 	}
 
 	assert.NoError(t, r.performReferenceDiscovery(context.Background()))
 	assert.Equal(t, expectedReferenceList, buf.String())
 }
+
+func TestClientCapabilities(t *testing.T) {
+	caps, err := pktline.ParseCapabilities([]byte("report-status side-band-64k atomic push-options agent=git/2.42.0 session-id=client-1\n"))
+	require.NoError(t, err)
+
+	assert.Equal(t, governor.ClientCapabilities{
+		Agent:       "git/2.42.0",
+		SessionID:   "client-1",
+		Sideband:    "side-band-64k",
+		Atomic:      true,
+		PushOptions: true,
+	}, clientCapabilities(caps))
+
+	caps, err = pktline.ParseCapabilities([]byte("report-status"))
+	require.NoError(t, err)
+	assert.Equal(t, governor.ClientCapabilities{}, clientCapabilities(caps))
+}
+
+func TestRecordForReplication(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replication.log")
+	journal, err := audit.Open(path)
+	require.NoError(t, err)
+
+	r := &spokesReceivePack{
+		replication: journal,
+		sockstat:    sockstat.Vars{RepoID: 12, QuarantineID: "q1"},
+	}
+	commands := []command{
+		{refname: "refs/heads/main", oldOID: nullSHA1OID, newOID: "1234", reportFF: "ok"},
+		{refname: "refs/pull/1/head", oldOID: nullSHA1OID, newOID: "5678", reportFF: "ng", err: "deny updating a hidden ref"},
+	}
+	r.recordForReplication(commands)
+	require.NoError(t, journal.Close())
+	assert.Empty(t, commands[0].err)
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var entry audit.ReplicationEntry
+	require.NoError(t, json.Unmarshal(contents, &entry))
+	assert.Equal(t, uint32(12), entry.RepoID)
+	assert.Equal(t, "q1", entry.QuarantineID)
+	assert.Equal(t, []audit.RefUpdate{{Refname: "refs/heads/main", OldOID: nullSHA1OID, NewOID: "1234"}}, entry.Updates)
+
+	// If the journal can't be written, nothing is accepted.
+	r = &spokesReceivePack{replicationErr: errors.New("no journal")}
+	r.recordForReplication(commands)
+	assert.Equal(t, "failed to record push for replication", commands[0].err)
+	assert.Equal(t, "ng", commands[0].reportFF)
+	assert.True(t, commands[0].retryable)
+	assert.Equal(t, "deny updating a hidden ref", commands[1].err)
+	assert.False(t, commands[1].retryable)
+}
+
+func TestApplyPushRules(t *testing.T) {
+	r := &spokesReceivePack{
+		pushRules: []policy.Rule{
+			{Name: "protect", Refs: []string{"refs/heads/main"}, On: []string{policy.OnDelete}, Action: policy.Deny, Message: "main can't be deleted"},
+		},
+	}
+	commands := []command{
+		{refname: "refs/heads/main", oldOID: "1234", newOID: nullSHA1OID, reportFF: "ok"},
+		{refname: "refs/heads/topic", oldOID: "1234", newOID: nullSHA1OID, reportFF: "ok"},
+	}
+	r.applyPushRules(context.Background(), commands)
+	assert.Equal(t, "main can't be deleted", commands[0].err)
+	assert.Equal(t, "ng", commands[0].reportFF)
+	assert.Empty(t, commands[1].err)
+
+	// Force pushes that are already known aren't checked again.
+	r.pushRules = []policy.Rule{{Name: "no-force", On: []string{policy.OnForce}, Action: policy.Deny}}
+	forced := []command{
+		{refname: "refs/heads/a", oldOID: "1234", newOID: "5678", reportFF: "ok", forced: true, forcedKnown: true},
+		{refname: "refs/heads/b", oldOID: "1234", newOID: "5678", reportFF: "ok", forcedKnown: true},
+	}
+	r.applyPushRules(context.Background(), forced)
+	assert.NotEmpty(t, forced[0].err)
+	assert.Empty(t, forced[1].err)
+
+	// Invalid rules reject everything.
+	r = &spokesReceivePack{pushRulesErr: errors.New("bad rule")}
+	r.applyPushRules(context.Background(), commands)
+	assert.Equal(t, "main can't be deleted", commands[0].err)
+	assert.Equal(t, "invalid push rules", commands[1].err)
+}
+
+func TestCheckPolicy(t *testing.T) {
+	var got policy.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&got))
+		_, _ = w.Write([]byte(`{"decision": "allow", "refs": {
+			"refs/heads/main": {"decision": "deny", "message": "main is protected", "warning": "ignored"},
+			"refs/heads/topic": {"decision": "allow", "warning": "topic is behind main"}
+		}}`))
+	}))
+	defer srv.Close()
+
+	r := &spokesReceivePack{
+		policy:   policy.New(srv.URL, time.Second, false),
+		sockstat: sockstat.Vars{RepoName: "a/b", UserID: 7},
+	}
+	commands := []command{
+		{refname: "refs/heads/main", oldOID: nullSHA1OID, newOID: "1234", reportFF: "ok"},
+		{refname: "refs/heads/topic", oldOID: nullSHA1OID, newOID: "5678", reportFF: "ok"},
+		{refname: "refs/pull/1/head", oldOID: nullSHA1OID, newOID: "9abc", reportFF: "ng", err: "deny updating a hidden ref"},
+	}
+	r.checkPolicy(context.Background(), commands)
+
+	// Commands that have already been rejected aren't asked about.
+	assert.Equal(t, policy.Request{
+		RepoName: "a/b",
+		UserID:   7,
+		Commands: []policy.Command{
+			{Refname: "refs/heads/main", OldOID: nullSHA1OID, NewOID: "1234"},
+			{Refname: "refs/heads/topic", OldOID: nullSHA1OID, NewOID: "5678"},
+		},
+	}, got)
+
+	assert.Equal(t, "main is protected", commands[0].err)
+	assert.Equal(t, "ng", commands[0].reportFF)
+	assert.False(t, commands[0].retryable)
+	assert.Empty(t, commands[0].warnings)
+	assert.Empty(t, commands[1].err)
+	assert.Equal(t, []string{"topic is behind main"}, commands[1].warnings)
+	assert.Equal(t, "deny updating a hidden ref", commands[2].err)
+
+	// If the policy service is down, the rejections are retryable.
+	srv.Close()
+	r.policy = policy.New(srv.URL, time.Second, true)
+	commands[1].reportFF = "ok"
+	r.checkPolicy(context.Background(), commands)
+	assert.Equal(t, policy.UnavailableMessage, commands[1].err)
+	assert.True(t, commands[1].retryable)
+}
+
+func TestRunChecks(t *testing.T) {
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, "env")
+	check := filepath.Join(dir, "check")
+	require.NoError(t, os.WriteFile(check, []byte(`#!/bin/sh
+cat >/dev/null
+env | grep -E '^GIT_(SSH_CONNECTION|REAL_IP|PUSH_PROTOCOL|PUSH_USER_AGENT|VIA|QUARANTINE_PATH)=' | sort >"`+envFile+`"
+echo '{"decision": "deny", "message": "not from here"}'
+`), 0755))
+
+	r := &spokesReceivePack{
+		repoPath:         dir,
+		quarantineFolder: filepath.Join(dir, "objects", "q1"),
+		checks:           policy.Checks{Commands: []string{check}, Timeout: 10 * time.Second},
+		sockstat: sockstat.Vars{
+			SSHConnection: "10.0.0.1 5555 10.0.0.2 22",
+			RealIP:        "10.0.0.1",
+			GitProtocol:   "ssh",
+		},
+	}
+	commands := []command{
+		{refname: "refs/heads/main", oldOID: nullSHA1OID, newOID: "1234", reportFF: "ok"},
+	}
+	r.runChecks(context.Background(), commands)
+	assert.Equal(t, "not from here", commands[0].err)
+
+	env, err := os.ReadFile(envFile)
+	require.NoError(t, err)
+	assert.Equal(t,
+		"GIT_PUSH_PROTOCOL=ssh\n"+
+			"GIT_QUARANTINE_PATH="+r.quarantineFolder+"\n"+
+			"GIT_REAL_IP=10.0.0.1\n"+
+			"GIT_SSH_CONNECTION=10.0.0.1 5555 10.0.0.2 22\n",
+		string(env))
+
+	// The check ran as a hook, so its metrics were recorded.
+	require.Len(t, r.stageMetrics, 1)
+	assert.Contains(t, r.stageMetrics[0].Stage, check)
+}
+
+func TestRunChecksMemoryLimit(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("memory usage is only known on Linux")
+	}
+
+	dir := t.TempDir()
+	check := filepath.Join(dir, "check")
+	require.NoError(t, os.WriteFile(check, []byte("#!/bin/sh\nsleep 10\necho '{\"decision\": \"allow\"}'\n"), 0755))
+
+	r := &spokesReceivePack{
+		repoPath:         dir,
+		quarantineFolder: filepath.Join(dir, "objects", "q1"),
+		checks:           policy.Checks{Commands: []string{check}, Timeout: 30 * time.Second},
+		log:              logger.New(io.Discard),
+		hookMemoryLimit:  1,
+	}
+	commands := []command{
+		{refname: "refs/heads/main", oldOID: nullSHA1OID, newOID: "1234", reportFF: "ok"},
+	}
+	start := time.Now()
+	r.runChecks(context.Background(), commands)
+	assert.Equal(t, policy.CheckFailedMessage, commands[0].err)
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
+
+func TestReportRetryable(t *testing.T) {
+	caps, err := pktline.ParseCapabilities([]byte("report-status side-band-64k"))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	r := &spokesReceivePack{output: &buf, config: &config.Config{}}
+	require.NoError(t, r.report(context.Background(), true, []command{
+		{refname: "refs/heads/main", reportFF: "ng", err: "push policy check unavailable", retryable: true},
+		{refname: "refs/heads/topic", reportFF: "ok"},
+	}, caps))
+
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, fmt.Sprintf("%04x\x02%s", 5+len(retryableNote), retryableNote)), out)
+	assert.Contains(t, out, "ng refs/heads/main push policy check unavailable (retryable)\n")
+
+	buf.Reset()
+	require.NoError(t, r.report(context.Background(), true, []command{
+		{refname: "refs/heads/main", reportFF: "ng", err: "main is protected"},
+	}, caps))
+	assert.NotContains(t, buf.String(), "\x02")
+	assert.NotContains(t, buf.String(), "(retryable)")
+}
+
+func TestReportWarnings(t *testing.T) {
+	caps, err := pktline.ParseCapabilities([]byte("report-status side-band-64k"))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	r := &spokesReceivePack{output: &buf, config: &config.Config{}}
+	require.NoError(t, r.report(context.Background(), true, []command{
+		{refname: "refs/heads/main", reportFF: "ng", err: "main is protected", warnings: []string{"not shown"}},
+		{refname: "refs/heads/topic", reportFF: "ok", warnings: []string{"topic is behind main"}},
+	}, caps))
+
+	note := "warning: refs/heads/topic: topic is behind main\n"
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, fmt.Sprintf("%04x\x02%s", 5+len(note), note)), out)
+	assert.NotContains(t, out, "not shown")
+	assert.Contains(t, out, "ok refs/heads/topic\n")
+}
+
+func TestEmitAcceptedPush(t *testing.T) {
+	var got []events.AcceptedPush
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var ev events.AcceptedPush
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&ev))
+		got = append(got, ev)
+	}))
+	defer srv.Close()
+
+	emitter, err := events.New(srv.URL)
+	require.NoError(t, err)
+	r := &spokesReceivePack{
+		events:   emitter,
+		sockstat: sockstat.Vars{RepoName: "a/b", UserID: 7},
+		packSize: 1024,
+	}
+
+	r.emitAcceptedPush(context.Background(), []command{
+		{refname: "refs/heads/main", oldOID: nullSHA1OID, newOID: "1234", reportFF: "ok"},
+		{refname: "refs/pull/1/head", oldOID: nullSHA1OID, newOID: "5678", reportFF: "ng", err: "deny updating a hidden ref"},
+	})
+	require.Len(t, got, 1)
+	assert.Equal(t, events.PushAccepted, got[0].Event)
+	assert.Equal(t, "a/b", got[0].RepoName)
+	assert.Equal(t, uint32(7), got[0].UserID)
+	assert.Equal(t, int64(1024), got[0].PackSize)
+	assert.Equal(t, []events.RefUpdate{{Refname: "refs/heads/main", OldOID: nullSHA1OID, NewOID: "1234"}}, got[0].Refs)
+
+	// Nothing is sent if nothing was accepted.
+	r.emitAcceptedPush(context.Background(), []command{
+		{refname: "refs/pull/1/head", oldOID: nullSHA1OID, newOID: "5678", reportFF: "ng", err: "deny updating a hidden ref"},
+	})
+	assert.Len(t, got, 1)
+}
+
+func TestParseCommand(t *testing.T) {
+	sha1 := objectformat.ObjectFormat("sha1")
+	sha256 := objectformat.ObjectFormat("sha256")
+	oid1 := "e83c5163316f89bfbde7d9ab23ca2e25604af290"
+	oid256 := strings.Repeat("ab", 32)
+
+	c, ok := parseCommand(sha1, nullSHA1OID+" "+oid1+" refs/heads/main\n")
+	require.True(t, ok)
+	assert.Equal(t, command{oldOID: nullSHA1OID, newOID: oid1, refname: "refs/heads/main"}, c)
+
+	c, ok = parseCommand(sha256, oid256+" "+nullSHA256OID+" refs/tags/v1")
+	require.True(t, ok)
+	assert.Equal(t, command{oldOID: oid256, newOID: nullSHA256OID, refname: "refs/tags/v1"}, c)
+
+	for _, line := range []string{
+		// The object IDs must match the repository's object format.
+		nullSHA256OID + " " + oid256 + " refs/heads/main",
+		oid1 + " " + oid256 + " refs/heads/main",
+		nullSHA1OID + " " + oid1,
+		nullSHA1OID + " " + oid1 + " ",
+		"shallow " + oid1,
+		// Only the first command can have capabilities.
+		nullSHA1OID + " " + oid1 + " refs/heads/main\x00report-status",
+	} {
+		_, ok := parseCommand(sha1, line)
+		assert.False(t, ok, line)
+	}
+}
+
+func TestReadCommandsCapabilities(t *testing.T) {
+	oid := "e83c5163316f89bfbde7d9ab23ca2e25604af290"
+	advertised := supportedCapabilities("sha1", receiveOptions{}) + " agent=github/spokes-receive-pack-test"
+
+	for _, tc := range []struct {
+		name       string
+		advertised string
+		requested  string
+		ok         bool
+	}{
+		{"advertised", advertised, "report-status side-band-64k atomic agent=git/2.42.0", true},
+		{"push-options advertised", advertised + " push-options", "report-status push-options", true},
+		{"push-options not advertised", advertised, "report-status push-options", false},
+		{"unknown", advertised, "report-status frobnicate", false},
+		{"side-band", advertised, "report-status side-band", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var input bytes.Buffer
+			require.NoError(t, writePacketf(&input, "%s %s refs/heads/main\x00%s\n", nullSHA1OID, oid, tc.requested))
+			input.WriteString("0000")
+
+			r := &spokesReceivePack{
+				input:        &input,
+				config:       &config.Config{},
+				objectFormat: "sha1",
+				capabilities: tc.advertised,
+			}
+			commands, _, _, err := r.readCommands(context.Background())
+			if tc.ok {
+				require.NoError(t, err)
+				assert.Len(t, commands, 1)
+				return
+			}
+			require.Error(t, err)
+			assert.True(t, isCategory(err, categoryProtocol))
+			assert.Contains(t, err.Error(), "not advertised")
+		})
+	}
+}
+
+func TestReadCommandsShallow(t *testing.T) {
+	oid := "e83c5163316f89bfbde7d9ab23ca2e25604af290"
+	shallow := strings.Repeat("1", 40)
+
+	for _, tc := range []struct {
+		name  string
+		lines []string
+	}{
+		{
+			"capabilities on the first command",
+			[]string{
+				"shallow " + shallow + "\n",
+				nullSHA1OID + " " + oid + " refs/heads/main\x00report-status side-band-64k\n",
+				nullSHA1OID + " " + oid + " refs/heads/topic\n",
+			},
+		},
+		{
+			"capabilities on the shallow line",
+			[]string{
+				"shallow " + shallow + "\x00report-status side-band-64k\n",
+				nullSHA1OID + " " + oid + " refs/heads/main\n",
+				nullSHA1OID + " " + oid + " refs/heads/topic\n",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var input bytes.Buffer
+			for _, line := range tc.lines {
+				require.NoError(t, writePacketf(&input, "%s", line))
+			}
+			input.WriteString("0000")
+
+			r := &spokesReceivePack{
+				input:        &input,
+				config:       &config.Config{},
+				objectFormat: "sha1",
+				capabilities: supportedCapabilities("sha1", receiveOptions{}),
+			}
+			commands, shallowInfo, caps, err := r.readCommands(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, []string{shallow}, shallowInfo)
+			require.Len(t, commands, 2)
+			assert.Equal(t, "refs/heads/main", commands[0].refname)
+			assert.True(t, caps.IsDefined(pktline.ReportStatus))
+			assert.True(t, caps.IsDefined(pktline.SideBand64k))
+		})
+	}
+
+	// Capabilities can't come after the first line that has them.
+	var input bytes.Buffer
+	require.NoError(t, writePacketf(&input, "shallow %s\x00report-status\n", shallow))
+	require.NoError(t, writePacketf(&input, "%s %s refs/heads/main\x00side-band-64k\n", nullSHA1OID, oid))
+	input.WriteString("0000")
+	r := &spokesReceivePack{
+		input:        &input,
+		config:       &config.Config{},
+		objectFormat: "sha1",
+		capabilities: supportedCapabilities("sha1", receiveOptions{}),
+	}
+	_, _, _, err := r.readCommands(context.Background())
+	assert.True(t, isCategory(err, categoryProtocol))
+}
+
+func TestReadCommandsShallowLimit(t *testing.T) {
+	oid := "e83c5163316f89bfbde7d9ab23ca2e25604af290"
+
+	read := func(limit string, shallow ...string) ([]string, error) {
+		var input bytes.Buffer
+		for _, s := range shallow {
+			require.NoError(t, writePacketf(&input, "shallow %s\n", s))
+		}
+		require.NoError(t, writePacketf(&input, "%s %s refs/heads/main\x00report-status\n", nullSHA1OID, oid))
+		input.WriteString("0000")
+
+		cfg := &config.Config{}
+		if limit != "" {
+			cfg.Entries = append(cfg.Entries, config.ConfigEntry{Key: "receive.shallowcountlimit", Value: limit})
+		}
+		r := &spokesReceivePack{
+			input:        &input,
+			config:       cfg,
+			objectFormat: "sha1",
+			capabilities: supportedCapabilities("sha1", receiveOptions{}),
+		}
+		_, shallowInfo, _, err := r.readCommands(context.Background())
+		return shallowInfo, err
+	}
+
+	a, b, c := strings.Repeat("a", 40), strings.Repeat("b", 40), strings.Repeat("c", 40)
+
+	shallow, err := read("", a, b, c)
+	require.NoError(t, err)
+	assert.Equal(t, []string{a, b, c}, shallow)
+
+	shallow, err = read("3", a, b, c)
+	require.NoError(t, err)
+	assert.Len(t, shallow, 3)
+
+	_, err = read("2", a, b, c)
+	assert.True(t, isCategory(err, categoryLimit), "%v", err)
+
+	_, err = read("0", a, b, c)
+	assert.NoError(t, err)
+
+	// Shallow lines must name objects of the repository's format.
+	_, err = read("", strings.Repeat("a", 64))
+	assert.True(t, isCategory(err, categoryProtocol), "%v", err)
+	_, err = read("", "HEAD")
+	assert.True(t, isCategory(err, categoryProtocol), "%v", err)
+}
+
+func TestShallowConnectivity(t *testing.T) {
+	ctx := context.Background()
+
+	// The repository has a history whose files are missing, like one that
+	// a shallow clone wouldn't send, and no refs, so the connectivity
+	// check can't stop early.
+	q := quarantinedSpec(t, genrepo.Spec{
+		Commits:      3,
+		BlobSize:     10,
+		MissingBlobs: 3,
+	})
+	repo := q.repo
+	q.git("", "update-ref", "-d", "refs/heads/main")
+
+	// The client's history ends at a commit on top of the broken history,
+	// and the push adds one on top of that.
+	shallowCommit := q.commit(repo.Head, "shallow.txt")
+	commit := q.commit(shallowCommit, "pushed.txt")
+
+	r := q.receivePack()
+	commands := []command{{oldOID: nullSHA1OID, newOID: commit, refname: "refs/heads/main"}}
+
+	_, err := r.performCheckConnectivity(ctx, commands, "")
+	assert.Error(t, err)
+	assert.Error(t, r.performCheckConnectivityOnObject(ctx, commit, ""))
+
+	// Only commits that were in the repository before the push count.
+	unknown := strings.Repeat("1", 40)
+	tree := q.git("", "rev-parse", commit+"^{tree}")
+	shallowTips := r.knownShallowCommits(ctx, []string{repo.Head, commit, unknown, tree})
+	assert.Equal(t, []string{repo.Head}, shallowTips)
+
+	shallowFile, remove := r.writeShallowFile([]string{shallowCommit})
+	newCommits, err := r.performCheckConnectivity(ctx, commands, shallowFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, newCommits)
+	assert.NoError(t, r.performCheckConnectivityOnObject(ctx, commit, shallowFile))
+	remove()
+	assert.NoFileExists(t, shallowFile)
+
+	// The tree of a shallow commit is still checked.
+	shallowFile, remove = r.writeShallowFile([]string{repo.Head})
+	defer remove()
+	commit = q.commit(repo.Head, "pushed.txt")
+	commands = []command{{oldOID: nullSHA1OID, newOID: commit, refname: "refs/heads/main"}}
+	_, err = r.performCheckConnectivity(ctx, commands, shallowFile)
+	assert.Error(t, err)
+	assert.Error(t, r.performCheckConnectivityOnObject(ctx, commit, shallowFile))
+}
+
+func TestWriteShallowFile(t *testing.T) {
+	r := &spokesReceivePack{repoPath: t.TempDir()}
+
+	path, remove := r.writeShallowFile(nil)
+	assert.Equal(t, "", path)
+	remove()
+
+	// The repository's own shallow commits stay shallow.
+	require.NoError(t, os.WriteFile(filepath.Join(r.repoPath, "shallow"), []byte("a"), 0o644))
+	path, remove = r.writeShallowFile([]string{"b", "c"})
+	defer remove()
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "a\nb\nc\n", string(content))
+}
+
+func TestIsForced(t *testing.T) {
+	ctx := context.Background()
+	q := quarantinedRepo(t)
+	r := q.receivePack()
+	head := q.repo.Head
+	child := q.commit(head, "child.txt")
+
+	ff := command{oldOID: head, newOID: child, refname: "refs/heads/main"}
+	assert.False(t, r.isForced(ctx, &ff))
+	assert.True(t, ff.forcedKnown)
+
+	rewind := command{oldOID: child, newOID: head, refname: "refs/heads/main"}
+	assert.False(t, rewind.forcedKnown)
+	assert.True(t, r.isForced(ctx, &rewind))
+	assert.Equal(t, 1, countForced([]command{ff, rewind}))
+}
+
+func TestFindForcedUpdates(t *testing.T) {
+	ctx := context.Background()
+	q := quarantinedRepo(t)
+	r := q.receivePack()
+	head := q.repo.Head
+	a := q.commit(head, "a.txt")
+	b := q.commit(a, "b.txt")
+	c := q.commit(b, "c.txt")
+	other := q.commit(head, "other.txt")
+
+	commands := []command{
+		{refname: "refs/heads/ff", oldOID: head, newOID: b},
+		{refname: "refs/heads/rewind", oldOID: b, newOID: a},
+		{refname: "refs/heads/sideways", oldOID: a, newOID: other},
+		// The way from c to a goes through b, which is the old value of
+		// the next update, so the walk doesn't tell.
+		{refname: "refs/heads/below", oldOID: a, newOID: c},
+		{refname: "refs/heads/next", oldOID: b, newOID: c},
+		{refname: "refs/heads/new", oldOID: nullSHA1OID, newOID: c},
+		{refname: "refs/heads/rejected", oldOID: c, newOID: head, err: "rejected"},
+	}
+	r.findForcedUpdates(ctx, commands, "")
+
+	forced := make(map[string]bool)
+	for _, c := range commands {
+		assert.Equal(t, c.isUpdate() && c.err == "", c.forcedKnown, c.refname)
+		forced[c.refname] = c.forced
+	}
+	assert.Equal(t, map[string]bool{
+		"refs/heads/ff":       false,
+		"refs/heads/rewind":   true,
+		"refs/heads/sideways": true,
+		"refs/heads/below":    false,
+		"refs/heads/next":     false,
+		"refs/heads/new":      false,
+		"refs/heads/rejected": false,
+	}, forced)
+	assert.Equal(t, 2, countForced(commands))
+}
+
+func TestIsForcedIn(t *testing.T) {
+	// d - c - b - a, with e on top of b too, and the history below a
+	// left out.
+	parents := map[string][]string{
+		"d": {"c"},
+		"c": {"b"},
+		"b": {"a"},
+		"a": {"root"},
+		"e": {"b"},
+	}
+	for _, tc := range []struct {
+		oldOID, newOID string
+		forced, ok     bool
+	}{
+		{"b", "d", false, true},
+		{"d", "d", false, true},
+		{"d", "b", true, true},
+		{"d", "e", true, true},
+		{"a", "d", false, true},
+		{"root", "d", false, false},
+		{"x", "d", false, false},
+		{"d", "x", false, false},
+	} {
+		forced, ok := isForcedIn(parents, &command{oldOID: tc.oldOID, newOID: tc.newOID})
+		assert.Equal(t, tc.forced, forced, "%s..%s", tc.oldOID, tc.newOID)
+		assert.Equal(t, tc.ok, ok, "%s..%s", tc.oldOID, tc.newOID)
+	}
+}
+
+func TestWriteReportForcedUpdate(t *testing.T) {
+	commands := []command{
+		{refname: "refs/heads/main", reportFF: "ok", forced: true},
+		{refname: "refs/heads/topic", reportFF: "ok"},
+	}
+
+	var v1, v2 bytes.Buffer
+	require.NoError(t, writeReport(&v1, true, commands, false))
+	require.NoError(t, writeReport(&v2, true, commands, true))
+
+	assert.Equal(t, "000eunpack ok\n0017ok refs/heads/main\n0018ok refs/heads/topic\n0000", v1.String())
+	assert.Equal(t, "000eunpack ok\n0017ok refs/heads/main\n0019option forced-update\n0018ok refs/heads/topic\n0000", v2.String())
+}
+
+func TestCountCommits(t *testing.T) {
+	commit := strings.Repeat("1", 40)
+	tree := strings.Repeat("2", 40)
+	output := commit + "\n" + tree + " \n" + tree + " " + strings.Repeat("x", 10000) + "\n" + commit + "\n" + commit
+
+	n, err := countCommits(strings.NewReader(output))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	n, err = countCommits(strings.NewReader(""))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestCheckCommitCount(t *testing.T) {
+	newCommands := func() []command {
+		return []command{
+			{refname: "refs/heads/main", reportFF: "ok"},
+			{refname: "refs/heads/hidden", reportFF: "ng", err: "deny updating a hidden ref"},
+		}
+	}
+	withLimit := func(limit string) *spokesReceivePack {
+		return &spokesReceivePack{config: &config.Config{Entries: []config.ConfigEntry{
+			{Key: "receive.maxcommitcount", Value: limit},
+		}}}
+	}
+
+	commands := newCommands()
+	(&spokesReceivePack{config: &config.Config{}}).checkCommitCount(commands, 1000000, nil)
+	assert.Empty(t, commands[0].err)
+
+	commands = newCommands()
+	withLimit("10").checkCommitCount(commands, 10, nil)
+	assert.Empty(t, commands[0].err)
+
+	commands = newCommands()
+	withLimit("10").checkCommitCount(commands, 11, nil)
+	assert.Equal(t, "push adds 11 commits, more than the limit of 10", commands[0].err)
+	assert.Equal(t, "ng", commands[0].reportFF)
+	assert.Equal(t, "deny updating a hidden ref", commands[1].err)
+
+	commands = newCommands()
+	withLimit("lots").checkCommitCount(commands, 1, nil)
+	assert.Equal(t, "invalid receive.maxCommitCount", commands[0].err)
+
+	// If the commits couldn't be counted, they might be over the limit.
+	commands = newCommands()
+	withLimit("10").checkCommitCount(commands, 0, errors.New("rev-list failed"))
+	assert.Equal(t, "new commits could not be counted", commands[0].err)
+	assert.True(t, commands[0].retryable)
+
+	commands = newCommands()
+	(&spokesReceivePack{config: &config.Config{}}).checkCommitCount(commands, 0, errors.New("rev-list failed"))
+	assert.Empty(t, commands[0].err)
+}
+
+func TestCheckConnectivityCountsCommits(t *testing.T) {
+	ctx := context.Background()
+	q := quarantinedRepo(t)
+	head := q.repo.Head
+
+	tip := head
+	for _, name := range []string{"a", "b", "c"} {
+		tip = q.commit(tip, name)
+	}
+	// A commit whose tree is missing a blob makes the batched check fail.
+	tree := q.git("100644 blob "+strings.Repeat("1", 40)+"\tmissing\n", "mktree", "--missing")
+	broken := q.git("", "-c", "user.name=a", "-c", "user.email=a@example.com",
+		"commit-tree", "-p", head, "-m", "broken", tree)
+
+	for _, tc := range []struct {
+		limit string
+		err   string
+	}{
+		{limit: "3"},
+		{limit: "2", err: "push adds 3 commits, more than the limit of 2"},
+	} {
+		r := q.receivePack()
+		r.config = &config.Config{Entries: []config.ConfigEntry{{Key: "receive.maxcommitcount", Value: tc.limit}}}
+		commands := []command{
+			{oldOID: nullSHA1OID, newOID: broken, refname: "refs/heads/broken"},
+			{oldOID: head, newOID: tip, refname: "refs/heads/main"},
+		}
+		r.checkConnectivity(ctx, commands, "")
+		assert.Equal(t, "missing necessary objects", commands[0].err, tc.limit)
+		assert.Equal(t, tc.err, commands[1].err, tc.limit)
+	}
+}
+
+func TestStageLimits(t *testing.T) {
+	lg := logger.New(io.Discard)
+	t.Setenv("SPOKES_TEST_TIMEOUT", "10s")
+	t.Setenv("SPOKES_TEST_MEMORY_LIMIT", "2m")
+
+	assert.Equal(t, 10*time.Second, stageTimeout(lg, "SPOKES_TEST_TIMEOUT", 0))
+	assert.Equal(t, 30*time.Second, stageTimeout(lg, "SPOKES_TEST_TIMEOUT", 30*time.Second))
+	assert.Equal(t, time.Duration(0), stageTimeout(lg, "SPOKES_TEST_UNSET", 0))
+
+	assert.Equal(t, uint64(2<<20), memoryLimit(lg, "SPOKES_TEST_MEMORY_LIMIT", 0))
+	assert.Equal(t, uint64(1<<20), memoryLimit(lg, "SPOKES_TEST_MEMORY_LIMIT", 1<<20))
+	assert.Equal(t, uint64(0), memoryLimit(lg, "SPOKES_TEST_UNSET", 0))
+}
+
+func TestSidebandWriter(t *testing.T) {
+	caps, err := pktline.ParseCapabilities([]byte("report-status side-band"))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := newSidebandWriter(&buf, caps)
+	n, err := w.Write(bytes.Repeat([]byte("x"), 1000))
+	require.NoError(t, err)
+	assert.Equal(t, 1000, n)
+
+	// A packet can't be longer than 1000 bytes, so the second one holds
+	// the bytes that didn't fit into the first.
+	assert.Equal(t, fmt.Sprintf("03e8\x02%s000a\x02xxxxx", strings.Repeat("x", 995)), buf.String())
+
+	// The packet buffer is reused.
+	allocs := testing.AllocsPerRun(10, func() {
+		_, _ = w.Write(bytes.Repeat([]byte("x"), 10))
+	})
+	assert.LessOrEqual(t, allocs, float64(1))
+}
+
+func TestReportSideband(t *testing.T) {
+	caps, err := pktline.ParseCapabilities([]byte("report-status side-band"))
+	require.NoError(t, err)
+
+	var commands []command
+	for i := 0; i < 100; i++ {
+		commands = append(commands, command{refname: fmt.Sprintf("refs/heads/branch-%d", i), reportFF: "ok"})
+	}
+	var expected bytes.Buffer
+	require.NoError(t, writeReport(&expected, true, commands, false))
+
+	var buf bytes.Buffer
+	r := &spokesReceivePack{output: &buf, config: &config.Config{}}
+	require.NoError(t, r.report(context.Background(), true, commands, caps))
+
+	// Every packet but the last one of the report is full.
+	var report bytes.Buffer
+	out := buf.Bytes()
+	for {
+		n, err := strconv.ParseUint(string(out[:4]), 16, 16)
+		require.NoError(t, err)
+		if n == 0 {
+			break
+		}
+		require.Equal(t, byte(1), out[4])
+		report.Write(out[5:n])
+		out = out[n:]
+		if report.Len() < expected.Len() {
+			assert.Equal(t, uint64(sideBandMaxPacket), n)
+		}
+	}
+	assert.Equal(t, expected.String(), report.String())
+	assert.Equal(t, "0000", string(out))
+}
+
+func TestWriteVersion(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeVersion(&buf, "abc123"))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, "spokes-receive-pack version abc123", lines[0])
+	assert.Equal(t, "go version "+runtime.Version(), lines[1])
+	assert.Contains(t, lines[2], "capabilities (sha1): ")
+	assert.Contains(t, lines[2], "object-format=sha1")
+	assert.Contains(t, lines[3], "capabilities (sha256): ")
+	assert.Contains(t, lines[3], "object-format=sha256")
+
+	buf.Reset()
+	require.NoError(t, writeVersion(&buf, ""))
+	assert.True(t, strings.HasPrefix(buf.String(), "spokes-receive-pack version unknown\n"))
+}
+
+func TestRecordDecisions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	journal, err := audit.Open(path)
+	require.NoError(t, err)
+
+	r := &spokesReceivePack{
+		audit:    journal,
+		sockstat: sockstat.Vars{RepoName: "a/b", UserID: 7, RequestID: "req"},
+	}
+	r.recordDecisions([]command{
+		{refname: "refs/heads/main", oldOID: "abcd", newOID: "1234", reportFF: "ok", forced: true},
+		{refname: "refs/pull/1/head", oldOID: nullSHA1OID, newOID: "5678", reportFF: "ng", err: "deny updating a hidden ref"},
+	})
+	require.NoError(t, journal.Close())
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	require.Len(t, lines, 2)
+
+	var accepted, rejected audit.Record
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &accepted))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &rejected))
+
+	assert.Equal(t, "refs/heads/main", accepted.Refname)
+	assert.Equal(t, audit.Accepted, accepted.Decision)
+	assert.Equal(t, "a/b", accepted.RepoName)
+	assert.Equal(t, uint32(7), accepted.UserID)
+	assert.Equal(t, "req", accepted.RequestID)
+	assert.Equal(t, "1234", accepted.NewOID)
+	assert.True(t, accepted.Forced)
+	assert.False(t, rejected.Forced)
+
+	assert.Equal(t, audit.Rejected, rejected.Decision)
+	assert.Equal(t, "deny updating a hidden ref", rejected.Reason)
+}
+
+func TestIsFastForwardIgnoresReplaceRefs(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "repo.git")
+	require.NoError(t, exec.Command("git", "init", "--quiet", "--bare", repo).Run())
+	quarantine := filepath.Join(repo, "objects", "q1")
+	require.NoError(t, os.MkdirAll(quarantine, 0777))
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(),
+			"GIT_DIR="+repo,
+			"GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com",
+			"GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com",
+		)
+		out, err := cmd.Output()
+		require.NoError(t, err, "git %v", args)
+		return strings.TrimSpace(string(out))
+	}
+	tree := git("hash-object", "-t", "tree", "-w", "/dev/null")
+	base := git("commit-tree", "-m", "base", tree)
+	unrelated := git("commit-tree", "-m", "unrelated", tree)
+
+	// Make the unrelated commit look like a child of the base, to git
+	// commands that honor replace refs.
+	git("replace", "--graft", unrelated, base)
+	git("merge-base", "--is-ancestor", base, unrelated)
+
+	r := &spokesReceivePack{
+		repoPath:         repo,
+		quarantineFolder: quarantine,
+		childEnv:         literalHistoryEnvVars(),
+	}
+	assert.False(t, r.isFastForward(&command{oldOID: base, newOID: unrelated}, context.Background()))
+}
+
+func TestDumpPushOptions(t *testing.T) {
+	options := func(opts ...string) *bytes.Buffer {
+		var input bytes.Buffer
+		for _, opt := range opts {
+			require.NoError(t, writePacketf(&input, "%s\n", opt))
+		}
+		input.WriteString("0000")
+		input.WriteString("PACK")
+		return &input
+	}
+
+	r := &spokesReceivePack{input: options("a=1", "b=2"), config: &config.Config{}}
+	n, err := r.dumpPushOptions(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	cfg := &config.Config{Entries: []config.ConfigEntry{
+		{Key: "receive.pushoptionsizelimit", Value: "8"},
+		{Key: "receive.pushoptionstotalsizelimit", Value: "12"},
+	}}
+
+	input := options("a=1", strings.Repeat("x", 9), "b=2")
+	r = &spokesReceivePack{input: input, config: cfg}
+	_, err = r.dumpPushOptions(context.Background())
+	require.Error(t, err)
+	assert.True(t, isCategory(err, categoryLimit), "%v", err)
+	assert.Contains(t, err.Error(), "push option too long")
+	// The long option wasn't read.
+	assert.True(t, strings.HasPrefix(input.String(), strings.Repeat("x", 9)))
+
+	r = &spokesReceivePack{input: options("a=1", "b=2", "c=3", "d=4"), config: cfg}
+	n, err = r.dumpPushOptions(context.Background())
+	require.Error(t, err)
+	assert.True(t, isCategory(err, categoryLimit), "%v", err)
+	assert.Equal(t, 4, n)
+	assert.Contains(t, err.Error(), "12 bytes in total")
+
+	r = &spokesReceivePack{input: strings.NewReader("0009a=1"), config: &config.Config{}}
+	_, err = r.dumpPushOptions(context.Background())
+	assert.True(t, isCategory(err, categoryProtocol), "%v", err)
+}
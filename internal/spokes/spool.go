@@ -0,0 +1,92 @@
+package spokes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+)
+
+// spoolPackEnv, if set to "1", makes stateless-rpc pushes copy the whole
+// pack to disk before index-pack reads it. The frontends of those pushes
+// buffer the whole request in memory, which they can release as soon as
+// we've read it, instead of holding on to it for as long as index-pack
+// takes. It also means that index-pack's runtime doesn't depend on how
+// fast the client uploads.
+const spoolPackEnv = "SPOKES_SPOOL_PACK"
+
+// shouldSpoolPack reports whether readPack should spool the pack to disk
+// before handing it to index-pack. A pack that was handed to us separately
+// is already on disk, or wherever its caller wanted it.
+func (r *spokesReceivePack) shouldSpoolPack() bool {
+	return r.statelessRPC && r.pack == nil && os.Getenv(spoolPackEnv) == "1"
+}
+
+// spoolPack copies the pack from `in` to a file in the quarantine, and
+// returns that file, positioned at its start. If `maxSize` is positive, at
+// most one byte more than that is copied, which is enough for index-pack
+// to tell that the pack is too big. The file has no name, so it goes away
+// when it's closed, and isn't migrated along with the pushed objects.
+func (r *spokesReceivePack) spoolPack(in io.Reader, maxSize int) (*os.File, error) {
+	f, err := os.CreateTemp(r.quarantineFolder, "incoming-*.pack")
+	if err != nil {
+		return nil, fmt.Errorf("creating pack spool: %w", err)
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("removing pack spool: %w", err)
+	}
+
+	if maxSize > 0 {
+		in = io.LimitReader(in, int64(maxSize)+1)
+	}
+
+	start := time.Now()
+	n, err := io.Copy(f, in)
+	r.spoolTime = time.Since(start)
+	if err != nil {
+		f.Close()
+		return nil, classifySpoolError(err, f.Name())
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("rewinding pack spool: %w", err)
+	}
+
+	r.log.With("phase", "read-pack").Info(
+		"spooled pack",
+		"bytes", n,
+		"elapsed_ms", r.spoolTime.Milliseconds(),
+		"bytes_per_sec", throughput(n, r.spoolTime),
+	)
+
+	return f, nil
+}
+
+// classifySpoolError categorizes a failure to copy the pack to the spool
+// file at `path`, like classifyIndexPackError does for index-pack's: if
+// the file couldn't be written, that's the server's problem, and otherwise
+// the pack stopped arriving.
+func classifySpoolError(err error, path string) error {
+	err = fmt.Errorf("spooling pack: %w", err)
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return withCategory(categoryDiskFull, err)
+	}
+	var pe *fs.PathError
+	if errors.As(err, &pe) && pe.Path == path {
+		return err
+	}
+	return withCategory(categoryInterrupted, err)
+}
+
+// throughput returns how many bytes per second `n` bytes in `d` is.
+func throughput(n int64, d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(float64(n) / d.Seconds())
+}
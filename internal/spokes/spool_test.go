@@ -0,0 +1,82 @@
+package spokes
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/github/spokes-receive-pack/internal/logger"
+)
+
+func TestShouldSpoolPack(t *testing.T) {
+	r := &spokesReceivePack{statelessRPC: true}
+	assert.False(t, r.shouldSpoolPack())
+
+	t.Setenv(spoolPackEnv, "1")
+	assert.True(t, r.shouldSpoolPack())
+
+	r.pack = strings.NewReader("PACK")
+	assert.False(t, r.shouldSpoolPack())
+
+	r = &spokesReceivePack{}
+	assert.False(t, r.shouldSpoolPack())
+}
+
+func TestSpoolPack(t *testing.T) {
+	dir := t.TempDir()
+	var logs bytes.Buffer
+	r := &spokesReceivePack{
+		quarantineFolder: dir,
+		log:              logger.New(&logs),
+	}
+
+	f, err := r.spoolPack(strings.NewReader("PACK and then some"), 0)
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, "PACK and then some", string(data))
+	assert.Contains(t, logs.String(), "spooled pack")
+
+	// The spool mustn't be left in the quarantine.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	f, err = r.spoolPack(strings.NewReader("PACK and then some"), 6)
+	require.NoError(t, err)
+	data, err = io.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, "PACK an", string(data))
+
+	_, err = r.spoolPack(iotest.ErrReader(io.ErrUnexpectedEOF), 0)
+	assert.True(t, isCategory(err, categoryInterrupted), err)
+}
+
+func TestClassifySpoolError(t *testing.T) {
+	path := "/quarantine/incoming-1.pack"
+
+	err := classifySpoolError(&os.PathError{Op: "write", Path: path, Err: syscall.ENOSPC}, path)
+	assert.True(t, isCategory(err, categoryDiskFull), err)
+
+	err = classifySpoolError(&os.PathError{Op: "write", Path: path, Err: syscall.EIO}, path)
+	assert.False(t, errors.As(err, new(categorizedError)), err)
+
+	err = classifySpoolError(&os.PathError{Op: "read", Path: "/dev/stdin", Err: syscall.EIO}, path)
+	assert.True(t, isCategory(err, categoryInterrupted), err)
+}
+
+func TestThroughput(t *testing.T) {
+	assert.Equal(t, int64(0), throughput(100, 0))
+	assert.Equal(t, int64(200), throughput(100, 500*time.Millisecond))
+}
@@ -0,0 +1,119 @@
+package spokes
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/logger"
+)
+
+// processStart approximates when the process started, for Exec.
+var processStart = time.Now()
+
+// startupBudgetEnv is the name of an environment variable that sets how
+// long the client may wait for the first byte of the ref advertisement,
+// from the start of the push, before we log a warning with a breakdown of
+// where the time went. A budget of 0 disables the warning.
+const startupBudgetEnv = "SPOKES_STARTUP_BUDGET"
+
+// defaultStartupBudget is the startup budget unless the environment says
+// otherwise.
+const defaultStartupBudget = 2 * time.Second
+
+// startupBudget returns the startup budget from the environment.
+func startupBudget(lg *logger.Logger) time.Duration {
+	v := os.Getenv(startupBudgetEnv)
+	if v == "" {
+		return defaultStartupBudget
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		lg.Warn("ignoring "+startupBudgetEnv, "error", err)
+		return defaultStartupBudget
+	}
+	return d
+}
+
+// firstWriteTimer notes when something is first written through it.
+type firstWriteTimer struct {
+	w io.Writer
+
+	mu sync.Mutex
+	at time.Time
+}
+
+func (t *firstWriteTimer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	if t.at.IsZero() {
+		t.at = time.Now()
+	}
+	t.mu.Unlock()
+	return t.w.Write(p)
+}
+
+// firstWrite returns when something was first written, or the zero time if
+// nothing was.
+func (t *firstWriteTimer) firstWrite() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.at
+}
+
+// startupTimes are the milestones of a push up to the ref advertisement.
+type startupTimes struct {
+	// started is when the push started.
+	started time.Time
+
+	// admitted is when governor let it go ahead.
+	admitted time.Time
+
+	// configured is when the config was read.
+	configured time.Time
+
+	// discovering is when the reference discovery started.
+	discovering time.Time
+
+	// advertisement notes when the ref advertisement started to be
+	// written.
+	advertisement *firstWriteTimer
+}
+
+// reportStartup reports how long the client waited for the ref
+// advertisement to governor, and logs a warning with the time spent before
+// each milestone if it exceeded the startup budget.
+func (r *spokesReceivePack) reportStartup() {
+	st := r.startup
+	if st.advertisement == nil || st.started.IsZero() {
+		return
+	}
+	advertised := st.advertisement.firstWrite()
+	if advertised.IsZero() {
+		return
+	}
+
+	elapsed := advertised.Sub(st.started)
+	r.governor.SetTimeToAdvertisement(elapsed)
+	if r.startupBudget <= 0 || elapsed <= r.startupBudget {
+		return
+	}
+
+	r.log.With("phase", phaseStartup).Warn(
+		"startup over budget",
+		"elapsed_ms", elapsed.Milliseconds(),
+		"budget_ms", r.startupBudget.Milliseconds(),
+		"governor_ms", st.admitted.Sub(st.started).Milliseconds(),
+		"config_ms", st.configured.Sub(st.admitted).Milliseconds(),
+		"setup_ms", st.discovering.Sub(st.configured).Milliseconds(),
+		"reference_discovery_ms", advertised.Sub(st.discovering).Milliseconds(),
+	)
+}
+
+// advertisementOutput returns where to write the ref advertisement.
+func (r *spokesReceivePack) advertisementOutput() io.Writer {
+	if r.startup.advertisement == nil {
+		return r.output
+	}
+	return r.startup.advertisement
+}
@@ -0,0 +1,95 @@
+package spokes
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartupBudget(t *testing.T) {
+	lg := logger.New(&bytes.Buffer{})
+
+	t.Setenv(startupBudgetEnv, "")
+	assert.Equal(t, defaultStartupBudget, startupBudget(lg))
+
+	t.Setenv(startupBudgetEnv, "500ms")
+	assert.Equal(t, 500*time.Millisecond, startupBudget(lg))
+
+	t.Setenv(startupBudgetEnv, "0")
+	assert.Equal(t, time.Duration(0), startupBudget(lg))
+
+	t.Setenv(startupBudgetEnv, "soon")
+	assert.Equal(t, defaultStartupBudget, startupBudget(lg))
+}
+
+func TestFirstWriteTimer(t *testing.T) {
+	var buf bytes.Buffer
+	w := &firstWriteTimer{w: &buf}
+	assert.True(t, w.firstWrite().IsZero())
+
+	before := time.Now()
+	_, err := w.Write([]byte("abc"))
+	require.NoError(t, err)
+	first := w.firstWrite()
+	assert.False(t, first.Before(before))
+
+	_, err = w.Write([]byte("def"))
+	require.NoError(t, err)
+	assert.Equal(t, first, w.firstWrite())
+	assert.Equal(t, "abcdef", buf.String())
+}
+
+func TestReportStartup(t *testing.T) {
+	now := time.Now()
+	newReceivePack := func(buf *bytes.Buffer, budget time.Duration) *spokesReceivePack {
+		r := &spokesReceivePack{
+			log: logger.New(buf),
+			startup: startupTimes{
+				started:       now.Add(-4 * time.Second),
+				admitted:      now.Add(-3 * time.Second),
+				configured:    now.Add(-2 * time.Second),
+				discovering:   now.Add(-time.Second),
+				advertisement: &firstWriteTimer{w: &bytes.Buffer{}},
+			},
+			startupBudget: budget,
+		}
+		r.output = r.advertisementOutput()
+		return r
+	}
+
+	// Nothing is reported before anything is advertised.
+	var buf bytes.Buffer
+	r := newReceivePack(&buf, time.Second)
+	r.reportStartup()
+	assert.Empty(t, buf.String())
+
+	_, err := r.advertisementOutput().Write([]byte("0000"))
+	require.NoError(t, err)
+	r.reportStartup()
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &entry))
+	assert.Equal(t, "startup over budget", entry["msg"])
+	assert.Equal(t, phaseStartup, entry["phase"])
+	assert.GreaterOrEqual(t, entry["elapsed_ms"], float64(4000))
+	assert.Equal(t, float64(1000), entry["budget_ms"])
+	assert.Equal(t, float64(1000), entry["governor_ms"])
+	assert.Equal(t, float64(1000), entry["config_ms"])
+	assert.Equal(t, float64(1000), entry["setup_ms"])
+	assert.GreaterOrEqual(t, entry["reference_discovery_ms"], float64(1000))
+
+	// Within the budget, or without one, nothing is logged.
+	for _, budget := range []time.Duration{time.Hour, 0} {
+		buf.Reset()
+		r = newReceivePack(&buf, budget)
+		_, err = r.advertisementOutput().Write([]byte("0000"))
+		require.NoError(t, err)
+		r.reportStartup()
+		assert.Empty(t, buf.String())
+	}
+}
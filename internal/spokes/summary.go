@@ -0,0 +1,58 @@
+package spokes
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// pushSummaryKey is the config setting that, if true, makes us send the
+// client a one-line summary of the push along with the report.
+const pushSummaryKey = "spokes.pushsummary"
+
+func (r *spokesReceivePack) isPushSummaryEnabled() bool {
+	return r.config.Get(pushSummaryKey) == "true"
+}
+
+// pushSummary describes the outcome of a push that received a pack of
+// `packSize` bytes and took `elapsed`, like "3 refs updated, 1 rejected,
+// 12.4 MiB received in 3.2s".
+func pushSummary(commands []command, packSize int64, elapsed time.Duration) string {
+	var updated, rejected int
+	for _, c := range commands {
+		if c.err == "" {
+			updated++
+		} else {
+			rejected++
+		}
+	}
+
+	var sb strings.Builder
+	if updated == 1 {
+		sb.WriteString("1 ref updated")
+	} else {
+		fmt.Fprintf(&sb, "%d refs updated", updated)
+	}
+	if rejected > 0 {
+		fmt.Fprintf(&sb, ", %d rejected", rejected)
+	}
+	fmt.Fprintf(&sb, ", %s received in %.1fs\n", formatBytes(packSize), elapsed.Seconds())
+	return sb.String()
+}
+
+// formatBytes formats `n` bytes using the largest binary unit that makes
+// the number at least 1.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	units := []string{"KiB", "MiB", "GiB", "TiB"}
+	value := float64(n) / unit
+	i := 0
+	for value >= unit && i < len(units)-1 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
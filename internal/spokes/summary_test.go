@@ -0,0 +1,70 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/pktline"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushSummary(t *testing.T) {
+	commands := []command{
+		{refname: "refs/heads/a", reportFF: "ok"},
+		{refname: "refs/heads/b", reportFF: "ok"},
+		{refname: "refs/heads/c", reportFF: "ok"},
+		{refname: "refs/heads/d", reportFF: "ng", err: "denied"},
+	}
+	assert.Equal(t,
+		"3 refs updated, 1 rejected, 12.4 MiB received in 3.2s\n",
+		pushSummary(commands, 13002342, 3210*time.Millisecond),
+	)
+	assert.Equal(t,
+		"1 ref updated, 512 bytes received in 0.1s\n",
+		pushSummary(commands[:1], 512, 120*time.Millisecond),
+	)
+	assert.Equal(t,
+		"0 refs updated, 1 rejected, 0 bytes received in 0.0s\n",
+		pushSummary(commands[3:], 0, 0),
+	)
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "1023 bytes", formatBytes(1023))
+	assert.Equal(t, "1.0 KiB", formatBytes(1024))
+	assert.Equal(t, "1.5 GiB", formatBytes(3<<29))
+	assert.Equal(t, "2048.0 TiB", formatBytes(1<<51))
+}
+
+func TestReportPushSummary(t *testing.T) {
+	caps, err := pktline.ParseCapabilities([]byte("report-status side-band-64k"))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	r := &spokesReceivePack{
+		output:   &buf,
+		config:   &config.Config{Entries: []config.ConfigEntry{{Key: "spokes.pushsummary", Value: "true"}}},
+		start:    time.Now(),
+		packSize: 2048,
+	}
+	commands := []command{{refname: "refs/heads/main", reportFF: "ok"}}
+	require.NoError(t, r.report(context.Background(), true, commands, caps))
+
+	// The summary comes after the report, before the final flush.
+	out := buf.String()
+	i := strings.Index(out, "\x021 ref updated, 2.0 KiB received in ")
+	require.Positive(t, i, out)
+	assert.Less(t, strings.Index(out, "ok refs/heads/main"), i)
+	assert.True(t, strings.HasSuffix(out, "s\n0000"), out)
+
+	quiet, err := pktline.ParseCapabilities([]byte("report-status side-band-64k quiet"))
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, r.report(context.Background(), true, commands, quiet))
+	assert.NotContains(t, buf.String(), "received in")
+}
@@ -0,0 +1,132 @@
+package spokes
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/governor"
+	"github.com/github/spokes-receive-pack/internal/pktline"
+)
+
+// pushTelemetry describes how a push went, from what the client negotiated
+// to what happened to each of its ref updates. It is logged as one record
+// per push, so that pushes can be queried without putting the logs,
+// governor, and audit data together.
+type pushTelemetry struct {
+	RequestID string `json:"request_id,omitempty"`
+	RepoName  string `json:"repo_name,omitempty"`
+
+	// What the client asked for.
+	Agent       string `json:"agent,omitempty"`
+	SessionID   string `json:"session_id,omitempty"`
+	Sideband    string `json:"sideband,omitempty"`
+	Atomic      bool   `json:"atomic"`
+	PushOptions int    `json:"push_options"`
+
+	// What it sent.
+	PackSize    int64  `json:"pack_size"`
+	ObjectCount uint32 `json:"object_count"`
+	SpoolMS     int64  `json:"spool_ms,omitempty"`
+
+	// What happened to its ref updates.
+	Accepted         int                `json:"accepted"`
+	Rejected         int                `json:"rejected"`
+	HiddenRefRejects int                `json:"hidden_ref_rejects"`
+	LimitRejects     int                `json:"limit_rejects"`
+	PolicyRejects    int                `json:"policy_rejects"`
+	Commands         []commandTelemetry `json:"commands"`
+
+	ElapsedMS int64 `json:"elapsed_ms"`
+}
+
+// commandTelemetry is what happened to one ref update.
+type commandTelemetry struct {
+	Refname   string `json:"refname"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+	Forced    bool   `json:"forced,omitempty"`
+	Retryable bool   `json:"retryable,omitempty"`
+}
+
+// telemetry returns the telemetry of the push of `commands` by a client
+// with `capabilities`.
+func (r *spokesReceivePack) telemetry(commands []command, capabilities pktline.Capabilities) pushTelemetry {
+	cc := clientCapabilities(capabilities)
+	t := pushTelemetry{
+		RequestID:   r.sockstat.RequestID,
+		RepoName:    r.sockstat.RepoName,
+		Agent:       cc.Agent,
+		SessionID:   cc.SessionID,
+		Sideband:    cc.Sideband,
+		Atomic:      cc.Atomic,
+		PushOptions: r.pushOptionsCount,
+		PackSize:    r.packSize,
+		ObjectCount: r.objectCount,
+		SpoolMS:     r.spoolTime.Milliseconds(),
+		Commands:    make([]commandTelemetry, 0, len(commands)),
+	}
+	if !r.start.IsZero() {
+		t.ElapsedMS = time.Since(r.start).Milliseconds()
+	}
+
+	for _, c := range commands {
+		ct := commandTelemetry{
+			Refname:   c.refname,
+			Status:    "ok",
+			Forced:    c.forced,
+			Retryable: c.retryable,
+		}
+		if c.err != "" {
+			ct.Status = "ng"
+			ct.Reason = c.err
+			t.Rejected++
+			switch c.rejection {
+			case rejectionHiddenRef:
+				t.HiddenRefRejects++
+			case rejectionLimit:
+				t.LimitRejects++
+			case rejectionPolicy:
+				t.PolicyRejects++
+			}
+		} else {
+			t.Accepted++
+		}
+		t.Commands = append(t.Commands, ct)
+	}
+	return t
+}
+
+// logTelemetry logs the telemetry of the push of `commands`, and tells
+// governor how many of them were rejected.
+func (r *spokesReceivePack) logTelemetry(commands []command, capabilities pktline.Capabilities) {
+	t := r.telemetry(commands, capabilities)
+	r.governor.SetRejections(governor.Rejections{
+		Rejected:  t.Rejected,
+		HiddenRef: t.HiddenRefRejects,
+		Limit:     t.LimitRejects,
+		Policy:    t.PolicyRejects,
+	})
+	r.log.Info("push telemetry", "telemetry", t)
+}
+
+// packObjectCount returns the number of objects in the pack at `path`,
+// from its header.
+func packObjectCount(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var header [12]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return 0, fmt.Errorf("reading pack header: %w", err)
+	}
+	if string(header[:4]) != "PACK" {
+		return 0, fmt.Errorf("%s is not a pack", path)
+	}
+	return binary.BigEndian.Uint32(header[8:]), nil
+}
@@ -0,0 +1,86 @@
+package spokes
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/github/spokes-receive-pack/internal/pktline"
+	"github.com/github/spokes-receive-pack/internal/sockstat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogTelemetry(t *testing.T) {
+	var buf bytes.Buffer
+	r := &spokesReceivePack{
+		log:              logger.New(&buf),
+		sockstat:         sockstat.Vars{RequestID: "req-1", RepoName: "a/b"},
+		packSize:         1234,
+		objectCount:      7,
+		pushOptionsCount: 2,
+	}
+	caps, err := pktline.ParseCapabilities([]byte("report-status side-band-64k atomic push-options agent=git/2.42.0 session-id=client-1\n"))
+	require.NoError(t, err)
+
+	r.logTelemetry([]command{
+		{refname: "refs/heads/main", reportFF: "ok", forced: true},
+		{refname: "refs/pull/1/head", reportFF: "ng", err: "deny updating a hidden ref", rejection: rejectionHiddenRef},
+		{refname: "refs/heads/other", reportFF: "ng", err: "missing necessary objects", retryable: true},
+		{refname: "refs/heads/big", reportFF: "ng", err: "too big", rejection: rejectionLimit},
+		{refname: "refs/heads/denied", reportFF: "ng", err: "denied", rejection: rejectionPolicy},
+	}, caps)
+
+	var entry struct {
+		Msg       string        `json:"msg"`
+		Telemetry pushTelemetry `json:"telemetry"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "push telemetry", entry.Msg)
+	assert.Equal(t, pushTelemetry{
+		RequestID:        "req-1",
+		RepoName:         "a/b",
+		Agent:            "git/2.42.0",
+		SessionID:        "client-1",
+		Sideband:         "side-band-64k",
+		Atomic:           true,
+		PushOptions:      2,
+		PackSize:         1234,
+		ObjectCount:      7,
+		Accepted:         1,
+		Rejected:         4,
+		HiddenRefRejects: 1,
+		LimitRejects:     1,
+		PolicyRejects:    1,
+		Commands: []commandTelemetry{
+			{Refname: "refs/heads/main", Status: "ok", Forced: true},
+			{Refname: "refs/pull/1/head", Status: "ng", Reason: "deny updating a hidden ref"},
+			{Refname: "refs/heads/other", Status: "ng", Reason: "missing necessary objects", Retryable: true},
+			{Refname: "refs/heads/big", Status: "ng", Reason: "too big"},
+			{Refname: "refs/heads/denied", Status: "ng", Reason: "denied"},
+		},
+	}, entry.Telemetry)
+}
+
+func TestPackObjectCount(t *testing.T) {
+	dir := t.TempDir()
+
+	pack := filepath.Join(dir, "good.pack")
+	require.NoError(t, os.WriteFile(pack, []byte("PACK\x00\x00\x00\x02\x00\x00\x01\x02rest"), 0644))
+	n, err := packObjectCount(pack)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(258), n)
+
+	bad := filepath.Join(dir, "bad.pack")
+	require.NoError(t, os.WriteFile(bad, []byte("JUNK\x00\x00\x00\x02\x00\x00\x01\x02"), 0644))
+	_, err = packObjectCount(bad)
+	assert.Error(t, err)
+
+	short := filepath.Join(dir, "short.pack")
+	require.NoError(t, os.WriteFile(short, []byte("PACK"), 0644))
+	_, err = packObjectCount(short)
+	assert.Error(t, err)
+}
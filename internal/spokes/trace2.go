@@ -0,0 +1,148 @@
+package spokes
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/github/spokes-receive-pack/internal/pipe"
+)
+
+// trace2DrainTimeout is how long we wait for connections from children that
+// have exited but haven't been accepted yet when stopping the relay.
+const trace2DrainTimeout = 50 * time.Millisecond
+
+// trace2Enabled returns true if the trace2 events of our git children should
+// be added to our logs.
+func trace2Enabled() bool {
+	return os.Getenv("SPOKES_TRACE2") == "1"
+}
+
+// trace2ParentName is what our git children report as their parent in the
+// hierarchy of their trace2 "cmd_name" events.
+const trace2ParentName = "spokes-receive-pack"
+
+// maxTrace2SessionIDLength is the longest that we let the request ID part of
+// a trace2 session ID be, since git children add theirs to it.
+const maxTrace2SessionIDLength = 64
+
+// trace2SessionID returns the trace2 session ID of the push with
+// `requestID`, handled by the process with `pid`. Git children use it as
+// the prefix of their own session IDs (see `GIT_TRACE2_PARENT_SID` in git's
+// documentation), so that wherever trace2 events are collected, those of
+// all of the children of one push can be found from its request ID.
+//
+// Without a request ID, the session ID is made up like git's own, from the
+// time and the pid.
+func trace2SessionID(requestID string, now time.Time, pid int) string {
+	if requestID == "" {
+		return fmt.Sprintf("%s-P%08x", now.UTC().Format("20060102T150405.000000Z"), pid)
+	}
+
+	// Keep the ID to characters that are safe in the file names that git
+	// derives from it when trace2 events go to a directory.
+	sid := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, requestID)
+	if len(sid) > maxTrace2SessionIDLength {
+		sid = sid[:maxTrace2SessionIDLength]
+	}
+	return fmt.Sprintf("%s-P%08x", sid, pid)
+}
+
+// trace2ParentEnvVars returns the environment variables that tell git
+// children that they are run by us, in the push with session ID `sid`.
+func trace2ParentEnvVars(sid string) []pipe.EnvVar {
+	return []pipe.EnvVar{
+		{Key: "GIT_TRACE2_PARENT_SID", Value: sid},
+		{Key: "GIT_TRACE2_PARENT_NAME", Value: trace2ParentName},
+	}
+}
+
+// trace2Relay listens on a unix socket that git children can send their
+// trace2 events to (see `GIT_TRACE2_EVENT` in git's documentation), and logs
+// every event that it receives.
+type trace2Relay struct {
+	dir        string
+	listener   *net.UnixListener
+	log        *logger.Logger
+	acceptDone chan struct{}
+	wg         sync.WaitGroup
+}
+
+func startTrace2Relay(lg *logger.Logger) (*trace2Relay, error) {
+	// Unix socket paths can't be very long, so don't put it in the repo.
+	dir, err := os.MkdirTemp("", "spokes-trace2-")
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, "sock"), Net: "unix"})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	t := &trace2Relay{dir: dir, listener: l, log: lg, acceptDone: make(chan struct{})}
+	go t.accept()
+	return t, nil
+}
+
+// env returns the environment variables that make git send its trace2
+// events to `t`.
+func (t *trace2Relay) env() []string {
+	return []string{"GIT_TRACE2_EVENT=af_unix:stream:" + t.listener.Addr().String()}
+}
+
+func (t *trace2Relay) accept() {
+	defer close(t.acceptDone)
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		t.wg.Add(1)
+		go t.relay(conn)
+	}
+}
+
+func (t *trace2Relay) relay(conn net.Conn) {
+	defer t.wg.Done()
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		event := json.RawMessage(scanner.Bytes())
+		if !json.Valid(event) {
+			continue
+		}
+		t.log.Info("trace2", "trace2", event)
+	}
+}
+
+// stop stops accepting events, waits for the ones that have already been
+// sent to be logged, and cleans up. It must only be called once the
+// children have exited.
+func (t *trace2Relay) stop() {
+	// A child may have connected, sent everything and exited without us
+	// having accepted its connection yet, so keep accepting for a little
+	// while before closing the socket.
+	_ = t.listener.SetDeadline(time.Now().Add(trace2DrainTimeout))
+	<-t.acceptDone
+	t.listener.Close()
+	t.wg.Wait()
+	os.RemoveAll(t.dir)
+}
@@ -0,0 +1,101 @@
+package spokes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/github/spokes-receive-pack/internal/logger"
+	"github.com/github/spokes-receive-pack/internal/pipe"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrace2Relay(t *testing.T) {
+	var buf bytes.Buffer
+	relay, err := startTrace2Relay(logger.New(&buf))
+	require.NoError(t, err)
+
+	cmd := exec.Command("git", "version")
+	cmd.Env = append(os.Environ(), relay.env()...)
+	cmd.Env = append(cmd.Env, "GIT_TRACE2_PARENT_SID=spokes-test")
+	require.NoError(t, cmd.Run())
+
+	relay.stop()
+	assert.NoDirExists(t, relay.dir)
+
+	var events []string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		var entry struct {
+			Msg    string `json:"msg"`
+			Trace2 struct {
+				Event string `json:"event"`
+				SID   string `json:"sid"`
+			} `json:"trace2"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		assert.Equal(t, "trace2", entry.Msg)
+		assert.True(t, strings.HasPrefix(entry.Trace2.SID, "spokes-test/"), entry.Trace2.SID)
+		events = append(events, entry.Trace2.Event)
+	}
+	assert.Contains(t, events, "start")
+	assert.Contains(t, events, "exit")
+}
+
+func TestTrace2SessionID(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 123456000, time.UTC)
+
+	assert.Equal(t, "abc-123_DEF.4-P000004d2", trace2SessionID("abc-123_DEF.4", now, 1234))
+	assert.Equal(t, "a_b_c_-P000004d2", trace2SessionID("a/b c\n", now, 1234))
+	assert.Equal(t, strings.Repeat("x", maxTrace2SessionIDLength)+"-P000004d2", trace2SessionID(strings.Repeat("x", 100), now, 1234))
+	assert.Equal(t, "20240506T070809.123456Z-P000004d2", trace2SessionID("", now, 1234))
+}
+
+func TestTrace2ParentEnv(t *testing.T) {
+	var buf bytes.Buffer
+	relay, err := startTrace2Relay(logger.New(&buf))
+	require.NoError(t, err)
+	for _, kv := range relay.env() {
+		name, value, _ := strings.Cut(kv, "=")
+		t.Setenv(name, value)
+	}
+
+	r := &spokesReceivePack{
+		repoPath: t.TempDir(),
+		childEnv: trace2ParentEnvVars("push-1"),
+	}
+	p := r.newPipeline()
+	p.Add(pipe.Command("git", "version"))
+	require.NoError(t, p.Run(context.Background()))
+
+	cmd := exec.Command("git", "version")
+	r.inRepo(cmd)
+	require.NoError(t, cmd.Run())
+
+	relay.stop()
+
+	var starts int
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		var entry struct {
+			Trace2 struct {
+				Event     string `json:"event"`
+				SID       string `json:"sid"`
+				Hierarchy string `json:"hierarchy"`
+			} `json:"trace2"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		assert.True(t, strings.HasPrefix(entry.Trace2.SID, "push-1/"), entry.Trace2.SID)
+		if entry.Trace2.Event == "cmd_name" {
+			assert.Equal(t, trace2ParentName+"/version", entry.Trace2.Hierarchy)
+		}
+		if entry.Trace2.Event == "start" {
+			starts++
+		}
+	}
+	assert.Equal(t, 2, starts)
+}
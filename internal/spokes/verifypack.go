@@ -0,0 +1,136 @@
+package spokes
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// verifyPackKey is the config setting that, if true, makes us check the
+// checksums of the packs that were received, and of their indexes, before
+// accepting a push.
+const verifyPackKey = "spokes.verifypack"
+
+// verifyPackFailedMessage is the reason given for rejecting the commands of
+// a push whose pack failed verification.
+const verifyPackFailedMessage = "received pack failed verification"
+
+func (r *spokesReceivePack) isVerifyPackEnabled() bool {
+	return r.config.Get(verifyPackKey) == "true"
+}
+
+// verifyQuarantine checks that the packs in the quarantine, and their
+// indexes, still have the checksums that index-pack wrote, if the config
+// asks for it. That catches a pack that was corrupted on its way to disk
+// while the push can still be retried, rather than when it is replicated.
+// If a pack can't be verified, the commands that haven't been rejected yet
+// are.
+func (r *spokesReceivePack) verifyQuarantine(commands []command) {
+	if !acceptsObjects(commands) || !r.isVerifyPackEnabled() {
+		return
+	}
+
+	start := time.Now()
+	n, err := verifyPackDir(filepath.Join(r.quarantineFolder, "pack"), r.objectFormat.NewHash)
+	if err == nil {
+		r.log.Info("verified quarantine", "packs", n, "elapsed_ms", time.Since(start).Milliseconds())
+		return
+	}
+
+	r.log.Error("verifying quarantine", "error", err)
+	for i := range commands {
+		c := &commands[i]
+		if c.err == "" {
+			c.err = verifyPackFailedMessage
+			c.reportFF = "ng"
+			c.retryable = true
+		}
+	}
+}
+
+// verifyPackDir verifies each pack in `dir` and its index, and returns how
+// many packs there were.
+func verifyPackDir(dir string, newHash func() hash.Hash) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("reading pack directory: %w", err)
+	}
+
+	n := 0
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".pack")
+		if !ok || !strings.HasPrefix(name, "pack-") {
+			continue
+		}
+		pack := filepath.Join(dir, entry.Name())
+		if err := verifyPack(pack, filepath.Join(dir, name+".idx"), newHash); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// verifyPack checks that the pack at `packPath` and its index at `idxPath`
+// each end with the checksum of the rest of the file, and that the index
+// is for that pack, without looking at the objects themselves, like
+// `git verify-pack --stat-only` does.
+func verifyPack(packPath, idxPath string, newHash func() hash.Hash) error {
+	packSum, err := verifyTrailer(packPath, newHash(), 0)
+	if err != nil {
+		return err
+	}
+
+	// An index ends with the checksum of its pack, followed by its own.
+	idxSum, err := verifyTrailer(idxPath, newHash(), len(packSum))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(idxSum, packSum) {
+		return fmt.Errorf("%s is not the index of %s", filepath.Base(idxPath), filepath.Base(packPath))
+	}
+	return nil
+}
+
+// verifyTrailer checks that the file at `path` ends with `h` of everything
+// before it. If `extra` isn't 0, it returns the `extra` bytes that precede
+// the checksum; otherwise, it returns the checksum.
+func verifyTrailer(path string, h hash.Hash, extra int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("verifying pack: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("verifying pack: %w", err)
+	}
+	size := h.Size()
+	if info.Size() < int64(size+extra) {
+		return nil, fmt.Errorf("%s is truncated", filepath.Base(path))
+	}
+
+	body := info.Size() - int64(size)
+	if _, err := io.CopyN(h, f, body-int64(extra)); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", filepath.Base(path), err)
+	}
+	tail := make([]byte, extra+size)
+	if _, err := io.ReadFull(f, tail); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", filepath.Base(path), err)
+	}
+	h.Write(tail[:extra])
+	if !bytes.Equal(h.Sum(nil), tail[extra:]) {
+		return nil, fmt.Errorf("%s has the wrong checksum", filepath.Base(path))
+	}
+
+	if extra == 0 {
+		return tail, nil
+	}
+	return tail[:extra], nil
+}
@@ -0,0 +1,69 @@
+package spokes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/github/spokes-receive-pack/internal/config"
+	"github.com/github/spokes-receive-pack/internal/objectformat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyQuarantine(t *testing.T) {
+	q := quarantinedRepo(t)
+	tip := q.commit(q.repo.Head, "file")
+	packDir := filepath.Join(q.path, "pack")
+	q.git(tip+"\n", "pack-objects", "--revs", filepath.Join(packDir, "pack"))
+
+	n, err := verifyPackDir(packDir, objectformat.ObjectFormat("sha1").NewHash)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	r := q.receivePack()
+	r.config = &config.Config{Entries: []config.ConfigEntry{{Key: verifyPackKey, Value: "true"}}}
+	commands := []command{{refname: "refs/heads/main", oldOID: q.repo.Head, newOID: tip}}
+	r.verifyQuarantine(commands)
+	assert.Equal(t, "", commands[0].err)
+
+	// Flip a bit in the middle of the pack.
+	packs, err := filepath.Glob(filepath.Join(packDir, "pack-*.pack"))
+	require.NoError(t, err)
+	require.Len(t, packs, 1)
+	data, err := os.ReadFile(packs[0])
+	require.NoError(t, err)
+	data[len(data)/2] ^= 1
+	require.NoError(t, os.WriteFile(packs[0], data, 0644))
+
+	_, err = verifyPackDir(packDir, objectformat.ObjectFormat("sha1").NewHash)
+	assert.ErrorContains(t, err, "wrong checksum")
+
+	r.verifyQuarantine(commands)
+	assert.Equal(t, verifyPackFailedMessage, commands[0].err)
+	assert.True(t, commands[0].retryable)
+
+	// Without the setting, nothing is checked.
+	commands[0].err = ""
+	r.config = &config.Config{}
+	r.verifyQuarantine(commands)
+	assert.Equal(t, "", commands[0].err)
+}
+
+func TestVerifyPackMismatchedIndex(t *testing.T) {
+	q := quarantinedRepo(t)
+	packDir := filepath.Join(q.path, "pack")
+	q.git(q.commit(q.repo.Head, "a")+"\n", "pack-objects", "--revs", filepath.Join(packDir, "pack"))
+	q.git(q.commit(q.repo.Head, "b")+"\n", "pack-objects", "--revs", filepath.Join(packDir, "pack"))
+
+	idxs, err := filepath.Glob(filepath.Join(packDir, "pack-*.idx"))
+	require.NoError(t, err)
+	require.Len(t, idxs, 2)
+	packs, err := filepath.Glob(filepath.Join(packDir, "pack-*.pack"))
+	require.NoError(t, err)
+
+	newHash := objectformat.ObjectFormat("sha1").NewHash
+	require.NoError(t, verifyPack(packs[0], idxs[0], newHash))
+	assert.ErrorContains(t, verifyPack(packs[0], idxs[1], newHash), "is not the index of")
+	assert.ErrorContains(t, verifyPack(packs[0], filepath.Join(packDir, "missing.idx"), newHash), "no such file")
+}
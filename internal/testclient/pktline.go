@@ -0,0 +1,210 @@
+package testclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ReadPktline reads a pkt-line from `r` and returns its data, or nil for a
+// flush packet.
+func ReadPktline(r io.Reader) ([]byte, error) {
+	sizeBuf := make([]byte, 4)
+	n, err := io.ReadFull(r, sizeBuf)
+	if err != nil {
+		if n > 0 {
+			return nil, fmt.Errorf("expected 4 bytes but got %d (%s)", n, sizeBuf[:n])
+		}
+		return nil, err
+	}
+
+	size, err := strconv.ParseUint(string(sizeBuf), 16, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	if size == 0 {
+		return nil, nil
+	}
+	if size < 4 {
+		return nil, fmt.Errorf("invalid length %q", sizeBuf)
+	}
+
+	buf := make([]byte, size-4)
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
+
+// WritePktlinef formats its arguments and writes the result to `w` as a
+// pkt-line.
+func WritePktlinef(w io.Writer, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	_, err := fmt.Fprintf(w, "%04x%s", 4+len(msg), msg)
+	return err
+}
+
+// WriteFlush writes a flush packet to `w`.
+func WriteFlush(w io.Writer) error {
+	_, err := io.WriteString(w, "0000")
+	return err
+}
+
+// Advertisement is what the server says before the client sends its
+// commands.
+type Advertisement struct {
+	// Refs maps the advertised refnames to their OIDs.
+	Refs map[string]string
+
+	// Capabilities is the capabilities line, as sent.
+	Capabilities string
+}
+
+// ReadAdvertisement reads a ref advertisement from `r`.
+func ReadAdvertisement(r io.Reader) (*Advertisement, error) {
+	adv := &Advertisement{Refs: make(map[string]string)}
+	firstLine := true
+	for {
+		data, err := ReadPktline(r)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			return adv, nil
+		}
+
+		if firstLine {
+			parts := bytes.SplitN(data, []byte{0}, 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("expected capabilities on first line of ref advertisement %q", string(data))
+			}
+			data = parts[0]
+			adv.Capabilities = string(parts[1])
+			firstLine = false
+		}
+
+		parts := bytes.SplitN(data, []byte(" "), 2)
+		if len(parts) != 2 || (len(parts[0]) != 40 && len(parts[0]) != 64) {
+			return nil, fmt.Errorf("bad advertisement line: %q", string(data))
+		}
+		oid := string(parts[0])
+		refName := strings.TrimSuffix(string(parts[1]), "\n")
+		if _, ok := adv.Refs[refName]; ok {
+			return nil, fmt.Errorf("duplicate entry for %q", refName)
+		}
+		adv.Refs[refName] = oid
+	}
+}
+
+// Result is the server's report about a push.
+type Result struct {
+	// Unpack is the unpack status line, like "unpack ok\n".
+	Unpack string
+
+	// Refs maps the refnames in the report to their status: "ok", or
+	// "ng" followed by the reason.
+	Refs map[string]string
+
+	// Progress is what the server sent on the progress sideband.
+	Progress [][]byte
+}
+
+// ReadResult reads the report of a push that was made with a sideband
+// from `r`, up to the flush packet that ends it.
+func ReadResult(r io.Reader) (*Result, error) {
+	// Read all of the output so that we can include it with errors.
+	data, err := io.ReadAll(r)
+	if err != nil && len(data) == 0 {
+		return nil, err
+	}
+	r = bytes.NewReader(data)
+
+	var res Result
+	var report []byte
+	for {
+		pkt, err := ReadPktline(r)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("%w while parsing %q", err, string(data))
+
+		case pkt == nil:
+			if report == nil {
+				return nil, fmt.Errorf("no sideband 1 packet in %q", string(data))
+			}
+			if err := res.parseReport(report); err != nil {
+				return nil, err
+			}
+			return &res, nil
+
+		case bytes.HasPrefix(pkt, []byte{1}):
+			// The report might be split across several packets, and
+			// keepalives are empty ones.
+			report = append(report, pkt[1:]...)
+
+		case bytes.HasPrefix(pkt, []byte{2}):
+			res.Progress = append(res.Progress, pkt[1:])
+
+		default:
+			return nil, fmt.Errorf("todo: handle %q from %q", string(pkt), string(data))
+		}
+	}
+}
+
+// ReadResultNoSideBand reads the lines of the report of a push that was
+// made without a sideband from `r`.
+func ReadResultNoSideBand(r io.Reader) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil && len(data) == 0 {
+		return nil, err
+	}
+	r = bytes.NewReader(data)
+
+	var lines []string
+	for {
+		pkt, err := ReadPktline(r)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("%w while parsing %q", err, string(data))
+
+		case pkt == nil:
+			return lines, nil
+
+		default:
+			lines = append(lines, string(pkt))
+		}
+	}
+}
+
+func (res *Result) parseReport(data []byte) error {
+	res.Refs = make(map[string]string)
+
+	r := bytes.NewReader(data)
+	for {
+		pkt, err := ReadPktline(r)
+		switch {
+		case err != nil:
+			return fmt.Errorf("%w while parsing report %q", err, string(data))
+
+		case pkt == nil:
+			return nil
+
+		case bytes.HasPrefix(pkt, []byte("unpack ")):
+			res.Unpack += string(pkt)
+
+		case bytes.HasPrefix(pkt, []byte("ng ")):
+			parts := bytes.SplitN(bytes.TrimSuffix(pkt[3:], []byte("\n")), []byte(" "), 2)
+			if len(parts) == 2 {
+				res.Refs[string(parts[0])] = "ng " + string(parts[1])
+			} else {
+				res.Refs[string(parts[0])] = "ng"
+			}
+
+		case len(pkt) > 3 && pkt[2] == ' ':
+			res.Refs[string(bytes.TrimSuffix(pkt[3:], []byte("\n")))] = string(pkt[0:2])
+
+		default:
+			return fmt.Errorf("unrecognized status %q in report %q", string(pkt), string(data))
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package testclient
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pkt formats `s` as a pkt-line.
+func pkt(s string) string {
+	var buf bytes.Buffer
+	_ = WritePktlinef(&buf, "%s", s)
+	return buf.String()
+}
+
+func TestReadAdvertisement(t *testing.T) {
+	oid := strings.Repeat("1", 40)
+	input := pkt(oid+" refs/heads/main\x00report-status agent=x\n") +
+		pkt(oid+" refs/tags/v1\n") +
+		"0000"
+
+	adv, err := ReadAdvertisement(strings.NewReader(input))
+	require.NoError(t, err)
+	assert.Equal(t, "report-status agent=x\n", adv.Capabilities)
+	assert.Equal(t, map[string]string{"refs/heads/main": oid, "refs/tags/v1": oid}, adv.Refs)
+
+	_, err = ReadAdvertisement(strings.NewReader(pkt(oid+" refs/heads/main\n") + "0000"))
+	assert.Error(t, err)
+}
+
+func TestReadResult(t *testing.T) {
+	report := pkt("unpack ok\n") + pkt("ok refs/heads/main\n") + pkt("ng refs/heads/topic denied (retryable)\n") + "0000"
+	input := pkt("\x02some progress\n") +
+		pkt("\x01") + // a keepalive
+		pkt("\x01"+report[:10]) +
+		pkt("\x01"+report[10:]) +
+		"0000"
+
+	res, err := ReadResult(strings.NewReader(input))
+	require.NoError(t, err)
+	assert.Equal(t, "unpack ok\n", res.Unpack)
+	assert.Equal(t, map[string]string{
+		"refs/heads/main":  "ok",
+		"refs/heads/topic": "ng denied (retryable)",
+	}, res.Refs)
+	assert.Equal(t, [][]byte{[]byte("some progress\n")}, res.Progress)
+
+	_, err = ReadResult(strings.NewReader(pkt("\x02only progress\n") + "0000"))
+	assert.Error(t, err)
+}
+
+func TestReadResultNoSideBand(t *testing.T) {
+	lines, err := ReadResultNoSideBand(strings.NewReader(pkt("unpack ok\n") + pkt("ok refs/heads/main\n") + "0000"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"unpack ok\n", "ok refs/heads/main\n"}, lines)
+}
+
+func TestReadPktline(t *testing.T) {
+	_, err := ReadPktline(strings.NewReader("00"))
+	assert.Error(t, err)
+
+	_, err = ReadPktline(strings.NewReader("0002"))
+	assert.Error(t, err)
+
+	data, err := ReadPktline(strings.NewReader("0000"))
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
@@ -0,0 +1,137 @@
+// Package testclient speaks the client's side of the push protocol to a
+// spokes-receive-pack process, so that tests don't each need their own
+// pkt-line parsing.
+package testclient
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Options say how to run spokes-receive-pack.
+type Options struct {
+	// Program is what to run. It defaults to "spokes-receive-pack".
+	Program string
+
+	// Args are its arguments. They default to ".", since it runs in the
+	// repository.
+	Args []string
+
+	// Env is added to the environment.
+	Env []string
+
+	// Stderr, if set, gets its stderr.
+	Stderr io.Writer
+}
+
+// RefUpdate is a command to update Ref from OldOID to NewOID.
+type RefUpdate struct {
+	OldOID, NewOID, Ref string
+}
+
+// PushSession is a push to a running spokes-receive-pack.
+type PushSession struct {
+	cmd  *exec.Cmd
+	in   io.WriteCloser
+	out  *bufio.Reader
+	done chan error
+}
+
+// Start runs spokes-receive-pack in the repository `repo`. The process is
+// killed if `ctx` is done before it exits.
+func Start(ctx context.Context, repo string, opts Options) (*PushSession, error) {
+	program := opts.Program
+	if program == "" {
+		program = "spokes-receive-pack"
+	}
+	args := opts.Args
+	if args == nil {
+		args = []string{"."}
+	}
+
+	cmd := exec.CommandContext(ctx, program, args...)
+	cmd.Dir = repo
+	cmd.Env = append(os.Environ(), opts.Env...)
+	cmd.Stderr = opts.Stderr
+
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	s := &PushSession{
+		cmd:  cmd,
+		in:   in,
+		out:  bufio.NewReader(out),
+		done: make(chan error, 1),
+	}
+	go func() { s.done <- cmd.Wait() }()
+	return s, nil
+}
+
+// Stdin and Stdout give direct access to the process's input and output,
+// for tests that need to send or read something unusual.
+func (s *PushSession) Stdin() io.WriteCloser { return s.in }
+func (s *PushSession) Stdout() io.Reader     { return s.out }
+
+// ReadAdvertisement reads the ref advertisement.
+func (s *PushSession) ReadAdvertisement() (*Advertisement, error) {
+	return ReadAdvertisement(s.out)
+}
+
+// SendCommands sends `updates`, with `caps` as the capabilities of the
+// first one, followed by a flush packet.
+func (s *PushSession) SendCommands(updates []RefUpdate, caps string) error {
+	sep := "\x00"
+	for _, up := range updates {
+		if err := WritePktlinef(s.in, "%s %s %s%s%s\n", up.OldOID, up.NewOID, up.Ref, sep, caps); err != nil {
+			return err
+		}
+		sep, caps = "", ""
+	}
+	return WriteFlush(s.in)
+}
+
+// SendPushOptions sends `options`, followed by a flush packet.
+func (s *PushSession) SendPushOptions(options ...string) error {
+	for _, opt := range options {
+		if err := WritePktlinef(s.in, "%s\n", opt); err != nil {
+			return err
+		}
+	}
+	return WriteFlush(s.in)
+}
+
+// SendPack sends `pack` and closes the input. The process might stop
+// reading before the whole pack is sent, so failing to write it isn't an
+// error; the result will say what went wrong.
+func (s *PushSession) SendPack(pack io.Reader) error {
+	_, _ = io.Copy(s.in, pack)
+	return s.in.Close()
+}
+
+// ReadResult reads the report of a push made with a sideband.
+func (s *PushSession) ReadResult() (*Result, error) {
+	return ReadResult(s.out)
+}
+
+// ReadResultNoSideBand reads the lines of the report of a push made
+// without a sideband.
+func (s *PushSession) ReadResultNoSideBand() ([]string, error) {
+	return ReadResultNoSideBand(s.out)
+}
+
+// Wait waits for the process to exit and returns its error.
+func (s *PushSession) Wait() error {
+	return <-s.done
+}
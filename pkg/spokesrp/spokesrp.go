@@ -0,0 +1,153 @@
+// Package spokesrp lets Go programs handle pushes the way the
+// spokes-receive-pack binary does, without running it.
+//
+// A ReceivePack is configured like the binary: the options below take the
+// place of its command-line arguments and sockstat vars, and everything
+// else comes from the same environment variables and git config. Unlike the
+// binary, it doesn't change the working directory or install signal
+// handlers.
+package spokesrp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+
+	"github.com/github/spokes-receive-pack/internal/sockstat"
+	"github.com/github/spokes-receive-pack/internal/spokes"
+)
+
+// The exit codes that Run returns, which are the same as the binary's.
+const (
+	ExitOK            = spokes.ExitOK
+	ExitInternalError = spokes.ExitInternalError
+	ExitProtocolError = spokes.ExitProtocolError
+	ExitLimitExceeded = spokes.ExitLimitExceeded
+	ExitFsckFailure   = spokes.ExitFsckFailure
+	ExitCanceled      = spokes.ExitCanceled
+	ExitTerminated    = spokes.ExitTerminated
+	ExitDiskFull      = spokes.ExitDiskFull
+	ExitBusy          = spokes.ExitBusy
+	ExitGovernorError = spokes.ExitGovernorError
+)
+
+// ReceivePack handles a single push to a repository.
+type ReceivePack struct {
+	opts spokes.Options
+}
+
+// Option configures a ReceivePack.
+type Option func(*ReceivePack)
+
+// New returns a ReceivePack for the bare repository at `repoPath`.
+func New(repoPath string, opts ...Option) *ReceivePack {
+	rp := &ReceivePack{
+		opts: spokes.Options{RepoPath: repoPath},
+	}
+	for _, opt := range opts {
+		opt(rp)
+	}
+	return rp
+}
+
+// WithStreams sets where the client's input comes from and where its
+// output and errors go.
+func WithStreams(stdin io.Reader, stdout, stderr io.Writer) Option {
+	return func(rp *ReceivePack) {
+		rp.opts.Stdin = stdin
+		rp.opts.Stdout = stdout
+		rp.opts.Stderr = stderr
+	}
+}
+
+// WithSockstatVars sets the sockstat vars of the push from `environ`, a
+// list of "GIT_SOCKSTAT_VAR_name=value" strings like the binary gets in
+// its environment. Other strings are ignored.
+func WithSockstatVars(environ []string) Option {
+	return func(rp *ReceivePack) {
+		quarantineID := rp.opts.Vars.QuarantineID
+		rp.opts.Vars = sockstat.Parse(environ)
+		if rp.opts.Vars.QuarantineID == "" {
+			rp.opts.Vars.QuarantineID = quarantineID
+		}
+	}
+}
+
+// WithQuarantineID sets the name of the directory in the repository's
+// objects directory where the pushed objects are received. It is required,
+// unless it is set with WithSockstatVars.
+func WithQuarantineID(id string) Option {
+	return func(rp *ReceivePack) {
+		rp.opts.Vars.QuarantineID = id
+	}
+}
+
+// WithStatelessRPC makes the ReceivePack speak the protocol the way that
+// the binary does with --stateless-rpc, for HTTP.
+func WithStatelessRPC() Option {
+	return func(rp *ReceivePack) {
+		rp.opts.StatelessRPC = true
+	}
+}
+
+// WithAdvertiseRefsOnly makes the ReceivePack only advertise the refs, like
+// the binary does with --advertise-refs.
+func WithAdvertiseRefsOnly() Option {
+	return func(rp *ReceivePack) {
+		rp.opts.AdvertiseRefs = true
+	}
+}
+
+// WithAdvertisement makes the ReceivePack advertise the refs read from
+// `snapshot`, instead of the ones in the repository, like the binary does
+// with --advertisement-file. `snapshot` has a line like "<oid> <refname>"
+// for each ref, and "<oid> .have" for each other object that the client may
+// assume the repository has.
+func WithAdvertisement(snapshot io.Reader) Option {
+	return func(rp *ReceivePack) {
+		rp.opts.Advertisement = snapshot
+	}
+}
+
+// WithPack makes the ReceivePack read the pack from `pack`, instead of from
+// the input after the commands, like the binary does with --pack-file. It
+// lets the caller receive, and check, the pack before the push starts.
+func WithPack(pack io.Reader) Option {
+	return func(rp *ReceivePack) {
+		rp.opts.Pack = pack
+	}
+}
+
+// WithPushOptions says whether to advertise the push-options capability,
+// instead of the repository's receive.advertisePushOptions.
+func WithPushOptions(enabled bool) Option {
+	return func(rp *ReceivePack) {
+		rp.opts.PushOptions = &enabled
+	}
+}
+
+// WithVersion sets the version advertised to the client in the agent
+// capability.
+func WithVersion(version string) Option {
+	return func(rp *ReceivePack) {
+		rp.opts.Version = version
+	}
+}
+
+// Run handles the push. It returns the exit code that the binary would
+// have exited with, and the error that caused it, if any.
+func (rp *ReceivePack) Run(ctx context.Context) (int, error) {
+	opts := rp.opts
+	if opts.Stdin == nil || opts.Stdout == nil || opts.Stderr == nil {
+		return ExitInternalError, errors.New("spokesrp: streams not set")
+	}
+	if !filepath.IsAbs(opts.RepoPath) {
+		abs, err := filepath.Abs(opts.RepoPath)
+		if err != nil {
+			return ExitInternalError, err
+		}
+		opts.RepoPath = abs
+	}
+	return spokes.Run(ctx, opts)
+}
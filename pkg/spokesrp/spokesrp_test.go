@@ -0,0 +1,104 @@
+package spokesrp
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdvertiseRefs(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "repo.git")
+	require.NoError(t, exec.Command("git", "init", "--quiet", "--bare", repo).Run())
+
+	var stdout, stderr bytes.Buffer
+	rp := New(repo,
+		WithStreams(strings.NewReader(""), &stdout, &stderr),
+		WithSockstatVars([]string{"GIT_SOCKSTAT_VAR_request_id=abc123"}),
+		WithQuarantineID("q1"),
+		WithStatelessRPC(),
+		WithAdvertiseRefsOnly(),
+		WithPushOptions(true),
+		WithVersion("test"),
+	)
+	code, err := rp.Run(context.Background())
+	require.NoError(t, err, stderr.String())
+	assert.Equal(t, ExitOK, code)
+
+	out := stdout.String()
+	assert.Contains(t, out, "capabilities^{}\x00")
+	assert.Contains(t, out, " agent=github/spokes-receive-pack-test")
+	assert.Contains(t, out, " session-id=abc123")
+	assert.Contains(t, out, " push-options")
+	assert.True(t, strings.HasSuffix(out, "0000"), out)
+}
+
+func TestAdvertisementSnapshot(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "repo.git")
+	require.NoError(t, exec.Command("git", "init", "--quiet", "--bare", repo).Run())
+
+	// The repository has no refs, but the snapshot does.
+	const oid = "e83c5163316f89bfbde7d9ab23ca2e25604af290"
+	var stdout, stderr bytes.Buffer
+	rp := New(repo,
+		WithStreams(strings.NewReader(""), &stdout, &stderr),
+		WithQuarantineID("q1"),
+		WithStatelessRPC(),
+		WithAdvertiseRefsOnly(),
+		WithAdvertisement(strings.NewReader(oid+" refs/heads/main\n")),
+	)
+	code, err := rp.Run(context.Background())
+	require.NoError(t, err, stderr.String())
+	assert.Equal(t, ExitOK, code)
+	assert.Contains(t, stdout.String(), oid+" refs/heads/main\x00")
+	assert.NotContains(t, stdout.String(), "capabilities^{}")
+}
+
+func TestConcurrentRepos(t *testing.T) {
+	dir := t.TempDir()
+	repos := []string{filepath.Join(dir, "a.git"), filepath.Join(dir, "b.git")}
+	for _, repo := range repos {
+		require.NoError(t, exec.Command("git", "init", "--quiet", "--bare", repo).Run())
+		blob, err := exec.Command("sh", "-c", "echo "+filepath.Base(repo)+" | git --git-dir="+repo+" hash-object -w --stdin").Output()
+		require.NoError(t, err)
+		require.NoError(t, exec.Command("git", "--git-dir="+repo, "update-ref", "refs/tags/"+filepath.Base(repo), strings.TrimSpace(string(blob))).Run())
+	}
+
+	outputs := make([]bytes.Buffer, len(repos))
+	var wg sync.WaitGroup
+	for i, repo := range repos {
+		wg.Add(1)
+		go func(i int, repo string) {
+			defer wg.Done()
+			var stderr bytes.Buffer
+			rp := New(repo,
+				WithStreams(strings.NewReader(""), &outputs[i], &stderr),
+				WithQuarantineID("q1"),
+				WithStatelessRPC(),
+				WithAdvertiseRefsOnly(),
+			)
+			code, err := rp.Run(context.Background())
+			assert.NoError(t, err, stderr.String())
+			assert.Equal(t, ExitOK, code)
+		}(i, repo)
+	}
+	wg.Wait()
+
+	// Each push only sees its own repository.
+	assert.Contains(t, outputs[0].String(), "refs/tags/a.git")
+	assert.NotContains(t, outputs[0].String(), "refs/tags/b.git")
+	assert.Contains(t, outputs[1].String(), "refs/tags/b.git")
+	assert.NotContains(t, outputs[1].String(), "refs/tags/a.git")
+}
+
+func TestRunRequiresStreams(t *testing.T) {
+	code, err := New(t.TempDir()).Run(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, ExitInternalError, code)
+}